@@ -0,0 +1,184 @@
+package contracts
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// ContractKeyEntryID is the contract of the instances that hold the values
+// of the individual keys of a keyValue contract (see core.KeyInstanceID).
+// They are only modified by the keyValue contract, so the contract does not
+// accept any instruction.
+const ContractKeyEntryID = "keyEntry"
+
+type ContractKeyEntry struct {
+	byzcoin.BasicContract
+}
+
+func ContractKeyEntryFromBytes(in []byte) (byzcoin.Contract, error) {
+	return &ContractKeyEntry{}, nil
+}
+
+// storedKeys are the keys of a contract that are stored in their own
+// instances (see loadStorage).
+type storedKeys struct {
+	// indexed is true if the contract has a key index (see core.KeyIndex)
+	indexed bool
+	values  map[string][]byte
+	// records is the number of records of the txn log, which are not
+	// loaded (see core.TxnRecordKey)
+	records uint64
+}
+
+// loadStorage returns the storage of contract cid whose instance holds
+// main. At core.StorageVersionKeys, the instance only holds the main keys
+// and the other keys are read from the key instances that are listed by the
+// key index. It also returns the keys that are stored in key instances. The
+// records of the txn log are not read.
+func loadStorage(rst byzcoin.ReadOnlyStateTrie, cid []byte,
+	main *core.Storage) (*core.Storage, *storedKeys, error) {
+	cs := &core.Storage{Version: main.Version,
+		Store: append([]core.KV{}, main.Store...)}
+	stored := &storedKeys{values: make(map[string][]byte)}
+	if main.Version < core.StorageVersionKeys {
+		return cs, stored, nil
+	}
+	buf, _, _, _, err := rst.GetValues(core.KeyInstanceID(cid,
+		core.KeyIndex).Slice())
+	if err != nil {
+		return nil, nil, xerrors.Errorf("reading key index: %v", err)
+	}
+	index, err := core.DecodeStorageIndex(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored.indexed = true
+	for _, key := range index.Keys {
+		v, _, _, _, err := rst.GetValues(core.KeyInstanceID(cid,
+			key).Slice())
+		if err != nil {
+			return nil, nil, xerrors.Errorf("reading key %s: %v", key, err)
+		}
+		cs.Set(key, v)
+		stored.values[key] = v
+	}
+	stored.records, err = core.TxnLogLen(cs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cs, stored, nil
+}
+
+// storageChanges returns the state changes that write the storage cs of
+// contract cid. action is applied to the instance of the contract. Before
+// core.StorageVersionKeys, the instance holds the whole storage. Otherwise,
+// it only holds the main keys, and the key instances and the key index are
+// made consistent with cs.
+func storageChanges(action byzcoin.StateAction, cid byzcoin.InstanceID,
+	stored *storedKeys, cs *core.Storage,
+	darcID darc.ID) ([]byzcoin.StateChange, error) {
+	if action == byzcoin.Remove {
+		cs = &core.Storage{Version: cs.Version}
+	}
+	main := cs
+	if cs.Version >= core.StorageVersionKeys {
+		main = &core.Storage{Version: cs.Version}
+		for _, kv := range cs.Store {
+			if core.IsMainKey(kv.Key) {
+				main.Set(kv.Key, kv.Value)
+			}
+		}
+	}
+	var buf []byte
+	if action != byzcoin.Remove {
+		var err error
+		buf, err = protobuf.Encode(main)
+		if err != nil {
+			return nil, xerrors.Errorf("encoding contract storage: %v", err)
+		}
+	}
+	sc := []byzcoin.StateChange{byzcoin.NewStateChange(action, cid,
+		ContractKeyValueID, buf, darcID)}
+	if cs.Version < core.StorageVersionKeys && !stored.indexed {
+		return sc, nil
+	}
+	ksc, err := keyStateChanges(action, cid, stored, cs, darcID)
+	if err != nil {
+		return nil, err
+	}
+	return append(sc, ksc...), nil
+}
+
+// keyStateChanges returns the state changes that make the key instances and
+// the key index of contract cid consistent with its storage cs.
+func keyStateChanges(action byzcoin.StateAction, cid byzcoin.InstanceID,
+	stored *storedKeys, cs *core.Storage,
+	darcID darc.ID) ([]byzcoin.StateChange, error) {
+	var sc []byzcoin.StateChange
+	curr := make(map[string]bool)
+	var keys []string
+	for _, kv := range cs.Store {
+		if core.IsMainKey(kv.Key) {
+			continue
+		}
+		id := core.KeyInstanceID(cid.Slice(), kv.Key)
+		oldValue, ok := stored.values[kv.Key]
+		if !ok {
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Create, id,
+				ContractKeyEntryID, kv.Value, darcID))
+		} else if !bytes.Equal(oldValue, kv.Value) {
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Update, id,
+				ContractKeyEntryID, kv.Value, darcID))
+		}
+		// The records of the txn log are found from its length, so they
+		// are not in the index and are only written when appended.
+		if core.IsTxnRecordKey(kv.Key) {
+			continue
+		}
+		curr[kv.Key] = true
+		keys = append(keys, kv.Key)
+	}
+	removed := make([]string, 0)
+	for key := range stored.values {
+		if !curr[key] {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove,
+			core.KeyInstanceID(cid.Slice(), key), ContractKeyEntryID, nil,
+			darcID))
+	}
+	indexID := core.KeyInstanceID(cid.Slice(), core.KeyIndex)
+	if action == byzcoin.Remove {
+		for _, key := range core.TxnRecordKeys(0, stored.records) {
+			sc = append(sc, byzcoin.NewStateChange(byzcoin.Remove,
+				core.KeyInstanceID(cid.Slice(), key), ContractKeyEntryID, nil,
+				darcID))
+		}
+		return append(sc, byzcoin.NewStateChange(byzcoin.Remove, indexID,
+			ContractKeyEntryID, nil, darcID)), nil
+	}
+	if stored.indexed && len(removed) == 0 &&
+		len(keys) == len(stored.values) {
+		return sc, nil
+	}
+	sort.Strings(keys)
+	buf, err := protobuf.Encode(&core.StorageIndex{Keys: keys})
+	if err != nil {
+		return nil, xerrors.Errorf("encoding key index: %v", err)
+	}
+	indexAction := byzcoin.Update
+	if !stored.indexed {
+		indexAction = byzcoin.Create
+	}
+	return append(sc, byzcoin.NewStateChange(indexAction, indexID,
+		ContractKeyEntryID, buf, darcID)), nil
+}
@@ -0,0 +1,140 @@
+package contracts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/protobuf"
+)
+
+func Test_StorageChanges(t *testing.T) {
+	cid := bytes.Repeat([]byte{1}, 32)
+	iid := byzcoin.NewInstanceID(cid)
+	tr := &testTrie{values: make(map[string][]byte)}
+	tr.set(t, cid, &core.ContractHeader{CID: iid, CurrState: "open"},
+		core.KV{Key: "x", Value: []byte("1")})
+
+	// The instance of the contract only holds the main keys
+	main := &core.Storage{}
+	require.NoError(t, protobuf.Decode(tr.values[string(cid)], main))
+	var mainKeys []string
+	for _, kv := range main.Store {
+		mainKeys = append(mainKeys, kv.Key)
+	}
+	require.ElementsMatch(t, []string{core.KeyRaw, core.KeyHeader}, mainKeys)
+
+	cs, stored, err := loadStorage(tr, cid, main)
+	require.NoError(t, err)
+	require.True(t, stored.indexed)
+	v, ok := cs.Get("x")
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), v)
+
+	// Updating a key does not rewrite the main instance or the index
+	cs.Set("x", []byte("2"))
+	sc, err := storageChanges(byzcoin.Update, iid, stored, cs, darc.ID{})
+	require.NoError(t, err)
+	require.Len(t, sc, 2)
+	require.Equal(t, core.KeyInstanceID(cid, "x").Slice(), sc[1].InstanceID)
+	tr.apply(t, sc)
+
+	// Adding and removing keys updates the index
+	cs, stored, err = loadStorage(tr, cid, main)
+	require.NoError(t, err)
+	cs.Delete("x")
+	cs.Set("y", []byte("3"))
+	sc, err = storageChanges(byzcoin.Update, iid, stored, cs, darc.ID{})
+	require.NoError(t, err)
+	tr.apply(t, sc)
+	cs = tr.storage(t, cid)
+	_, ok = cs.Get("x")
+	require.False(t, ok)
+	v, ok = cs.Get("y")
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), v)
+
+	// Removing the contract removes its key instances and index
+	_, stored, err = loadStorage(tr, cid, main)
+	require.NoError(t, err)
+	sc, err = storageChanges(byzcoin.Remove, iid, stored, cs, darc.ID{})
+	require.NoError(t, err)
+	tr.apply(t, sc)
+	require.Empty(t, tr.values)
+}
+
+func Test_StorageChangesLegacy(t *testing.T) {
+	cid := bytes.Repeat([]byte{1}, 32)
+	iid := byzcoin.NewInstanceID(cid)
+	tr := &testTrie{values: make(map[string][]byte)}
+	legacy := &core.Storage{Version: core.StorageVersionNamed,
+		Store: []core.KV{{Key: core.KeyHeader, Value: []byte("h")},
+			{Key: "x", Value: []byte("1")}}}
+	buf, err := protobuf.Encode(legacy)
+	require.NoError(t, err)
+	tr.values[string(cid)] = buf
+
+	// Until it is migrated, the contract keeps its whole storage in its
+	// instance
+	cs, stored, err := loadStorage(tr, cid, legacy)
+	require.NoError(t, err)
+	require.False(t, stored.indexed)
+	cs.Set("x", []byte("2"))
+	sc, err := storageChanges(byzcoin.Update, iid, stored, cs, darc.ID{})
+	require.NoError(t, err)
+	require.Len(t, sc, 1)
+
+	cs.Version = core.CurrentStorageVersion
+	sc, err = storageChanges(byzcoin.Update, iid, stored, cs, darc.ID{})
+	require.NoError(t, err)
+	tr.apply(t, sc)
+	cs = tr.storage(t, cid)
+	require.Equal(t, core.CurrentStorageVersion, cs.Version)
+	v, ok := cs.Get("x")
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), v)
+}
+
+func Test_StorageChangesTxnLog(t *testing.T) {
+	cid := bytes.Repeat([]byte{1}, 32)
+	iid := byzcoin.NewInstanceID(cid)
+	tr := &testTrie{values: make(map[string][]byte)}
+	tr.set(t, cid, &core.ContractHeader{CID: iid, CurrState: "open"})
+	main := &core.Storage{}
+	require.NoError(t, protobuf.Decode(tr.values[string(cid)], main))
+
+	// Appending a record only writes the record and the length of the log
+	for _, txn := range []string{"vote", "close"} {
+		cs, stored, err := loadStorage(tr, cid, main)
+		require.NoError(t, err)
+		require.NoError(t, core.AppendTxnRecord(cs,
+			core.TxnRecord{TxnName: txn}))
+		sc, err := storageChanges(byzcoin.Update, iid, stored, cs, darc.ID{})
+		require.NoError(t, err)
+		tr.apply(t, sc)
+	}
+	cs, stored, err := loadStorage(tr, cid, main)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), stored.records)
+	_, ok := cs.Get(core.TxnRecordKey(0))
+	require.False(t, ok)
+	index, err := core.DecodeStorageIndex(
+		tr.values[string(core.KeyInstanceID(cid, core.KeyIndex).Slice())])
+	require.NoError(t, err)
+	require.Equal(t, []string{core.KeyTxnLog}, index.Keys)
+	buf, ok := tr.values[string(core.KeyInstanceID(cid,
+		core.TxnRecordKey(1)).Slice())]
+	require.True(t, ok)
+	rec := core.TxnRecord{}
+	require.NoError(t, protobuf.Decode(buf, &rec))
+	require.Equal(t, "close", rec.TxnName)
+
+	// Removing the contract removes its records
+	sc, err := storageChanges(byzcoin.Remove, iid, stored, cs, darc.ID{})
+	require.NoError(t, err)
+	tr.apply(t, sc)
+	require.Empty(t, tr.values)
+}
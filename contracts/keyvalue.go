@@ -2,10 +2,14 @@ package contracts
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"strings"
+	"sync"
+
 	"github.com/dedis/protean/core"
+	statebase "github.com/dedis/protean/libstate/base"
 	"go.dedis.ch/cothority/v3/byzcoin"
 	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/kyber/v3"
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/sign"
 	"go.dedis.ch/onet/v3/log"
@@ -17,6 +21,27 @@ var suite = pairing.NewSuiteBn256()
 
 const ContractKeyValueID = "keyValue"
 
+var registerOnce sync.Once
+var registerErr error
+
+// RegisterGlobalContracts registers the keyValue contract and the keyEntry
+// contract that stores its keys with byzcoin. The state unit and the
+// registry both host keyValue contracts, and byzcoin rejects a contract
+// that is registered twice, so the contracts are only registered on the
+// first call.
+func RegisterGlobalContracts() error {
+	registerOnce.Do(func() {
+		registerErr = byzcoin.RegisterGlobalContract(ContractKeyValueID,
+			ContractKeyValueFromBytes)
+		if registerErr != nil {
+			return
+		}
+		registerErr = byzcoin.RegisterGlobalContract(ContractKeyEntryID,
+			ContractKeyEntryFromBytes)
+	})
+	return registerErr
+}
+
 type Request struct {
 	ExecReq    *core.ExecutionRequest
 	InReceipts map[int]map[string]*core.OpcodeReceipt
@@ -47,17 +72,22 @@ func (c *ContractKeyValue) Spawn(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Ins
 		log.Errorf("GetValues failed: %v", err)
 		return
 	}
+	if !isRegistryInit(inst.Spawn.Args) {
+		err = verifyInitArgs(inst.Spawn.Args)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
 	cs := &c.Storage
 	for _, kv := range inst.Spawn.Args {
-		cs.Store = append(cs.Store, core.KV{kv.Name, kv.Value})
+		cs.Set(kv.Name, kv.Value)
 	}
-	csBuf, err := protobuf.Encode(&c.Storage)
+	cs.Version = core.CurrentStorageVersion
+	cid := inst.DeriveID("")
+	sc, err = storageChanges(byzcoin.Create, cid, &storedKeys{}, cs, darcID)
 	if err != nil {
-		log.Errorf("Protobuf encode failed: %v", err)
-		return
-	}
-	sc = []byzcoin.StateChange{
-		byzcoin.NewStateChange(byzcoin.Create, inst.DeriveID(""), ContractKeyValueID, csBuf, darcID),
+		log.Error(err)
 	}
 	return
 }
@@ -66,21 +96,124 @@ func (c *ContractKeyValue) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.In
 	cout = coins
 	var darcID darc.ID
 	iid := inst.InstanceID.Slice()
-	kvd := &c.Storage
+	kvd, stored, err := loadStorage(rst, iid, &c.Storage)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, err
+	}
+	args := inst.Invoke.Args
+	// A contract in a terminal state can only be deleted, so that the
+	// snapshot that is archived before deleting it is its final state
+	err = verifyNotTerminal(kvd)
+	if err != nil {
+		log.Errorf("cannot invoke %s: %v", inst.Invoke.Command, err)
+		return nil, nil, err
+	}
 
-	if inst.Invoke.Command == "update" {
+	var plan *core.ExecutionPlan
+	var execReq *core.ExecutionRequest
+	var participants []*participant
+	switch inst.Invoke.Command {
+	case "update", "upgrade", "lock":
+		err = verifyNotPending(kvd)
+		if err != nil {
+			log.Error(err)
+			return nil, nil, err
+		}
+	}
+	switch inst.Invoke.Command {
+	case "update":
 		pr, err := rst.GetProof(iid)
 		if err != nil {
 			log.Errorf("get proof failed: %v", err)
 			return nil, nil, err
 		}
-		err = verifyRequest(iid, pr.GetRoot(), kvd, inst.Invoke.Args)
+		req, err := verifyRequest(iid, pr.GetRoot(), rst.GetIndex(), kvd,
+			inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+		participants, err = verifyParticipants(rst, inst, pr.GetRoot(), req)
+		if err != nil {
+			return nil, nil, err
+		}
+		plan = req.ExecReq.EP
+		execReq = req.ExecReq
+		args = writeset(args)
+	case "upgrade":
+		args, err = verifyUpgrade(iid, kvd, inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "lock":
+		pr, err := rst.GetProof(iid)
+		if err != nil {
+			log.Errorf("get proof failed: %v", err)
+			return nil, nil, err
+		}
+		args, err = verifyLock(iid, pr.GetRoot(), rst.GetIndex(), kvd,
+			inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "precommit":
+		args, err = verifyPrecommit(iid, rst.GetIndex(), kvd,
+			inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "update_registry":
+		err = verifyIsRegistry(kvd)
+		if err != nil {
+			return nil, nil, err
+		}
+		args, err = verifyRegistryUpdate(kvd, inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "register_dfu", "update_dfu", "retire_dfu":
+		err = verifyIsRegistry(kvd)
+		if err != nil {
+			return nil, nil, err
+		}
+		args, err = verifyDFUCommand(inst.Invoke.Command, kvd,
+			inst.Invoke.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+	case "migrate":
+		err = kvd.Migrate()
+		if err != nil {
+			log.Errorf("migrating contract storage: %v", err)
+			return nil, nil, err
+		}
+		args = nil
+	case "prepare":
+		sc, err = prepare(rst, inst)
+		return sc, cout, err
+	case "commit":
+		sc, err = commit(rst, inst)
+		return sc, cout, err
+	case "abort":
+		sc, err = abort(rst, inst)
+		return sc, cout, err
+	case "init_contract":
+		err = verifyInit(kvd, args)
+		if err != nil {
+			log.Error(err)
+			return nil, nil, err
+		}
+	case "dummy":
+		err = verifyDummyArgs(args)
 		if err != nil {
+			log.Error(err)
 			return nil, nil, err
 		}
-	} else if inst.Invoke.Command != "init_contract" && inst.Invoke.Command != "dummy" {
+	default:
 		log.Errorf("value contract can only init_contract, update, " +
-			"or dummy")
+			"upgrade, lock, precommit, update_registry, " +
+			"register_dfu, update_dfu, retire_dfu, migrate, prepare, " +
+			"commit, abort, or dummy")
 		return nil, nil, xerrors.New("invalid command")
 	}
 
@@ -89,19 +222,79 @@ func (c *ContractKeyValue) Invoke(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.In
 		log.Errorf("Get values failed: %v", err)
 		return
 	}
-	Update(kvd, inst.Invoke.Args)
-	var buf []byte
-	buf, err = protobuf.Encode(kvd)
+	var from string
+	if plan != nil {
+		from, err = currState(kvd)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	err = Update(kvd, args)
 	if err != nil {
-		log.Errorf("Protobuf encode failed: %v", err)
+		log.Errorf("updating contract storage: %v", err)
 		return
 	}
-	sc = []byzcoin.StateChange{
-		byzcoin.NewStateChange(byzcoin.Update, inst.InstanceID, ContractKeyValueID, buf, darcID),
+	if plan != nil {
+		err = recordTxn(kvd, iid, plan, execReq.Index, execReq.OpReceipts,
+			rst.GetIndex(), from, args)
+		if err != nil {
+			log.Errorf("recording txn: %v", err)
+			return
+		}
+		err = recordPlan(kvd, plan)
+		if err != nil {
+			log.Errorf("recording plan: %v", err)
+			return
+		}
+		err = releaseLock(kvd, plan.PlanID)
+		if err != nil {
+			return
+		}
+	}
+	sc, err = storageChanges(byzcoin.Update, inst.InstanceID, stored, kvd,
+		darcID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, p := range participants {
+		var psc []byzcoin.StateChange
+		psc, err = p.update(execReq, rst.GetIndex())
+		if err != nil {
+			log.Errorf("updating contract %s: %v", p.cid, err)
+			return
+		}
+		sc = append(sc, psc...)
 	}
 	return
 }
 
+// verifyNotTerminal returns an error if the contract is in a terminal state
+// of its FSM. Contracts without an FSM, such as the registry, are never in a
+// terminal state.
+func verifyNotTerminal(cs *core.Storage) error {
+	if _, ok := cs.Get(core.KeyRaw); !ok {
+		return nil
+	}
+	raw, err := cs.GetRaw()
+	if err != nil {
+		return err
+	}
+	if raw.FSM == nil {
+		return nil
+	}
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		return err
+	}
+	if raw.FSM.IsTerminal(hdr.CurrState) {
+		return xerrors.Errorf("contract is in the terminal state %s",
+			hdr.CurrState)
+	}
+	return nil
+}
+
 func (c *ContractKeyValue) Delete(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction, coins []byzcoin.Coin) (sc []byzcoin.StateChange, cout []byzcoin.Coin, err error) {
 	cout = coins
 	var darcID darc.ID
@@ -110,79 +303,257 @@ func (c *ContractKeyValue) Delete(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.In
 		log.Errorf("Get values failed: %v", err)
 		return
 	}
-
-	sc = byzcoin.StateChanges{byzcoin.NewStateChange(byzcoin.Remove, inst.InstanceID, ContractKeyValueID, nil, darcID)}
+	cs, stored, err := loadStorage(rst, inst.InstanceID.Slice(), &c.Storage)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	err = cs.VerifyTerminal()
+	if err != nil {
+		log.Errorf("cannot delete contract: %v", err)
+		return
+	}
+	err = verifyNotPending(cs)
+	if err != nil {
+		log.Errorf("cannot delete contract: %v", err)
+		return
+	}
+	sc, err = storageChanges(byzcoin.Remove, inst.InstanceID, stored, cs,
+		darcID)
+	if err != nil {
+		log.Error(err)
+	}
 	return
 }
 
-func Update(cs *core.Storage, args byzcoin.Arguments) {
+// Update applies the writeset args to the contract storage. An argument
+// overwrites its key, or deletes it if the value is empty, unless its name
+// starts with a writeset operation (see core.OpAppend).
+func Update(cs *core.Storage, args byzcoin.Arguments) error {
 	for _, kv := range args {
-		var updated bool
-		for i, stored := range cs.Store {
-			if stored.Key == kv.Name {
-				updated = true
-				if kv.Value == nil || len(kv.Value) == 0 {
-					cs.Store = append(cs.Store[0:i], cs.Store[i+1:]...)
-					break
-				}
-				cs.Store[i].Value = kv.Value
+		name, value := kv.Name, kv.Value
+		op, key := core.SplitOp(name)
+		if op != "" {
+			var err error
+			value, err = core.ApplyOp(op, cs.Map()[key], kv.Value)
+			if err != nil {
+				return xerrors.Errorf("applying %s: %v", name, err)
 			}
+			name = key
 		}
-		if !updated {
-			cs.Store = append(cs.Store, core.KV{Key: kv.Name, Value: kv.Value})
+		if len(value) == 0 {
+			cs.Delete(name)
+		} else {
+			cs.Set(name, value)
 		}
 	}
+	return nil
 }
 
-func verifyRequest(iid []byte, contractRoot []byte, cs *core.Storage, args byzcoin.Arguments) error {
+func verifyRequest(iid []byte, contractRoot []byte, index int,
+	cs *core.Storage, args byzcoin.Arguments) (*Request, error) {
 	req, err := getRequest(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// 1) Check if Merkle roots match
-	if !bytes.Equal(req.ExecReq.EP.StateRoot, contractRoot) {
-		err := xerrors.New("merkle roots do not match")
+	ext, err := extWritesets(args)
+	if err != nil {
 		log.Error(err)
-		return err
+		return nil, err
 	}
 	// Get contract header
-	hdr := &core.ContractHeader{}
-	err = protobuf.Decode(cs.Store[1].Value, hdr)
+	hdr, err := cs.GetHeader()
 	if err != nil {
 		log.Errorf("retrieving contract header: %v", err)
-		return err
+		return nil, err
+	}
+	// 1) Check if Merkle roots match. A plan that is generated from an
+	// older state can still be applied if its writeset commutes, unless it
+	// updates other contracts too. A plan that holds the contract lock was
+	// generated from the state on which the lock was taken, and no other
+	// plan can update the contract while it is locked.
+	if !bytes.Equal(req.ExecReq.EP.StateRoot, contractRoot) &&
+		!hdr.HeldBy(req.ExecReq.EP.PlanID, index) {
+		if len(req.ExecReq.EP.Contracts) > 0 {
+			err := xerrors.New("merkle roots do not match")
+			log.Error(err)
+			return nil, err
+		}
+		err := VerifyRebase(cs, req.ExecReq.EP, args)
+		if err != nil {
+			log.Errorf("merkle roots do not match: %v", err)
+			return nil, xerrors.Errorf("merkle roots do not match: %v", err)
+		}
 	}
 	// 2) Check that the CIDs match
 	if !bytes.Equal(req.ExecReq.EP.CID, iid) || !bytes.Equal(req.ExecReq.EP.CID, hdr.CID[:]) {
 		err := xerrors.New("inconsistent CID values")
 		log.Error(err)
-		return err
+		return nil, err
 	}
 	// 3) Check that writeset is generated by the correct code
 	if !bytes.Equal(req.ExecReq.EP.CodeHash, hdr.CodeHash) {
 		err := xerrors.New("code hashes do no match")
 		log.Error(err)
-		return err
+		return nil, err
 	}
-	// 4) verify execution request
+	// 4) Check that the contract is not locked by another client
+	err = hdr.CheckLock(req.ExecReq.EP.PlanID, index)
+	if err != nil {
+		log.Errorf("verifying contract lock: %v", err)
+		return nil, err
+	}
+	// 5) Check that the writeset moves the contract to the state that is
+	// specified by the FSM
+	err = verifyTransition(req.ExecReq.EP.TxnName, cs, hdr, args)
+	if err != nil {
+		log.Errorf("verifying state transition: %v", err)
+		return nil, err
+	}
+	// 6) verify execution request. Every node of the ledger runs the
+	// contract, so it uses the default hashing configuration, which rejects
+	// legacy plans, rather than one that could differ between the nodes.
 	err = req.ExecReq.Verify(&core.VerificationData{UID: req.UID,
-		OpcodeName: req.OpcodeName, InputHashes: prepareHashes(args)})
+		OpcodeName:  req.OpcodeName,
+		InputHashes: prepareHashes(req.ExecReq.EP.Version, args, ext)})
 	if err != nil {
 		log.Errorf("verifying execution request: %v", err)
-		return err
+		return nil, err
 	}
-	// 5) verify input receipts
+	// 7) verify input receipts
 	inputMap := createInputMap(req.ExecReq)
 	err = verifyInputReceipts(req.ExecReq, req.InReceipts, inputMap)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// verifyTransition checks that the header in the writeset is consistent
+// with the FSM transition of the txn. The transition, including its guards,
+// is resolved against the contract state before the update. The new header
+// must have its CurrState set to the target state of the transition, and
+// the remaining header fields must be unchanged. If the writeset does not
+// contain a header, the target state must be the current state.
+func verifyTransition(txnName string, cs *core.Storage,
+	hdr *core.ContractHeader, args byzcoin.Arguments) error {
+	raw, err := cs.GetRaw()
+	if err != nil {
+		return err
+	}
+	transition, err := raw.FSM.Resolve(txnName, hdr.CurrState, cs.Map())
 	if err != nil {
 		return err
 	}
+	newHdr := hdr
+	for _, arg := range writeset(args) {
+		op, key := core.SplitOp(arg.Name)
+		if core.IsReserved(key) && (key != core.KeyHeader || op != "") {
+			return xerrors.Errorf("writeset cannot modify %s", key)
+		}
+		if key == core.KeyHeader {
+			if len(arg.Value) == 0 {
+				return xerrors.New("writeset cannot delete the header")
+			}
+			newHdr = &core.ContractHeader{}
+			err = protobuf.Decode(arg.Value, newHdr)
+			if err != nil {
+				return xerrors.Errorf("decoding new contract header: %v", err)
+			}
+		}
+	}
+	if newHdr.CurrState != transition.To {
+		return xerrors.Errorf("invalid state transition: expected %s but "+
+			"received %s", transition.To, newHdr.CurrState)
+	}
+	if !newHdr.CID.Equal(hdr.CID) {
+		return xerrors.New("writeset cannot modify the contract ID")
+	}
+	// The writeset of a plan that holds the lock is computed from the
+	// header before the lock was taken, so it can carry the lock-free
+	// header. The lock is released by the update anyway (see releaseLock),
+	// and a lock of another plan is rejected by CheckLock before.
+	unlocked := *hdr
+	unlocked.ClearLock()
+	if !sameLock(newHdr, hdr) && !sameLock(newHdr, &unlocked) {
+		return xerrors.New("writeset cannot modify the contract lock")
+	}
+	if !bytes.Equal(newHdr.CodeHash, hdr.CodeHash) {
+		return xerrors.New("writeset cannot modify the code hash")
+	}
+	if newHdr.UnitID != hdr.UnitID {
+		return xerrors.New("writeset cannot modify the state unit")
+	}
+	if !samePoints(newHdr.Admins, hdr.Admins) ||
+		newHdr.AdminThreshold != hdr.AdminThreshold {
+		return xerrors.New("writeset cannot modify the contract admins")
+	}
+	return nil
+}
+
+func sameLock(a *core.ContractHeader, b *core.ContractHeader) bool {
+	return a.Lock == b.Lock && bytes.Equal(a.LockID, b.LockID) &&
+		a.LockExpiry == b.LockExpiry
+}
+
+// verifyInitArgs checks that the arguments that initialize a contract do not
+// write reserved keys other than raw and header.
+func verifyInitArgs(args byzcoin.Arguments) error {
+	for _, arg := range args {
+		op, key := core.SplitOp(arg.Name)
+		if core.IsReserved(key) && (op != "" ||
+			(key != core.KeyRaw && key != core.KeyHeader)) {
+			return xerrors.Errorf("cannot initialize reserved key %s",
+				arg.Name)
+		}
+	}
+	return nil
+}
+
+// isRegistryInit returns true if the arguments of a spawn initialize the
+// registry contract, which only stores DFUs (see core.DFUKey).
+func isRegistryInit(args byzcoin.Arguments) bool {
+	if len(args) == 0 {
+		return false
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg.Name, core.DFUKeyPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyInit checks that init_contract sets the raw contract and the header
+// of a contract that has just been spawned, whose header does not have a
+// CID yet. Otherwise, init_contract could replace the code and the state of
+// a contract without an upgrade or an execution plan.
+func verifyInit(cs *core.Storage, args byzcoin.Arguments) error {
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		return err
+	}
+	if hdr.CID != (byzcoin.InstanceID{}) {
+		return xerrors.New("contract is already initialized")
+	}
+	return verifyInitArgs(args)
+}
+
+// verifyDummyArgs checks that a dummy update, which is not authorized by an
+// execution plan, does not modify the keys that are maintained by Protean.
+func verifyDummyArgs(args byzcoin.Arguments) error {
+	for _, arg := range args {
+		_, key := core.SplitOp(arg.Name)
+		if core.IsReserved(key) {
+			return xerrors.Errorf("dummy update cannot modify %s", key)
+		}
+	}
 	return nil
 }
 
 func getRequest(args byzcoin.Arguments) (*Request, error) {
 	for _, arg := range args {
-		if arg.Name == "request" {
+		if arg.Name == core.KeyRequest {
 			var req Request
 			err := protobuf.Decode(arg.Value, &req)
 			if err != nil {
@@ -195,17 +566,25 @@ func getRequest(args byzcoin.Arguments) (*Request, error) {
 	return nil, xerrors.New("missing execution request")
 }
 
-func prepareHashes(args byzcoin.Arguments) map[string][]byte {
-	h := sha256.New()
+// prepareHashes returns the input hashes of the update with hash version,
+// the version of its execution plan.
+func prepareHashes(version int, args byzcoin.Arguments,
+	ext map[string]*core.Writeset) map[string][]byte {
+	input := statebase.UpdateInput{Args: writeset(args), ExtArgs: ext}
+	return input.PrepareHashes(version)
+}
+
+// writeset returns the arguments of an update without the execution
+// request and the writesets of other contracts.
+func writeset(args byzcoin.Arguments) byzcoin.Arguments {
+	var ws byzcoin.Arguments
 	for _, arg := range args {
-		if arg.Name != "request" {
-			h.Write([]byte(arg.Name))
-			h.Write(arg.Value)
+		if arg.Name != core.KeyRequest &&
+			!strings.HasPrefix(arg.Name, core.WritesetPrefix) {
+			ws = append(ws, arg)
 		}
 	}
-	hashes := make(map[string][]byte)
-	hashes["ws"] = h.Sum(nil)
-	return hashes
+	return ws
 }
 
 type pair struct {
@@ -213,6 +592,8 @@ type pair struct {
 	name string
 }
 
+// createInputMap returns the inputs of the opcodes of the plan that take
+// each opcode output, keyed by the output.
 func createInputMap(execReq *core.ExecutionRequest) map[pair][]pair {
 	depMap := make(map[pair][]pair)
 	for opIdx, opcode := range execReq.EP.Txn.Opcodes {
@@ -220,27 +601,29 @@ func createInputMap(execReq *core.ExecutionRequest) map[pair][]pair {
 			if dep.Src == core.OPCODE {
 				pKey := pair{idx: dep.Idx, name: dep.SrcName}
 				pVal := pair{idx: opIdx, name: depName}
-				pairs, ok := depMap[pKey]
-				if ok {
-					pairs = append(pairs, pVal)
-				} else {
-					depMap[pKey] = []pair{pVal}
-				}
+				depMap[pKey] = append(depMap[pKey], pVal)
 			}
 		}
 	}
 	return depMap
 }
 
-// Note: This function is NOT tested! None of the applications have a
-//transaction where an opcode output is passed to multiple opcode inputs.
-//Therefore, in our experiments, the code inside the if-statement is never executed.
+// verifyInputReceipts checks that the inputs that take the same opcode
+// output (see createInputMap) have receipts with the same hash, signed by
+// the DFUs of their opcodes, so that the opcodes got the same value.
 func verifyInputReceipts(execReq *core.ExecutionRequest,
 	inReceipts map[int]map[string]*core.OpcodeReceipt,
 	inputMap map[pair][]pair) error {
 
 	for _, destPairs := range inputMap {
 		if len(destPairs) > 1 {
+			for _, p := range destPairs {
+				if inReceipts[p.idx][p.name] == nil {
+					log.Errorf("missing receipt of input %d:%s", p.idx,
+						p.name)
+					return xerrors.New("cannot verify input receipts")
+				}
+			}
 			for i := 0; i < len(destPairs)-1; i++ {
 				h1 := inReceipts[destPairs[i].idx][destPairs[i].name].HashBytes
 				h2 := inReceipts[destPairs[i+1].idx][destPairs[i+1].name].HashBytes
@@ -254,7 +637,16 @@ func verifyInputReceipts(execReq *core.ExecutionRequest,
 			for _, pair := range destPairs {
 				dfuid := execReq.EP.Txn.Opcodes[pair.idx].DFUID
 				dfuData := execReq.EP.DFUData[dfuid]
+				if dfuData == nil {
+					log.Errorf("cannot find dfu info for %s", dfuid)
+					return xerrors.New("cannot verify input receipts")
+				}
 				receipt := inReceipts[pair.idx][pair.name]
+				if receipt.Version != execReq.EP.Version {
+					log.Errorf("receipt %d:%s has hash version %d", pair.idx,
+						pair.name, receipt.Version)
+					return xerrors.New("cannot verify input receipts")
+				}
 				err := receipt.Sig.VerifyWithPolicy(suite, receipt.Hash(),
 					dfuData.Keys, sign.NewThresholdPolicy(dfuData.Threshold))
 				if err != nil {
@@ -266,3 +658,15 @@ func verifyInputReceipts(execReq *core.ExecutionRequest,
 	}
 	return nil
 }
+
+func samePoints(a, b []kyber.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
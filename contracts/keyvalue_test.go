@@ -0,0 +1,121 @@
+package contracts
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/dedis/protean/core/coretest"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/protobuf"
+)
+
+func Test_VerifyInit(t *testing.T) {
+	args := byzcoin.Arguments{{Name: core.KeyRaw, Value: []byte("raw")},
+		{Name: core.KeyHeader, Value: []byte("header")},
+		{Name: "tickets", Value: []byte("tickets")}}
+	cs := lockStorage(t, &core.ContractHeader{})
+	require.NoError(t, verifyInit(cs, args))
+
+	// Only the raw contract and the header can be initialized
+	bad := append(byzcoin.Arguments{}, args...)
+	bad = append(bad, byzcoin.Argument{Name: core.KeyIndex})
+	require.Error(t, verifyInit(cs, bad))
+	bad = byzcoin.Arguments{core.AppendArg(core.KeyHeader, []byte("h"))}
+	require.Error(t, verifyInit(cs, bad))
+	for _, key := range []string{core.KeyRegistry, core.DFUKey("app")} {
+		bad = append(byzcoin.Arguments{}, args...)
+		bad = append(bad, byzcoin.Argument{Name: key})
+		require.Error(t, verifyInit(cs, bad))
+		require.False(t, isRegistryInit(bad))
+	}
+	require.True(t, isRegistryInit(byzcoin.Arguments{
+		{Name: core.DFUKey(core.CEUID)}}))
+
+	// An initialized contract cannot be initialized again
+	cs = lockStorage(t, &core.ContractHeader{
+		CID: byzcoin.NewInstanceID([]byte("cid"))})
+	require.Error(t, verifyInit(cs, args))
+}
+
+func Test_VerifyDummyArgs(t *testing.T) {
+	require.NoError(t, verifyDummyArgs(byzcoin.Arguments{
+		{Name: "tickets", Value: []byte("tickets")},
+		core.AppendArg("votes", []byte("vote"))}))
+	for _, key := range []string{core.KeyRaw, core.KeyHeader, core.KeyIndex,
+		core.KeyRegistry, core.DFUKey(core.CEUID)} {
+		require.Error(t, verifyDummyArgs(byzcoin.Arguments{
+			{Name: key, Value: []byte("value")}}))
+	}
+	require.Error(t, verifyDummyArgs(byzcoin.Arguments{
+		core.AppendArg(core.KeyHeader, []byte("header"))}))
+}
+
+func Test_VerifyNotTerminal(t *testing.T) {
+	// The registry has no raw contract and is never terminal
+	cs := lockStorage(t, &core.ContractHeader{CurrState: "closed"})
+	require.NoError(t, verifyNotTerminal(cs))
+
+	buf, err := protobuf.Encode(&core.ContractRaw{FSM: &core.FSM{
+		InitialState: "open", States: []string{"open", "closed"},
+		Transitions: map[string]*core.Transition{
+			"close": {From: "open", To: "closed"}},
+	}})
+	require.NoError(t, err)
+	cs.Set(core.KeyRaw, buf)
+	require.Error(t, verifyNotTerminal(cs))
+	cs = lockStorage(t, &core.ContractHeader{CurrState: "open"})
+	cs.Set(core.KeyRaw, buf)
+	require.NoError(t, verifyNotTerminal(cs))
+}
+
+func Test_VerifyInputReceipts(t *testing.T) {
+	execPriv, execPub := bdn.NewKeyPair(suite, random.New())
+	statePriv, statePub := bdn.NewKeyPair(suite, random.New())
+	// The output of opcode 0 is the input of opcodes 1 and 2
+	execReq := &core.ExecutionRequest{EP: &core.ExecutionPlan{
+		Version: core.CurrentHashVersion, Txn: &core.Transaction{
+			Opcodes: []*core.Opcode{
+				{Name: "exec", DFUID: "codeexec"},
+				{Name: "exec", DFUID: "codeexec",
+					Dependencies: map[string]*core.DataDependency{
+						"in": {Src: core.OPCODE, SrcName: "out", Idx: 0}}},
+				{Name: "update_state", DFUID: core.SUID,
+					Dependencies: map[string]*core.DataDependency{
+						"ws": {Src: core.OPCODE, SrcName: "out", Idx: 0}}},
+			}},
+		DFUData: map[string]*core.DFUIdentity{
+			"codeexec": {Threshold: 1, Keys: []kyber.Point{execPub}},
+			core.SUID:  {Threshold: 1, Keys: []kyber.Point{statePub}},
+		}}}
+	inputMap := createInputMap(execReq)
+	require.Len(t, inputMap, 1)
+	require.ElementsMatch(t, []pair{{idx: 1, name: "in"},
+		{idx: 2, name: "ws"}}, inputMap[pair{idx: 0, name: "out"}])
+
+	receipt := func(priv kyber.Scalar, pub kyber.Point,
+		hash string) *core.OpcodeReceipt {
+		r := &core.OpcodeReceipt{Version: core.CurrentHashVersion,
+			OpIdx: 0, Name: "out", HashBytes: []byte(hash)}
+		r.Sig = coretest.BdnSign(t, priv, pub, r.Hash())
+		return r
+	}
+	inReceipts := map[int]map[string]*core.OpcodeReceipt{
+		1: {"in": receipt(execPriv, execPub, "output")},
+		2: {"ws": receipt(statePriv, statePub, "output")},
+	}
+	require.NoError(t, verifyInputReceipts(execReq, inReceipts, inputMap))
+
+	// The opcodes must get the same output
+	inReceipts[2]["ws"] = receipt(statePriv, statePub, "other output")
+	require.Error(t, verifyInputReceipts(execReq, inReceipts, inputMap))
+	// The receipt must be signed by the DFU of its opcode
+	inReceipts[2]["ws"] = receipt(execPriv, execPub, "output")
+	require.Error(t, verifyInputReceipts(execReq, inReceipts, inputMap))
+	// Every input must have a receipt
+	delete(inReceipts, 2)
+	require.Error(t, verifyInputReceipts(execReq, inReceipts, inputMap))
+}
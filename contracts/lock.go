@@ -0,0 +1,96 @@
+package contracts
+
+import (
+	"bytes"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// verifyLock checks the "lock" command and returns the arguments that write
+// the locked header. The command takes the execution plan ("plan") for which
+// the contract is locked, which must be signed by the CEU and generated from
+// the current state of the contract. The plan holds the lock for
+// plan.LockBlocks blocks, so no other plan can update the contract in the
+// meantime.
+func verifyLock(iid []byte, root []byte, index int, cs *core.Storage,
+	args byzcoin.Arguments) (byzcoin.Arguments, error) {
+	plan := &core.ExecutionPlan{}
+	err := protobuf.Decode(args.Search("plan"), plan)
+	if err != nil {
+		log.Errorf("decoding execution plan: %v", err)
+		return nil, err
+	}
+	if plan.LockBlocks <= 0 || plan.LockBlocks > core.MaxLockBlocks {
+		err := xerrors.Errorf("lock duration must be between 1 and %d "+
+			"blocks", core.MaxLockBlocks)
+		log.Error(err)
+		return nil, err
+	}
+	if len(plan.Contracts) > 0 {
+		err := xerrors.New("a plan that updates several contracts cannot " +
+			"lock them")
+		log.Error(err)
+		return nil, err
+	}
+	if !bytes.Equal(plan.CID, iid) {
+		err := xerrors.New("inconsistent CID values")
+		log.Error(err)
+		return nil, err
+	}
+	// The plan must be generated from the current state. This also keeps
+	// the plan from locking the contract again after its update.
+	if !bytes.Equal(plan.StateRoot, root) {
+		err := xerrors.New("merkle roots do not match")
+		log.Error(err)
+		return nil, err
+	}
+	err = plan.VerifySig(core.HashConfig{})
+	if err != nil {
+		log.Errorf("verifying execution plan: %v", err)
+		return nil, err
+	}
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		log.Errorf("retrieving contract header: %v", err)
+		return nil, err
+	}
+	err = hdr.CheckLock(plan.PlanID, index)
+	if err != nil {
+		log.Errorf("cannot lock contract: %v", err)
+		return nil, err
+	}
+	hdr.SetLock(plan.PlanID, index+plan.LockBlocks)
+	return encodeHeader(hdr)
+}
+
+// releaseLock releases the lock on the contract after its storage is
+// updated by the plan planID, if the plan holds the lock.
+func releaseLock(cs *core.Storage, planID []byte) error {
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		log.Errorf("retrieving contract header: %v", err)
+		return err
+	}
+	if !hdr.Lock || !bytes.Equal(hdr.LockID, planID) {
+		return nil
+	}
+	hdr.ClearLock()
+	args, err := encodeHeader(hdr)
+	if err != nil {
+		return err
+	}
+	return Update(cs, args)
+}
+
+func encodeHeader(hdr *core.ContractHeader) (byzcoin.Arguments, error) {
+	buf, err := protobuf.Encode(hdr)
+	if err != nil {
+		log.Errorf("encoding contract header: %v", err)
+		return nil, err
+	}
+	return byzcoin.Arguments{{Name: core.KeyHeader, Value: buf}}, nil
+}
@@ -0,0 +1,169 @@
+package contracts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/dedis/protean/core/coretest"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/protobuf"
+)
+
+// lockPlan returns an execution plan for contract cid that locks it for
+// blocks blocks and is signed by a new CEU key.
+func lockPlan(t *testing.T, cid []byte, root []byte,
+	blocks int) *core.ExecutionPlan {
+	priv, pub := bdn.NewKeyPair(suite, random.New())
+	plan := &core.ExecutionPlan{Version: core.CurrentHashVersion,
+		PlanID: []byte("plan"), CID: cid, StateRoot: root,
+		LockBlocks: blocks, Txn: &core.Transaction{
+			Opcodes: []*core.Opcode{{Name: "update_state",
+				DFUID: core.SUID}}},
+		DFUData: map[string]*core.DFUIdentity{
+			core.CEUID: {Threshold: 1, Keys: []kyber.Point{pub}},
+		}}
+	plan.Sig = coretest.BdnSign(t, priv, pub, plan.Hash())
+	return plan
+}
+
+func lockStorage(t *testing.T, hdr *core.ContractHeader) *core.Storage {
+	cs := &core.Storage{Version: core.CurrentStorageVersion}
+	buf, err := protobuf.Encode(hdr)
+	require.NoError(t, err)
+	cs.Set(core.KeyHeader, buf)
+	return cs
+}
+
+func lockArgs(t *testing.T, plan *core.ExecutionPlan) byzcoin.Arguments {
+	buf, err := protobuf.Encode(plan)
+	require.NoError(t, err)
+	return byzcoin.Arguments{{Name: "plan", Value: buf}}
+}
+
+func Test_VerifyLock(t *testing.T) {
+	cid := bytes.Repeat([]byte{1}, 32)
+	root := []byte("root")
+	hdr := &core.ContractHeader{CID: byzcoin.NewInstanceID(cid),
+		CurrState: "open"}
+	plan := lockPlan(t, cid, root, 5)
+
+	args, err := verifyLock(cid, root, 10, lockStorage(t, hdr),
+		lockArgs(t, plan))
+	require.NoError(t, err)
+	locked := &core.ContractHeader{}
+	require.NoError(t, protobuf.Decode(args.Search(core.KeyHeader), locked))
+	require.True(t, locked.HeldBy(plan.PlanID, 14))
+	require.False(t, locked.IsLocked(15))
+
+	// The plan must be generated from the current state, so it cannot lock
+	// the contract again after the lock changes the state
+	_, err = verifyLock(cid, []byte("other root"), 10, lockStorage(t, hdr),
+		lockArgs(t, plan))
+	require.Error(t, err)
+	_, err = verifyLock(bytes.Repeat([]byte{2}, 32), root, 10,
+		lockStorage(t, hdr), lockArgs(t, plan))
+	require.Error(t, err)
+
+	// The lock duration is bounded and covered by the CEU signature
+	_, err = verifyLock(cid, root, 10, lockStorage(t, hdr),
+		lockArgs(t, lockPlan(t, cid, root, 0)))
+	require.Error(t, err)
+	_, err = verifyLock(cid, root, 10, lockStorage(t, hdr),
+		lockArgs(t, lockPlan(t, cid, root, core.MaxLockBlocks+1)))
+	require.Error(t, err)
+	forged := *plan
+	forged.LockBlocks = core.MaxLockBlocks
+	_, err = verifyLock(cid, root, 10, lockStorage(t, hdr),
+		lockArgs(t, &forged))
+	require.Error(t, err)
+
+	// A plan that updates other contracts cannot lock
+	multi := lockPlan(t, cid, root, 5)
+	multi.Contracts = []core.ContractRoot{{CID: bytes.Repeat([]byte{2}, 32)}}
+	_, err = verifyLock(cid, root, 10, lockStorage(t, hdr),
+		lockArgs(t, multi))
+	require.Error(t, err)
+
+	// Another plan cannot lock the contract until the lock expires
+	other := *hdr
+	other.SetLock([]byte("other plan"), 12)
+	_, err = verifyLock(cid, root, 10, lockStorage(t, &other),
+		lockArgs(t, plan))
+	require.Error(t, err)
+	_, err = verifyLock(cid, root, 12, lockStorage(t, &other),
+		lockArgs(t, plan))
+	require.NoError(t, err)
+}
+
+func Test_ReleaseLock(t *testing.T) {
+	hdr := &core.ContractHeader{CurrState: "open"}
+	hdr.SetLock([]byte("plan"), 12)
+
+	// The update of another plan does not release the lock
+	cs := lockStorage(t, hdr)
+	require.NoError(t, releaseLock(cs, []byte("other plan")))
+	got, err := cs.GetHeader()
+	require.NoError(t, err)
+	require.True(t, got.HeldBy([]byte("plan"), 10))
+
+	require.NoError(t, releaseLock(cs, []byte("plan")))
+	got, err = cs.GetHeader()
+	require.NoError(t, err)
+	require.False(t, got.Lock)
+	require.Empty(t, got.LockID)
+	require.Equal(t, "open", got.CurrState)
+}
+
+func Test_LockThenUpdate(t *testing.T) {
+	cid := bytes.Repeat([]byte{1}, 32)
+	root := []byte("root")
+	hdr := &core.ContractHeader{CID: byzcoin.NewInstanceID(cid),
+		CurrState: "open"}
+	cs := lockStorage(t, hdr)
+	buf, err := protobuf.Encode(&core.ContractRaw{FSM: &core.FSM{
+		InitialState: "open", States: []string{"open", "closed"},
+		Transitions: map[string]*core.Transition{
+			"close": {From: "open", To: "closed"}},
+	}})
+	require.NoError(t, err)
+	cs.Set(core.KeyRaw, buf)
+
+	// The app computes the writeset of the plan from the header that it
+	// reads before the lock is taken
+	closed := *hdr
+	closed.CurrState = "closed"
+	hdrBuf, err := protobuf.Encode(&closed)
+	require.NoError(t, err)
+	ws := byzcoin.Arguments{{Name: core.KeyHeader, Value: hdrBuf}}
+
+	plan := lockPlan(t, cid, root, 5)
+	args, err := verifyLock(cid, root, 10, cs, lockArgs(t, plan))
+	require.NoError(t, err)
+	require.NoError(t, Update(cs, args))
+	locked, err := cs.GetHeader()
+	require.NoError(t, err)
+	require.True(t, locked.HeldBy(plan.PlanID, 12))
+
+	require.NoError(t, locked.CheckLock(plan.PlanID, 12))
+	require.NoError(t, verifyTransition("close", cs, locked, ws))
+	require.NoError(t, Update(cs, ws))
+	require.NoError(t, releaseLock(cs, plan.PlanID))
+	got, err := cs.GetHeader()
+	require.NoError(t, err)
+	require.Equal(t, "closed", got.CurrState)
+	require.False(t, got.Lock)
+
+	// The writeset cannot take a lock of its own
+	cs = lockStorage(t, hdr)
+	cs.Set(core.KeyRaw, buf)
+	closed.SetLock([]byte("other plan"), 20)
+	hdrBuf, err = protobuf.Encode(&closed)
+	require.NoError(t, err)
+	require.Error(t, verifyTransition("close", cs, hdr, byzcoin.Arguments{
+		{Name: core.KeyHeader, Value: hdrBuf}}))
+}
@@ -0,0 +1,252 @@
+package contracts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// participant is a contract other than the invoked one that is updated by
+// an execution plan.
+type participant struct {
+	cid    byzcoin.InstanceID
+	cs     *core.Storage
+	stored *storedKeys
+	args   byzcoin.Arguments
+	darcID darc.ID
+}
+
+// extWritesets returns the writesets of the other contracts of the plan,
+// keyed by the name of their argument (see core.WritesetInput).
+func extWritesets(args byzcoin.Arguments) (map[string]*core.Writeset, error) {
+	ext := make(map[string]*core.Writeset)
+	for _, arg := range args {
+		_, ok, err := core.WritesetCID(arg.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		ws := &core.Writeset{}
+		err = protobuf.Decode(arg.Value, ws)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding writeset %s: %v", arg.Name,
+				err)
+		}
+		ext[arg.Name] = ws
+	}
+	return ext, nil
+}
+
+// verifyParticipants checks the writesets of the contracts other than the
+// invoked one that are updated by the plan of req. Every contract of the
+// plan must have a writeset that is an input of the update_state opcode,
+// its state root must be the current one, its darc must let the signers of
+// inst update it, and the writeset must move it to the state that is
+// specified by its FSM for the txn.
+func verifyParticipants(rst byzcoin.ReadOnlyStateTrie,
+	inst byzcoin.Instruction, root []byte, req *Request) ([]*participant,
+	error) {
+	iid := inst.InstanceID.Slice()
+	args := inst.Invoke.Args
+	plan := req.ExecReq.EP
+	if plan.IsCrossUnit() {
+		err := xerrors.New("plan spans several state units and must be " +
+			"prepared")
+		log.Error(err)
+		return nil, err
+	}
+	ext, err := extWritesets(args)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(ext) != len(plan.Contracts) {
+		err := xerrors.New("writesets do not match the contracts of the plan")
+		log.Error(err)
+		return nil, err
+	}
+	opcode := plan.Txn.Opcodes[req.ExecReq.Index]
+	var ps []*participant
+	for _, pc := range plan.Contracts {
+		name := core.WritesetInput(pc.CID)
+		ws, ok := ext[name]
+		if !ok || bytes.Equal(pc.CID, iid) {
+			err := xerrors.Errorf("invalid writeset for contract %x", pc.CID)
+			log.Error(err)
+			return nil, err
+		}
+		delete(ext, name)
+		if _, ok := opcode.Dependencies[name]; !ok {
+			err := xerrors.Errorf("writeset of contract %x is not an input "+
+				"of the opcode", pc.CID)
+			log.Error(err)
+			return nil, err
+		}
+		if !bytes.Equal(pc.StateRoot, root) {
+			err := xerrors.Errorf("merkle roots do not match for contract %x",
+				pc.CID)
+			log.Error(err)
+			return nil, err
+		}
+		p, hdr, err := loadParticipant(rst, pc.CID)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		err = authorize(rst, inst, p)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		err = verifyNotPending(p.cs)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if !bytes.Equal(hdr.CID[:], pc.CID) {
+			err := xerrors.New("inconsistent CID values")
+			log.Error(err)
+			return nil, err
+		}
+		if !bytes.Equal(pc.CodeHash, hdr.CodeHash) {
+			err := xerrors.New("code hashes do no match")
+			log.Error(err)
+			return nil, err
+		}
+		err = hdr.CheckLock(plan.PlanID, rst.GetIndex())
+		if err != nil {
+			log.Errorf("verifying contract lock: %v", err)
+			return nil, err
+		}
+		err = verifyTransition(plan.TxnName, p.cs, hdr, ws.Args)
+		if err != nil {
+			log.Errorf("verifying state transition of contract %x: %v",
+				pc.CID, err)
+			return nil, err
+		}
+		p.args = ws.Args
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// authorize checks that the darc of participant p lets the signers of inst
+// run its command. Byzcoin only checks the instruction against the darc of
+// the invoked instance, but the command also writes the instances of the
+// other contracts of the plan.
+func authorize(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction,
+	p *participant) error {
+	_, _, _, invoked, err := rst.GetValues(inst.InstanceID.Slice())
+	if err != nil {
+		return xerrors.Errorf("get values failed: %v", err)
+	}
+	if bytes.Equal(p.darcID, invoked) {
+		return nil
+	}
+	d, err := byzcoin.LoadDarcFromTrie(rst, p.darcID)
+	if err != nil {
+		return xerrors.Errorf("loading darc of contract %s: %v", p.cid, err)
+	}
+	action := darc.Action(inst.Action())
+	expr := d.Rules.Get(action)
+	if len(expr) == 0 {
+		return xerrors.Errorf("darc of contract %s has no rule for %s",
+			p.cid, action)
+	}
+	getDarc := func(id string, latest bool) *darc.Darc {
+		if !strings.HasPrefix(id, "darc:") {
+			return nil
+		}
+		buf, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+		if err != nil {
+			return nil
+		}
+		d, err := byzcoin.LoadDarcFromTrie(rst, buf)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+	ids := make([]string, len(inst.SignerIdentities))
+	for i, id := range inst.SignerIdentities {
+		ids[i] = id.String()
+	}
+	err = darc.EvalExpr(expr, getDarc, ids...)
+	if err != nil {
+		return xerrors.Errorf("signers cannot %s contract %s: %v", action,
+			p.cid, err)
+	}
+	return nil
+}
+
+// update applies the writeset of the participant for the execution request
+// at block index and returns the state changes of its instances.
+func (p *participant) update(req *core.ExecutionRequest, index int) (
+	[]byzcoin.StateChange, error) {
+	plan := req.EP
+	from, err := currState(p.cs)
+	if err != nil {
+		return nil, err
+	}
+	err = Update(p.cs, p.args)
+	if err != nil {
+		return nil, xerrors.Errorf("updating contract storage: %v", err)
+	}
+	err = recordTxn(p.cs, p.cid.Slice(), plan, req.Index, req.OpReceipts,
+		index, from, p.args)
+	if err != nil {
+		return nil, xerrors.Errorf("recording txn: %v", err)
+	}
+	err = recordPlan(p.cs, plan)
+	if err != nil {
+		return nil, xerrors.Errorf("recording plan: %v", err)
+	}
+	err = releaseLock(p.cs, plan.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	return p.stateChanges()
+}
+
+// loadParticipant reads the storage of the keyValue contract cid.
+func loadParticipant(rst byzcoin.ReadOnlyStateTrie, cid []byte) (*participant,
+	*core.ContractHeader, error) {
+	buf, _, contractID, darcID, err := rst.GetValues(cid)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("get values failed: %v", err)
+	}
+	if contractID != ContractKeyValueID {
+		return nil, nil, xerrors.Errorf("contract %x is not a %s contract",
+			cid, ContractKeyValueID)
+	}
+	main := &core.Storage{}
+	err = protobuf.Decode(buf, main)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("decoding contract storage: %v", err)
+	}
+	cs, stored, err := loadStorage(rst, cid, main)
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("retrieving contract header: %v", err)
+	}
+	return &participant{cid: byzcoin.NewInstanceID(cid), cs: cs,
+		stored: stored, darcID: darcID}, hdr, nil
+}
+
+// stateChanges returns the state changes that write the storage of the
+// participant and its key instances.
+func (p *participant) stateChanges() ([]byzcoin.StateChange, error) {
+	return storageChanges(byzcoin.Update, p.cid, p.stored, p.cs, p.darcID)
+}
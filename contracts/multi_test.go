@@ -0,0 +1,60 @@
+package contracts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/protobuf"
+)
+
+// multiRequest returns a request for the update_state opcode of a plan on
+// cid1 that also updates the contracts of crs.
+func multiRequest(cid1 []byte, crs ...core.ContractRoot) *Request {
+	deps := make(map[string]*core.DataDependency)
+	for _, cr := range crs {
+		deps[core.WritesetInput(cr.CID)] = &core.DataDependency{
+			Src: core.OPCODE}
+	}
+	plan := &core.ExecutionPlan{CID: cid1, PlanID: []byte("plan"),
+		TxnName: "close", Contracts: crs, Txn: &core.Transaction{
+			Opcodes: []*core.Opcode{{Name: "update_state",
+				Dependencies: deps}}}}
+	return &Request{ExecReq: &core.ExecutionRequest{EP: plan, Index: 0}}
+}
+
+func writesetArg(t *testing.T, cid []byte) byzcoin.Argument {
+	buf, err := protobuf.Encode(&core.Writeset{
+		Args: byzcoin.Arguments{{Name: "x", Value: []byte("1")}}})
+	require.NoError(t, err)
+	return byzcoin.Argument{Name: core.WritesetInput(cid), Value: buf}
+}
+
+func Test_VerifyParticipants(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	cid2 := bytes.Repeat([]byte{2}, 32)
+	root := []byte("root")
+	tr := &testTrie{values: make(map[string][]byte)}
+	tr.set(t, cid2, &core.ContractHeader{CID: byzcoin.NewInstanceID(cid2),
+		CurrState: "open"})
+
+	// Missing writeset
+	req := multiRequest(cid1, core.ContractRoot{CID: cid2, StateRoot: root})
+	_, err := verifyParticipants(tr, invoke(cid1, "update",
+		byzcoin.Arguments{}), root, req)
+	require.Error(t, err)
+
+	// Stale root
+	args := byzcoin.Arguments{writesetArg(t, cid2)}
+	_, err = verifyParticipants(tr, invoke(cid1, "update", args),
+		[]byte("newroot"), req)
+	require.Error(t, err)
+
+	// The plan's own CID cannot be a participant
+	req = multiRequest(cid1, core.ContractRoot{CID: cid1, StateRoot: root})
+	_, err = verifyParticipants(tr, invoke(cid1, "update",
+		byzcoin.Arguments{writesetArg(t, cid1)}), root, req)
+	require.Error(t, err)
+}
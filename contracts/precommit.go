@@ -0,0 +1,67 @@
+package contracts
+
+import (
+	"bytes"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// verifyPrecommit checks the "precommit" command and returns the arguments
+// that store the commitment ("precommit", an encoded core.Precommit). A
+// commitment is accepted until the block index reaches the
+// PrecommitDeadline of the contract header, and only from the client that
+// the Precommitters of the header authorize for its key. The first
+// commitment after the deadline has changed starts a new round.
+func verifyPrecommit(iid []byte, index int, cs *core.Storage,
+	args byzcoin.Arguments) (byzcoin.Arguments, error) {
+	pc := core.Precommit{}
+	err := protobuf.Decode(args.Search("precommit"), &pc)
+	if err != nil {
+		log.Errorf("decoding precommit: %v", err)
+		return nil, err
+	}
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		log.Errorf("retrieving contract header: %v", err)
+		return nil, err
+	}
+	if index >= hdr.PrecommitDeadline {
+		err := xerrors.Errorf("precommit round closed at block %d",
+			hdr.PrecommitDeadline)
+		log.Error(err)
+		return nil, err
+	}
+	if !bytes.Equal(pc.CID.Slice(), iid) {
+		err := xerrors.New("precommit is for a different contract")
+		log.Error(err)
+		return nil, err
+	}
+	err = pc.Verify()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	round, err := core.GetPrecommits(cs)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if round == nil || round.Deadline != hdr.PrecommitDeadline {
+		round = &core.PrecommitRound{Deadline: hdr.PrecommitDeadline}
+	}
+	err = round.Add(pc, hdr.Precommitters)
+	if err != nil {
+		log.Errorf("adding precommit: %v", err)
+		return nil, err
+	}
+	buf, err := protobuf.Encode(round)
+	if err != nil {
+		log.Errorf("encoding precommit round: %v", err)
+		return nil, err
+	}
+	return byzcoin.Arguments{{Name: core.KeyPrecommits, Value: buf}}, nil
+}
@@ -0,0 +1,76 @@
+package contracts
+
+import (
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// VerifyRebase checks that the writeset of a plan that is generated from an
+// older state of the contract can be applied to its current state cs. The
+// writeset can only consist of commutative operations on the
+// CommutativeKeys of the contract, and the plan must be within the rebase
+// window and not applied before. Contracts without CommutativeKeys do not
+// keep a rebase log, so their plans can never be rebased.
+func VerifyRebase(cs *core.Storage, plan *core.ExecutionPlan,
+	args byzcoin.Arguments) error {
+	raw, err := cs.GetRaw()
+	if err != nil {
+		return err
+	}
+	if raw.Contract == nil || len(raw.Contract.CommutativeKeys) == 0 {
+		return xerrors.New("contract does not allow commutative updates")
+	}
+	keys := make(map[string]bool)
+	for _, k := range raw.Contract.CommutativeKeys {
+		keys[k] = true
+	}
+	numOps := 0
+	for _, arg := range args {
+		if arg.Name == core.KeyRequest {
+			continue
+		}
+		op, key := core.SplitOp(arg.Name)
+		if op == "" {
+			return xerrors.Errorf("writeset overwrites %s", key)
+		}
+		if !keys[key] {
+			return xerrors.Errorf("key %s does not allow commutative "+
+				"updates", key)
+		}
+		numOps++
+	}
+	if numOps == 0 {
+		return xerrors.New("writeset has no commutative operations")
+	}
+	rlog, err := core.GetRebaseLog(cs)
+	if err != nil {
+		return err
+	}
+	return rlog.CheckRebase(plan)
+}
+
+// recordPlan adds the plan to the rebase log of the contract. Only plans
+// on contracts with CommutativeKeys can be rebased, so the other contracts
+// do not store a rebase log.
+func recordPlan(cs *core.Storage, plan *core.ExecutionPlan) error {
+	raw, err := cs.GetRaw()
+	if err != nil {
+		return err
+	}
+	if raw.Contract == nil || len(raw.Contract.CommutativeKeys) == 0 {
+		return nil
+	}
+	rlog, err := core.GetRebaseLog(cs)
+	if err != nil {
+		return err
+	}
+	rlog.Record(plan)
+	buf, err := protobuf.Encode(rlog)
+	if err != nil {
+		return xerrors.Errorf("encoding rebase log: %v", err)
+	}
+	return Update(cs, byzcoin.Arguments{{Name: core.RebaseLogKey,
+		Value: buf}})
+}
@@ -0,0 +1,68 @@
+package contracts
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/protobuf"
+)
+
+func newRebaseStorage(t *testing.T, keys ...string) *core.Storage {
+	cs := &core.Storage{Version: core.CurrentStorageVersion}
+	buf, err := protobuf.Encode(&core.ContractRaw{
+		Contract: &core.Contract{CommutativeKeys: keys}})
+	require.NoError(t, err)
+	cs.Set(core.KeyRaw, buf)
+	return cs
+}
+
+func Test_VerifyRebase(t *testing.T) {
+	plan := &core.ExecutionPlan{PlanID: []byte("plan")}
+	reqOnly := byzcoin.Arguments{{Name: core.KeyRequest, Value: []byte{}}}
+	appendArgs := byzcoin.Arguments{
+		{Name: core.KeyRequest, Value: []byte{}},
+		{Name: core.OpAppend + "tickets", Value: []byte("t")},
+	}
+
+	// Contracts without commutative keys cannot rebase plans, even if the
+	// writeset only carries the request
+	cs := newRebaseStorage(t)
+	require.Error(t, VerifyRebase(cs, plan, reqOnly))
+	require.Error(t, VerifyRebase(cs, plan, appendArgs))
+
+	cs = &core.Storage{Version: core.CurrentStorageVersion}
+	buf, err := protobuf.Encode(&core.ContractRaw{})
+	require.NoError(t, err)
+	cs.Set(core.KeyRaw, buf)
+	require.Error(t, VerifyRebase(cs, plan, appendArgs))
+
+	cs = newRebaseStorage(t, "tickets")
+	require.Error(t, VerifyRebase(cs, plan, reqOnly))
+	require.Error(t, VerifyRebase(cs, plan, byzcoin.Arguments{
+		{Name: "tickets", Value: []byte("t")}}))
+	require.NoError(t, VerifyRebase(cs, plan, appendArgs))
+	require.NoError(t, recordPlan(cs, plan))
+	require.Error(t, VerifyRebase(cs, plan, appendArgs))
+}
+
+func Test_RecordPlan(t *testing.T) {
+	plan := &core.ExecutionPlan{PlanID: []byte("plan")}
+	newStorage := func(keys ...string) *core.Storage {
+		return newRebaseStorage(t, keys...)
+	}
+
+	// Contracts without commutative keys do not store a rebase log
+	cs := newStorage()
+	require.NoError(t, recordPlan(cs, plan))
+	_, ok := cs.Get(core.RebaseLogKey)
+	require.False(t, ok)
+
+	cs = newStorage("tickets")
+	require.NoError(t, recordPlan(cs, plan))
+	rlog, err := core.GetRebaseLog(cs)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rlog.Seq)
+	require.Error(t, rlog.CheckRebase(plan))
+}
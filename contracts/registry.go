@@ -0,0 +1,128 @@
+package contracts
+
+import (
+	"sort"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// verifyRegistryUpdate checks the "update_registry" command of the registry
+// contract and returns the arguments that store the new registry
+// ("registry", an encoded core.DFURegistry). Every DFU is stored under its
+// own key (see core.DFUKey), so a registry that is stored as a single value
+// is converted. The keys of a unit are updated when its roster changes, so
+// that its DFUIdentity in new plans matches the roster that signs its blocks
+// and receipts. Units cannot be removed by this command. They are retired
+// one at a time with "retire_dfu" (see verifyDFUCommand).
+func verifyRegistryUpdate(cs *core.Storage,
+	args byzcoin.Arguments) (byzcoin.Arguments, error) {
+	old, err := core.GetDFURegistry(cs)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	reg := &core.DFURegistry{}
+	err = protobuf.Decode(args.Search(core.KeyRegistry), reg)
+	if err != nil {
+		log.Errorf("decoding new registry: %v", err)
+		return nil, err
+	}
+	err = reg.Validate()
+	if err != nil {
+		log.Errorf("invalid registry: %v", err)
+		return nil, err
+	}
+	for id := range old.Units {
+		if _, ok := reg.Units[id]; !ok {
+			err := xerrors.Errorf("unit %s cannot be removed", id)
+			log.Error(err)
+			return nil, err
+		}
+	}
+	// An empty value deletes the key (see Update)
+	ws := byzcoin.Arguments{{Name: core.KeyRegistry}}
+	for _, id := range sortedUnits(reg) {
+		buf, err := protobuf.Encode(reg.Units[id])
+		if err != nil {
+			log.Errorf("encoding DFU %s: %v", id, err)
+			return nil, err
+		}
+		ws = append(ws, byzcoin.Argument{Name: core.DFUKey(id), Value: buf})
+	}
+	return ws, nil
+}
+
+// verifyIsRegistry returns an error if the contract is not the registry
+// contract. The contracts of applications have a raw contract.
+func verifyIsRegistry(cs *core.Storage) error {
+	if _, ok := cs.Get(core.KeyRaw); ok {
+		err := xerrors.New("contract is not a registry")
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// verifyDFUCommand checks the "register_dfu", "update_dfu" and "retire_dfu"
+// commands of the registry contract and returns the arguments that write
+// the entry of the DFU ("id"). The new entry ("dfu", an encoded core.DFU)
+// must have keys and a threshold that they can reach. A DFU can only be
+// registered once and only registered DFUs can be updated or retired.
+func verifyDFUCommand(cmd string, cs *core.Storage,
+	args byzcoin.Arguments) (byzcoin.Arguments, error) {
+	if _, ok := cs.Get(core.KeyRegistry); ok {
+		err := xerrors.New("registry must be converted with update_registry")
+		log.Error(err)
+		return nil, err
+	}
+	id := string(args.Search("id"))
+	if id == "" {
+		err := xerrors.New("missing DFU id")
+		log.Error(err)
+		return nil, err
+	}
+	key := core.DFUKey(id)
+	_, exists := cs.Get(key)
+	if cmd == "register_dfu" && exists {
+		err := xerrors.Errorf("DFU %s is already registered", id)
+		log.Error(err)
+		return nil, err
+	}
+	if cmd != "register_dfu" && !exists {
+		err := xerrors.Errorf("unknown DFU: %s", id)
+		log.Error(err)
+		return nil, err
+	}
+	if cmd == "retire_dfu" {
+		return byzcoin.Arguments{{Name: key}}, nil
+	}
+	buf := args.Search("dfu")
+	dfu := &core.DFU{}
+	err := protobuf.Decode(buf, dfu)
+	if err != nil {
+		log.Errorf("decoding DFU: %v", err)
+		return nil, err
+	}
+	reg := &core.DFURegistry{Units: map[string]*core.DFU{id: dfu}}
+	err = reg.Validate()
+	if err != nil {
+		log.Errorf("invalid DFU: %v", err)
+		return nil, err
+	}
+	return byzcoin.Arguments{{Name: key, Value: buf}}, nil
+}
+
+// sortedUnits returns the IDs of the units of the registry in sorted order,
+// so that the writeset does not depend on the map iteration order.
+func sortedUnits(reg *core.DFURegistry) []string {
+	ids := make([]string, 0, len(reg.Units))
+	for id := range reg.Units {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
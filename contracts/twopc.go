@@ -0,0 +1,425 @@
+package contracts
+
+import (
+	"bytes"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// verifyNotPending returns an error if the contract is prepared for a plan.
+// A prepared contract can only be committed or aborted.
+func verifyNotPending(cs *core.Storage) error {
+	pending, err := core.GetPending(cs)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		return xerrors.Errorf("contract is prepared for plan %x",
+			pending.Plan.PlanID)
+	}
+	return nil
+}
+
+// hostedParticipants loads the contracts of the plan that are hosted by the
+// state unit of the invoked contract, which must be the first of them. The
+// darcs of the other contracts must let the signers of inst run its
+// command.
+func hostedParticipants(rst byzcoin.ReadOnlyStateTrie,
+	inst byzcoin.Instruction, plan *core.ExecutionPlan) ([]core.ContractRoot,
+	[]*participant, []*core.ContractHeader, error) {
+	iid := inst.InstanceID.Slice()
+	_, hdr, err := loadParticipant(rst, iid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hosted := plan.HostedContracts(hdr.StateUnit())
+	if len(hosted) == 0 || !bytes.Equal(hosted[0].CID, iid) {
+		return nil, nil, nil, xerrors.Errorf("contract %x is not the first "+
+			"contract of the plan on unit %s", iid, hdr.StateUnit())
+	}
+	ps := make([]*participant, len(hosted))
+	hdrs := make([]*core.ContractHeader, len(hosted))
+	for i, c := range hosted {
+		ps[i], hdrs[i], err = loadParticipant(rst, c.CID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if hdrs[i].StateUnit() != hdr.StateUnit() {
+			return nil, nil, nil, xerrors.Errorf("contract %x is not hosted "+
+				"by unit %s", c.CID, hdr.StateUnit())
+		}
+		err = authorize(rst, inst, ps[i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return hosted, ps, hdrs, nil
+}
+
+// prepare handles the "prepare" command of a plan whose contracts are
+// hosted by several state units. It verifies the execution request and the
+// writesets of the contracts that are hosted by this unit, stores them
+// under core.KeyPending and locks the contracts with the plan ID for
+// core.PrepareBlocks blocks.
+func prepare(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) (
+	[]byzcoin.StateChange, error) {
+	iid := inst.InstanceID.Slice()
+	args := inst.Invoke.Args
+	req, err := getRequest(args)
+	if err != nil {
+		return nil, err
+	}
+	plan := req.ExecReq.EP
+	if !plan.IsCrossUnit() {
+		err := xerrors.New("plan does not span several state units")
+		log.Error(err)
+		return nil, err
+	}
+	pr, err := rst.GetProof(iid)
+	if err != nil {
+		log.Errorf("get proof failed: %v", err)
+		return nil, err
+	}
+	ext, err := extWritesets(args)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(ext) != len(plan.Contracts) {
+		err := xerrors.New("writesets do not match the contracts of the plan")
+		log.Error(err)
+		return nil, err
+	}
+	opcode := plan.Txn.Opcodes[req.ExecReq.Index]
+	for _, c := range plan.Contracts {
+		name := core.WritesetInput(c.CID)
+		_, ok := opcode.Dependencies[name]
+		if _, found := ext[name]; !found || !ok {
+			err := xerrors.Errorf("invalid writeset for contract %x", c.CID)
+			log.Error(err)
+			return nil, err
+		}
+	}
+	hosted, ps, hdrs, err := hostedParticipants(rst, inst, plan)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for i, c := range hosted {
+		// 1) Check that the contract is in the state of the plan
+		if !bytes.Equal(c.StateRoot, pr.GetRoot()) {
+			err := xerrors.Errorf("merkle roots do not match for contract %x",
+				c.CID)
+			log.Error(err)
+			return nil, err
+		}
+		if !bytes.Equal(hdrs[i].CID[:], c.CID) {
+			err := xerrors.New("inconsistent CID values")
+			log.Error(err)
+			return nil, err
+		}
+		if !bytes.Equal(c.CodeHash, hdrs[i].CodeHash) {
+			err := xerrors.New("code hashes do no match")
+			log.Error(err)
+			return nil, err
+		}
+		// 2) Check that the contract is not prepared or locked by another
+		// client
+		err = verifyNotPending(ps[i].cs)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		err = hdrs[i].CheckLock(plan.PlanID, rst.GetIndex())
+		if err != nil {
+			log.Errorf("verifying contract lock: %v", err)
+			return nil, err
+		}
+		// 3) Check the state transition of the contract
+		ws := writeset(args)
+		if !bytes.Equal(c.CID, plan.CID) {
+			ws = ext[core.WritesetInput(c.CID)].Args
+		}
+		err = verifyTransition(plan.TxnName, ps[i].cs, hdrs[i], ws)
+		if err != nil {
+			log.Errorf("verifying state transition of contract %x: %v",
+				c.CID, err)
+			return nil, err
+		}
+		ps[i].args = ws
+	}
+	// 4) verify execution request
+	err = req.ExecReq.Verify(&core.VerificationData{UID: req.UID,
+		OpcodeName:  req.OpcodeName,
+		InputHashes: prepareHashes(req.ExecReq.EP.Version, args, ext)})
+	if err != nil {
+		log.Errorf("verifying execution request: %v", err)
+		return nil, err
+	}
+	// 5) verify input receipts
+	inputMap := createInputMap(req.ExecReq)
+	err = verifyInputReceipts(req.ExecReq, req.InReceipts, inputMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var sc []byzcoin.StateChange
+	for i, p := range ps {
+		buf, err := protobuf.Encode(&core.PendingUpdate{Plan: plan,
+			Args: p.args, OpIdx: req.ExecReq.Index,
+			Receipts: req.ExecReq.OpReceipts})
+		if err != nil {
+			log.Errorf("encoding pending update: %v", err)
+			return nil, err
+		}
+		p.cs.Set(core.KeyPending, buf)
+		hdrs[i].SetLock(plan.PlanID, rst.GetIndex()+core.PrepareBlocks)
+		psc, err := p.writeHeader(hdrs[i])
+		if err != nil {
+			log.Errorf("preparing contract %s: %v", p.cid, err)
+			return nil, err
+		}
+		sc = append(sc, psc...)
+	}
+	return sc, nil
+}
+
+// commit handles the "commit" command of a prepared plan ("plan_id"). The
+// "evidence" argument carries the core.PrepareEvidence: on the coordinator
+// of the plan, the proofs that the contracts on the other state units are
+// prepared for the plan, which must be given before the prepare lock
+// expires; on the other units, the proof that the coordinator has decided
+// to commit the plan. The pending writesets of the contracts that are
+// hosted by this unit are applied and their locks are released.
+func commit(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) (
+	[]byzcoin.StateChange, error) {
+	ps, hdrs, plan, err := preparedParticipants(rst, inst)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := getEvidence(inst.Invoke.Args)
+	if err != nil {
+		return nil, err
+	}
+	coordinator := hdrs[0].StateUnit() == plan.Coordinator()
+	if coordinator {
+		if !hdrs[0].IsLocked(rst.GetIndex()) {
+			err := xerrors.Errorf("prepare lock expired at block %d",
+				hdrs[0].LockExpiry)
+			log.Error(err)
+			return nil, err
+		}
+		err = plan.VerifyPrepared(hdrs[0].StateUnit(), ev.Proofs)
+		if err != nil {
+			log.Errorf("verifying prepare evidence: %v", err)
+			return nil, err
+		}
+		err = recordDecision(ps[0], plan, true)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = plan.VerifyDecision(ev.Decision, true)
+		if err != nil {
+			log.Errorf("verifying commit decision: %v", err)
+			return nil, err
+		}
+	}
+	var sc []byzcoin.StateChange
+	for _, p := range ps {
+		pending, err := core.GetPending(p.cs)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		p.cs.Delete(core.KeyPending)
+		from, err := currState(p.cs)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		err = Update(p.cs, pending.Args)
+		if err != nil {
+			log.Errorf("updating contract storage: %v", err)
+			return nil, err
+		}
+		err = recordTxn(p.cs, p.cid.Slice(), plan, pending.OpIdx,
+			pending.Receipts, rst.GetIndex(), from, pending.Args)
+		if err != nil {
+			log.Errorf("recording txn: %v", err)
+			return nil, err
+		}
+		err = recordPlan(p.cs, plan)
+		if err != nil {
+			log.Errorf("recording plan: %v", err)
+			return nil, err
+		}
+		hdr, err := p.cs.GetHeader()
+		if err != nil {
+			log.Errorf("retrieving contract header: %v", err)
+			return nil, err
+		}
+		hdr.ClearLock()
+		psc, err := p.writeHeader(hdr)
+		if err != nil {
+			log.Errorf("committing contract %s: %v", p.cid, err)
+			return nil, err
+		}
+		sc = append(sc, psc...)
+	}
+	return sc, nil
+}
+
+// abort handles the "abort" command of a prepared plan ("plan_id"). The
+// pending writesets are dropped and the locks are released. The coordinator
+// of the plan aborts it once its prepare lock has expired, or earlier if
+// the "evidence" argument proves that another unit failed to prepare it
+// (see core.PrepareProof.VerifyFailed). The other units need the proof
+// that the coordinator has decided to abort the plan.
+func abort(rst byzcoin.ReadOnlyStateTrie, inst byzcoin.Instruction) (
+	[]byzcoin.StateChange, error) {
+	ps, hdrs, plan, err := preparedParticipants(rst, inst)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := getEvidence(inst.Invoke.Args)
+	if err != nil {
+		return nil, err
+	}
+	if hdrs[0].StateUnit() == plan.Coordinator() {
+		if hdrs[0].IsLocked(rst.GetIndex()) {
+			if ev.Failed == nil {
+				err := xerrors.Errorf("plan cannot be aborted before block "+
+					"%d", hdrs[0].LockExpiry)
+				log.Error(err)
+				return nil, err
+			}
+			err = ev.Failed.VerifyFailed(plan)
+			if err != nil {
+				log.Errorf("verifying abort evidence: %v", err)
+				return nil, err
+			}
+		}
+		err = recordDecision(ps[0], plan, false)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = plan.VerifyDecision(ev.Decision, false)
+		if err != nil {
+			log.Errorf("verifying abort decision: %v", err)
+			return nil, err
+		}
+	}
+	var sc []byzcoin.StateChange
+	for i, p := range ps {
+		p.cs.Delete(core.KeyPending)
+		hdrs[i].ClearLock()
+		psc, err := p.writeHeader(hdrs[i])
+		if err != nil {
+			log.Errorf("aborting contract %s: %v", p.cid, err)
+			return nil, err
+		}
+		sc = append(sc, psc...)
+	}
+	return sc, nil
+}
+
+// getEvidence decodes the "evidence" argument. A missing argument is an
+// empty evidence.
+func getEvidence(args byzcoin.Arguments) (*core.PrepareEvidence, error) {
+	ev := &core.PrepareEvidence{}
+	buf := args.Search("evidence")
+	if buf == nil {
+		return ev, nil
+	}
+	err := protobuf.Decode(buf, ev)
+	if err != nil {
+		log.Errorf("decoding prepare evidence: %v", err)
+		return nil, err
+	}
+	return ev, nil
+}
+
+// recordDecision stores the decision of the coordinator in the storage of
+// the contract of the plan, which is the first contract that the
+// coordinator hosts.
+func recordDecision(p *participant, plan *core.ExecutionPlan,
+	commit bool) error {
+	if !bytes.Equal(p.cid.Slice(), plan.CID) {
+		err := xerrors.New("decision must be recorded in the contract of " +
+			"the plan")
+		log.Error(err)
+		return err
+	}
+	buf, err := protobuf.Encode(&core.Decision{PlanID: plan.PlanID,
+		Commit: commit})
+	if err != nil {
+		log.Errorf("encoding decision: %v", err)
+		return err
+	}
+	p.cs.Set(core.KeyDecision, buf)
+	return nil
+}
+
+// preparedParticipants loads the contracts that are hosted by the state
+// unit of the invoked contract and prepared for the plan "plan_id".
+func preparedParticipants(rst byzcoin.ReadOnlyStateTrie,
+	inst byzcoin.Instruction) ([]*participant, []*core.ContractHeader,
+	*core.ExecutionPlan, error) {
+	iid := inst.InstanceID.Slice()
+	planID := inst.Invoke.Args.Search("plan_id")
+	anchor, _, err := loadParticipant(rst, iid)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, nil, err
+	}
+	pending, err := core.GetPending(anchor.cs)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, nil, err
+	}
+	if pending == nil || !bytes.Equal(pending.Plan.PlanID, planID) {
+		err := xerrors.Errorf("contract is not prepared for plan %x", planID)
+		log.Error(err)
+		return nil, nil, nil, err
+	}
+	_, ps, hdrs, err := hostedParticipants(rst, inst, pending.Plan)
+	if err != nil {
+		log.Error(err)
+		return nil, nil, nil, err
+	}
+	for _, p := range ps {
+		pu, err := core.GetPending(p.cs)
+		if err != nil {
+			log.Error(err)
+			return nil, nil, nil, err
+		}
+		if pu == nil || !bytes.Equal(pu.Plan.PlanID, planID) {
+			err := xerrors.Errorf("contract %s is not prepared for plan %x",
+				p.cid, planID)
+			log.Error(err)
+			return nil, nil, nil, err
+		}
+	}
+	return ps, hdrs, pending.Plan, nil
+}
+
+// writeHeader stores hdr in the storage of the participant and returns the
+// state changes of its instances.
+func (p *participant) writeHeader(hdr *core.ContractHeader) (
+	[]byzcoin.StateChange, error) {
+	args, err := encodeHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	err = Update(p.cs, args)
+	if err != nil {
+		return nil, err
+	}
+	return p.stateChanges()
+}
@@ -0,0 +1,201 @@
+package contracts
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// testTrie holds the storages of keyValue instances. The methods that the
+// tests do not use are left to the nil embedded interface.
+type testTrie struct {
+	byzcoin.ReadOnlyStateTrie
+	index  int
+	values map[string][]byte
+}
+
+func (tr *testTrie) GetValues(key []byte) ([]byte, uint64, string, darc.ID,
+	error) {
+	v, ok := tr.values[string(key)]
+	if !ok {
+		return nil, 0, "", nil, xerrors.New("key not set")
+	}
+	return v, 0, ContractKeyValueID, darc.ID{}, nil
+}
+
+func (tr *testTrie) GetIndex() int {
+	return tr.index
+}
+
+func (tr *testTrie) set(t *testing.T, cid []byte, hdr *core.ContractHeader,
+	kvs ...core.KV) {
+	cs := &core.Storage{Version: core.CurrentStorageVersion}
+	buf, err := protobuf.Encode(hdr)
+	require.NoError(t, err)
+	cs.Set(core.KeyHeader, buf)
+	buf, err = protobuf.Encode(&core.ContractRaw{CID: hdr.CID,
+		Contract: &core.Contract{}})
+	require.NoError(t, err)
+	cs.Set(core.KeyRaw, buf)
+	for _, kv := range kvs {
+		cs.Set(kv.Key, kv.Value)
+	}
+	sc, err := storageChanges(byzcoin.Create, byzcoin.NewInstanceID(cid),
+		&storedKeys{}, cs, darc.ID{})
+	require.NoError(t, err)
+	tr.apply(t, sc)
+}
+
+// apply writes the state changes to the trie, checking that instances are
+// only created once and only updated or removed if they exist.
+func (tr *testTrie) apply(t *testing.T, sc []byzcoin.StateChange) {
+	for _, c := range sc {
+		_, ok := tr.values[string(c.InstanceID)]
+		switch c.StateAction {
+		case byzcoin.Create:
+			require.False(t, ok)
+			tr.values[string(c.InstanceID)] = c.Value
+		case byzcoin.Update:
+			require.True(t, ok)
+			tr.values[string(c.InstanceID)] = c.Value
+		case byzcoin.Remove:
+			require.True(t, ok)
+			delete(tr.values, string(c.InstanceID))
+		}
+	}
+}
+
+// storage returns the storage of contract cid, including its key instances.
+func (tr *testTrie) storage(t *testing.T, cid []byte) *core.Storage {
+	main := &core.Storage{}
+	require.NoError(t, protobuf.Decode(tr.values[string(cid)], main))
+	cs, _, err := loadStorage(tr, cid, main)
+	require.NoError(t, err)
+	return cs
+}
+
+func invoke(cid []byte, cmd string, args byzcoin.Arguments) byzcoin.Instruction {
+	return byzcoin.Instruction{InstanceID: byzcoin.NewInstanceID(cid),
+		Invoke: &byzcoin.Invoke{ContractID: ContractKeyValueID,
+			Command: cmd, Args: args}}
+}
+
+// preparedTrie returns a trie in which contract cid is prepared for plan
+// until block 20.
+func preparedTrie(t *testing.T, cid []byte, unit string,
+	plan *core.ExecutionPlan) *testTrie {
+	tr := &testTrie{values: make(map[string][]byte)}
+	pending, err := protobuf.Encode(&core.PendingUpdate{Plan: plan,
+		Args: byzcoin.Arguments{{Name: "x", Value: []byte("1")}}})
+	require.NoError(t, err)
+	tr.set(t, cid, &core.ContractHeader{CID: byzcoin.NewInstanceID(cid),
+		CurrState: "open", UnitID: unit, Lock: true, LockID: plan.PlanID,
+		LockExpiry: 20}, core.KV{Key: core.KeyPending, Value: pending})
+	return tr
+}
+
+func Test_TwoPCCoordinator(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	cid2 := bytes.Repeat([]byte{2}, 32)
+	plan := &core.ExecutionPlan{CID: cid1, PlanID: []byte("plan"),
+		TxnName: "close", Txn: &core.Transaction{},
+		Contracts: []core.ContractRoot{{CID: cid2, UnitID: "state2"}}}
+	tr := preparedTrie(t, cid1, "", plan)
+	args := byzcoin.Arguments{{Name: "plan_id", Value: plan.PlanID}}
+
+	// The coordinator needs the prepare proofs of the other units
+	tr.index = 5
+	_, err := commit(tr, invoke(cid1, "commit", args))
+	require.Error(t, err)
+	// and cannot abort before its lock expires without evidence
+	_, err = abort(tr, invoke(cid1, "abort", args))
+	require.Error(t, err)
+	buf, err := protobuf.Encode(&core.PrepareEvidence{
+		Failed: &core.PrepareProof{UnitID: core.SUID, CID: cid1}})
+	require.NoError(t, err)
+	_, err = abort(tr, invoke(cid1, "abort", append(args,
+		byzcoin.Argument{Name: "evidence", Value: buf})))
+	require.Error(t, err)
+	// A plan cannot be committed after the lock expires
+	tr.index = 20
+	_, err = commit(tr, invoke(cid1, "commit", args))
+	require.Error(t, err)
+
+	sc, err := abort(tr, invoke(cid1, "abort", args))
+	require.NoError(t, err)
+	tr.apply(t, sc)
+	cs := tr.storage(t, cid1)
+	_, ok := cs.Get(core.KeyPending)
+	require.False(t, ok)
+	d, err := core.GetDecision(cs)
+	require.NoError(t, err)
+	require.Equal(t, &core.Decision{PlanID: plan.PlanID, Commit: false}, d)
+	hdr, err := cs.GetHeader()
+	require.NoError(t, err)
+	require.False(t, hdr.Lock)
+}
+
+func Test_TwoPCCoordinatorCommit(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	// Without contracts on other units, no prepare proof is needed
+	plan := &core.ExecutionPlan{CID: cid1, PlanID: []byte("plan"),
+		TxnName: "close", Txn: &core.Transaction{}}
+	tr := preparedTrie(t, cid1, "", plan)
+	tr.index = 5
+	sc, err := commit(tr, invoke(cid1, "commit",
+		byzcoin.Arguments{{Name: "plan_id", Value: plan.PlanID}}))
+	require.NoError(t, err)
+	tr.apply(t, sc)
+	cs := tr.storage(t, cid1)
+	v, ok := cs.Get("x")
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), v)
+	_, ok = cs.Get(core.KeyPending)
+	require.False(t, ok)
+	d, err := core.GetDecision(cs)
+	require.NoError(t, err)
+	require.True(t, d.Commit)
+
+	// The decision is final
+	tr.index = 30
+	_, err = abort(tr, invoke(cid1, "abort",
+		byzcoin.Arguments{{Name: "plan_id", Value: plan.PlanID}}))
+	require.Error(t, err)
+}
+
+func Test_TwoPCParticipant(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	cid2 := bytes.Repeat([]byte{2}, 32)
+	plan := &core.ExecutionPlan{CID: cid1, PlanID: []byte("plan"),
+		TxnName: "close", Txn: &core.Transaction{},
+		Contracts: []core.ContractRoot{{CID: cid2, UnitID: "state2"}}}
+	tr := preparedTrie(t, cid2, "state2", plan)
+	args := byzcoin.Arguments{{Name: "plan_id", Value: plan.PlanID}}
+
+	// The other units need the decision of the coordinator, even after
+	// their lock has expired
+	for _, index := range []int{5, 100} {
+		tr.index = index
+		_, err := commit(tr, invoke(cid2, "commit", args))
+		require.Error(t, err)
+		_, err = abort(tr, invoke(cid2, "abort", args))
+		require.Error(t, err)
+	}
+	// Prepare proofs are not a decision
+	buf, err := protobuf.Encode(&core.PrepareEvidence{
+		Proofs: []core.PrepareProof{{UnitID: core.SUID, CID: cid1}}})
+	require.NoError(t, err)
+	_, err = commit(tr, invoke(cid2, "commit", append(args,
+		byzcoin.Argument{Name: "evidence", Value: buf})))
+	require.Error(t, err)
+	// A plan that the contract is not prepared for is rejected
+	_, err = abort(tr, invoke(cid2, "abort",
+		byzcoin.Arguments{{Name: "plan_id", Value: []byte("other")}}))
+	require.Error(t, err)
+}
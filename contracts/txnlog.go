@@ -0,0 +1,37 @@
+package contracts
+
+import (
+	"bytes"
+
+	"github.com/dedis/protean/core"
+	statebase "github.com/dedis/protean/libstate/base"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"golang.org/x/xerrors"
+)
+
+// currState returns the FSM state of the contract.
+func currState(cs *core.Storage) (string, error) {
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		return "", xerrors.Errorf("retrieving contract header: %v", err)
+	}
+	return hdr.CurrState, nil
+}
+
+// recordTxn appends the record of the update of contract cid by plan to
+// its txn log. from is the state of the contract before the update and ws
+// is its writeset, which must already be applied to cs.
+func recordTxn(cs *core.Storage, cid []byte, plan *core.ExecutionPlan,
+	opIdx int, receipts map[string]*core.OpcodeReceipt, index int,
+	from string, ws byzcoin.Arguments) error {
+	to, err := currState(cs)
+	if err != nil {
+		return err
+	}
+	input := "ws"
+	if !bytes.Equal(cid, plan.CID) {
+		input = core.WritesetInput(cid)
+	}
+	return core.AppendTxnRecord(cs, core.NewTxnRecord(plan, opIdx, receipts,
+		index, from, to, input, statebase.Hash(plan.Version, ws)))
+}
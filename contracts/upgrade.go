@@ -0,0 +1,129 @@
+package contracts
+
+import (
+	"bytes"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// UpgradesKey is the key under which the upgrade history of a contract is
+// stored.
+const UpgradesKey = core.KeyUpgrades
+
+// verifyUpgrade checks the upgrade that is given in the "upgrade" argument
+// and returns the arguments that apply it to the contract storage.
+func verifyUpgrade(iid []byte, cs *core.Storage,
+	args byzcoin.Arguments) (byzcoin.Arguments, error) {
+	var upgrade *core.Upgrade
+	for _, arg := range args {
+		if arg.Name == "upgrade" {
+			upgrade = &core.Upgrade{}
+			err := protobuf.Decode(arg.Value, upgrade)
+			if err != nil {
+				log.Errorf("decoding upgrade: %v", err)
+				return nil, err
+			}
+		}
+	}
+	if upgrade == nil {
+		err := xerrors.New("missing upgrade")
+		log.Error(err)
+		return nil, err
+	}
+	raw, err := cs.GetRaw()
+	if err != nil {
+		log.Errorf("retrieving raw contract: %v", err)
+		return nil, err
+	}
+	hdr, err := cs.GetHeader()
+	if err != nil {
+		log.Errorf("retrieving contract header: %v", err)
+		return nil, err
+	}
+	history := &core.UpgradeHistory{}
+	if buf, ok := cs.Get(UpgradesKey); ok {
+		err = protobuf.Decode(buf, history)
+		if err != nil {
+			log.Errorf("retrieving upgrade history: %v", err)
+			return nil, err
+		}
+	}
+	// 1) Check that the upgrade is for the current version of this contract
+	if !bytes.Equal(upgrade.CID[:], iid) {
+		err := xerrors.New("upgrade is for a different contract")
+		log.Error(err)
+		return nil, err
+	}
+	if upgrade.Seq != len(history.Records) {
+		err := xerrors.Errorf("expected upgrade sequence number %d but "+
+			"received %d", len(history.Records), upgrade.Seq)
+		log.Error(err)
+		return nil, err
+	}
+	if !bytes.Equal(upgrade.OldCodeHash, hdr.CodeHash) {
+		err := xerrors.New("old code hash does not match")
+		log.Error(err)
+		return nil, err
+	}
+	if len(upgrade.CodeHash) == 0 {
+		err := xerrors.New("missing code hash")
+		log.Error(err)
+		return nil, err
+	}
+	// 2) Check the signatures of the admins
+	signers, err := upgrade.Verify(hdr)
+	if err != nil {
+		log.Errorf("verifying upgrade signatures: %v", err)
+		return nil, err
+	}
+	// 3) The current state must exist in the new FSM
+	if upgrade.FSM != nil {
+		found := false
+		for _, s := range upgrade.FSM.States {
+			found = found || s == hdr.CurrState
+		}
+		if !found {
+			err := xerrors.Errorf("new FSM does not have the current state %s",
+				hdr.CurrState)
+			log.Error(err)
+			return nil, err
+		}
+		raw.FSM = upgrade.FSM
+	}
+	if upgrade.Contract != nil {
+		raw.Contract = upgrade.Contract
+	}
+	history.Records = append(history.Records, core.UpgradeRecord{
+		Seq:             upgrade.Seq,
+		OldCodeHash:     hdr.CodeHash,
+		NewCodeHash:     upgrade.CodeHash,
+		ContractChanged: upgrade.Contract != nil,
+		FSMChanged:      upgrade.FSM != nil,
+		Signers:         signers,
+	})
+	hdr.CodeHash = upgrade.CodeHash
+	rawBuf, err := protobuf.Encode(raw)
+	if err != nil {
+		log.Errorf("encoding raw contract: %v", err)
+		return nil, err
+	}
+	hdrBuf, err := protobuf.Encode(hdr)
+	if err != nil {
+		log.Errorf("encoding contract header: %v", err)
+		return nil, err
+	}
+	historyBuf, err := protobuf.Encode(history)
+	if err != nil {
+		log.Errorf("encoding upgrade history: %v", err)
+		return nil, err
+	}
+	return byzcoin.Arguments{
+		{Name: core.KeyRaw, Value: rawBuf},
+		{Name: core.KeyHeader, Value: hdrBuf},
+		{Name: UpgradesKey, Value: historyBuf},
+	}, nil
+}
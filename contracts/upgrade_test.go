@@ -0,0 +1,88 @@
+package contracts
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/key"
+	"go.dedis.ch/protobuf"
+)
+
+func upgradeStorage(t *testing.T, hdr *core.ContractHeader) *core.Storage {
+	cs := lockStorage(t, hdr)
+	buf, err := protobuf.Encode(&core.ContractRaw{CID: hdr.CID,
+		FSM: &core.FSM{InitialState: "open",
+			States: []string{"open", "closed"}}})
+	require.NoError(t, err)
+	cs.Set(core.KeyRaw, buf)
+	return cs
+}
+
+func upgradeArgs(t *testing.T, u *core.Upgrade) byzcoin.Arguments {
+	buf, err := protobuf.Encode(u)
+	require.NoError(t, err)
+	return byzcoin.Arguments{{Name: "upgrade", Value: buf}}
+}
+
+func Test_VerifyUpgrade(t *testing.T) {
+	kp := key.NewKeyPair(cothority.Suite)
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	hdr := &core.ContractHeader{CID: cid, CodeHash: []byte("old"),
+		CurrState: "open", Admins: []kyber.Point{kp.Public},
+		AdminThreshold: 1}
+	cs := upgradeStorage(t, hdr)
+	newUpgrade := func() *core.Upgrade {
+		return &core.Upgrade{CID: cid, OldCodeHash: []byte("old"),
+			CodeHash: []byte("new"), FSM: &core.FSM{InitialState: "open",
+				States: []string{"open", "paused", "closed"}}}
+	}
+
+	// Missing signatures
+	u := newUpgrade()
+	_, err := verifyUpgrade(cid.Slice(), cs, upgradeArgs(t, u))
+	require.Error(t, err)
+
+	// Wrong sequence number and old code hash
+	u = newUpgrade()
+	u.Seq = 1
+	require.NoError(t, u.Sign(0, kp.Private))
+	_, err = verifyUpgrade(cid.Slice(), cs, upgradeArgs(t, u))
+	require.Error(t, err)
+	u = newUpgrade()
+	u.OldCodeHash = []byte("other")
+	require.NoError(t, u.Sign(0, kp.Private))
+	_, err = verifyUpgrade(cid.Slice(), cs, upgradeArgs(t, u))
+	require.Error(t, err)
+
+	// The new FSM must have the current state
+	u = newUpgrade()
+	u.FSM.States = []string{"closed"}
+	require.NoError(t, u.Sign(0, kp.Private))
+	_, err = verifyUpgrade(cid.Slice(), cs, upgradeArgs(t, u))
+	require.Error(t, err)
+
+	// The signatures cover the FSM
+	u = newUpgrade()
+	require.NoError(t, u.Sign(0, kp.Private))
+	u.FSM.States = append(u.FSM.States, "cancelled")
+	_, err = verifyUpgrade(cid.Slice(), cs, upgradeArgs(t, u))
+	require.Error(t, err)
+
+	u = newUpgrade()
+	require.NoError(t, u.Sign(0, kp.Private))
+	args, err := verifyUpgrade(cid.Slice(), cs, upgradeArgs(t, u))
+	require.NoError(t, err)
+	newHdr := &core.ContractHeader{}
+	require.NoError(t, protobuf.Decode(args.Search(core.KeyHeader), newHdr))
+	require.Equal(t, []byte("new"), newHdr.CodeHash)
+	history := &core.UpgradeHistory{}
+	require.NoError(t, protobuf.Decode(args.Search(UpgradesKey), history))
+	require.Len(t, history.Records, 1)
+	require.Equal(t, []int{0}, history.Records[0].Signers)
+	require.True(t, history.Records[0].FSMChanged)
+	require.False(t, history.Records[0].ContractChanged)
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"go.dedis.ch/cothority/v3"
 	"go.dedis.ch/cothority/v3/byzcoin"
@@ -28,6 +31,15 @@ type VerificationData struct {
 	InputHashes map[string][]byte
 	StateProofs map[string]*StateProof
 	Precommits  *KVDict
+	// Hashes is the hashing configuration of the DFU, which tells whether
+	// legacy plans are accepted.
+	Hashes HashConfig
+	// Replay is the replay cache of the DFU. If it is set, the plan must not
+	// have expired and the opcode is recorded in the cache once the request
+	// is verified. It is not set by the state unit, whose byzcoin contract
+	// cannot use the local clock and which is protected from replays by the
+	// state root check instead.
+	Replay *ReplayCache
 }
 
 func (r *ExecutionRequest) Verify(data *VerificationData) error {
@@ -44,12 +56,9 @@ func (r *ExecutionRequest) Verify(data *VerificationData) error {
 			opcode.Name, data.OpcodeName)
 	}
 	// 2) Check CEU's signature on the execution plan
-	ceuData := r.EP.DFUData[CEUID]
-	epHash := r.EP.Hash()
-	err := r.EP.Sig.VerifyWithPolicy(suite, epHash, ceuData.Keys,
-		sign.NewThresholdPolicy(ceuData.Threshold))
+	err := r.EP.VerifySig(data.Hashes)
 	if err != nil {
-		return xerrors.Errorf("cannot verify signature on the execution plan: %v", err)
+		return err
 	}
 	// 3) Check that the hash of code-to-be-executed matches H(code) of the execution request
 	if len(data.CodeHash) > 0 {
@@ -57,10 +66,21 @@ func (r *ExecutionRequest) Verify(data *VerificationData) error {
 			return xerrors.New("code hashes do not match")
 		}
 	}
-	// 4) Check dependencies
+	// 4) Check that the plan has not expired
+	now := time.Now()
+	if data.Replay != nil {
+		err = r.EP.CheckExpiry(now)
+		if err != nil {
+			return err
+		}
+	}
+	// 5) Check dependencies
 	for inputName, dep := range opcode.Dependencies {
 		if dep.Src == OPCODE {
-			receipt, ok := r.OpReceipts[dep.SrcName]
+			receipt, ok := r.OpReceipts[ReceiptKey(dep.Idx, dep.SrcName)]
+			if !ok {
+				receipt, ok = r.OpReceipts[dep.SrcName]
+			}
 			if !ok {
 				return xerrors.Errorf("missing opcode receipt from output %s for input %s", dep.SrcName, inputName)
 			}
@@ -70,6 +90,10 @@ func (r *ExecutionRequest) Verify(data *VerificationData) error {
 			if receipt.OpIdx != dep.Idx {
 				return xerrors.Errorf("expected index %d but received %d", dep.Idx, receipt.OpIdx)
 			}
+			if receipt.Version != r.EP.Version {
+				return xerrors.Errorf("expected hash version %d but received %d",
+					r.EP.Version, receipt.Version)
+			}
 			inputHash, ok := data.InputHashes[inputName]
 			if !ok {
 				return xerrors.Errorf("cannot find the input data for %s", inputName)
@@ -89,39 +113,132 @@ func (r *ExecutionRequest) Verify(data *VerificationData) error {
 				return xerrors.Errorf("cannot verify signature for on opcode receipt: %v", err)
 			}
 		} else if dep.Src == KEYVALUE {
-			proof, ok := data.StateProofs[inputName]
-			if !ok {
-				return xerrors.Errorf("missing keyvalue for input %s", inputName)
-			}
-			if !bytes.Equal(r.EP.StateRoot, proof.Proof.InclusionProof.GetRoot()) {
-				return xerrors.Errorf("merkle roots do not match")
+			keys, err := dep.Value.Keys()
+			if err != nil {
+				return xerrors.Errorf("invalid keys for input %s: %v",
+					inputName, err)
 			}
-			publics := r.EP.DFUData[SUID].Keys
-			err := proof.VerifyFromBlock(publics)
+			_, err = r.verifyStateProof(inputName, dep, data, keys)
 			if err != nil {
-				return xerrors.Errorf("cannot verify keyvalue proof: %v", err)
+				return err
 			}
 		} else if dep.Src == PRECOMMIT {
-			keys := strings.Split(dep.StringValue, ",")
-			if len(keys) != len(data.Precommits.Data) {
-				return xerrors.Errorf("precommit count mismatch: "+
-					"expected %d received %d", len(keys), len(data.Precommits.Data))
+			keys, err := dep.Value.Keys()
+			if err != nil {
+				return xerrors.Errorf("invalid precommit keys for input %s: %v",
+					inputName, err)
 			}
-			for _, key := range keys {
-				if _, ok := data.Precommits.Data[key]; !ok {
-					return xerrors.Errorf("missing precommit key: %s", key)
-				}
+			// The commitments are read from the state of the contract that
+			// is bound by the plan, after the precommit round has closed.
+			store, err := r.verifyStateProof(inputName, dep, data,
+				[]string{KeyPrecommits})
+			if err != nil {
+				return err
+			}
+			round, err := GetPrecommits(store)
+			if err != nil {
+				return err
+			}
+			if round == nil {
+				return xerrors.Errorf("contract has no precommits for "+
+					"input %s", inputName)
+			}
+			index := data.StateProofs[inputName].Proof.Latest.Index
+			if index < round.Deadline {
+				return xerrors.Errorf("precommit round is open until "+
+					"block %d", round.Deadline)
+			}
+			err = round.VerifyReveals(keys, data.Precommits)
+			if err != nil {
+				return xerrors.Errorf("verifying precommits for input %s: "+
+					"%v", inputName, err)
 			}
 		} else if dep.Src == CONST {
 			inputHash, ok := data.InputHashes[inputName]
 			if !ok {
 				return xerrors.Errorf("cannot find the input data for %s", inputName)
 			}
-			if !bytes.Equal(getValueHash(dep), inputHash) {
+			if !bytes.Equal(dep.Value.Hash(r.EP.Version), inputHash) {
 				return xerrors.New("received input does not match the CONST value")
 			}
 		}
 	}
+	// 6) Check that the opcode has not been executed before
+	if data.Replay != nil {
+		return data.Replay.Add(r.EP, idx, now)
+	}
+	return nil
+}
+
+// verifyStateProof checks the state proof of the contract that is read by
+// the input dependency dep against the state root that is bound by the plan
+// and returns the storage that it proves. The proof must cover keys.
+func (r *ExecutionRequest) verifyStateProof(inputName string,
+	dep *DataDependency, data *VerificationData, keys []string) (*Storage,
+	error) {
+	proof, ok := data.StateProofs[inputName]
+	if !ok {
+		return nil, xerrors.Errorf("missing keyvalue for input %s", inputName)
+	}
+	root, err := r.EP.ReadRoot(dep)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(root, proof.Proof.InclusionProof.GetRoot()) {
+		return nil, xerrors.Errorf("merkle roots do not match")
+	}
+	unitID := dep.StateUnit(r.EP.StateUnit())
+	unit, ok := r.EP.DFUData[unitID]
+	if !ok {
+		return nil, xerrors.Errorf("cannot find dfu info for %s", unitID)
+	}
+	err = proof.VerifyUnit(unit)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot verify keyvalue proof: %v", err)
+	}
+	cid, err := dep.ContractID(r.EP)
+	if err != nil {
+		return nil, err
+	}
+	err = proof.CoversKeys(cid, keys)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid keyvalue proof for input "+
+			"%s: %v", inputName, err)
+	}
+	store, err := proof.Storage(cid)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid keyvalue proof for input "+
+			"%s: %v", inputName, err)
+	}
+	return store, nil
+}
+
+// ReceiptKey returns the key of the receipt for output name of opcode idx
+// in ExecutionRequest.OpReceipts.
+func ReceiptKey(idx int, name string) string {
+	return strconv.Itoa(idx) + ":" + name
+}
+
+// AddReceipts merges receipts into the opcode receipts of the request. Each
+// receipt is stored under the key that is derived from its (signed) opcode
+// index and output name, so the result does not depend on the order in
+// which receipts from concurrently executed opcodes are added. Adding a
+// different receipt for the same output is an error.
+func (r *ExecutionRequest) AddReceipts(receipts map[string]*OpcodeReceipt) error {
+	if r.OpReceipts == nil {
+		r.OpReceipts = make(map[string]*OpcodeReceipt)
+	}
+	for _, receipt := range receipts {
+		key := ReceiptKey(receipt.OpIdx, receipt.Name)
+		if stored, ok := r.OpReceipts[key]; ok {
+			if !bytes.Equal(stored.HashBytes, receipt.HashBytes) {
+				return xerrors.Errorf("conflicting receipts for output %s",
+					key)
+			}
+			continue
+		}
+		r.OpReceipts[key] = receipt
+	}
 	return nil
 }
 
@@ -131,15 +248,25 @@ func PrepareKVDicts(r *ExecutionRequest, proofs map[string]*StateProof) (map[str
 	kvDicts := make(map[string]KVDict)
 	for inputName, dep := range opcode.Dependencies {
 		if dep.Src == KEYVALUE {
-			v, _, _, err := proofs[inputName].Proof.Get(r.EP.CID)
+			proof, ok := proofs[inputName]
+			if !ok {
+				return nil, xerrors.Errorf("missing keyvalue for input %s",
+					inputName)
+			}
+			cid, err := dep.ContractID(r.EP)
 			if err != nil {
 				return nil, err
 			}
-			storageMap, err := getStorageMap(v)
+			store, err := proof.Storage(cid)
 			if err != nil {
 				return nil, err
 			}
-			keys := strings.Split(dep.StringValue, ",")
+			storageMap := store.Map()
+			keys, err := dep.Value.Keys()
+			if err != nil {
+				return nil, xerrors.Errorf("invalid keys for input %s: %v",
+					inputName, err)
+			}
 			data := make(map[string][]byte)
 			for _, key := range keys {
 				val, ok := storageMap[key]
@@ -154,17 +281,152 @@ func PrepareKVDicts(r *ExecutionRequest, proofs map[string]*StateProof) (map[str
 	return kvDicts, nil
 }
 
-func getStorageMap(v []byte) (map[string][]byte, error) {
-	kvStore := Storage{}
-	err := protobuf.Decode(v, &kvStore)
+// ContractID returns the instance ID of the contract that the KEYVALUE
+// dependency reads in plan p.
+func (d *DataDependency) ContractID(p *ExecutionPlan) ([]byte, error) {
+	if d.CID == "" {
+		return p.CID, nil
+	}
+	return d.decodeCID()
+}
+
+// ContractKey returns the canonical (lower-case) hex encoding of the
+// contract ID of a KEYVALUE dependency that names a CID. It keys
+// ExecutionPlan.ExtRoots, so that different spellings of a CID refer to the
+// same contract. It returns an error if the dependency does not name a CID.
+func (d *DataDependency) ContractKey() (string, error) {
+	if d.CID == "" {
+		return "", xerrors.New("dependency does not name a contract ID")
+	}
+	cid, err := d.decodeCID()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(cid), nil
+}
+
+func (d *DataDependency) decodeCID() ([]byte, error) {
+	cid, err := hex.DecodeString(d.CID)
+	if err != nil || len(cid) != len(byzcoin.InstanceID{}) {
+		return nil, xerrors.Errorf("invalid contract ID: %s", d.CID)
+	}
+	return cid, nil
+}
+
+// StateUnit returns the DFU ID of the state unit that stores the contract
+// that the KEYVALUE dependency reads. planUnit is the unit that hosts the
+// contract of the txn, which is the default.
+func (d *DataDependency) StateUnit(planUnit string) string {
+	if d.UnitID == "" {
+		return planUnit
+	}
+	return d.UnitID
+}
+
+// ReadRoot returns the state root that the plan binds for the contract that
+// the KEYVALUE dependency dep reads.
+func (p *ExecutionPlan) ReadRoot(dep *DataDependency) ([]byte, error) {
+	if dep.CID == "" {
+		return p.StateRoot, nil
+	}
+	key, err := dep.ContractKey()
 	if err != nil {
 		return nil, err
 	}
+	root, ok := p.ExtRoots[key]
+	if !ok {
+		return nil, xerrors.Errorf("plan does not bind the state of "+
+			"contract %s", dep.CID)
+	}
+	return root, nil
+}
+
+const (
+	// ExtStateLag is the number of blocks by which the proof of a contract
+	// that a txn reads can be behind the proof of the contract of the txn
+	// if both are stored by the same state unit. The client requests the
+	// proofs one after the other, so new blocks can be added in between.
+	ExtStateLag = 2
+	// ExtStateAge is the longest time by which the latest block of the
+	// proof of a contract that a txn reads from another state unit can
+	// precede the latest block of the proof of the contract of the txn.
+	ExtStateAge = time.Minute
+)
+
+// CheckExtFreshness checks that the proof ext of a contract that a txn reads
+// (see DataDependency.CID) is not stale compared to the proof of the
+// contract of the txn. If both contracts are stored by the same state unit
+// (sameUnit), the latest block of ext can be at most ExtStateLag blocks
+// behind that of proof. Otherwise the ledgers are compared by the
+// timestamps of their latest blocks, which can be at most ExtStateAge
+// apart.
+func CheckExtFreshness(proof *byzcoin.Proof, ext *byzcoin.Proof,
+	sameUnit bool) error {
+	if sameUnit {
+		if ext.Latest.Index+ExtStateLag < proof.Latest.Index {
+			return xerrors.Errorf("proof is from block %d, which is more "+
+				"than %d blocks before block %d", ext.Latest.Index,
+				ExtStateLag, proof.Latest.Index)
+		}
+		return nil
+	}
+	ts, err := blockTimestamp(&proof.Latest)
+	if err != nil {
+		return err
+	}
+	extTs, err := blockTimestamp(&ext.Latest)
+	if err != nil {
+		return err
+	}
+	if time.Duration(ts-extTs) > ExtStateAge {
+		return xerrors.Errorf("proof is more than %s older than the proof "+
+			"of the contract", ExtStateAge)
+	}
+	return nil
+}
+
+func blockTimestamp(sb *skipchain.SkipBlock) (int64, error) {
+	var hdr byzcoin.DataHeader
+	err := protobuf.Decode(sb.Data, &hdr)
+	if err != nil {
+		return 0, xerrors.Errorf("decoding block header: %v", err)
+	}
+	return hdr.Timestamp, nil
+}
+
+// Map returns the key/value pairs in the storage as a map.
+func (s *Storage) Map() map[string][]byte {
 	smap := make(map[string][]byte)
-	for _, kv := range kvStore.Store {
+	for _, kv := range s.Store {
 		smap[kv.Key] = kv.Value
 	}
-	return smap, nil
+	return smap
+}
+
+// Verify checks that the snapshot proof is from the ledger of the state
+// unit and that Storage is the storage of the contract that the proof
+// covers.
+func (s *ContractSnapshot) Verify(unit *DFUIdentity) error {
+	err := s.Proof.VerifyUnit(unit)
+	if err != nil {
+		return xerrors.Errorf("verifying snapshot proof: %v", err)
+	}
+	store, err := s.Proof.Storage(s.CID.Slice())
+	if err != nil {
+		return xerrors.Errorf("getting contract storage from proof: %v", err)
+	}
+	v, err := protobuf.Encode(store)
+	if err != nil {
+		return xerrors.Errorf("encoding proven storage: %v", err)
+	}
+	buf, err := protobuf.Encode(&s.Storage)
+	if err != nil {
+		return xerrors.Errorf("encoding contract storage: %v", err)
+	}
+	if !bytes.Equal(v, buf) {
+		return xerrors.New("snapshot storage does not match the proof")
+	}
+	return nil
 }
 
 // VerifyFromBlock takes a skipchain id and the first block of the proof. It
@@ -173,6 +435,8 @@ func getStorageMap(v []byte) (map[string][]byte, error) {
 // the skipblock is indeed part of the skipchain. It also uses the provided block
 // to insure the first roster is correct. If all verifications are correct, the error
 // will be nil. It does not verify wether a certain key/value pair exists in the proof.
+// The genesis block of the proof must be trusted by the caller (see
+// VerifyUnit and VerifyGenesis).
 //func (p StateProof) VerifyFromBlock(verifiedBlock *skipchain.SkipBlock, publics []kyber.Point) error {
 func (p StateProof) VerifyFromBlock(publics []kyber.Point) error {
 	if len(p.Proof.Links) > 0 {
@@ -187,11 +451,48 @@ func (p StateProof) VerifyFromBlock(publics []kyber.Point) error {
 	return cothority.ErrorOrNil(err, "verification failed")
 }
 
-// Verify takes a skipchain id and verifies that the proof is valid for this
+// VerifyGenesis verifies the proof against a trusted genesis block of the
+// state unit's ledger instead of the genesis block that comes with the
+// proof.
+func (p *StateProof) VerifyGenesis(genesis *skipchain.SkipBlock) error {
+	if p.Proof == nil {
+		return xerrors.New("missing proof")
+	}
+	if !p.Proof.Latest.SkipChainID().Equal(genesis.Hash) {
+		return xerrors.New("proof is from a different ledger")
+	}
+	p.Genesis = genesis
+	return p.VerifyFromBlock(genesis.Roster.ServicePublics(skipchain.ServiceName))
+}
+
+// VerifyUnit verifies the proof against unit, the identity of the state
+// unit in the DFU registry. The genesis block of the proof must be the one
+// of the ledger that is pinned by unit, so a self-made ledger whose rosters
+// list the keys of the unit is rejected.
+func (p StateProof) VerifyUnit(unit *DFUIdentity) error {
+	if p.Proof == nil || p.Genesis == nil {
+		return xerrors.New("missing proof")
+	}
+	if len(unit.SkipchainID) == 0 {
+		return xerrors.New("state unit has no skipchain ID")
+	}
+	if !p.Genesis.CalculateHash().Equal(unit.SkipchainID) ||
+		!p.Genesis.Hash.Equal(unit.SkipchainID) {
+		return xerrors.New("proof is not from the ledger of the state unit")
+	}
+	return p.VerifyFromBlock(unit.Keys)
+}
+
+// verify takes a skipchain id and verifies that the proof is valid for this
 // skipchain. It verifies the proof, that the merkle-root is stored in the
 // skipblock of the proof and the fact that the skipblock is indeed part of the
-// skipchain. If all verifications are correct, the error will be nil. It does
-// not verify whether a certain key/value pair exists in the proof.
+// skipchain. Every forward link is verified against the roster of the block
+// it starts from, so the rosters follow the NewRoster of the links, and at
+// least one link must be signed by publics, the keys of the state unit in the
+// DFU registry. The rosters after that link are endorsed by it, so a state
+// unit can change its roster before its registry entry is updated. If all
+// verifications are correct, the error will be nil. It does not verify
+// whether a certain key/value pair exists in the proof.
 func (p StateProof) verify(sbID skipchain.SkipBlockID, publics []kyber.Point) error {
 	err := p.Proof.VerifyInclusionProof(&p.Proof.Latest)
 	if err != nil {
@@ -205,21 +506,31 @@ func (p StateProof) verify(sbID skipchain.SkipBlockID, publics []kyber.Point) er
 		return cothority.WrapError(byzcoin.ErrorMalformedForwardLink)
 	}
 
-	// Get the first from the synthetic link which is assumed to be verified
-	// before against the block with ID stored in the To field by the caller.
-	//publics := p.Proof.Links[0].NewRoster.ServicePublics(skipchain.ServiceName)
-
+	// Get the first roster from the synthetic link which is assumed to be
+	// verified before against the block with ID stored in the To field by
+	// the caller.
+	signers := p.Proof.Links[0].NewRoster.ServicePublics(skipchain.ServiceName)
+	// A proof without links other than the synthetic one is for the genesis
+	// block, which is anchored if it is created by the state unit. The
+	// genesis block itself is trusted by the caller.
+	anchored := len(p.Proof.Links) == 1 && SamePublics(signers, publics)
 	for _, l := range p.Proof.Links[1:] {
-		if err = l.VerifyWithScheme(pairing.NewSuiteBn256(), publics, p.Proof.Latest.SignatureScheme); err != nil {
+		if err = l.VerifyWithScheme(pairing.NewSuiteBn256(), signers, p.Proof.Latest.SignatureScheme); err != nil {
 			return cothority.WrapError(byzcoin.ErrorVerifySkipchain)
 		}
 		if !l.From.Equal(sbID) {
 			return cothority.WrapError(byzcoin.ErrorVerifySkipchain)
 		}
+		if !anchored && SamePublics(signers, publics) {
+			anchored = true
+		}
 		sbID = l.To
-		//if l.NewRoster != nil {
-		//	publics = l.NewRoster.ServicePublics(skipchain.ServiceName)
-		//}
+		if l.NewRoster != nil {
+			signers = l.NewRoster.ServicePublics(skipchain.ServiceName)
+		}
+	}
+	if !anchored {
+		return xerrors.New("proof is not signed by the state unit")
 	}
 
 	// Check that the given latest block matches the last forward link target
@@ -229,8 +540,189 @@ func (p StateProof) verify(sbID skipchain.SkipBlockID, publics []kyber.Point) er
 	return nil
 }
 
+// Validate checks that every unit of the registry has keys and a threshold
+// that its keys can reach.
+func (r *DFURegistry) Validate() error {
+	for id, unit := range r.Units {
+		if len(unit.Keys) == 0 {
+			return xerrors.Errorf("unit %s has no keys", id)
+		}
+		if unit.Threshold <= 0 || unit.Threshold > len(unit.Keys) {
+			return xerrors.Errorf("unit %s has threshold %d for %d keys", id,
+				unit.Threshold, len(unit.Keys))
+		}
+	}
+	return nil
+}
+
+// Identity returns the identity of the DFU that is copied into execution
+// plans.
+func (d *DFU) Identity() *DFUIdentity {
+	return &DFUIdentity{Threshold: d.Threshold, Keys: d.Keys,
+		SkipchainID: d.SkipchainID}
+}
+
+// SamePublics returns true if a and b hold the same keys, in any order.
+func SamePublics(a []kyber.Point, b []kyber.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := make(map[string]int)
+	for _, pk := range a {
+		keys[pk.String()]++
+	}
+	for _, pk := range b {
+		if keys[pk.String()] == 0 {
+			return false
+		}
+		keys[pk.String()]--
+	}
+	return true
+}
+
+// VerifySig checks the hash version of the plan against the hashing
+// configuration cfg of the verifier and the signature of the CEU on the
+// plan.
+func (p *ExecutionPlan) VerifySig(cfg HashConfig) error {
+	err := cfg.CheckVersion(p.Version)
+	if err != nil {
+		return err
+	}
+	if p.Txn == nil {
+		return xerrors.New("execution plan does not have a txn")
+	}
+	if p.Version == HashVersionLegacy {
+		err = p.checkLegacyFields()
+		if err != nil {
+			return err
+		}
+	}
+	ceuData, ok := p.DFUData[CEUID]
+	if !ok {
+		return xerrors.Errorf("cannot find dfu info for %s", CEUID)
+	}
+	err = p.Sig.VerifyWithPolicy(suite, p.Hash(), ceuData.Keys,
+		sign.NewThresholdPolicy(ceuData.Threshold))
+	if err != nil {
+		return xerrors.Errorf("cannot verify signature on the execution "+
+			"plan: %v", err)
+	}
+	return nil
+}
+
+// Hash returns the hash of the plan that is signed by the CEU. The hashing
+// scheme is selected by the version of the plan.
 func (p *ExecutionPlan) Hash() []byte {
+	if p.Version == HashVersionLegacy {
+		return p.legacyHash()
+	}
+	hr := NewVersionedHasher(p.Version, DomainPlan)
+	hr.WriteBytes(p.PlanID)
+	hr.WriteBytes(p.CID)
+	hr.WriteBytes(p.StateRoot)
+	hr.WriteBytes(p.CodeHash)
+	hr.WriteString(p.WfName)
+	hr.WriteString(p.TxnName)
+	opcodes := p.opcodes()
+	hr.WriteLen(len(opcodes))
+	for _, opcode := range opcodes {
+		hr.WriteString(opcode.Name)
+		hr.WriteString(opcode.DFUID)
+		sortedDeps := make([]string, 0, len(opcode.Dependencies))
+		for k := range opcode.Dependencies {
+			sortedDeps = append(sortedDeps, k)
+		}
+		sort.Strings(sortedDeps)
+		hr.WriteLen(len(sortedDeps))
+		for _, k := range sortedDeps {
+			dep := opcode.Dependencies[k]
+			hr.WriteString(k)
+			hr.WriteString(dep.Src)
+			hr.WriteString(dep.SrcName)
+			hr.WriteInt(dep.Idx)
+			hr.WriteBytes(dep.Value.Encode())
+			hr.WriteString(dep.CID)
+			hr.WriteString(dep.UnitID)
+		}
+	}
+	sortedID := make([]string, 0, len(p.DFUData))
+	for k := range p.DFUData {
+		sortedID = append(sortedID, k)
+	}
+	sort.Strings(sortedID)
+	hr.WriteLen(len(sortedID))
+	for _, k := range sortedID {
+		hr.WriteString(k)
+		hr.WriteInt(p.DFUData[k].Threshold)
+		hr.WriteLen(len(p.DFUData[k].Keys))
+		for _, pk := range p.DFUData[k].Keys {
+			hr.WriteString(pk.String())
+		}
+		hr.WriteBytes(p.DFUData[k].SkipchainID)
+	}
+	hr.WriteUint64(uint64(p.Expiry))
+	hr.WriteInt(p.LockBlocks)
+	hr.WriteUint64(p.StateSeq)
+	sortedCID := make([]string, 0, len(p.ExtRoots))
+	for k := range p.ExtRoots {
+		sortedCID = append(sortedCID, k)
+	}
+	sort.Strings(sortedCID)
+	hr.WriteLen(len(sortedCID))
+	for _, k := range sortedCID {
+		hr.WriteString(k)
+		hr.WriteBytes(p.ExtRoots[k])
+	}
+	hr.WriteLen(len(p.Contracts))
+	for _, c := range p.Contracts {
+		hr.WriteBytes(c.CID)
+		hr.WriteBytes(c.StateRoot)
+		hr.WriteBytes(c.CodeHash)
+		hr.WriteString(c.UnitID)
+	}
+	hr.WriteString(p.UnitID)
+	return hr.Sum()
+}
+
+// opcodes returns the opcodes of the txn of the plan, or nil if the plan
+// does not have a txn.
+func (p *ExecutionPlan) opcodes() []*Opcode {
+	if p.Txn == nil {
+		return nil
+	}
+	return p.Txn.Opcodes
+}
+
+// checkLegacyFields returns an error if the plan sets a field that the
+// legacy hash does not cover, since the signature of the CEU would not
+// cover it either.
+func (p *ExecutionPlan) checkLegacyFields() error {
+	if p.LockBlocks != 0 || p.StateSeq != 0 || len(p.ExtRoots) > 0 ||
+		len(p.Contracts) > 0 || p.UnitID != "" {
+		return xerrors.New("legacy plan sets fields that its hash does " +
+			"not cover")
+	}
+	for id, dfu := range p.DFUData {
+		if len(dfu.SkipchainID) > 0 {
+			return xerrors.Errorf("legacy plan sets the skipchain ID of %s",
+				id)
+		}
+	}
+	for i, opcode := range p.opcodes() {
+		for name, dep := range opcode.Dependencies {
+			if dep.CID != "" || dep.UnitID != "" {
+				return xerrors.Errorf("legacy plan sets the contract of "+
+					"input %s of opcode %d", name, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *ExecutionPlan) legacyHash() []byte {
 	h := sha256.New()
+	// PlanID
+	h.Write(p.PlanID)
 	// CID
 	h.Write(p.CID)
 	// StateRoot
@@ -243,7 +735,7 @@ func (p *ExecutionPlan) Hash() []byte {
 	h.Write([]byte(p.TxnName))
 
 	// Serialize transaction
-	for _, opcode := range p.Txn.Opcodes {
+	for _, opcode := range p.opcodes() {
 		h.Write([]byte(opcode.Name))
 		h.Write([]byte(opcode.DFUID))
 
@@ -262,7 +754,7 @@ func (p *ExecutionPlan) Hash() []byte {
 			h.Write([]byte(dep.Src))
 			h.Write([]byte(dep.SrcName))
 			h.Write(b)
-			h.Write(getValueBytes(dep))
+			h.Write(dep.Value.Encode())
 		}
 	}
 
@@ -283,18 +775,23 @@ func (p *ExecutionPlan) Hash() []byte {
 			h.Write([]byte(pk.String()))
 		}
 	}
+	// Expiry
+	binary.LittleEndian.PutUint64(b, uint64(p.Expiry))
+	h.Write(b)
 	return h.Sum(nil)
 }
 
 func (p *ExecutionPlan) String() string {
 	res := new(strings.Builder)
 	res.WriteString("==== Execution plan ====\n")
+	fmt.Fprintf(res, "-- PlanID: %x\n", p.PlanID)
 	fmt.Fprintf(res, "-- CID: %x\n", p.CID)
 	fmt.Fprintf(res, "-- Root: %x\n", p.StateRoot)
 	fmt.Fprintf(res, "-- Code hash: %x\n", p.CodeHash)
 	fmt.Fprintf(res, "-- Txn: %s\n", p.TxnName)
+	fmt.Fprintf(res, "-- Expiry: %s\n", time.Unix(p.Expiry, 0))
 	fmt.Fprintf(res, "--- Opcodes ---\n")
-	for _, op := range p.Txn.Opcodes {
+	for _, op := range p.opcodes() {
 		fmt.Fprintf(res, ">> Name: %s DFUID: %s\n", op.Name, op.DFUID)
 	}
 	fmt.Fprintf(res, "--- DFUs ---\n")
@@ -304,7 +801,22 @@ func (p *ExecutionPlan) String() string {
 	return res.String()
 }
 
+// Hash returns the hash of the receipt that is signed by the DFU. The hashing
+// scheme is selected by the version of the receipt, which is the version of
+// the execution plan.
 func (r *OpcodeReceipt) Hash() []byte {
+	if r.Version == HashVersionLegacy {
+		return r.legacyHash()
+	}
+	hr := NewHasher(DomainReceipt)
+	hr.WriteBytes(r.EPID)
+	hr.WriteInt(r.OpIdx)
+	hr.WriteString(r.Name)
+	hr.WriteBytes(r.HashBytes)
+	return hr.Sum()
+}
+
+func (r *OpcodeReceipt) legacyHash() []byte {
 	h := sha256.New()
 	// EPID
 	h.Write(r.EPID)
@@ -318,20 +830,3 @@ func (r *OpcodeReceipt) Hash() []byte {
 	h.Write(r.HashBytes)
 	return h.Sum(nil)
 }
-
-func getValueHash(dep *DataDependency) []byte {
-	buf := getValueBytes(dep)
-	h := sha256.New()
-	h.Write(buf)
-	return h.Sum(nil)
-}
-
-func getValueBytes(dep *DataDependency) []byte {
-	if len(dep.StringValue) > 0 {
-		return []byte(dep.StringValue)
-	} else {
-		b := make([]byte, 8)
-		binary.LittleEndian.PutUint64(b, dep.UintValue)
-		return b
-	}
-}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dedis/protean/core/coretest"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/trie"
+	"go.dedis.ch/cothority/v3/byzcoinx"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"go.dedis.ch/protobuf"
+)
+
+func Test_SamePublics(t *testing.T) {
+	var keys []kyber.Point
+	for i := 0; i < 3; i++ {
+		keys = append(keys, suite.G2().Point().Pick(suite.RandomStream()))
+	}
+	require.True(t, SamePublics(keys, []kyber.Point{keys[2], keys[0],
+		keys[1]}))
+	require.False(t, SamePublics(keys, keys[:2]))
+	require.False(t, SamePublics(keys, []kyber.Point{keys[0], keys[0],
+		keys[1]}))
+}
+
+func Test_DFURegistryValidate(t *testing.T) {
+	key := suite.G2().Point().Pick(suite.RandomStream())
+	reg := &DFURegistry{Units: map[string]*DFU{
+		SUID: {Threshold: 1, Keys: []kyber.Point{key}},
+	}}
+	require.NoError(t, reg.Validate())
+	reg.Units[SUID].Threshold = 2
+	require.Error(t, reg.Validate())
+	reg.Units[CEUID] = &DFU{Threshold: 1}
+	require.Error(t, reg.Validate())
+}
+
+func Test_DependencyStateUnit(t *testing.T) {
+	plan := &ExecutionPlan{UnitID: "state2"}
+	dep := &DataDependency{Src: KEYVALUE}
+	require.Equal(t, "state2", dep.StateUnit(plan.StateUnit()))
+	dep.CID = "aa"
+	require.Equal(t, "state2", dep.StateUnit(plan.StateUnit()))
+	dep.UnitID = "state3"
+	require.Equal(t, "state3", dep.StateUnit(plan.StateUnit()))
+	require.Equal(t, SUID, (&DataDependency{}).StateUnit(
+		(&ExecutionPlan{}).StateUnit()))
+}
+
+func Test_DependencyContractKey(t *testing.T) {
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	lower := &DataDependency{Src: KEYVALUE, CID: cid.String()}
+	upper := &DataDependency{Src: KEYVALUE,
+		CID: strings.ToUpper(cid.String())}
+	key, err := lower.ContractKey()
+	require.NoError(t, err)
+	require.Equal(t, cid.String(), key)
+	key, err = upper.ContractKey()
+	require.NoError(t, err)
+	require.Equal(t, cid.String(), key)
+
+	plan := &ExecutionPlan{ExtRoots: map[string][]byte{key: []byte("root")}}
+	root, err := plan.ReadRoot(upper)
+	require.NoError(t, err)
+	require.Equal(t, []byte("root"), root)
+
+	_, err = (&DataDependency{CID: "aa"}).ContractKey()
+	require.Error(t, err)
+	_, err = (&DataDependency{Src: KEYVALUE}).ContractKey()
+	require.Error(t, err)
+}
+
+func Test_CheckExtFreshness(t *testing.T) {
+	proofAt := func(index int, ts time.Time) *byzcoin.Proof {
+		data, err := protobuf.Encode(&byzcoin.DataHeader{
+			Timestamp: ts.UnixNano()})
+		require.NoError(t, err)
+		sb := skipchain.NewSkipBlock()
+		sb.Index = index
+		sb.Data = data
+		return &byzcoin.Proof{Latest: *sb}
+	}
+	now := time.Now()
+	proof := proofAt(10, now)
+
+	// Same state unit: compared by block index
+	require.NoError(t, CheckExtFreshness(proof, proofAt(12, now), true))
+	require.NoError(t, CheckExtFreshness(proof,
+		proofAt(10-ExtStateLag, now), true))
+	require.Error(t, CheckExtFreshness(proof,
+		proofAt(9-ExtStateLag, now), true))
+
+	// Another state unit: compared by timestamp
+	require.NoError(t, CheckExtFreshness(proof, proofAt(1, now), false))
+	require.NoError(t, CheckExtFreshness(proof,
+		proofAt(1, now.Add(-ExtStateAge)), false))
+	require.Error(t, CheckExtFreshness(proof,
+		proofAt(1, now.Add(-ExtStateAge-time.Second)), false))
+}
+
+func Test_VerifyLegacyHashVersion(t *testing.T) {
+	req := &ExecutionRequest{EP: &ExecutionPlan{
+		Version: HashVersionLegacy,
+		Txn: &Transaction{Opcodes: []*Opcode{
+			{Name: "exec", DFUID: "codeexec"},
+		}},
+	}}
+	data := &VerificationData{UID: "codeexec", OpcodeName: "exec"}
+	err := req.Verify(data)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "legacy hash version")
+	data.Hashes.AcceptLegacy = true
+	err = req.Verify(data)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "hash version")
+	req.EP.Version = CurrentHashVersion + 1
+	err = req.Verify(data)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported hash version")
+}
+
+func Test_ExecutionPlanHashVersion(t *testing.T) {
+	plan := &ExecutionPlan{Version: CurrentHashVersion, CID: []byte("cid"),
+		PlanID: []byte("plan"), Txn: &Transaction{
+			Opcodes: []*Opcode{{Name: "update_state", DFUID: SUID}}},
+	}
+	current := plan.Hash()
+
+	// The plan hash is computed with the version of the plan, so that the
+	// plans signed under another version keep their hash
+	plan.Version = CurrentHashVersion + 1
+	next := plan.Hash()
+	require.NotEqual(t, current, next)
+	require.Equal(t, next, plan.Hash())
+	plan.Version = CurrentHashVersion
+	require.Equal(t, current, plan.Hash())
+}
+
+func Test_ExecutionPlanVerifySig(t *testing.T) {
+	priv, pub := bdn.NewKeyPair(suite, random.New())
+	plan := &ExecutionPlan{Version: CurrentHashVersion, CID: []byte("cid"),
+		PlanID: []byte("plan"), LockBlocks: 5, Txn: &Transaction{
+			Opcodes: []*Opcode{{Name: "update_state", DFUID: SUID}}},
+		DFUData: map[string]*DFUIdentity{
+			CEUID: {Threshold: 1, Keys: []kyber.Point{pub}},
+		}}
+	plan.Sig = coretest.BdnSign(t, priv, pub, plan.Hash())
+	cfg := HashConfig{}
+	require.NoError(t, plan.VerifySig(cfg))
+
+	// The signature covers the lock duration
+	plan.LockBlocks = 6
+	require.Error(t, plan.VerifySig(cfg))
+	plan.LockBlocks = 5
+	plan.Version = HashVersionLegacy
+	require.Error(t, plan.VerifySig(cfg))
+
+	// A legacy plan is only accepted if it does not set the fields that
+	// its hash does not cover
+	legacy := HashConfig{AcceptLegacy: true}
+	plan.Sig = coretest.BdnSign(t, priv, pub, plan.Hash())
+	require.Error(t, plan.VerifySig(legacy))
+	plan.LockBlocks = 0
+	plan.Sig = coretest.BdnSign(t, priv, pub, plan.Hash())
+	require.NoError(t, plan.VerifySig(legacy))
+	require.Error(t, plan.VerifySig(cfg))
+	plan.UnitID = "unit"
+	require.Error(t, plan.VerifySig(legacy))
+	plan.UnitID = ""
+	plan.Txn.Opcodes[0].Dependencies = map[string]*DataDependency{
+		"ws": {Src: OPCODE, CID: "cid"}}
+	require.Error(t, plan.VerifySig(legacy))
+	plan.Txn.Opcodes[0].Dependencies = nil
+	plan.Version = CurrentHashVersion
+	plan.LockBlocks = 5
+	plan.Sig = coretest.BdnSign(t, priv, pub, plan.Hash())
+
+	// A plan without a txn is rejected instead of hashed
+	txn := plan.Txn
+	plan.Txn = nil
+	require.Error(t, plan.VerifySig(cfg))
+	plan.Txn = txn
+	require.NoError(t, plan.VerifySig(cfg))
+	delete(plan.DFUData, CEUID)
+	require.Error(t, plan.VerifySig(cfg))
+}
+
+// testLedger is a ledger of a state unit whose rosters have a single node.
+type testLedger struct {
+	blocks []*skipchain.SkipBlock
+	links  []skipchain.ForwardLink
+}
+
+func testRoster() (kyber.Scalar, *onet.Roster) {
+	priv, pub := bdn.NewKeyPair(suite, random.New())
+	si := network.NewServerIdentity(pub,
+		network.NewTCPAddress("127.0.0.1:7770"))
+	return priv, onet.NewRoster([]*network.ServerIdentity{si})
+}
+
+func newTestLedger(ro *onet.Roster, data []byte) *testLedger {
+	sb := skipchain.NewSkipBlock()
+	sb.Roster = ro
+	sb.SignatureScheme = skipchain.BdnSignatureSchemeIndex
+	sb.Data = data
+	sb.Hash = sb.CalculateHash()
+	return &testLedger{blocks: []*skipchain.SkipBlock{sb}}
+}
+
+// add appends a block with roster ro, whose forward link is signed by priv.
+func (l *testLedger) add(t *testing.T, ro *onet.Roster, priv kyber.Scalar,
+	data []byte) {
+	prev := l.blocks[len(l.blocks)-1]
+	sb := skipchain.NewSkipBlock()
+	sb.Index = prev.Index + 1
+	sb.GenesisID = l.blocks[0].Hash
+	sb.BackLinkIDs = []skipchain.SkipBlockID{prev.Hash}
+	sb.Roster = ro
+	sb.SignatureScheme = skipchain.BdnSignatureSchemeIndex
+	sb.Data = data
+	sb.Hash = sb.CalculateHash()
+	fl := skipchain.ForwardLink{From: prev.Hash, To: sb.Hash}
+	if !prev.Roster.ID.Equal(ro.ID) {
+		fl.NewRoster = ro
+	}
+	msg := fl.Hash()
+	fl.Signature = byzcoinx.FinalSignature{Msg: msg,
+		Sig: coretest.BdnSign(t, priv, prev.Roster.List[0].Public, msg)}
+	prev.ForwardLink = append(prev.ForwardLink, &fl)
+	l.links = append(l.links, fl)
+	l.blocks = append(l.blocks, sb)
+}
+
+// proof returns the proof of pr at the last block of the ledger.
+func (l *testLedger) proof(pr *trie.Proof) *StateProof {
+	links := []skipchain.ForwardLink{{To: l.blocks[0].Hash,
+		NewRoster: l.blocks[0].Roster}}
+	links = append(links, l.links...)
+	return &StateProof{Proof: &byzcoin.Proof{InclusionProof: *pr,
+		Latest: *l.blocks[len(l.blocks)-1], Links: links},
+		Genesis: l.blocks[0]}
+}
+
+func Test_StateProofVerifyUnit(t *testing.T) {
+	priv1, ro1 := testRoster()
+	priv2, ro2 := testRoster()
+	tr, err := trie.NewTrie(trie.NewMemDB(), []byte("nonce"))
+	require.NoError(t, err)
+	require.NoError(t, tr.Set([]byte("key"), []byte("value")))
+	pr, err := tr.GetProof([]byte("key"))
+	require.NoError(t, err)
+	data, err := protobuf.Encode(&byzcoin.DataHeader{TrieRoot: tr.GetRoot()})
+	require.NoError(t, err)
+
+	l := newTestLedger(ro1, data)
+	genesisID := l.blocks[0].Hash
+	unit1 := &DFUIdentity{Threshold: 1,
+		Keys: ro1.ServicePublics(skipchain.ServiceName), SkipchainID: genesisID}
+	unit2 := &DFUIdentity{Threshold: 1,
+		Keys: ro2.ServicePublics(skipchain.ServiceName), SkipchainID: genesisID}
+	require.NoError(t, l.proof(pr).VerifyUnit(unit1))
+	require.Error(t, l.proof(pr).VerifyUnit(&DFUIdentity{Keys: unit1.Keys}))
+
+	// A ledger that lists the keys of the unit but is not pinned by the
+	// registry is rejected
+	forged := newTestLedger(ro1, []byte("forged"))
+	forged.add(t, ro1, priv1, data)
+	require.Error(t, forged.proof(pr).VerifyUnit(unit1))
+
+	// The unit changes its roster before its registry entry is updated
+	l.add(t, ro2, priv1, data)
+	require.NoError(t, l.proof(pr).VerifyUnit(unit1))
+	// The new roster has not signed a block yet
+	require.Error(t, l.proof(pr).VerifyUnit(unit2))
+	l.add(t, ro2, priv2, data)
+	require.NoError(t, l.proof(pr).VerifyUnit(unit2))
+	require.NoError(t, l.proof(pr).VerifyUnit(unit1))
+
+	// A link must be signed by the roster of the block that it starts from
+	bad := newTestLedger(ro1, data)
+	bad.add(t, ro2, priv2, data)
+	require.Error(t, bad.proof(pr).VerifyUnit(&DFUIdentity{Threshold: 1,
+		Keys: unit1.Keys, SkipchainID: bad.blocks[0].Hash}))
+}
@@ -0,0 +1,32 @@
+// Package coretest has the fixtures that the tests of several packages
+// share.
+package coretest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/kyber/v3/sign"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+)
+
+var suite = pairing.NewSuiteBn256()
+
+// BdnSign returns the signature of priv on msg, for a mask that only has
+// pub.
+func BdnSign(t *testing.T, priv kyber.Scalar, pub kyber.Point,
+	msg []byte) bdnproto.BdnSignature {
+	sig, err := bdn.Sign(suite, priv, msg)
+	require.NoError(t, err)
+	mask, err := sign.NewMask(suite, []kyber.Point{pub}, nil)
+	require.NoError(t, err)
+	require.NoError(t, mask.SetBit(0, true))
+	agg, err := bdn.AggregateSignatures(suite, [][]byte{sig}, mask)
+	require.NoError(t, err)
+	buf, err := agg.MarshalBinary()
+	require.NoError(t, err)
+	return append(buf, mask.Mask()...)
+}
@@ -0,0 +1,315 @@
+package core
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+const (
+	GuardExists  string = "exists"
+	GuardMissing string = "missing"
+	GuardEq      string = "=="
+	GuardNeq     string = "!="
+	GuardLt      string = "<"
+	GuardLe      string = "<="
+	GuardGt      string = ">"
+	GuardGe      string = ">="
+)
+
+const (
+	FieldLen       string = "len"
+	FieldSize      string = "size"
+	FieldCurrState string = "curr_state"
+	FieldLock      string = "lock"
+)
+
+// Resolve returns the branch that txnName takes when the contract is in
+// currState and its key/value store is kvs. The default transition is tried
+// first, followed by the branches in the order they are listed.
+func (f *FSM) Resolve(txnName string, currState string,
+	kvs map[string][]byte) (*Branch, error) {
+	transition, ok := f.Transitions[txnName]
+	if !ok {
+		return nil, xerrors.Errorf("invalid txn name: %s", txnName)
+	}
+	var candidates []*Branch
+	if len(transition.From) > 0 {
+		candidates = append(candidates, &Branch{
+			From:   []string{transition.From},
+			To:     transition.To,
+			Guards: transition.Guards,
+		})
+	}
+	candidates = append(candidates, transition.Branches...)
+	var guardErr error
+	for _, b := range candidates {
+		if !b.hasSource(currState) {
+			continue
+		}
+		guardErr = evaluateGuards(b.Guards, kvs)
+		if guardErr == nil {
+			return b, nil
+		}
+	}
+	if guardErr != nil {
+		return nil, xerrors.Errorf("cannot execute txn %s: %v", txnName,
+			guardErr)
+	}
+	return nil, xerrors.Errorf("cannot execute txn %s in curr_state %s",
+		txnName, currState)
+}
+
+// Allows returns true if txnName has a transition or branch from state from
+// to state to. Unlike Resolve, it does not evaluate the guards.
+func (f *FSM) Allows(txnName string, from string, to string) bool {
+	transition, ok := f.Transitions[txnName]
+	if !ok {
+		return false
+	}
+	if transition.From == from && transition.To == to {
+		return true
+	}
+	for _, b := range transition.Branches {
+		if b.hasSource(from) && b.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+// GuardKeys returns the keys that are read by the guards of txnName.
+func (f *FSM) GuardKeys(txnName string) []string {
+	transition, ok := f.Transitions[txnName]
+	if !ok {
+		return nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	guards := append([]*Guard{}, transition.Guards...)
+	for _, b := range transition.Branches {
+		guards = append(guards, b.Guards...)
+	}
+	for _, g := range guards {
+		if !seen[g.Key] {
+			seen[g.Key] = true
+			keys = append(keys, g.Key)
+		}
+	}
+	return keys
+}
+
+// IsTerminal returns true if no txn can be executed in the given state.
+func (f *FSM) IsTerminal(state string) bool {
+	for _, t := range f.Transitions {
+		if t.From == state {
+			return false
+		}
+		for _, b := range t.Branches {
+			if b.hasSource(state) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (b *Branch) hasSource(state string) bool {
+	for _, from := range b.From {
+		if from == state {
+			return true
+		}
+	}
+	return false
+}
+
+func evaluateGuards(guards []*Guard, kvs map[string][]byte) error {
+	for _, g := range guards {
+		err := g.Evaluate(kvs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evaluate returns nil if the guard holds for the given key/value store.
+func (g *Guard) Evaluate(kvs map[string][]byte) error {
+	val, ok := kvs[g.Key]
+	switch g.Op {
+	case GuardExists:
+		if !ok {
+			return xerrors.Errorf("guard failed: missing key %s", g.Key)
+		}
+		return nil
+	case GuardMissing:
+		if ok {
+			return xerrors.Errorf("guard failed: key %s exists", g.Key)
+		}
+		return nil
+	}
+	if !ok {
+		return xerrors.Errorf("guard failed: missing key %s", g.Key)
+	}
+	switch g.Field {
+	case FieldLen:
+		count, err := countElements(val, g.FieldPath)
+		if err != nil {
+			return xerrors.Errorf("cannot count elements of %s: %v", g.Key, err)
+		}
+		return g.compareInt(count)
+	case FieldSize:
+		return g.compareInt(len(val))
+	case FieldCurrState, FieldLock:
+		if g.Key != KeyHeader {
+			return xerrors.Errorf("field %s is only defined for the header",
+				g.Field)
+		}
+		hdr := &ContractHeader{}
+		err := protobuf.Decode(val, hdr)
+		if err != nil {
+			return xerrors.Errorf("cannot decode contract header: %v", err)
+		}
+		if g.Field == FieldCurrState {
+			return g.compareString(hdr.CurrState)
+		}
+		return g.compareString(strconv.FormatBool(hdr.Lock))
+	default:
+		return xerrors.Errorf("invalid guard field: %s", g.Field)
+	}
+}
+
+func (g *Guard) compareString(actual string) error {
+	var ok bool
+	switch g.Op {
+	case GuardEq:
+		ok = actual == g.Value
+	case GuardNeq:
+		ok = actual != g.Value
+	default:
+		return xerrors.Errorf("invalid operator %s for field %s", g.Op,
+			g.Field)
+	}
+	if !ok {
+		return xerrors.Errorf("guard failed: %s.%s %s %s", g.Key, g.Field,
+			g.Op, g.Value)
+	}
+	return nil
+}
+
+func (g *Guard) compareInt(actual int) error {
+	expected, err := strconv.Atoi(g.Value)
+	if err != nil {
+		return xerrors.Errorf("invalid guard value %s: %v", g.Value, err)
+	}
+	var ok bool
+	switch g.Op {
+	case GuardEq:
+		ok = actual == expected
+	case GuardNeq:
+		ok = actual != expected
+	case GuardLt:
+		ok = actual < expected
+	case GuardLe:
+		ok = actual <= expected
+	case GuardGt:
+		ok = actual > expected
+	case GuardGe:
+		ok = actual >= expected
+	default:
+		return xerrors.Errorf("invalid guard operator: %s", g.Op)
+	}
+	if !ok {
+		return xerrors.Errorf("guard failed: %s(%s) = %d, expected %s %s",
+			g.Field, g.Key, actual, g.Op, g.Value)
+	}
+	return nil
+}
+
+// countElements returns the number of elements of the repeated field at
+// path in a protobuf-encoded message. All but the last field number of path
+// select embedded messages, and a missing embedded message is an empty
+// list. An empty path selects field 1, which is the list of messages such
+// as core.ItemList that consist of a single repeated field.
+func countElements(buf []byte, path []int) (int, error) {
+	if len(path) == 0 {
+		path = []int{1}
+	}
+	for _, num := range path {
+		if num <= 0 {
+			return 0, xerrors.Errorf("invalid field number %d", num)
+		}
+	}
+	for _, num := range path[:len(path)-1] {
+		var embedded []byte
+		found := false
+		err := walkFields(buf, func(n uint64, wireType uint64,
+			payload []byte) {
+			if n == uint64(num) && wireType == 2 {
+				embedded = payload
+				found = true
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, nil
+		}
+		buf = embedded
+	}
+	count := 0
+	last := uint64(path[len(path)-1])
+	err := walkFields(buf, func(n uint64, _ uint64, _ []byte) {
+		if n == last {
+			count++
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// walkFields calls fn with the field number, the wire type and the payload
+// of every top-level field of a protobuf-encoded message. The payload of a
+// length-delimited field does not include its length.
+func walkFields(buf []byte, fn func(num uint64, wireType uint64,
+	payload []byte)) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return xerrors.New("malformed tag")
+		}
+		buf = buf[n:]
+		start := 0
+		switch tag & 0x7 {
+		case 0:
+			_, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return xerrors.New("malformed varint")
+			}
+		case 1:
+			n = 8
+		case 2:
+			l, m := binary.Uvarint(buf)
+			if m <= 0 || l > uint64(len(buf)-m) {
+				return xerrors.New("malformed length")
+			}
+			start = m
+			n = m + int(l)
+		case 5:
+			n = 4
+		default:
+			return xerrors.Errorf("unsupported wire type %d", tag&0x7)
+		}
+		if n > len(buf) {
+			return xerrors.New("truncated message")
+		}
+		fn(tag>>3, tag&0x7, buf[start:n])
+		buf = buf[n:]
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/protobuf"
+)
+
+type testItems struct {
+	Data []testItem
+}
+
+type testItem struct {
+	Name string
+}
+
+// testBallots stores its list in field 2 and in an embedded message
+type testBallots struct {
+	Name   string
+	Data   []testItem
+	Nested testItems
+}
+
+func testStore(t *testing.T, state string, count int) map[string][]byte {
+	hdrBuf, err := protobuf.Encode(&ContractHeader{CurrState: state})
+	require.NoError(t, err)
+	items := testItems{Data: make([]testItem, count)}
+	for i := range items.Data {
+		items.Data[i].Name = "item"
+	}
+	itemsBuf, err := protobuf.Encode(&items)
+	require.NoError(t, err)
+	return map[string][]byte{"header": hdrBuf, "items": itemsBuf}
+}
+
+func Test_FSMResolve(t *testing.T) {
+	fsm := &FSM{
+		InitialState: "open",
+		States:       []string{"open", "paused", "closed", "cancelled"},
+		Transitions: map[string]*Transition{
+			"join": {
+				Branches: []*Branch{{From: []string{"open", "paused"},
+					To: "open"}},
+			},
+			"close": {
+				From: "open",
+				To:   "closed",
+				Guards: []*Guard{{Key: "items", Field: FieldLen, Op: GuardGe,
+					Value: "3"}},
+				Branches: []*Branch{{From: []string{"open"}, To: "cancelled"}},
+			},
+		},
+	}
+	b, err := fsm.Resolve("join", "paused", testStore(t, "paused", 0))
+	require.NoError(t, err)
+	require.Equal(t, "open", b.To)
+	_, err = fsm.Resolve("join", "closed", testStore(t, "closed", 0))
+	require.Error(t, err)
+	_, err = fsm.Resolve("vote", "open", testStore(t, "open", 0))
+	require.Error(t, err)
+
+	b, err = fsm.Resolve("close", "open", testStore(t, "open", 3))
+	require.NoError(t, err)
+	require.Equal(t, "closed", b.To)
+	b, err = fsm.Resolve("close", "open", testStore(t, "open", 2))
+	require.NoError(t, err)
+	require.Equal(t, "cancelled", b.To)
+
+	require.Equal(t, []string{"items"}, fsm.GuardKeys("close"))
+	require.Empty(t, fsm.GuardKeys("join"))
+	require.False(t, fsm.IsTerminal("open"))
+	require.True(t, fsm.IsTerminal("closed"))
+
+	require.True(t, fsm.Allows("close", "open", "cancelled"))
+	require.True(t, fsm.Allows("join", "paused", "open"))
+	require.False(t, fsm.Allows("close", "paused", "closed"))
+	require.False(t, fsm.Allows("vote", "open", "open"))
+}
+
+func Test_GuardEvaluate(t *testing.T) {
+	kvs := testStore(t, "open", 5)
+	require.NoError(t, (&Guard{Key: "items", Op: GuardExists}).Evaluate(kvs))
+	require.Error(t, (&Guard{Key: "items", Op: GuardMissing}).Evaluate(kvs))
+	require.NoError(t, (&Guard{Key: "items", Field: FieldLen, Op: GuardEq,
+		Value: "5"}).Evaluate(kvs))
+	require.Error(t, (&Guard{Key: "items", Field: FieldLen, Op: GuardLt,
+		Value: "5"}).Evaluate(kvs))
+	require.NoError(t, (&Guard{Key: "header", Field: FieldCurrState,
+		Op: GuardEq, Value: "open"}).Evaluate(kvs))
+	require.NoError(t, (&Guard{Key: "header", Field: FieldLock,
+		Op: GuardEq, Value: "false"}).Evaluate(kvs))
+	require.Error(t, (&Guard{Key: "items", Field: FieldCurrState,
+		Op: GuardEq, Value: "open"}).Evaluate(kvs))
+	require.Error(t, (&Guard{Key: "missing", Field: FieldSize,
+		Op: GuardGe, Value: "0"}).Evaluate(kvs))
+}
+
+func Test_GuardFieldPath(t *testing.T) {
+	items := make([]testItem, 3)
+	buf, err := protobuf.Encode(&testBallots{Name: "ballots", Data: items,
+		Nested: testItems{Data: items[:2]}})
+	require.NoError(t, err)
+	kvs := map[string][]byte{"ballots": buf}
+	lenGuard := func(path []int, value string) *Guard {
+		return &Guard{Key: "ballots", Field: FieldLen, FieldPath: path,
+			Op: GuardEq, Value: value}
+	}
+	require.NoError(t, lenGuard(nil, "1").Evaluate(kvs))
+	require.NoError(t, lenGuard([]int{2}, "3").Evaluate(kvs))
+	require.NoError(t, lenGuard([]int{3, 1}, "2").Evaluate(kvs))
+	require.Error(t, lenGuard([]int{2}, "2").Evaluate(kvs))
+	require.Error(t, lenGuard([]int{0}, "0").Evaluate(kvs))
+
+	// A missing embedded message is an empty list
+	buf, err = protobuf.Encode(&testBallots{Name: "ballots"})
+	require.NoError(t, err)
+	kvs["ballots"] = buf
+	require.NoError(t, lenGuard([]int{3, 1}, "0").Evaluate(kvs))
+}
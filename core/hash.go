@@ -0,0 +1,147 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/xerrors"
+)
+
+// Versions of the scheme that is used to hash execution plans and opcode
+// receipts, and the values, writesets, points and DFU outputs whose hashes
+// are signed in the receipts. The version is part of the signed plan and
+// receipt, and every hash that is signed for a plan is computed with the
+// version of the plan, so that the DFUs and the state unit agree on the
+// hashes of a plan that is generated by an old CEU node.
+const (
+	// HashVersionLegacy concatenates the fields without any framing.
+	HashVersionLegacy = 0
+	// HashVersion1 uses Hasher.
+	HashVersion1 = 1
+	// CurrentHashVersion is the version of the plans that the CEU generates.
+	CurrentHashVersion = HashVersion1
+)
+
+// Domain tags that separate the hashes of different structures.
+const (
+	DomainPlan         = "protean/execution_plan"
+	DomainPlanID       = "protean/plan_id"
+	DomainReceipt      = "protean/opcode_receipt"
+	DomainValue        = "protean/value"
+	DomainWriteset     = "protean/writeset"
+	DomainPoint        = "protean/point"
+	DomainPoints       = "protean/points"
+	DomainElGamalPairs = "protean/elgamal_pairs"
+	DomainRandomness   = "protean/randomness"
+	DomainShuffle      = "protean/shuffle"
+	DomainUpgrade      = "protean/upgrade"
+	DomainDeletion     = "protean/deletion"
+	DomainStorageKey   = "protean/storage_key"
+	DomainPrecommit    = "protean/precommit"
+	DomainPrecommitSig = "protean/precommit_sig"
+)
+
+// HashConfig is the hashing configuration of a service that verifies
+// execution plans and their receipts. The zero value only accepts the
+// framed hash versions.
+type HashConfig struct {
+	// AcceptLegacy makes the service accept plans that are hashed with
+	// HashVersionLegacy. The legacy scheme does not frame its fields, so two
+	// different plans can have the same hash.
+	AcceptLegacy bool
+}
+
+// CheckVersion returns an error if the service does not accept plans of
+// the given hash version.
+func (c HashConfig) CheckVersion(version int) error {
+	if version == HashVersionLegacy && !c.AcceptLegacy {
+		return xerrors.New("legacy hash version is not accepted")
+	}
+	if version != HashVersionLegacy && version != HashVersion1 {
+		return xerrors.Errorf("unsupported hash version: %d", version)
+	}
+	return nil
+}
+
+// Hasher computes SHA-256 hashes in which every variable-length field is
+// prefixed with its length, so that two different sequences of fields never
+// produce the same input to the hash function. Every hash starts with the
+// hash version and a domain tag that names the hashed structure. A legacy
+// hasher (see NewVersionedHasher) concatenates the fields instead.
+type Hasher struct {
+	h      hash.Hash
+	buf    *bytes.Buffer
+	legacy bool
+}
+
+// NewHasher returns a hasher for the given domain that uses
+// CurrentHashVersion. It is used for the hashes that are not signed for an
+// execution plan, such as the IDs of plans and key instances.
+func NewHasher(domain string) *Hasher {
+	return NewVersionedHasher(CurrentHashVersion, domain)
+}
+
+// NewVersionedHasher returns a hasher for the given domain that uses hash
+// version, which is the version of the execution plan for the hashes that
+// are signed in its receipts. With HashVersionLegacy, the fields are written
+// without their length, the integers in little-endian order and neither the
+// version nor the domain is written, as the nodes that predate the versions
+// do.
+func NewVersionedHasher(version int, domain string) *Hasher {
+	hr := &Hasher{h: sha256.New(), buf: new(bytes.Buffer),
+		legacy: version == HashVersionLegacy}
+	if !hr.legacy {
+		hr.WriteUint64(uint64(version))
+		hr.WriteString(domain)
+	}
+	return hr
+}
+
+// WriteBytes writes a length-prefixed byte slice.
+func (hr *Hasher) WriteBytes(b []byte) {
+	if hr.legacy {
+		hr.h.Write(b)
+		return
+	}
+	hr.buf.Reset()
+	writeLengthPrefixed(hr.buf, b)
+	hr.h.Write(hr.buf.Bytes())
+}
+
+// WriteString writes a length-prefixed string.
+func (hr *Hasher) WriteString(s string) {
+	hr.WriteBytes([]byte(s))
+}
+
+// WriteUint64 writes a fixed-size integer.
+func (hr *Hasher) WriteUint64(u uint64) {
+	hr.buf.Reset()
+	if hr.legacy {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, u)
+		hr.buf.Write(b)
+	} else {
+		writeUint64(hr.buf, u)
+	}
+	hr.h.Write(hr.buf.Bytes())
+}
+
+// WriteInt writes a fixed-size integer.
+func (hr *Hasher) WriteInt(i int) {
+	hr.WriteUint64(uint64(i))
+}
+
+// WriteLen writes the number of elements of a list before the elements. A
+// legacy hasher does not write it.
+func (hr *Hasher) WriteLen(n int) {
+	if !hr.legacy {
+		hr.WriteInt(n)
+	}
+}
+
+// Sum returns the hash.
+func (hr *Hasher) Sum() []byte {
+	return hr.h.Sum(nil)
+}
@@ -0,0 +1,496 @@
+package core
+
+import (
+	"bytes"
+	"sort"
+
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/trie"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/kyber/v3/pairing"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// HistoricalProof proves the state of a contract as of block Index. Byzcoin
+// only keeps the current trie, so the proof relies on the versions of the
+// contract instance instead: Change is the block that wrote the version that
+// was current at Index and Next is the block that wrote the following
+// version. If Next is nil, the version is still the current one, as shown by
+// Head. Both blocks are linked to the block of Head, which is verified
+// against the genesis block. For a contract that keeps its keys in their own
+// instances (see StorageVersionKeys), Keys proves the keys other than the
+// main ones in the same way, with the key proofs of Head.
+// At is the block at Index and the forward-linked blocks from it up to the
+// block of Head, which prove the state root of the block (see VerifyRoot).
+type HistoricalProof struct {
+	CID    byzcoin.InstanceID
+	Index  int
+	Change BlockChange
+	Next   *BlockChange
+	Keys   []KeyHistory
+	Head   StateProof
+	At     []*skipchain.SkipBlock
+}
+
+// KeyHistory proves the value of Key as of block Index with the versions of
+// the instance of the key (see KeyInstanceID), like the Change and Next of
+// HistoricalProof. Change is nil if the instance did not exist at Index;
+// Next is then the block that created it, if any. If Next is nil, Head must
+// have a key proof of Key.
+type KeyHistory struct {
+	Key    string
+	Change *BlockChange
+	Next   *BlockChange
+}
+
+// BlockChange holds the state changes of Block and the forward-linked blocks
+// from Block up to (at least) the latest block of the head proof.
+type BlockChange struct {
+	Block        *skipchain.SkipBlock
+	StateChanges byzcoin.StateChanges
+	Links        []*skipchain.SkipBlock
+}
+
+// Verify checks the proof against genesis, the trusted genesis block of the
+// state unit's ledger, and returns the storage of the contract at block
+// Index. The storage has the keys of Keys that existed at Index, except for
+// the key index. If Keys is not empty, it must have the key index, which
+// proves which keys existed at Index, and all the keys in it, so that a key
+// cannot be left out of the whole storage.
+func (hp *HistoricalProof) Verify(genesis *skipchain.SkipBlock) (*Storage,
+	error) {
+	err := hp.Head.VerifyGenesis(genesis)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying head proof: %v", err)
+	}
+	sc, err := hp.verifyInstance(hp.CID, &hp.Change, hp.Next,
+		func() (uint64, bool, error) {
+			return instanceVersion(&hp.Head.Proof.InclusionProof, hp.CID)
+		})
+	if err != nil {
+		return nil, err
+	}
+	if sc == nil {
+		return nil, xerrors.Errorf("contract was deleted at block %d",
+			hp.Change.Block.Index)
+	}
+	store := &Storage{}
+	err = protobuf.Decode(sc.Value, store)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding contract storage: %v", err)
+	}
+	if len(hp.Keys) == 0 {
+		return store, nil
+	}
+	if store.Version < StorageVersionKeys {
+		return nil, xerrors.New("contract does not store its keys in " +
+			"their own instances")
+	}
+	covered := make(map[string]bool)
+	var index *StorageIndex
+	for _, kh := range hp.Keys {
+		covered[kh.Key] = true
+		if IsMainKey(kh.Key) {
+			continue
+		}
+		key := kh.Key
+		ksc, err := hp.verifyInstance(KeyInstanceID(hp.CID.Slice(), key),
+			kh.Change, kh.Next, func() (uint64, bool, error) {
+				return hp.Head.keyVersion(hp.CID.Slice(), key)
+			})
+		if err != nil {
+			return nil, xerrors.Errorf("verifying key %s: %v", key, err)
+		}
+		if ksc == nil {
+			continue
+		}
+		if key == KeyIndex {
+			index, err = DecodeStorageIndex(ksc.Value)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		store.Set(key, ksc.Value)
+	}
+	// A key history can show a key as absent without any change of its
+	// instance, so only the key index, which a contract at
+	// StorageVersionKeys always has, proves that a key did not exist
+	if index == nil {
+		return nil, xerrors.New("proof does not have the key index")
+	}
+	listed := make(map[string]bool)
+	for _, key := range index.Keys {
+		listed[key] = true
+		if !covered[key] {
+			return nil, xerrors.Errorf("proof does not cover key %s", key)
+		}
+		if _, ok := store.Get(key); !ok {
+			return nil, xerrors.Errorf("missing value of key %s", key)
+		}
+	}
+	for _, kh := range hp.Keys {
+		if IsMainKey(kh.Key) || kh.Key == KeyIndex || listed[kh.Key] {
+			continue
+		}
+		if _, ok := store.Get(kh.Key); ok {
+			return nil, xerrors.Errorf("key %s is not in the key index",
+				kh.Key)
+		}
+	}
+	return store, nil
+}
+
+// verifyInstance checks that change and next are the blocks that wrote the
+// version of instance iid that was current at block Index and the following
+// version. If next is nil, head must return the version of the instance at
+// the head block, or false if it does not exist there. It returns the state
+// change of the current version, or nil if the instance did not exist at
+// Index.
+func (hp *HistoricalProof) verifyInstance(iid byzcoin.InstanceID, change,
+	next *BlockChange, head func() (uint64, bool, error)) (
+	*byzcoin.StateChange, error) {
+	latest := &hp.Head.Proof.Latest
+	var sc *byzcoin.StateChange
+	if change != nil {
+		scs, err := change.Verify(iid, latest)
+		if err != nil {
+			return nil, xerrors.Errorf("verifying change block: %v", err)
+		}
+		// The last change of the block is the one that is current after it
+		sc = scs[len(scs)-1]
+		if change.Block.Index > hp.Index {
+			return nil, xerrors.Errorf("change is in block %d after block %d",
+				change.Block.Index, hp.Index)
+		}
+	}
+	absent := sc == nil || sc.StateAction == byzcoin.Remove
+	if next != nil {
+		nexts, err := next.Verify(iid, latest)
+		if err != nil {
+			return nil, xerrors.Errorf("verifying next change block: %v", err)
+		}
+		n := nexts[0]
+		if absent && (n.StateAction != byzcoin.Create || n.Version != 0) {
+			return nil, xerrors.New("next change does not create the " +
+				"instance")
+		}
+		if !absent && n.Version != sc.Version+1 {
+			return nil, xerrors.Errorf("next change has version %d instead "+
+				"of %d", n.Version, sc.Version+1)
+		}
+		if next.Block.Index <= hp.Index {
+			return nil, xerrors.Errorf("instance changed again in block %d",
+				next.Block.Index)
+		}
+	} else {
+		version, ok, err := head()
+		if err != nil {
+			return nil, xerrors.Errorf("verifying head proof: %v", err)
+		}
+		if absent && ok {
+			return nil, xerrors.New("instance exists at the head")
+		}
+		if !absent && !ok {
+			return nil, xerrors.New("instance does not exist at the head")
+		}
+		if !absent && version != sc.Version {
+			return nil, xerrors.Errorf("instance has version %d instead of "+
+				"%d at the head", version, sc.Version)
+		}
+	}
+	if absent {
+		return nil, nil
+	}
+	return sc, nil
+}
+
+// VerifyRoot verifies the proof like Verify and also checks that root, such
+// as the StateRoot of an execution plan, is the state root of block Index.
+func (hp *HistoricalProof) VerifyRoot(genesis *skipchain.SkipBlock,
+	root []byte) (*Storage, error) {
+	store, hdr, err := hp.VerifyAt(genesis)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr.TrieRoot, root) {
+		return nil, xerrors.Errorf("block %d has a different state root",
+			hp.Index)
+	}
+	return store, nil
+}
+
+// VerifyAt verifies the proof like Verify and also returns the header of
+// block Index, which has the state root and the timestamp of the block.
+func (hp *HistoricalProof) VerifyAt(genesis *skipchain.SkipBlock) (*Storage,
+	*byzcoin.DataHeader, error) {
+	store, err := hp.Verify(genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hp.At) == 0 || hp.At[0] == nil {
+		return nil, nil, xerrors.Errorf("missing block %d", hp.Index)
+	}
+	sb := hp.At[0]
+	if sb.Index != hp.Index || !sb.CalculateHash().Equal(sb.Hash) {
+		return nil, nil, xerrors.Errorf("invalid block %d", hp.Index)
+	}
+	err = verifyLinks(sb, hp.At, &hp.Head.Proof.Latest)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("verifying block %d: %v", hp.Index,
+			err)
+	}
+	hdr := &byzcoin.DataHeader{}
+	err = protobuf.Decode(sb.Data, hdr)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("decoding block header: %v", err)
+	}
+	return store, hdr, nil
+}
+
+// ApplyStateChanges returns the storage of contract cid after the state
+// changes scs of a block, given its storage prev before the block, and the
+// version of the contract instance after the block. The block must change
+// the contract instance. As in the storage of GetStorageProof, the records
+// of the txn log are left out. A deleted contract has an empty storage.
+func ApplyStateChanges(cid byzcoin.InstanceID, prev *Storage,
+	scs byzcoin.StateChanges) (*Storage, uint64, error) {
+	// The last change of an instance in the block is the one that is
+	// current after it
+	last := make(map[string]*byzcoin.StateChange)
+	for i := range scs {
+		last[string(scs[i].InstanceID)] = &scs[i]
+	}
+	main, ok := last[string(cid.Slice())]
+	if !ok {
+		return nil, 0, xerrors.New("block does not change the contract")
+	}
+	if main.StateAction == byzcoin.Remove {
+		return &Storage{Version: prev.Version}, main.Version, nil
+	}
+	store := &Storage{}
+	err := protobuf.Decode(main.Value, store)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("decoding contract storage: %v", err)
+	}
+	if store.Version < StorageVersionKeys {
+		return store, main.Version, nil
+	}
+	var keys []string
+	indexID := KeyInstanceID(cid.Slice(), KeyIndex)
+	if sc, ok := last[string(indexID.Slice())]; ok {
+		index, err := DecodeStorageIndex(sc.Value)
+		if err != nil {
+			return nil, 0, err
+		}
+		keys = index.Keys
+	} else {
+		for _, kv := range prev.Store {
+			if !IsMainKey(kv.Key) {
+				keys = append(keys, kv.Key)
+			}
+		}
+	}
+	for _, key := range keys {
+		id := KeyInstanceID(cid.Slice(), key)
+		if sc, ok := last[string(id.Slice())]; ok {
+			if sc.StateAction != byzcoin.Remove {
+				store.Set(key, sc.Value)
+			}
+			continue
+		}
+		v, ok := prev.Get(key)
+		if !ok {
+			return nil, 0, xerrors.Errorf("missing value of key %s", key)
+		}
+		store.Set(key, v)
+	}
+	return store, main.Version, nil
+}
+
+// Version returns the version of instance iid in the proof. The caller
+// must have verified p.Proof.
+func (p *StateProof) Version(iid byzcoin.InstanceID) (uint64, error) {
+	version, ok, err := instanceVersion(&p.Proof.InclusionProof, iid)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, xerrors.Errorf("instance %s is not in the proof", iid)
+	}
+	return version, nil
+}
+
+// keyVersion returns the version of the instance of key of contract cid
+// that is proven by the key proof of the key, or false if its absence is
+// proven. The caller must have verified p.Proof.
+func (p *StateProof) keyVersion(cid []byte, key string) (uint64, bool,
+	error) {
+	for _, kp := range p.KeyProofs {
+		if kp.Key != key {
+			continue
+		}
+		if !bytes.Equal(kp.Proof.GetRoot(),
+			p.Proof.InclusionProof.GetRoot()) {
+			return 0, false, xerrors.Errorf("proof of key %s has a "+
+				"different root", key)
+		}
+		return instanceVersion(&kp.Proof, KeyInstanceID(cid, key))
+	}
+	return 0, false, xerrors.Errorf("proof does not cover key %s", key)
+}
+
+// instanceVersion returns the version of instance iid in pr, or false if
+// its absence is proven.
+func instanceVersion(pr *trie.Proof, iid byzcoin.InstanceID) (uint64, bool,
+	error) {
+	ok, err := pr.Exists(iid.Slice())
+	if err != nil {
+		return 0, false, xerrors.Errorf("verifying proof of instance %s: %v",
+			iid, err)
+	}
+	if !ok {
+		return 0, false, nil
+	}
+	body := byzcoin.StateChangeBody{}
+	err = protobuf.Decode(pr.Get(iid.Slice()), &body)
+	if err != nil {
+		return 0, false, xerrors.Errorf("decoding instance: %v", err)
+	}
+	return body.Version, true, nil
+}
+
+// Verify checks that the state changes are the ones of the block and that
+// the block is linked to head. It returns the state changes of instance cid
+// in the order in which they are applied.
+func (bc *BlockChange) Verify(cid byzcoin.InstanceID,
+	head *skipchain.SkipBlock) ([]*byzcoin.StateChange, error) {
+	if bc.Block == nil || !bc.Block.CalculateHash().Equal(bc.Block.Hash) {
+		return nil, xerrors.New("invalid block")
+	}
+	hdr := byzcoin.DataHeader{}
+	err := protobuf.Decode(bc.Block.Data, &hdr)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding block header: %v", err)
+	}
+	if !bytes.Equal(bc.StateChanges.Hash(), hdr.StateChangesHash) {
+		return nil, xerrors.New("state changes do not match the block")
+	}
+	var scs []*byzcoin.StateChange
+	for i := range bc.StateChanges {
+		if bytes.Equal(bc.StateChanges[i].InstanceID, cid.Slice()) {
+			scs = append(scs, &bc.StateChanges[i])
+		}
+	}
+	if len(scs) == 0 {
+		return nil, xerrors.New("block does not change the instance")
+	}
+	err = verifyLinks(bc.Block, bc.Links, head)
+	if err != nil {
+		return nil, err
+	}
+	return scs, nil
+}
+
+// verifyLinks checks that links is a forward-linked chain of blocks that
+// starts with from and contains head.
+func verifyLinks(from *skipchain.SkipBlock, links []*skipchain.SkipBlock,
+	head *skipchain.SkipBlock) error {
+	if len(links) == 0 || !links[0].Hash.Equal(from.Hash) {
+		return xerrors.New("links do not start with the block")
+	}
+	if from.Hash.Equal(head.Hash) {
+		return nil
+	}
+	for i := 0; i < len(links)-1; i++ {
+		curr, next := links[i], links[i+1]
+		if !curr.CalculateHash().Equal(curr.Hash) {
+			return xerrors.Errorf("invalid block %d in links", curr.Index)
+		}
+		var fl *skipchain.ForwardLink
+		for _, l := range curr.ForwardLink {
+			if l.To.Equal(next.Hash) {
+				fl = l
+			}
+		}
+		if fl == nil || !fl.From.Equal(curr.Hash) {
+			return xerrors.Errorf("missing forward link from block %d to "+
+				"%d", curr.Index, next.Index)
+		}
+		publics := curr.Roster.ServicePublics(skipchain.ServiceName)
+		err := fl.VerifyWithScheme(pairing.NewSuiteBn256(), publics,
+			curr.SignatureScheme)
+		if err != nil {
+			return xerrors.Errorf("verifying forward link of block %d: %v",
+				curr.Index, err)
+		}
+		if next.Hash.Equal(head.Hash) {
+			return nil
+		}
+	}
+	return xerrors.New("links do not reach the head block")
+}
+
+// GetInstanceVersions returns the versions of instance iid, together with
+// the index of the block that wrote each of them, from the oldest to the
+// latest one. Byzcoin orders them by version, which starts again from 0 if
+// the instance is created again after a removal.
+func GetInstanceVersions(bc *byzcoin.Client, iid byzcoin.InstanceID) (
+	[]byzcoin.GetInstanceVersionResponse, error) {
+	req := &byzcoin.GetAllInstanceVersion{SkipChainID: bc.ID,
+		InstanceID: iid}
+	reply := &byzcoin.GetAllInstanceVersionResponse{}
+	err := bc.SendProtobuf(bc.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("getting instance versions: %v", err)
+	}
+	versions := reply.StateChanges
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].BlockIndex != versions[j].BlockIndex {
+			return versions[i].BlockIndex < versions[j].BlockIndex
+		}
+		return versions[i].StateChange.Version <
+			versions[j].StateChange.Version
+	})
+	return versions, nil
+}
+
+// GetLastVersion returns the latest version of instance iid.
+func GetLastVersion(bc *byzcoin.Client, iid byzcoin.InstanceID) (uint64,
+	error) {
+	req := &byzcoin.GetLastInstanceVersion{SkipChainID: bc.ID,
+		InstanceID: iid}
+	reply := &byzcoin.GetInstanceVersionResponse{}
+	err := bc.SendProtobuf(bc.Roster.List[0], req, reply)
+	if err != nil {
+		return 0, xerrors.Errorf("getting last instance version: %v", err)
+	}
+	return reply.StateChange.Version, nil
+}
+
+// GetBlockChange returns the block in which version of instance iid is
+// written, together with its state changes and the update chain from the
+// block to the latest block.
+func GetBlockChange(bc *byzcoin.Client, iid byzcoin.InstanceID,
+	version uint64) (*BlockChange, error) {
+	req := &byzcoin.CheckStateChangeValidity{SkipChainID: bc.ID,
+		InstanceID: iid, Version: version}
+	reply := &byzcoin.CheckStateChangeValidityResponse{}
+	err := bc.SendProtobuf(bc.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("getting state changes of version %d: %v",
+			version, err)
+	}
+	cl := skipchain.NewClient()
+	sb, err := cl.GetSingleBlock(&bc.Roster, reply.BlockID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting block: %v", err)
+	}
+	chain, err := cl.GetUpdateChain(&bc.Roster, reply.BlockID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting update chain: %v", err)
+	}
+	return &BlockChange{Block: sb, StateChanges: reply.StateChanges,
+		Links: chain.Update}, nil
+}
@@ -0,0 +1,364 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/trie"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/protobuf"
+)
+
+// historyLedger is a ledger in which block 1 creates a contract in state
+// open, block 2 only changes another instance and block 3 closes the
+// contract.
+type historyLedger struct {
+	*testLedger
+	cid     byzcoin.InstanceID
+	changes []byzcoin.StateChanges
+	roots   [][]byte
+	head    *StateProof
+}
+
+func contractChange(t *testing.T, action byzcoin.StateAction,
+	cid byzcoin.InstanceID, version uint64, state string) byzcoin.StateChange {
+	hdr, err := protobuf.Encode(&ContractHeader{CID: cid, CurrState: state})
+	require.NoError(t, err)
+	store := &Storage{Version: StorageVersionNamed}
+	store.Set(KeyHeader, hdr)
+	buf, err := protobuf.Encode(store)
+	require.NoError(t, err)
+	sc := byzcoin.NewStateChange(action, cid, "keyValue", buf, darc.ID{})
+	sc.Version = version
+	return sc
+}
+
+func newHistoryLedger(t *testing.T) *historyLedger {
+	cid := byzcoin.NewInstanceID(bytes.Repeat([]byte{1}, 32))
+	other := byzcoin.NewInstanceID(bytes.Repeat([]byte{2}, 32))
+	hl, tr := buildHistoryLedger(t, cid, []byzcoin.StateChanges{nil,
+		{contractChange(t, byzcoin.Create, cid, 0, "open")},
+		{contractChange(t, byzcoin.Create, other, 0, "open")},
+		{contractChange(t, byzcoin.Update, cid, 1, "closed")}})
+	pr, err := tr.GetProof(cid.Slice())
+	require.NoError(t, err)
+	hl.head = hl.proof(pr)
+	return hl
+}
+
+// buildHistoryLedger returns a ledger with a block for each of blocks and
+// the trie after the last block.
+func buildHistoryLedger(t *testing.T, cid byzcoin.InstanceID,
+	blocks []byzcoin.StateChanges) (*historyLedger, *trie.Trie) {
+	priv, ro := testRoster()
+	tr, err := trie.NewTrie(trie.NewMemDB(), []byte("nonce"))
+	require.NoError(t, err)
+	hl := &historyLedger{cid: cid}
+	for i, scs := range blocks {
+		for _, sc := range scs {
+			if sc.StateAction == byzcoin.Remove {
+				require.NoError(t, tr.Delete(sc.InstanceID))
+				continue
+			}
+			body, err := protobuf.Encode(&byzcoin.StateChangeBody{
+				StateAction: sc.StateAction, ContractID: sc.ContractID,
+				Value: sc.Value, Version: sc.Version})
+			require.NoError(t, err)
+			require.NoError(t, tr.Set(sc.InstanceID, body))
+		}
+		data, err := protobuf.Encode(&byzcoin.DataHeader{
+			TrieRoot: tr.GetRoot(), StateChangesHash: scs.Hash()})
+		require.NoError(t, err)
+		if i == 0 {
+			hl.testLedger = newTestLedger(ro, data)
+		} else {
+			hl.add(t, ro, priv, data)
+		}
+		hl.changes = append(hl.changes, scs)
+		hl.roots = append(hl.roots, tr.GetRoot())
+	}
+	return hl, tr
+}
+
+// newKeyHistoryLedger returns a ledger in which block 1 creates a contract
+// in state open with key x set to 1, block 2 sets x to 2 and block 3 closes
+// the contract and removes x. The head proof covers x and the key index.
+func newKeyHistoryLedger(t *testing.T) *historyLedger {
+	cid := byzcoin.NewInstanceID(bytes.Repeat([]byte{1}, 32))
+	hl, tr := buildHistoryLedger(t, cid, []byzcoin.StateChanges{nil,
+		{mainChange(t, cid, 0, "open"),
+			versioned(keyChange(cid, "x", []byte("1")), byzcoin.Create, 0),
+			versioned(indexChange(t, cid, "x"), byzcoin.Create, 0)},
+		{versioned(keyChange(cid, "x", []byte("2")), byzcoin.Update, 1)},
+		{mainChange(t, cid, 1, "closed"),
+			versioned(keyChange(cid, "x", nil), byzcoin.Remove, 2),
+			versioned(indexChange(t, cid), byzcoin.Update, 1)}})
+	pr, err := tr.GetProof(cid.Slice())
+	require.NoError(t, err)
+	hl.head = hl.proof(pr)
+	hl.head.KeyProofs = []KeyProof{{Key: KeyHeader, Proof: *pr}}
+	for _, key := range []string{KeyIndex, "x"} {
+		kpr, err := tr.GetProof(KeyInstanceID(cid.Slice(), key).Slice())
+		require.NoError(t, err)
+		hl.head.KeyProofs = append(hl.head.KeyProofs,
+			KeyProof{Key: key, Proof: *kpr})
+	}
+	return hl
+}
+
+func versioned(sc byzcoin.StateChange, action byzcoin.StateAction,
+	version uint64) byzcoin.StateChange {
+	sc.StateAction = action
+	sc.Version = version
+	return sc
+}
+
+// change returns the change of block i, linked to the head block.
+func (hl *historyLedger) change(i int) *BlockChange {
+	return &BlockChange{Block: hl.blocks[i], StateChanges: hl.changes[i],
+		Links: hl.blocks[i:]}
+}
+
+func Test_HistoricalProofVerify(t *testing.T) {
+	hl := newHistoryLedger(t)
+	genesis := hl.blocks[0]
+
+	// The contract is open as of block 2 and closed in block 3
+	hp := &HistoricalProof{CID: hl.cid, Index: 2, Change: *hl.change(1),
+		Next: hl.change(3), Head: *hl.head, At: hl.blocks[2:]}
+	store, err := hp.Verify(genesis)
+	require.NoError(t, err)
+	hdr, err := store.GetHeader()
+	require.NoError(t, err)
+	require.Equal(t, "open", hdr.CurrState)
+	hp = &HistoricalProof{CID: hl.cid, Index: 3, Change: *hl.change(3),
+		Head: *hl.head, At: hl.blocks[3:]}
+	store, err = hp.Verify(genesis)
+	require.NoError(t, err)
+	hdr, err = store.GetHeader()
+	require.NoError(t, err)
+	require.Equal(t, "closed", hdr.CurrState)
+
+	// The next version must be written after block Index
+	hp = &HistoricalProof{CID: hl.cid, Index: 3, Change: *hl.change(1),
+		Next: hl.change(3), Head: *hl.head}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// Without Next, the version of the change must be the current one
+	hp = &HistoricalProof{CID: hl.cid, Index: 2, Change: *hl.change(1),
+		Head: *hl.head}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The change must be written before block Index
+	hp = &HistoricalProof{CID: hl.cid, Index: 2, Change: *hl.change(3),
+		Head: *hl.head}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The state changes must be the ones of the block
+	change := hl.change(1)
+	change.StateChanges = hl.changes[3]
+	hp = &HistoricalProof{CID: hl.cid, Index: 2, Change: *change,
+		Next: hl.change(3), Head: *hl.head}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The block must change the contract
+	hp = &HistoricalProof{CID: hl.cid, Index: 2, Change: *hl.change(2),
+		Next: hl.change(3), Head: *hl.head}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The change must be linked to the head block
+	change = hl.change(1)
+	change.Links = hl.blocks[1:3]
+	hp = &HistoricalProof{CID: hl.cid, Index: 2, Change: *change,
+		Next: hl.change(3), Head: *hl.head}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The proof must be from the ledger of genesis
+	_, ro := testRoster()
+	other := newTestLedger(ro, genesis.Data)
+	hp = &HistoricalProof{CID: hl.cid, Index: 3, Change: *hl.change(3),
+		Head: *hl.head}
+	_, err = hp.Verify(other.blocks[0])
+	require.Error(t, err)
+}
+
+func Test_HistoricalProofVerifyRoot(t *testing.T) {
+	hl := newHistoryLedger(t)
+	genesis := hl.blocks[0]
+	hp := &HistoricalProof{CID: hl.cid, Index: 2, Change: *hl.change(1),
+		Next: hl.change(3), Head: *hl.head, At: hl.blocks[2:]}
+	_, err := hp.VerifyRoot(genesis, hl.roots[2])
+	require.NoError(t, err)
+	_, err = hp.VerifyRoot(genesis, hl.roots[3])
+	require.Error(t, err)
+
+	// The block must be the one at Index and be linked to the head block
+	hp.At = hl.blocks[1:]
+	_, err = hp.VerifyRoot(genesis, hl.roots[1])
+	require.Error(t, err)
+	hp.At = hl.blocks[2:3]
+	_, err = hp.VerifyRoot(genesis, hl.roots[2])
+	require.Error(t, err)
+	hp.At = nil
+	_, err = hp.VerifyRoot(genesis, hl.roots[2])
+	require.Error(t, err)
+}
+
+func Test_HistoricalProofVerifyKeys(t *testing.T) {
+	hl := newKeyHistoryLedger(t)
+	genesis := hl.blocks[0]
+
+	// x is 1 as of block 1, 2 as of block 2 and removed in block 3
+	hp := &HistoricalProof{CID: hl.cid, Index: 1, Change: *hl.change(1),
+		Next: hl.change(3), Head: *hl.head, Keys: []KeyHistory{
+			{Key: KeyIndex, Change: hl.change(1), Next: hl.change(3)},
+			{Key: "x", Change: hl.change(1), Next: hl.change(2)}}}
+	store, err := hp.Verify(genesis)
+	require.NoError(t, err)
+	v, _ := store.Get("x")
+	require.Equal(t, []byte("1"), v)
+	_, ok := store.Get(KeyIndex)
+	require.False(t, ok)
+	hp.Index = 2
+	hp.Keys[1] = KeyHistory{Key: "x", Change: hl.change(2),
+		Next: hl.change(3)}
+	store, err = hp.Verify(genesis)
+	require.NoError(t, err)
+	v, _ = store.Get("x")
+	require.Equal(t, []byte("2"), v)
+	hp = &HistoricalProof{CID: hl.cid, Index: 3, Change: *hl.change(3),
+		Head: *hl.head, Keys: []KeyHistory{
+			{Key: KeyIndex, Change: hl.change(3)},
+			{Key: "x", Change: hl.change(3)}}}
+	store, err = hp.Verify(genesis)
+	require.NoError(t, err)
+	_, ok = store.Get("x")
+	require.False(t, ok)
+	hdr, err := store.GetHeader()
+	require.NoError(t, err)
+	require.Equal(t, "closed", hdr.CurrState)
+
+	// The key index must not leave out a key
+	hp = &HistoricalProof{CID: hl.cid, Index: 2, Change: *hl.change(1),
+		Next: hl.change(3), Head: *hl.head, Keys: []KeyHistory{
+			{Key: KeyIndex, Change: hl.change(1), Next: hl.change(3)}}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The absence of a key is only proven by the key index
+	hp.Keys = []KeyHistory{{Key: "x"}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	hp.Keys = []KeyHistory{
+		{Key: KeyIndex, Change: hl.change(1), Next: hl.change(3)},
+		{Key: "x"}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	hp.Keys = []KeyHistory{{Key: "x", Change: hl.change(1),
+		Next: hl.change(2)}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// The next version of the key must follow the current one
+	hp.Keys = []KeyHistory{{Key: "x", Change: hl.change(1),
+		Next: hl.change(3)}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// Without Next, the head must have the version of the change
+	hp.Keys = []KeyHistory{{Key: "x", Change: hl.change(2)}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+	// A key that did not exist at Index can only be created afterwards
+	hp.Keys = []KeyHistory{{Key: "x", Next: hl.change(2)}}
+	_, err = hp.Verify(genesis)
+	require.Error(t, err)
+
+	// A contract that keeps all its keys in its instance has no key
+	// histories
+	old := newHistoryLedger(t)
+	hp = &HistoricalProof{CID: old.cid, Index: 3, Change: *old.change(3),
+		Head: *old.head, Keys: []KeyHistory{{Key: "x"}}}
+	_, err = hp.Verify(old.blocks[0])
+	require.Error(t, err)
+}
+
+// mainChange returns the update to version of the instance of contract
+// cid that keeps its keys in their own instances.
+func mainChange(t *testing.T, cid byzcoin.InstanceID, version uint64,
+	state string) byzcoin.StateChange {
+	sc := contractChange(t, byzcoin.Update, cid, version, state)
+	store := &Storage{}
+	require.NoError(t, protobuf.Decode(sc.Value, store))
+	store.Version = StorageVersionKeys
+	buf, err := protobuf.Encode(store)
+	require.NoError(t, err)
+	sc.Value = buf
+	return sc
+}
+
+// keyChange returns the state change that sets key of contract cid to
+// value, or removes it if value is nil.
+func keyChange(cid byzcoin.InstanceID, key string,
+	value []byte) byzcoin.StateChange {
+	action := byzcoin.Update
+	if value == nil {
+		action = byzcoin.Remove
+	}
+	return byzcoin.NewStateChange(action, KeyInstanceID(cid.Slice(), key),
+		"keyEntry", value, darc.ID{})
+}
+
+func indexChange(t *testing.T, cid byzcoin.InstanceID,
+	keys ...string) byzcoin.StateChange {
+	buf, err := protobuf.Encode(&StorageIndex{Keys: keys})
+	require.NoError(t, err)
+	return keyChange(cid, KeyIndex, buf)
+}
+
+func Test_ApplyStateChanges(t *testing.T) {
+	cid := byzcoin.NewInstanceID(bytes.Repeat([]byte{1}, 32))
+	other := byzcoin.NewInstanceID(bytes.Repeat([]byte{2}, 32))
+	prev := &Storage{Version: StorageVersionKeys}
+	prev.Set("x", []byte("1"))
+	prev.Set("y", []byte("2"))
+
+	// The last change of an instance in the block is applied; the keys
+	// that are not changed keep their value
+	scs := byzcoin.StateChanges{mainChange(t, cid, 3, "open"),
+		keyChange(cid, "x", []byte("2")), mainChange(t, cid, 4, "closed"),
+		keyChange(cid, "x", []byte("3")), keyChange(other, "y", []byte("9")),
+		keyChange(cid, TxnRecordKey(0), []byte("rec"))}
+	store, version, err := ApplyStateChanges(cid, prev, scs)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), version)
+	hdr, err := store.GetHeader()
+	require.NoError(t, err)
+	require.Equal(t, "closed", hdr.CurrState)
+	require.Len(t, store.Store, 3)
+	v, _ := store.Get("x")
+	require.Equal(t, []byte("3"), v)
+	v, _ = store.Get("y")
+	require.Equal(t, []byte("2"), v)
+
+	// The key index gives the keys after the block
+	scs = byzcoin.StateChanges{mainChange(t, cid, 5, "closed"),
+		keyChange(cid, "x", nil), keyChange(cid, "z", []byte("4")),
+		indexChange(t, cid, "y", "z")}
+	store, _, err = ApplyStateChanges(cid, store, scs)
+	require.NoError(t, err)
+	_, ok := store.Get("x")
+	require.False(t, ok)
+	v, _ = store.Get("z")
+	require.Equal(t, []byte("4"), v)
+
+	// A key of the index needs a value
+	scs = byzcoin.StateChanges{mainChange(t, cid, 6, "closed"),
+		indexChange(t, cid, "y", "w")}
+	_, _, err = ApplyStateChanges(cid, store, scs)
+	require.Error(t, err)
+
+	// The block must change the contract instance
+	_, _, err = ApplyStateChanges(cid, store,
+		byzcoin.StateChanges{keyChange(cid, "y", []byte("5"))})
+	require.Error(t, err)
+}
@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bytes"
+
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// StorageIndex is the value that is stored under KeyIndex.
+type StorageIndex struct {
+	Keys []string
+}
+
+// DecodeStorageIndex decodes the value that is stored under KeyIndex.
+func DecodeStorageIndex(buf []byte) (*StorageIndex, error) {
+	index := &StorageIndex{}
+	err := protobuf.Decode(buf, index)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding key index: %v", err)
+	}
+	return index, nil
+}
+
+// IsMainKey returns true if key is stored in the instance of the contract
+// itself. Only the raw contract and the header are stored there, so that an
+// update does not rewrite the other keys.
+func IsMainKey(key string) bool {
+	return key == KeyRaw || key == KeyHeader
+}
+
+// KeyInstanceID returns the ID of the byzcoin instance in which the state
+// unit stores the value of key of contract cid. Storing every key in its
+// own instance lets a state proof cover only the keys that are read. The
+// main keys (see IsMainKey) are stored in the instance of the contract.
+func KeyInstanceID(cid []byte, key string) byzcoin.InstanceID {
+	if IsMainKey(key) {
+		return byzcoin.NewInstanceID(cid)
+	}
+	hr := NewHasher(DomainStorageKey)
+	hr.WriteBytes(cid)
+	hr.WriteString(key)
+	return byzcoin.NewInstanceID(hr.Sum())
+}
+
+// Storage returns the storage of contract cid that is proven by the state
+// proof. If the proof has key proofs, the storage only has the keys that
+// are covered by them; keys whose absence is proven are left out (see
+// CoversKeys). Otherwise, it is the storage in the instance of the
+// contract, which only has the main keys unless the contract predates
+// StorageVersionKeys. The caller must have verified p.Proof (see
+// VerifyFromBlock).
+func (p *StateProof) Storage(cid []byte) (*Storage, error) {
+	main, err := p.mainStorage(cid)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.KeyProofs) == 0 {
+		return main, nil
+	}
+	if main.Version < StorageVersionKeys {
+		return nil, xerrors.New("contract does not store its keys in " +
+			"their own instances")
+	}
+	store := &Storage{Version: main.Version}
+	covered := make(map[string]bool)
+	var index *StorageIndex
+	for _, kp := range p.KeyProofs {
+		covered[kp.Key] = true
+		if IsMainKey(kp.Key) {
+			if v, ok := main.Get(kp.Key); ok {
+				store.Set(kp.Key, v)
+			}
+			continue
+		}
+		v, ok, err := p.keyValue(cid, kp)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if kp.Key == KeyIndex {
+			index, err = DecodeStorageIndex(v)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		store.Set(kp.Key, v)
+	}
+	// A proof of the key index must cover all the keys, so that a key
+	// cannot be left out of the whole storage.
+	if index != nil {
+		for _, key := range index.Keys {
+			if !covered[key] {
+				return nil, xerrors.Errorf("proof does not cover key %s",
+					key)
+			}
+		}
+	}
+	return store, nil
+}
+
+// CoversKeys returns an error if the state proof of contract cid does not
+// prove the value or the absence of each of keys. Without a key proof, a
+// key that is not covered cannot be told apart from a key whose absence is
+// proven.
+func (p *StateProof) CoversKeys(cid []byte, keys []string) error {
+	covered := make(map[string]bool)
+	for _, kp := range p.KeyProofs {
+		covered[kp.Key] = true
+	}
+	if len(p.KeyProofs) == 0 {
+		main, err := p.mainStorage(cid)
+		if err != nil {
+			return err
+		}
+		if main.Version < StorageVersionKeys {
+			// The instance of the contract has all its keys
+			return nil
+		}
+		covered[KeyRaw] = true
+		covered[KeyHeader] = true
+	}
+	for _, key := range keys {
+		if !covered[key] {
+			return xerrors.Errorf("proof does not cover key %s", key)
+		}
+	}
+	return nil
+}
+
+// mainStorage returns the storage in the instance of contract cid. If the
+// proof has key proofs, one of them must be the proof of a main key.
+func (p *StateProof) mainStorage(cid []byte) (*Storage, error) {
+	if len(p.KeyProofs) == 0 {
+		return decodeStorage(p.Proof, cid)
+	}
+	for _, kp := range p.KeyProofs {
+		if IsMainKey(kp.Key) {
+			if !bytes.Equal(kp.Proof.GetRoot(),
+				p.Proof.InclusionProof.GetRoot()) {
+				return nil, xerrors.Errorf("proof of key %s has a "+
+					"different root", kp.Key)
+			}
+			return decodeStorage(&byzcoin.Proof{InclusionProof: kp.Proof},
+				cid)
+		}
+	}
+	return nil, xerrors.New("proof does not cover the contract instance")
+}
+
+// keyValue returns the value of the key of contract cid that is proven by
+// key proof kp, or false if its absence is proven.
+func (p *StateProof) keyValue(cid []byte, kp KeyProof) ([]byte, bool,
+	error) {
+	if !bytes.Equal(kp.Proof.GetRoot(), p.Proof.InclusionProof.GetRoot()) {
+		return nil, false, xerrors.Errorf("proof of key %s has a "+
+			"different root", kp.Key)
+	}
+	id := KeyInstanceID(cid, kp.Key)
+	ok, err := kp.Proof.Exists(id.Slice())
+	if err != nil {
+		return nil, false, xerrors.Errorf("verifying proof of key %s: %v",
+			kp.Key, err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	pr := byzcoin.Proof{InclusionProof: kp.Proof}
+	v, _, _, err := pr.Get(id.Slice())
+	if err != nil {
+		return nil, false, xerrors.Errorf("getting value of key %s: %v",
+			kp.Key, err)
+	}
+	return v, true, nil
+}
+
+func decodeStorage(pr *byzcoin.Proof, cid []byte) (*Storage, error) {
+	v, _, _, err := pr.Get(cid)
+	if err != nil {
+		return nil, xerrors.Errorf("getting contract storage: %v", err)
+	}
+	store := &Storage{}
+	err = protobuf.Decode(v, store)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding contract storage: %v", err)
+	}
+	return store, nil
+}
+
+// keyProofAttempts is the number of times that GetStorageProof tries to get
+// the proofs of the keys at the same block.
+const keyProofAttempts = 5
+
+// GetStorageProof gets a state proof of contract cid that covers keys, or
+// all the keys of the contract if keys is empty. The records of the txn log
+// are only covered if their keys are given (see TxnRecordKey). The proof
+// also covers the header, which shows the storage version of the contract.
+// A contract that predates StorageVersionKeys has no key instances, so the
+// proof of its instance is returned. The proofs of the keys are requested
+// one by one, so they are requested again if a block is added in between.
+func GetStorageProof(bc *byzcoin.Client, cid byzcoin.InstanceID,
+	keys []string) (*StateProof, error) {
+	for i := 0; i < keyProofAttempts; i++ {
+		pr, err := bc.GetProof(cid.Slice())
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get proof from byzcoin: %v",
+				err)
+		}
+		main, err := decodeStorage(&pr.Proof, cid.Slice())
+		if err != nil {
+			return nil, err
+		}
+		if main.Version < StorageVersionKeys {
+			return &StateProof{Proof: &pr.Proof, Genesis: bc.Genesis}, nil
+		}
+		root := pr.Proof.InclusionProof.GetRoot()
+		kps := []KeyProof{{Key: KeyHeader, Proof: pr.Proof.InclusionProof}}
+		requested := keys
+		if len(requested) == 0 {
+			id := KeyInstanceID(cid.Slice(), KeyIndex)
+			ipr, err := bc.GetProof(id.Slice())
+			if err != nil {
+				return nil, xerrors.Errorf("failed to get proof from "+
+					"byzcoin: %v", err)
+			}
+			if !bytes.Equal(ipr.Proof.InclusionProof.GetRoot(), root) {
+				continue
+			}
+			v, _, _, err := ipr.Proof.Get(id.Slice())
+			if err != nil {
+				return nil, xerrors.Errorf("getting key index: %v", err)
+			}
+			index, err := DecodeStorageIndex(v)
+			if err != nil {
+				return nil, err
+			}
+			kps = append(kps, KeyProof{Key: KeyRaw,
+				Proof: pr.Proof.InclusionProof}, KeyProof{Key: KeyIndex,
+				Proof: ipr.Proof.InclusionProof})
+			requested = index.Keys
+		}
+		consistent := true
+		for _, key := range requested {
+			if key == KeyHeader {
+				continue
+			}
+			if IsMainKey(key) {
+				kps = append(kps, KeyProof{Key: key,
+					Proof: pr.Proof.InclusionProof})
+				continue
+			}
+			kpr, err := bc.GetProof(KeyInstanceID(cid.Slice(), key).Slice())
+			if err != nil {
+				return nil, xerrors.Errorf("failed to get proof from "+
+					"byzcoin: %v", err)
+			}
+			if !bytes.Equal(kpr.Proof.InclusionProof.GetRoot(), root) {
+				consistent = false
+				break
+			}
+			kps = append(kps, KeyProof{Key: key,
+				Proof: kpr.Proof.InclusionProof})
+		}
+		if consistent {
+			return &StateProof{Proof: &pr.Proof, Genesis: bc.Genesis,
+				KeyProofs: kps}, nil
+		}
+	}
+	return nil, xerrors.New("state changed while getting the key proofs")
+}
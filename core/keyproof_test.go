@@ -0,0 +1,27 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+)
+
+func Test_KeyInstanceID(t *testing.T) {
+	cid := bytes.Repeat([]byte{1}, 32)
+	require.Equal(t, byzcoin.NewInstanceID(cid), KeyInstanceID(cid, KeyRaw))
+	require.Equal(t, byzcoin.NewInstanceID(cid),
+		KeyInstanceID(cid, KeyHeader))
+	id := KeyInstanceID(cid, "x")
+	require.NotEqual(t, byzcoin.NewInstanceID(cid), id)
+	require.NotEqual(t, id, KeyInstanceID(cid, "y"))
+	require.NotEqual(t, id, KeyInstanceID(bytes.Repeat([]byte{2}, 32), "x"))
+}
+
+func Test_CoversKeys(t *testing.T) {
+	p := &StateProof{KeyProofs: []KeyProof{{Key: KeyHeader}, {Key: "x"}}}
+	require.NoError(t, p.CoversKeys(nil, []string{"x", KeyHeader}))
+	require.NoError(t, p.CoversKeys(nil, nil))
+	require.Error(t, p.CoversKeys(nil, []string{"x", "y"}))
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"bytes"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// DefaultLockBlocks is the number of blocks for which the driver locks
+	// a contract for its plan.
+	DefaultLockBlocks = 10
+	// MaxLockBlocks is the longest period (in blocks) for which a contract
+	// can be locked. A lock is only released early by the update of its
+	// plan, so this bounds the time that a crashed client can keep other
+	// clients from updating the contract.
+	MaxLockBlocks = 100
+)
+
+// IsLocked returns true if the contract is locked at the given block index
+// of the state unit's ledger. A lock expires at block LockExpiry.
+func (h *ContractHeader) IsLocked(index int) bool {
+	return h.Lock && index < h.LockExpiry
+}
+
+// HeldBy returns true if the contract is locked at the given block index
+// by the execution plan planID.
+func (h *ContractHeader) HeldBy(planID []byte, index int) bool {
+	return h.IsLocked(index) && bytes.Equal(h.LockID, planID)
+}
+
+// CheckLock returns an error if the contract is locked at the given block
+// index by an execution plan other than planID.
+func (h *ContractHeader) CheckLock(planID []byte, index int) error {
+	if h.IsLocked(index) && !bytes.Equal(h.LockID, planID) {
+		return xerrors.Errorf("contract is locked until block %d",
+			h.LockExpiry)
+	}
+	return nil
+}
+
+// SetLock records that the execution plan planID locks the contract until
+// block expiry.
+func (h *ContractHeader) SetLock(planID []byte, expiry int) {
+	h.Lock = true
+	h.LockID = planID
+	h.LockExpiry = expiry
+}
+
+// ClearLock releases the lock on the contract.
+func (h *ContractHeader) ClearLock() {
+	h.Lock = false
+	h.LockID = nil
+	h.LockExpiry = 0
+}
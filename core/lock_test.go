@@ -0,0 +1,31 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ContractLock(t *testing.T) {
+	hdr := &ContractHeader{}
+	require.False(t, hdr.IsLocked(0))
+	require.NoError(t, hdr.CheckLock(nil, 0))
+
+	hdr.SetLock([]byte("plan"), 10)
+	require.True(t, hdr.IsLocked(9))
+	require.True(t, hdr.HeldBy([]byte("plan"), 9))
+	require.False(t, hdr.HeldBy([]byte("other"), 9))
+	require.NoError(t, hdr.CheckLock([]byte("plan"), 9))
+	require.Error(t, hdr.CheckLock([]byte("other"), 9))
+	require.Error(t, hdr.CheckLock(nil, 9))
+
+	// The lock expires at block LockExpiry
+	require.False(t, hdr.IsLocked(10))
+	require.False(t, hdr.HeldBy([]byte("plan"), 10))
+	require.NoError(t, hdr.CheckLock([]byte("other"), 10))
+
+	hdr.ClearLock()
+	require.False(t, hdr.IsLocked(0))
+	require.Nil(t, hdr.LockID)
+	require.NoError(t, hdr.CheckLock([]byte("other"), 0))
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"golang.org/x/xerrors"
+)
+
+// WritesetPrefix starts the names of the update_state inputs that carry the
+// writesets of contracts other than the contract of the plan. The rest of
+// the name is the hex-encoded CID of the contract (see WritesetInput).
+const WritesetPrefix = "ws:"
+
+// Writeset is the writeset of a contract that is updated by a plan together
+// with the contract of the plan.
+type Writeset struct {
+	Args byzcoin.Arguments
+}
+
+// WritesetInput returns the name of the update_state input that carries the
+// writeset of contract cid.
+func WritesetInput(cid []byte) string {
+	return WritesetPrefix + hex.EncodeToString(cid)
+}
+
+// WritesetCID returns the CID of the contract whose writeset is carried by
+// the update_state input name. It returns false if name is not such an
+// input.
+func WritesetCID(name string) ([]byte, bool, error) {
+	if !strings.HasPrefix(name, WritesetPrefix) {
+		return nil, false, nil
+	}
+	cidStr := strings.TrimPrefix(name, WritesetPrefix)
+	cid, err := hex.DecodeString(cidStr)
+	if err != nil || len(cid) != len(byzcoin.InstanceID{}) {
+		return nil, true, xerrors.Errorf("invalid contract ID: %s", cidStr)
+	}
+	return cid, true, nil
+}
+
+// UpdatedContracts returns the CIDs of the contracts other than the
+// contract of the plan that are updated by txn, in the order in which their
+// writesets appear in the inputs of the update_state opcodes.
+func (txn *Transaction) UpdatedContracts() ([][]byte, error) {
+	var cids [][]byte
+	seen := make(map[string]bool)
+	for _, opcode := range txn.Opcodes {
+		if opcode.DFUID != SUID {
+			continue
+		}
+		names := make([]string, 0, len(opcode.Dependencies))
+		for name := range opcode.Dependencies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cid, ok, err := WritesetCID(name)
+			if err != nil {
+				return nil, err
+			}
+			if ok && !seen[name] {
+				seen[name] = true
+				cids = append(cids, cid)
+			}
+		}
+	}
+	return cids, nil
+}
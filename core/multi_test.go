@@ -0,0 +1,33 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_UpdatedContracts(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	cid2 := bytes.Repeat([]byte{2}, 32)
+	txn := &Transaction{Opcodes: []*Opcode{
+		{Name: "exec", DFUID: CEUID},
+		{Name: "update_state", DFUID: SUID,
+			Dependencies: map[string]*DataDependency{
+				"ws":                {Src: OPCODE, SrcName: "ws", Idx: 0},
+				WritesetInput(cid2): {Src: OPCODE, SrcName: "ws2", Idx: 0},
+				WritesetInput(cid1): {Src: OPCODE, SrcName: "ws1", Idx: 0},
+			}},
+	}}
+	cids, err := txn.UpdatedContracts()
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{cid1, cid2}, cids)
+
+	cid, ok, err := WritesetCID("ws")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Nil(t, cid)
+	_, ok, err = WritesetCID(WritesetPrefix + "zz")
+	require.True(t, ok)
+	require.Error(t, err)
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"bytes"
+
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// Precommit is the signed commitment of a client to the value of a
+// PRECOMMIT input of a contract. The commitment is stored by the state unit
+// until the round closes at block Deadline. The value is then revealed to
+// the opcodes of a later txn, which check it against Hash (see
+// PrecommitRound.VerifyReveals). A value that must stay hidden until the
+// reveal, such as a sealed bid, has to include a random salt.
+type Precommit struct {
+	CID      byzcoin.InstanceID
+	Key      string
+	Hash     []byte
+	Deadline int
+	Public   kyber.Point
+	Sig      []byte
+}
+
+// Precommitter authorizes the client with public key Public to commit to
+// the PRECOMMIT input Key (see ContractHeader.Precommitters).
+type Precommitter struct {
+	Key    string
+	Public kyber.Point
+}
+
+// PrecommitRound holds the commitments that are collected until block
+// Deadline.
+type PrecommitRound struct {
+	Deadline int
+	Commits  []Precommit
+}
+
+// PrecommitHash returns the commitment to value for the PRECOMMIT input key.
+func PrecommitHash(key string, value []byte) []byte {
+	hr := NewHasher(DomainPrecommit)
+	hr.WriteString(key)
+	hr.WriteBytes(value)
+	return hr.Sum()
+}
+
+// NewPrecommit returns the commitment to value for the input key of
+// contract cid in the round that closes at block deadline, signed with
+// private.
+func NewPrecommit(cid byzcoin.InstanceID, key string, value []byte,
+	deadline int, private kyber.Scalar) (*Precommit, error) {
+	pc := &Precommit{
+		CID:      cid,
+		Key:      key,
+		Hash:     PrecommitHash(key, value),
+		Deadline: deadline,
+		Public:   cothority.Suite.Point().Mul(private, nil),
+	}
+	sig, err := schnorr.Sign(cothority.Suite, private, pc.message())
+	if err != nil {
+		return nil, xerrors.Errorf("signing precommit: %v", err)
+	}
+	pc.Sig = sig
+	return pc, nil
+}
+
+func (pc *Precommit) message() []byte {
+	hr := NewHasher(DomainPrecommitSig)
+	hr.WriteBytes(pc.CID.Slice())
+	hr.WriteString(pc.Key)
+	hr.WriteBytes(pc.Hash)
+	hr.WriteInt(pc.Deadline)
+	return hr.Sum()
+}
+
+// Verify checks the signature of the commitment.
+func (pc *Precommit) Verify() error {
+	if pc.Public == nil {
+		return xerrors.New("missing public key")
+	}
+	err := schnorr.Verify(cothority.Suite, pc.Public, pc.message(), pc.Sig)
+	if err != nil {
+		return xerrors.Errorf("verifying precommit signature: %v", err)
+	}
+	return nil
+}
+
+// Get returns the commitment for key, or nil if there is none.
+func (r *PrecommitRound) Get(key string) *Precommit {
+	for i := range r.Commits {
+		if r.Commits[i].Key == key {
+			return &r.Commits[i]
+		}
+	}
+	return nil
+}
+
+// Add adds a commitment to the round. Only the client that committers
+// authorize for the key of the commitment can commit to it, so that another
+// client cannot take the key first. The client can replace its commitment
+// until the round closes.
+func (r *PrecommitRound) Add(pc Precommit, committers []Precommitter) error {
+	if pc.Deadline != r.Deadline {
+		return xerrors.Errorf("precommit is for the round that closes at "+
+			"block %d instead of %d", pc.Deadline, r.Deadline)
+	}
+	authorized := false
+	for _, c := range committers {
+		if c.Key == pc.Key && c.Public != nil && pc.Public != nil &&
+			c.Public.Equal(pc.Public) {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return xerrors.Errorf("client is not authorized to commit to key %s",
+			pc.Key)
+	}
+	old := r.Get(pc.Key)
+	if old == nil {
+		r.Commits = append(r.Commits, pc)
+		return nil
+	}
+	*old = pc
+	return nil
+}
+
+// VerifyReveals checks that reveals holds exactly the values of keys and
+// that every value matches its commitment in the round.
+func (r *PrecommitRound) VerifyReveals(keys []string, reveals *KVDict) error {
+	if reveals == nil {
+		return xerrors.New("missing precommit reveals")
+	}
+	if len(keys) != len(reveals.Data) {
+		return xerrors.Errorf("precommit count mismatch: expected %d "+
+			"received %d", len(keys), len(reveals.Data))
+	}
+	for _, key := range keys {
+		value, ok := reveals.Data[key]
+		if !ok {
+			return xerrors.Errorf("missing precommit key: %s", key)
+		}
+		pc := r.Get(key)
+		if pc == nil {
+			return xerrors.Errorf("no commitment for key %s", key)
+		}
+		if !bytes.Equal(pc.Hash, PrecommitHash(key, value)) {
+			return xerrors.Errorf("revealed value of key %s does not match "+
+				"its commitment", key)
+		}
+	}
+	return nil
+}
+
+// GetPrecommits returns the precommit round of a contract, or nil if no
+// commitments have been submitted.
+func GetPrecommits(s *Storage) (*PrecommitRound, error) {
+	buf, ok := s.Get(KeyPrecommits)
+	if !ok {
+		return nil, nil
+	}
+	round := &PrecommitRound{}
+	err := protobuf.Decode(buf, round)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding precommit round: %v", err)
+	}
+	return round, nil
+}
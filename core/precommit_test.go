@@ -0,0 +1,55 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+)
+
+func Test_PrecommitRound(t *testing.T) {
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	alice := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+	bob := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
+
+	committers := []Precommitter{
+		{Key: "bid_alice", Public: cothority.Suite.Point().Mul(alice, nil)},
+		{Key: "bid_bob", Public: cothority.Suite.Point().Mul(bob, nil)}}
+
+	pc, err := NewPrecommit(cid, "bid_alice", []byte("10|salt"), 5, alice)
+	require.NoError(t, err)
+	require.NoError(t, pc.Verify())
+	round := &PrecommitRound{Deadline: 5}
+	require.NoError(t, round.Add(*pc, committers))
+
+	// Only alice can commit to her key, even before she does
+	other, err := NewPrecommit(cid, "bid_alice", []byte("1|salt"), 5, bob)
+	require.NoError(t, err)
+	require.Error(t, round.Add(*other, committers))
+	other, err = NewPrecommit(cid, "bid_bob", []byte("1|salt"), 5, alice)
+	require.NoError(t, err)
+	require.Error(t, round.Add(*other, committers))
+	require.Nil(t, round.Get("bid_bob"))
+	other, err = NewPrecommit(cid, "bid_carol", []byte("1|salt"), 5, alice)
+	require.NoError(t, err)
+	require.Error(t, round.Add(*other, committers))
+	pc, err = NewPrecommit(cid, "bid_alice", []byte("20|salt"), 5, alice)
+	require.NoError(t, err)
+	require.NoError(t, round.Add(*pc, committers))
+	// A commitment for another round is rejected
+	other, err = NewPrecommit(cid, "bid_bob", []byte("15|salt"), 6, bob)
+	require.NoError(t, err)
+	require.Error(t, round.Add(*other, committers))
+	// A tampered commitment does not verify
+	other.Deadline = 5
+	require.Error(t, other.Verify())
+
+	keys := []string{"bid_alice"}
+	reveals := &KVDict{Data: map[string][]byte{"bid_alice": []byte("20|salt")}}
+	require.NoError(t, round.VerifyReveals(keys, reveals))
+	reveals.Data["bid_alice"] = []byte("10|salt")
+	require.Error(t, round.VerifyReveals(keys, reveals))
+	require.Error(t, round.VerifyReveals([]string{"bid_bob"},
+		&KVDict{Data: map[string][]byte{"bid_bob": []byte("15|salt")}}))
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// Writeset operations. The value of an argument whose name starts with one
+// of these prefixes is combined with the stored value of the key that
+// follows the prefix instead of replacing it. The operations commute, so a
+// writeset that only consists of them can be applied to a newer contract
+// state than the one it was computed from (see RebaseLog).
+const (
+	// OpAppend appends the argument value to the ItemList that is stored
+	// under the key.
+	OpAppend = "append:"
+	// OpIncr adds the argument value (a little-endian int64) to the counter
+	// that is stored under the key.
+	OpIncr = "incr:"
+)
+
+const (
+	// RebaseLogKey is the key under which the state unit stores the
+	// RebaseLog of a contract.
+	RebaseLogKey = "rebase_log"
+	// RebaseWindow is the number of updates by which the contract state
+	// can be ahead of the state that a commutative writeset is computed
+	// from.
+	RebaseWindow = 64
+)
+
+// AppendArg returns a writeset argument that appends item to the ItemList
+// that is stored under key.
+func AppendArg(key string, item []byte) byzcoin.Argument {
+	return byzcoin.Argument{Name: OpAppend + key, Value: item}
+}
+
+// IncrArg returns a writeset argument that adds n to the counter that is
+// stored under key.
+func IncrArg(key string, n int64) byzcoin.Argument {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(n))
+	return byzcoin.Argument{Name: OpIncr + key, Value: buf}
+}
+
+// SplitOp splits the name of a writeset argument into the operation and
+// the key. The operation is empty if the argument overwrites the key.
+func SplitOp(name string) (string, string) {
+	for _, op := range []string{OpAppend, OpIncr} {
+		if strings.HasPrefix(name, op) {
+			return op, strings.TrimPrefix(name, op)
+		}
+	}
+	return "", name
+}
+
+// ApplyOp returns the new value of a key after applying the operation op
+// with the argument value arg to its stored value.
+func ApplyOp(op string, stored []byte, arg []byte) ([]byte, error) {
+	switch op {
+	case OpAppend:
+		list, err := DecodeItemList(stored)
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, arg)
+		return protobuf.Encode(list)
+	case OpIncr:
+		ctr, err := DecodeCounter(stored)
+		if err != nil {
+			return nil, err
+		}
+		n, err := DecodeCounter(arg)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(ctr+n))
+		return buf, nil
+	default:
+		return nil, xerrors.Errorf("unknown operation %s", op)
+	}
+}
+
+// DecodeItemList decodes the value of a key that is updated with OpAppend.
+// An empty value is an empty list.
+func DecodeItemList(buf []byte) (*ItemList, error) {
+	list := &ItemList{}
+	err := protobuf.Decode(buf, list)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding item list: %v", err)
+	}
+	return list, nil
+}
+
+// DecodeCounter decodes the value of a key that is updated with OpIncr.
+// An empty value is zero.
+func DecodeCounter(buf []byte) (int64, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if len(buf) != 8 {
+		return 0, xerrors.Errorf("invalid counter length %d", len(buf))
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// GetRebaseLog returns the rebase log of a contract. A contract that has
+// not been updated yet has an empty log.
+func GetRebaseLog(s *Storage) (*RebaseLog, error) {
+	rlog := &RebaseLog{}
+	buf, ok := s.Get(RebaseLogKey)
+	if !ok {
+		return rlog, nil
+	}
+	err := protobuf.Decode(buf, rlog)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding rebase log: %v", err)
+	}
+	return rlog, nil
+}
+
+// CheckRebase returns an error if the plan cannot be applied to the
+// contract because it is generated from a state that is more than
+// RebaseWindow updates old or because it has already been applied.
+func (l *RebaseLog) CheckRebase(plan *ExecutionPlan) error {
+	if plan.StateSeq > l.Seq || l.Seq-plan.StateSeq > RebaseWindow {
+		return xerrors.Errorf("plan is generated at update %d, which is "+
+			"outside the rebase window of update %d", plan.StateSeq, l.Seq)
+	}
+	for _, applied := range l.Applied {
+		if bytes.Equal(applied.PlanID, plan.PlanID) {
+			return xerrors.Errorf("plan %x has already been applied",
+				plan.PlanID)
+		}
+	}
+	return nil
+}
+
+// Record records that the plan is applied to the contract. Plans that can
+// no longer be rebased are removed from the log.
+func (l *RebaseLog) Record(plan *ExecutionPlan) {
+	l.Seq++
+	applied := l.Applied[:0]
+	for _, a := range l.Applied {
+		if l.Seq-a.StateSeq <= RebaseWindow {
+			applied = append(applied, a)
+		}
+	}
+	l.Applied = append(applied, AppliedPlan{PlanID: plan.PlanID,
+		StateSeq: plan.StateSeq})
+}
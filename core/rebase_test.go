@@ -0,0 +1,62 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ApplyOp(t *testing.T) {
+	op, key := SplitOp("append:tickets")
+	require.Equal(t, OpAppend, op)
+	require.Equal(t, "tickets", key)
+	op, key = SplitOp("header")
+	require.Empty(t, op)
+	require.Equal(t, "header", key)
+
+	// Appends commute up to the order of the items
+	var stored []byte
+	for _, item := range []string{"a", "b"} {
+		arg := AppendArg("tickets", []byte(item))
+		var err error
+		stored, err = ApplyOp(OpAppend, stored, arg.Value)
+		require.NoError(t, err)
+	}
+	list, err := DecodeItemList(stored)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("a"), []byte("b")}, list.Items)
+
+	stored = nil
+	for _, n := range []int64{5, -2} {
+		stored, err = ApplyOp(OpIncr, stored, IncrArg("count", n).Value)
+		require.NoError(t, err)
+	}
+	ctr, err := DecodeCounter(stored)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), ctr)
+}
+
+func Test_RebaseLog(t *testing.T) {
+	rlog := &RebaseLog{}
+	p1 := &ExecutionPlan{PlanID: []byte("plan1"), StateSeq: 0}
+	p2 := &ExecutionPlan{PlanID: []byte("plan2"), StateSeq: 0}
+	require.NoError(t, rlog.CheckRebase(p1))
+	rlog.Record(p1)
+	// p2 was generated before p1 was applied
+	require.NoError(t, rlog.CheckRebase(p2))
+	rlog.Record(p2)
+	require.Equal(t, uint64(2), rlog.Seq)
+	require.Error(t, rlog.CheckRebase(p1))
+	require.Error(t, rlog.CheckRebase(p2))
+	// Plans from the future or outside the window are rejected
+	require.Error(t, rlog.CheckRebase(&ExecutionPlan{PlanID: []byte("p"),
+		StateSeq: 3}))
+	for i := 0; i < RebaseWindow; i++ {
+		rlog.Record(&ExecutionPlan{PlanID: []byte{byte(i)},
+			StateSeq: rlog.Seq})
+	}
+	require.Error(t, rlog.CheckRebase(&ExecutionPlan{PlanID: []byte("p"),
+		StateSeq: 0}))
+	// Plans that are outside the window are pruned
+	require.Len(t, rlog.Applied, RebaseWindow)
+}
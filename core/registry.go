@@ -0,0 +1,63 @@
+package core
+
+import (
+	"strings"
+
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// DFUKeyPrefix is the prefix of the keys under which the registry contract
+// stores its DFUs. Every DFU has its own key, so a plan can cite the entry
+// of a single DFU with a key proof (see KeyInstanceID).
+const DFUKeyPrefix = "dfu:"
+
+// DFUKey returns the key of the registry contract that stores DFU id.
+func DFUKey(id string) string {
+	return DFUKeyPrefix + id
+}
+
+// GetDFURegistry returns the DFU registry that is stored in the storage of
+// the registry contract. Registries that were created before every DFU had
+// its own key are stored as a single value under KeyRegistry.
+func GetDFURegistry(s *Storage) (*DFURegistry, error) {
+	reg := &DFURegistry{}
+	if buf, ok := s.Get(KeyRegistry); ok {
+		err := protobuf.Decode(buf, reg)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding registry: %v", err)
+		}
+	}
+	if reg.Units == nil {
+		reg.Units = make(map[string]*DFU)
+	}
+	for _, kv := range s.Store {
+		if !strings.HasPrefix(kv.Key, DFUKeyPrefix) {
+			continue
+		}
+		dfu := &DFU{}
+		err := protobuf.Decode(kv.Value, dfu)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding %s: %v", kv.Key, err)
+		}
+		reg.Units[strings.TrimPrefix(kv.Key, DFUKeyPrefix)] = dfu
+	}
+	if len(reg.Units) == 0 {
+		return nil, xerrors.New("storage does not hold a DFU registry")
+	}
+	return reg, nil
+}
+
+// GetDFU returns DFU id of the registry that is stored in s.
+func GetDFU(s *Storage, id string) (*DFU, error) {
+	buf, ok := s.Get(DFUKey(id))
+	if !ok {
+		return nil, xerrors.Errorf("unknown DFU: %s", id)
+	}
+	dfu := &DFU{}
+	err := protobuf.Decode(buf, dfu)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding DFU %s: %v", id, err)
+	}
+	return dfu, nil
+}
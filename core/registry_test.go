@@ -0,0 +1,34 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/protobuf"
+)
+
+func Test_GetDFURegistry(t *testing.T) {
+	s := &Storage{}
+	_, err := GetDFURegistry(s)
+	require.Error(t, err)
+
+	legacy, err := protobuf.Encode(&DFURegistry{Units: map[string]*DFU{
+		SUID: {NumNodes: 4, Threshold: 3}}})
+	require.NoError(t, err)
+	s.Set(KeyRegistry, legacy)
+	ceu, err := protobuf.Encode(&DFU{NumNodes: 7, Threshold: 5})
+	require.NoError(t, err)
+	s.Set(DFUKey(CEUID), ceu)
+
+	reg, err := GetDFURegistry(s)
+	require.NoError(t, err)
+	require.Len(t, reg.Units, 2)
+	require.Equal(t, 3, reg.Units[SUID].Threshold)
+	require.Equal(t, 5, reg.Units[CEUID].Threshold)
+
+	dfu, err := GetDFU(s, CEUID)
+	require.NoError(t, err)
+	require.Equal(t, 7, dfu.NumNodes)
+	_, err = GetDFU(s, SUID)
+	require.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// DefaultPlanTTL is the validity period of an execution plan that is
+	// requested by libexec.Client.
+	DefaultPlanTTL = 5 * time.Minute
+	// MaxPlanTTL is the longest validity period that the CEU accepts for an
+	// execution plan. It bounds the time that an entry has to be kept in a
+	// ReplayCache.
+	MaxPlanTTL = 30 * time.Minute
+	// DefaultReplayCacheSize is the number of (plan, opcode) pairs that a
+	// DFU remembers.
+	DefaultReplayCacheSize = 100000
+)
+
+// GeneratePlanID returns the ID of an execution plan. It is derived from
+// the contract state that the plan is generated for and a nonce that is
+// chosen by the client, so that all CEU nodes compute the same ID.
+func GeneratePlanID(cid []byte, root []byte, wfName string, txnName string,
+	nonce []byte) []byte {
+	hr := NewHasher(DomainPlanID)
+	hr.WriteBytes(cid)
+	hr.WriteBytes(root)
+	hr.WriteString(wfName)
+	hr.WriteString(txnName)
+	hr.WriteBytes(nonce)
+	return hr.Sum()
+}
+
+// CheckExpiry returns an error if the plan has expired at time now.
+func (p *ExecutionPlan) CheckExpiry(now time.Time) error {
+	if len(p.PlanID) == 0 {
+		return xerrors.New("execution plan does not have an ID")
+	}
+	if now.Unix() >= p.Expiry {
+		return xerrors.Errorf("execution plan expired at %s",
+			time.Unix(p.Expiry, 0))
+	}
+	return nil
+}
+
+// ReplayCache records the (plan, opcode index) pairs that a DFU has
+// executed so that it serves each opcode of a plan at most once. An entry
+// is kept until its plan expires, after which the plan is refused anyway.
+// If the cache is full of unexpired entries, new requests are refused
+// rather than evicting an entry that could then be replayed.
+type ReplayCache struct {
+	sync.Mutex
+	capacity int
+	entries  map[string]int64
+}
+
+// NewReplayCache returns a cache that holds at most capacity entries.
+func NewReplayCache(capacity int) *ReplayCache {
+	return &ReplayCache{
+		capacity: capacity,
+		entries:  make(map[string]int64),
+	}
+}
+
+// Add records that opcode idx of plan is executed at time now. It returns
+// an error if the pair has already been recorded.
+func (c *ReplayCache) Add(plan *ExecutionPlan, idx int, now time.Time) error {
+	key := hex.EncodeToString(plan.PlanID) + ":" + strconv.Itoa(idx)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return xerrors.Errorf("opcode %d of plan %x has already been "+
+			"executed", idx, plan.PlanID)
+	}
+	if len(c.entries) >= c.capacity {
+		c.prune(now)
+		if len(c.entries) >= c.capacity {
+			return xerrors.New("replay cache is full")
+		}
+	}
+	c.entries[key] = plan.Expiry
+	return nil
+}
+
+func (c *ReplayCache) prune(now time.Time) {
+	for key, expiry := range c.entries {
+		if now.Unix() >= expiry {
+			delete(c.entries, key)
+		}
+	}
+}
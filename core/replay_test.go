@@ -0,0 +1,27 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReplayCache(t *testing.T) {
+	now := time.Now()
+	plan := &ExecutionPlan{PlanID: []byte("plan1"),
+		Expiry: now.Add(time.Minute).Unix()}
+	require.NoError(t, plan.CheckExpiry(now))
+	require.Error(t, plan.CheckExpiry(now.Add(2*time.Minute)))
+
+	cache := NewReplayCache(2)
+	require.NoError(t, cache.Add(plan, 0, now))
+	require.Error(t, cache.Add(plan, 0, now))
+	require.NoError(t, cache.Add(plan, 1, now))
+	// The cache is full and none of its entries have expired
+	other := &ExecutionPlan{PlanID: []byte("plan2"),
+		Expiry: now.Add(time.Hour).Unix()}
+	require.Error(t, cache.Add(other, 0, now))
+	// The entries of the first plan are pruned once it expires
+	require.NoError(t, cache.Add(other, 0, now.Add(2*time.Minute)))
+}
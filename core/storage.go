@@ -0,0 +1,189 @@
+package core
+
+import (
+	"strings"
+
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// Keys that are maintained by Protean. Application writesets cannot write
+// reserved keys, except for the header, whose changes are checked against
+// the FSM of the contract.
+const (
+	// KeyRaw stores the protobuf-encoded ContractRaw.
+	KeyRaw = "raw"
+	// KeyHeader stores the protobuf-encoded ContractHeader.
+	KeyHeader = "header"
+	// KeyUpgrades stores the protobuf-encoded UpgradeHistory.
+	KeyUpgrades = "upgrades"
+	// KeyRequest is the name of the argument that carries the execution
+	// request of an update. It is never stored in a current storage.
+	KeyRequest = "request"
+	// KeyRegistry stores the protobuf-encoded DFURegistry in the storage of
+	// the registry contract.
+	KeyRegistry = "registry"
+	// KeyPending stores the PendingUpdate of a contract that is prepared for
+	// a plan (see PrepareProof).
+	KeyPending = "pending"
+	// KeyDecision stores the Decision of the coordinator of the last plan
+	// that spanned several state units.
+	KeyDecision = "decision"
+	// KeyPrecommits stores the PrecommitRound of a contract.
+	KeyPrecommits = "precommits"
+	// KeyTxnLog stores the TxnLogHead of a contract. Its records are stored
+	// under the keys of TxnRecordKey, which are also reserved.
+	KeyTxnLog = "txn_log"
+	// KeyIndex stores the StorageIndex of a contract: the sorted names of
+	// its keys that have their own instance (see KeyInstanceID). It lets
+	// the contract find its keys without reading the whole trie.
+	KeyIndex = "key_index"
+)
+
+// Storage schema versions.
+const (
+	// StorageVersionLegacy is the layout in which raw and header are the
+	// first two entries of the store and the execution request of the last
+	// update is stored under KeyRequest.
+	StorageVersionLegacy = 0
+	// StorageVersionNamed is the layout in which the keys are looked up by
+	// name and the execution request is not stored.
+	StorageVersionNamed = 1
+	// StorageVersionKeys is the layout in which the instance of the
+	// contract only stores the main keys (see IsMainKey) and every other
+	// key is stored in its own instance (see KeyInstanceID).
+	StorageVersionKeys = 2
+	// CurrentStorageVersion is the version of newly created storages.
+	CurrentStorageVersion = StorageVersionKeys
+)
+
+var reservedKeys = map[string]bool{
+	KeyRaw:        true,
+	KeyHeader:     true,
+	KeyUpgrades:   true,
+	KeyRequest:    true,
+	RebaseLogKey:  true,
+	KeyPending:    true,
+	KeyDecision:   true,
+	KeyPrecommits: true,
+	KeyTxnLog:     true,
+	KeyIndex:      true,
+	KeyRegistry:   true,
+}
+
+// IsReserved returns true if key is maintained by Protean. The keys of the
+// DFUs of the registry contract (see DFUKey) are reserved too.
+func IsReserved(key string) bool {
+	return reservedKeys[key] || IsTxnRecordKey(key) ||
+		strings.HasPrefix(key, DFUKeyPrefix)
+}
+
+// Get returns the value that is stored under key.
+func (s *Storage) Get(key string) ([]byte, bool) {
+	for _, kv := range s.Store {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set stores value under key. An existing key keeps its position in the
+// store, and a new key is appended.
+func (s *Storage) Set(key string, value []byte) {
+	for i, kv := range s.Store {
+		if kv.Key == key {
+			s.Store[i].Value = value
+			return
+		}
+	}
+	s.Store = append(s.Store, KV{Key: key, Value: value})
+}
+
+// Delete removes key from the store.
+func (s *Storage) Delete(key string) {
+	for i, kv := range s.Store {
+		if kv.Key == key {
+			s.Store = append(s.Store[:i], s.Store[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetRaw returns the raw contract data.
+func (s *Storage) GetRaw() (*ContractRaw, error) {
+	buf, ok := s.Get(KeyRaw)
+	if !ok {
+		return nil, xerrors.Errorf("missing key %s", KeyRaw)
+	}
+	raw := &ContractRaw{}
+	err := protobuf.Decode(buf, raw)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding raw contract: %v", err)
+	}
+	return raw, nil
+}
+
+// GetHeader returns the contract header.
+func (s *Storage) GetHeader() (*ContractHeader, error) {
+	buf, ok := s.Get(KeyHeader)
+	if !ok {
+		return nil, xerrors.Errorf("missing key %s", KeyHeader)
+	}
+	hdr := &ContractHeader{}
+	err := protobuf.Decode(buf, hdr)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding contract header: %v", err)
+	}
+	return hdr, nil
+}
+
+// VerifyTerminal checks that no txn of the contract can be executed in its
+// current state, which is required to delete the contract.
+func (s *Storage) VerifyTerminal() error {
+	raw, err := s.GetRaw()
+	if err != nil {
+		return err
+	}
+	hdr, err := s.GetHeader()
+	if err != nil {
+		return err
+	}
+	if !raw.FSM.IsTerminal(hdr.CurrState) {
+		return xerrors.Errorf("state %s is not a terminal state",
+			hdr.CurrState)
+	}
+	return nil
+}
+
+// Migrate converts the storage to CurrentStorageVersion. It returns an
+// error if the storage is newer than this version. The keys are moved to
+// their own instances when the storage is written (see KeyInstanceID).
+// A legacy storage only has the raw contract, the header and the request
+// as system keys, so it cannot be migrated if one of its application keys
+// has the name of a key that is reserved now.
+func (s *Storage) Migrate() error {
+	if s.Version > CurrentStorageVersion {
+		return xerrors.Errorf("unknown storage version %d", s.Version)
+	}
+	if s.Version == StorageVersionLegacy {
+		if _, err := s.GetRaw(); err != nil {
+			return err
+		}
+		if _, err := s.GetHeader(); err != nil {
+			return err
+		}
+		for _, kv := range s.Store {
+			switch kv.Key {
+			case KeyRaw, KeyHeader, KeyRequest:
+				continue
+			}
+			if IsReserved(kv.Key) {
+				return xerrors.Errorf("key %s is reserved", kv.Key)
+			}
+		}
+		s.Delete(KeyRequest)
+	}
+	s.Version = CurrentStorageVersion
+	return nil
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/protobuf"
+)
+
+func Test_Storage(t *testing.T) {
+	s := &Storage{}
+	s.Set("a", []byte("1"))
+	s.Set("b", []byte("2"))
+	s.Set("a", []byte("3"))
+	v, ok := s.Get("a")
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), v)
+	require.Equal(t, "a", s.Store[0].Key)
+
+	s.Delete("a")
+	_, ok = s.Get("a")
+	require.False(t, ok)
+	v, ok = s.Get("b")
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), v)
+
+	require.True(t, IsReserved(KeyHeader))
+	require.True(t, IsReserved(RebaseLogKey))
+	require.True(t, IsReserved(TxnRecordKey(3)))
+	require.True(t, IsReserved(KeyRegistry))
+	require.True(t, IsReserved(DFUKey(CEUID)))
+	require.False(t, IsReserved("tickets"))
+}
+
+func Test_Migrate(t *testing.T) {
+	rawBuf, err := protobuf.Encode(&ContractRaw{})
+	require.NoError(t, err)
+	hdrBuf, err := protobuf.Encode(&ContractHeader{CurrState: "open"})
+	require.NoError(t, err)
+
+	// Legacy storage without a header
+	s := &Storage{Store: []KV{{Key: KeyRaw, Value: rawBuf}}}
+	require.Error(t, s.Migrate())
+
+	// Legacy storage with a stored request and the header after other keys
+	s = &Storage{Store: []KV{{Key: KeyRaw, Value: rawBuf},
+		{Key: "tickets", Value: []byte("t")},
+		{Key: KeyHeader, Value: hdrBuf},
+		{Key: KeyRequest, Value: []byte("r")}}}
+	require.NoError(t, s.Migrate())
+	require.Equal(t, CurrentStorageVersion, s.Version)
+	_, ok := s.Get(KeyRequest)
+	require.False(t, ok)
+	hdr, err := s.GetHeader()
+	require.NoError(t, err)
+	require.Equal(t, "open", hdr.CurrState)
+
+	s.Version = CurrentStorageVersion + 1
+	require.Error(t, s.Migrate())
+
+	// Legacy application keys that are now reserved are not taken for
+	// system keys
+	for _, key := range []string{KeyPending, KeyDecision, KeyIndex,
+		TxnRecordKey(1), KeyRegistry, DFUKey("app")} {
+		s = &Storage{Store: []KV{{Key: KeyRaw, Value: rawBuf},
+			{Key: KeyHeader, Value: hdrBuf},
+			{Key: key, Value: []byte("app")}}}
+		require.Error(t, s.Migrate())
+	}
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/byzcoin/trie"
 	"go.dedis.ch/cothority/v3/skipchain"
 	"go.dedis.ch/kyber/v3"
 )
@@ -24,6 +25,10 @@ const (
 type Contract struct {
 	Workflows map[string]*Workflow `json:"workflows"`
 	DFUs      []string             `json:"dfus"`
+	// CommutativeKeys are the keys that are only updated with commutative
+	// operations (see OpAppend), so writesets that update them can be
+	// applied to a newer contract state.
+	CommutativeKeys []string `json:"commutative_keys,omitempty"`
 }
 
 type Workflow struct {
@@ -41,25 +46,27 @@ type Opcode struct {
 }
 
 type DataDependency struct {
-	Src     string      `json:"src"`
-	SrcName string      `json:"src_name,omitempty"`
-	Idx     int         `json:"idx,omitempty"`
-	Value   interface{} `json:"value,omitempty"`
-	// This is a terrible hack but the only quick way I could think of to
-	//make it work with protobuf.
-	//DataDependency is serialized as part of sending the contract
-	//data to the state unit. However,
-	//protobuf does not like the interface{} type. Therefore,
-	//after reading in the JSON files,
-	//we check the type of Value; assign its value to one of the following
-	//variables; and set Value to nil.
-	StringValue string
-	UintValue   uint64
+	Src     string `json:"src"`
+	SrcName string `json:"src_name,omitempty"`
+	Idx     int    `json:"idx,omitempty"`
+	Value   *Value `json:"value,omitempty"`
+	// CID is the hex-encoded instance ID of the contract that a KEYVALUE
+	// dependency reads. If it is empty, the dependency reads the contract
+	// that is updated by the txn.
+	CID string `json:"cid,omitempty"`
+	// UnitID is the DFU ID of the state unit that stores CID. If it is
+	// empty, CID is stored by the state unit that hosts the contract of the
+	// txn (see StateUnit).
+	UnitID string `json:"unit_id,omitempty"`
 }
 
 // Execution data
 
 type ExecutionPlan struct {
+	// Version is the hash version of the plan and its receipts
+	Version int
+	// PlanID uniquely identifies the plan (see GeneratePlanID)
+	PlanID    []byte
 	CID       []byte
 	StateRoot []byte
 	CodeHash  []byte
@@ -67,9 +74,48 @@ type ExecutionPlan struct {
 	TxnName   string
 	Txn       *Transaction
 	DFUData   map[string]*DFUIdentity
-	Sig       bdnproto.BdnSignature
+	// Expiry is the Unix time (in seconds) at which DFUs stop accepting
+	// the plan
+	Expiry int64
+	// LockBlocks is the number of blocks for which the plan locks CID (see
+	// ContractHeader.SetLock). The lock is taken by InitTransaction and is
+	// held by the plan, not by the client: only the writeset of this plan
+	// can update the contract while it is locked.
+	LockBlocks int
+	// StateSeq is the number of updates that had been applied to the
+	// contract when the plan was generated (see RebaseLog)
+	StateSeq uint64
+	// ExtRoots holds the state roots of the contracts that are read by
+	// KEYVALUE dependencies with a CID, keyed by
+	// DataDependency.ContractKey
+	ExtRoots map[string][]byte
+	// Contracts are the contracts other than CID that are updated by the
+	// plan. The state unit applies the writesets of CID and Contracts in
+	// one byzcoin transaction, unless they are hosted by several state units
+	// (see IsCrossUnit).
+	Contracts []ContractRoot
+	// UnitID is the DFU ID of the state unit that hosts CID. If it is
+	// empty, CID is hosted by SUID.
+	UnitID string
+	Sig    bdnproto.BdnSignature
+}
+
+// ContractRoot binds the state of a contract that is updated by a plan
+// together with the contract of the plan.
+type ContractRoot struct {
+	CID       []byte
+	StateRoot []byte
+	CodeHash  []byte
+	UnitID    string
 }
 
+// ExecutionRequest is sent to a DFU to execute the opcode at Index. Opcodes
+// that do not depend on each other can be executed concurrently, each with
+// its own ExecutionRequest for the same plan. OpReceipts holds the receipts
+// of the opcode outputs that are used by the opcode. Receipts are stored
+// under ReceiptKey(OpIdx, Name) (see AddReceipts) so that outputs with the
+// same name from different opcodes do not collide. For backwards
+// compatibility, a receipt can also be stored under its output name.
 type ExecutionRequest struct {
 	Index      int
 	EP         *ExecutionPlan
@@ -77,8 +123,10 @@ type ExecutionRequest struct {
 }
 
 type OpcodeReceipt struct {
-	EPID  []byte // Hash of the execution plan
-	OpIdx int
+	// Version is the hash version of the execution plan
+	Version int
+	EPID    []byte // Hash of the execution plan
+	OpIdx   int
 	//OpName string
 	// Name of the output variable
 	Name string
@@ -90,6 +138,9 @@ type OpcodeReceipt struct {
 type DFUIdentity struct {
 	Threshold int
 	Keys      []kyber.Point
+	// SkipchainID is the ID of the ledger of a state unit (see
+	// StateProof.VerifyUnit)
+	SkipchainID skipchain.SkipBlockID
 }
 
 // FSM
@@ -100,9 +151,41 @@ type FSM struct {
 	Transitions  map[string]*Transition `json:"transitions"`
 }
 
+// Transition describes the state change caused by a txn. From and To
+// describe the default transition, which is only taken if all its guards
+// evaluate to true. Branches are alternative transitions with a list of
+// allowed source states. They are tried in order after the default
+// transition.
 type Transition struct {
-	From string `json:"from"`
-	To   string `json:"to"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Guards   []*Guard  `json:"guards,omitempty"`
+	Branches []*Branch `json:"branches,omitempty"`
+}
+
+type Branch struct {
+	From   []string `json:"from"`
+	To     string   `json:"to"`
+	Guards []*Guard `json:"guards,omitempty"`
+}
+
+// Guard is a predicate over the key/value store of a contract. If Field is
+// empty, the guard checks whether the key exists (Op is GuardExists or
+// GuardMissing). Otherwise, Field selects the property of the stored value
+// that is compared against Value using Op:
+//   - "len": number of elements in the repeated field of the stored message
+//     at FieldPath
+//   - "size": length of the stored value in bytes
+//   - "curr_state", "lock": fields of the contract header (Key == "header")
+type Guard struct {
+	Key   string `json:"key"`
+	Field string `json:"field,omitempty"`
+	// FieldPath holds the protobuf field numbers that lead from the stored
+	// message to the repeated field that "len" counts: all but the last
+	// number select embedded messages. It defaults to [1].
+	FieldPath []int  `json:"field_path,omitempty"`
+	Op        string `json:"op"`
+	Value     string `json:"value,omitempty"`
 }
 
 // DFU
@@ -116,6 +199,9 @@ type DFU struct {
 	Threshold int           `json:"threshold"`
 	Opcodes   []string      `json:"opcodes"`
 	Keys      []kyber.Point `json:",omitempty"`
+	// SkipchainID pins the ledger of a state unit, so that its proofs
+	// cannot come from another ledger that lists the same keys
+	SkipchainID skipchain.SkipBlockID `json:",omitempty"`
 }
 
 // State
@@ -131,11 +217,113 @@ type ContractHeader struct {
 	CodeHash  []byte
 	Lock      bool
 	CurrState string
+	// LockID is the PlanID of the execution plan that holds the lock (see
+	// SetLock) and LockExpiry is the block index at which the lock expires.
+	LockID     []byte
+	LockExpiry int
+	// Admins can upgrade the contract if AdminThreshold of them sign the
+	// upgrade. A contract without admins cannot be upgraded.
+	Admins         []kyber.Point
+	AdminThreshold int
+	// UnitID is the DFU ID of the state unit that hosts the contract. If it
+	// is empty, the contract is hosted by SUID.
+	UnitID string
+	// PrecommitDeadline is the block index at which the current precommit
+	// round closes (see PrecommitRound). Writesets open a new round by
+	// changing it.
+	PrecommitDeadline int
+	// Precommitters bind every PRECOMMIT input to the public key of the
+	// client that can commit to it. Writesets can change them for a new
+	// round.
+	Precommitters []Precommitter
+}
+
+// Upgrade replaces the code hash of a contract and, optionally, its
+// contract and FSM. CID, Seq and OldCodeHash must match the current state
+// of the contract, so that the signatures cannot be replayed.
+type Upgrade struct {
+	CID         byzcoin.InstanceID
+	Seq         int
+	OldCodeHash []byte
+	CodeHash    []byte
+	Contract    *Contract
+	FSM         *FSM
+	Sigs        []AdminSignature
+}
+
+// Deletion authorizes the deletion of a contract that is in a terminal
+// state. Like an upgrade, it must be signed by AdminThreshold admins of the
+// contract.
+type Deletion struct {
+	CID  byzcoin.InstanceID
+	Sigs []AdminSignature
+}
+
+// AdminSignature is the Schnorr signature of the admin at Index in
+// ContractHeader.Admins.
+type AdminSignature struct {
+	Index int
+	Sig   []byte
+}
+
+// UpgradeRecord is an entry of the upgrade history of a contract.
+type UpgradeRecord struct {
+	Seq             int
+	OldCodeHash     []byte
+	NewCodeHash     []byte
+	ContractChanged bool
+	FSMChanged      bool
+	Signers         []int
+}
+
+// UpgradeHistory is stored under the "upgrades" key of a contract.
+type UpgradeHistory struct {
+	Records []UpgradeRecord
+}
+
+// ItemList is the value of a key that is updated with OpAppend.
+type ItemList struct {
+	Items [][]byte
+}
+
+// RebaseLog is kept by the state unit for every contract. It counts the
+// updates of the contract and remembers the plans that could still be
+// rebased, so that a plan that is applied to a newer state than the one it
+// was generated from cannot be applied twice.
+type RebaseLog struct {
+	Seq     uint64
+	Applied []AppliedPlan
+}
+
+type AppliedPlan struct {
+	PlanID   []byte
+	StateSeq uint64
+}
+
+// ContractSnapshot is the final state of an archived contract. Proof shows
+// that Storage was the state of the contract in a block that is signed by
+// the state unit, so the results of the contract can be verified after the
+// contract is deleted.
+type ContractSnapshot struct {
+	CID     byzcoin.InstanceID
+	Storage Storage
+	Proof   StateProof
 }
 
 type StateProof struct {
 	Proof   *byzcoin.Proof
 	Genesis *skipchain.SkipBlock
+	// KeyProofs prove the values of individual keys of the contract (see
+	// KeyInstanceID). They have the same root as Proof, which anchors them
+	// in a block; the inclusion proof of Proof is then the proof of the
+	// first key. One of them must prove a main key (see IsMainKey), which
+	// shows the storage version of the contract.
+	KeyProofs []KeyProof
+}
+
+type KeyProof struct {
+	Key   string
+	Proof trie.Proof
 }
 
 type KV struct {
@@ -143,12 +331,14 @@ type KV struct {
 	Value []byte
 }
 
-// Storage holds the contract state. Store[0] stores the raw contract data,
-// and Store[1] stores the contract header. (i.e. Store[0].Key == "raw",
-// Store[1].Key == "header"). The stored value is a protobuf-encoded
-// core.ContractRaw and core.ContractHeader struct.
+// Storage holds the contract state. The raw contract data and the contract
+// header are stored under KeyRaw and KeyHeader as a protobuf-encoded
+// core.ContractRaw and core.ContractHeader struct. Keys must be looked up by
+// name (see Get), since their positions can change. Version is the schema
+// version of the storage (see Migrate).
 type Storage struct {
-	Store []KV
+	Store   []KV
+	Version int
 }
 
 type KVDict struct {
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"bytes"
+	"sort"
+
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// A plan whose contracts are hosted by several state units is applied with
+// a two-phase commit. Every unit first prepares the plan: it verifies the
+// writesets of the contracts that it hosts, stores them under KeyPending
+// and locks the contracts with the plan ID for PrepareBlocks blocks.
+//
+// The unit that hosts the contract of the plan is the coordinator. It
+// decides the outcome of the plan once and records it under KeyDecision in
+// the storage of that contract. It commits the plan if the state proofs of
+// the prepared contracts (PrepareProof) show that all other units have
+// prepared it before its own lock expires. It aborts the plan once its lock
+// has expired, or earlier if a proof shows that a unit can no longer
+// prepare it (see PrepareProof.VerifyFailed). The other units never decide
+// on their own: they commit or abort the plan only with a proof of the
+// decision of the coordinator (see ExecutionPlan.VerifyDecision), so a
+// prepared contract stays pending until the decision is known.
+
+// PrepareBlocks is the number of blocks for which a prepared contract is
+// locked.
+const PrepareBlocks = 20
+
+// PendingUpdate is the writeset of a contract that is prepared for a plan.
+type PendingUpdate struct {
+	Plan *ExecutionPlan
+	Args byzcoin.Arguments
+	// OpIdx and Receipts are the index of the update_state opcode and the
+	// receipts of its inputs, which are recorded in the txn log on commit
+	OpIdx    int
+	Receipts map[string]*OpcodeReceipt
+}
+
+// PrepareProof proves that the contract CID, which is hosted by the state
+// unit UnitID, is prepared for a plan.
+type PrepareProof struct {
+	UnitID string
+	CID    []byte
+	Proof  StateProof
+}
+
+// Decision is the outcome of a plan that spans several state units, as
+// decided by its coordinator.
+type Decision struct {
+	PlanID []byte
+	Commit bool
+}
+
+// PrepareEvidence is the argument of the commit and abort commands. On the
+// coordinator, the commit command needs the prepare proofs of the contracts
+// on the other state units and the abort command can carry a proof that
+// one of them failed to prepare before the lock of the coordinator expires.
+// On the other units, both commands need the proof of the decision of the
+// coordinator.
+type PrepareEvidence struct {
+	Proofs   []PrepareProof
+	Failed   *PrepareProof
+	Decision *StateProof
+}
+
+// StateUnit returns the DFU ID of the state unit that hosts the contract.
+func (h *ContractHeader) StateUnit() string {
+	if h.UnitID == "" {
+		return SUID
+	}
+	return h.UnitID
+}
+
+// StateUnit returns the DFU ID of the state unit that hosts the contract.
+func (c *ContractRoot) StateUnit() string {
+	if c.UnitID == "" {
+		return SUID
+	}
+	return c.UnitID
+}
+
+// StateUnit returns the DFU ID of the state unit that hosts the contract of
+// the plan.
+func (p *ExecutionPlan) StateUnit() string {
+	if p.UnitID == "" {
+		return SUID
+	}
+	return p.UnitID
+}
+
+// Coordinator returns the DFU ID of the state unit that decides the outcome
+// of the plan if it spans several state units.
+func (p *ExecutionPlan) Coordinator() string {
+	return p.StateUnit()
+}
+
+// IsCrossUnit returns true if the contracts of the plan are hosted by more
+// than one state unit.
+func (p *ExecutionPlan) IsCrossUnit() bool {
+	for _, c := range p.Contracts {
+		if c.StateUnit() != p.StateUnit() {
+			return true
+		}
+	}
+	return false
+}
+
+// StateUnits returns the sorted IDs of the state units that host the
+// contracts of the plan.
+func (p *ExecutionPlan) StateUnits() []string {
+	units := []string{p.StateUnit()}
+	seen := map[string]bool{p.StateUnit(): true}
+	for _, c := range p.Contracts {
+		if !seen[c.StateUnit()] {
+			seen[c.StateUnit()] = true
+			units = append(units, c.StateUnit())
+		}
+	}
+	sort.Strings(units)
+	return units
+}
+
+// HostedContracts returns the contracts of the plan that are hosted by the
+// state unit. The contract of the plan comes first.
+func (p *ExecutionPlan) HostedContracts(unit string) []ContractRoot {
+	var hosted []ContractRoot
+	if p.StateUnit() == unit {
+		hosted = append(hosted, ContractRoot{CID: p.CID,
+			StateRoot: p.StateRoot, CodeHash: p.CodeHash, UnitID: p.UnitID})
+	}
+	for _, c := range p.Contracts {
+		if c.StateUnit() == unit {
+			hosted = append(hosted, c)
+		}
+	}
+	return hosted
+}
+
+// GetPending returns the pending update of a contract, or nil if the
+// contract is not prepared.
+func GetPending(s *Storage) (*PendingUpdate, error) {
+	buf, ok := s.Get(KeyPending)
+	if !ok {
+		return nil, nil
+	}
+	pending := &PendingUpdate{}
+	err := protobuf.Decode(buf, pending)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding pending update: %v", err)
+	}
+	return pending, nil
+}
+
+// GetDecision returns the decision that is recorded in the storage of a
+// contract, or nil if there is none.
+func GetDecision(s *Storage) (*Decision, error) {
+	buf, ok := s.Get(KeyDecision)
+	if !ok {
+		return nil, nil
+	}
+	d := &Decision{}
+	err := protobuf.Decode(buf, d)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding decision: %v", err)
+	}
+	return d, nil
+}
+
+// Verify checks that the proof is signed by the state unit, as given by the
+// DFU data of the plan, and that the contract is prepared for the plan.
+func (pp *PrepareProof) Verify(plan *ExecutionPlan) error {
+	pending, err := pp.pending(plan)
+	if err != nil {
+		return err
+	}
+	if pending == nil || !bytes.Equal(pending.Plan.PlanID, plan.PlanID) {
+		return xerrors.Errorf("contract %x is not prepared for the plan",
+			pp.CID)
+	}
+	return nil
+}
+
+// VerifyFailed checks that the proof shows that a contract of the plan on
+// another unit than the coordinator can no longer be prepared for it: the
+// contract is not prepared for the plan and the ledger of its unit has left
+// the state of the plan, to which it cannot return. A proof from a block
+// before the plan was generated passes as well, but it can only make the
+// coordinator abort a plan, which keeps the units consistent.
+func (pp *PrepareProof) VerifyFailed(plan *ExecutionPlan) error {
+	if pp.UnitID == plan.Coordinator() {
+		return xerrors.New("the coordinator cannot fail to prepare the plan")
+	}
+	var root *ContractRoot
+	for _, c := range plan.HostedContracts(pp.UnitID) {
+		if bytes.Equal(c.CID, pp.CID) {
+			root = &c
+			break
+		}
+	}
+	if root == nil {
+		return xerrors.Errorf("contract %x is not hosted by unit %s",
+			pp.CID, pp.UnitID)
+	}
+	pending, err := pp.pending(plan)
+	if err != nil {
+		return err
+	}
+	if pending != nil && bytes.Equal(pending.Plan.PlanID, plan.PlanID) {
+		return xerrors.Errorf("contract %x is prepared for the plan", pp.CID)
+	}
+	if bytes.Equal(pp.Proof.Proof.InclusionProof.GetRoot(), root.StateRoot) {
+		return xerrors.Errorf("contract %x can still be prepared", pp.CID)
+	}
+	return nil
+}
+
+// pending verifies the proof against the ledger of the state unit and
+// returns the pending update of the contract.
+func (pp *PrepareProof) pending(plan *ExecutionPlan) (*PendingUpdate,
+	error) {
+	unit, ok := plan.DFUData[pp.UnitID]
+	if !ok {
+		return nil, xerrors.Errorf("cannot find dfu info for %s", pp.UnitID)
+	}
+	if pp.Proof.Proof == nil || pp.Proof.Genesis == nil {
+		return nil, xerrors.New("missing prepare proof")
+	}
+	err := pp.Proof.VerifyUnit(unit)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying prepare proof: %v", err)
+	}
+	err = pp.Proof.CoversKeys(pp.CID, []string{KeyPending})
+	if err != nil {
+		return nil, err
+	}
+	store, err := pp.Proof.Storage(pp.CID)
+	if err != nil {
+		return nil, err
+	}
+	return GetPending(store)
+}
+
+// VerifyDecision checks that proof shows that the coordinator of the plan
+// has decided to commit the plan if commit is true, or to abort it
+// otherwise. A decision is final, so the proof can be from any block after
+// it.
+func (p *ExecutionPlan) VerifyDecision(proof *StateProof, commit bool) error {
+	if proof == nil || proof.Proof == nil || proof.Genesis == nil {
+		return xerrors.New("missing decision of the coordinator")
+	}
+	unit, ok := p.DFUData[p.Coordinator()]
+	if !ok {
+		return xerrors.Errorf("cannot find dfu info for %s", p.Coordinator())
+	}
+	err := proof.VerifyUnit(unit)
+	if err != nil {
+		return xerrors.Errorf("verifying decision proof: %v", err)
+	}
+	err = proof.CoversKeys(p.CID, []string{KeyDecision})
+	if err != nil {
+		return err
+	}
+	store, err := proof.Storage(p.CID)
+	if err != nil {
+		return err
+	}
+	d, err := GetDecision(store)
+	if err != nil {
+		return err
+	}
+	if d == nil || !bytes.Equal(d.PlanID, p.PlanID) {
+		return xerrors.New("coordinator has not decided on the plan")
+	}
+	if d.Commit != commit {
+		return xerrors.Errorf("coordinator decided commit=%v", d.Commit)
+	}
+	return nil
+}
+
+// VerifyPrepared checks that proofs show that every contract of the plan
+// that is not hosted by unit is prepared for the plan.
+func (p *ExecutionPlan) VerifyPrepared(unit string,
+	proofs []PrepareProof) error {
+	for _, other := range p.StateUnits() {
+		if other == unit {
+			continue
+		}
+		for _, c := range p.HostedContracts(other) {
+			var found bool
+			for i := range proofs {
+				if proofs[i].UnitID == other &&
+					bytes.Equal(proofs[i].CID, c.CID) {
+					err := proofs[i].Verify(p)
+					if err != nil {
+						return err
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return xerrors.Errorf("missing prepare proof for contract "+
+					"%x on unit %s", c.CID, other)
+			}
+		}
+	}
+	return nil
+}
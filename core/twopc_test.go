@@ -0,0 +1,56 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HostedContracts(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	cid2 := bytes.Repeat([]byte{2}, 32)
+	cid3 := bytes.Repeat([]byte{3}, 32)
+	plan := &ExecutionPlan{CID: cid1, Contracts: []ContractRoot{
+		{CID: cid2},
+		{CID: cid3, UnitID: "state2"},
+	}}
+	require.True(t, plan.IsCrossUnit())
+	require.Equal(t, []string{SUID, "state2"}, plan.StateUnits())
+
+	hosted := plan.HostedContracts(SUID)
+	require.Len(t, hosted, 2)
+	require.Equal(t, cid1, hosted[0].CID)
+	require.Equal(t, cid2, hosted[1].CID)
+	hosted = plan.HostedContracts("state2")
+	require.Len(t, hosted, 1)
+	require.Equal(t, cid3, hosted[0].CID)
+
+	// The contracts on state2 need a prepare proof
+	require.Error(t, plan.VerifyPrepared(SUID, nil))
+	// A plan on a single unit does not need prepare proofs
+	plan.Contracts = plan.Contracts[:1]
+	require.False(t, plan.IsCrossUnit())
+	require.NoError(t, plan.VerifyPrepared(SUID, nil))
+}
+
+func Test_TwoPCEvidence(t *testing.T) {
+	cid1 := bytes.Repeat([]byte{1}, 32)
+	cid2 := bytes.Repeat([]byte{2}, 32)
+	plan := &ExecutionPlan{CID: cid1, PlanID: []byte("plan"),
+		Contracts: []ContractRoot{{CID: cid2, UnitID: "state2"}},
+		DFUData:   map[string]*DFUIdentity{"state2": {}}}
+	require.Equal(t, SUID, plan.Coordinator())
+	require.Error(t, plan.VerifyDecision(nil, true))
+	require.Error(t, plan.VerifyDecision(&StateProof{}, false))
+
+	// The coordinator decides, so it cannot fail to prepare
+	pp := &PrepareProof{UnitID: SUID, CID: cid1}
+	require.Error(t, pp.VerifyFailed(plan))
+	// The contract must be hosted by the unit
+	pp = &PrepareProof{UnitID: "state2", CID: cid1}
+	require.Error(t, pp.VerifyFailed(plan))
+	pp = &PrepareProof{UnitID: "state2", CID: cid2}
+	require.Error(t, pp.VerifyFailed(plan))
+	require.Error(t, pp.Verify(plan))
+}
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+
+	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
+	"go.dedis.ch/kyber/v3/sign"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// TxnRecord is the entry of the txn log of a contract for an applied plan.
+// It keeps the hashes and the signatures that authorized the update, so
+// that the state transitions of a contract can be audited after the plan is
+// discarded (see Verify). Each record is stored under its own key (see
+// TxnRecordKey), so that appending a record does not rewrite the log.
+type TxnRecord struct {
+	// Seq is the position of the record in the log
+	Seq uint64
+	// BlockIndex is the index of the block that applied the plan
+	BlockIndex int
+	// PlanCID is the contract of the plan, whose txn TxnName was executed.
+	// It is a different contract if the record is for a contract that is
+	// updated together with it (see ExecutionPlan.Contracts).
+	PlanCID  []byte
+	PlanID   []byte
+	PlanHash []byte
+	PlanSig  bdnproto.BdnSignature
+	// HashVersion is the hash version of the plan and its receipts
+	HashVersion int
+	WfName      string
+	TxnName     string
+	FromState   string
+	ToState     string
+	// OpIdx is the index of the update_state opcode and Input is its input
+	// that carries the writeset of the contract
+	OpIdx int
+	Input string
+	// WritesetHash is the hash of the writeset and WritesetSig is the
+	// signature of the DFU on the receipt of the writeset input
+	WritesetHash []byte
+	WritesetSig  bdnproto.BdnSignature
+}
+
+// txnRecordPrefix is the prefix of the keys of the txn log records.
+const txnRecordPrefix = KeyTxnLog + "/"
+
+// TxnLogHead is stored under KeyTxnLog. It has the number of records in the
+// txn log.
+type TxnLogHead struct {
+	Len uint64
+}
+
+// TxnRecordKey returns the key of the record of the txn log with sequence
+// number seq.
+func TxnRecordKey(seq uint64) string {
+	return txnRecordPrefix + strconv.FormatUint(seq, 10)
+}
+
+// TxnRecordKeys returns the keys of the records with a sequence number in
+// [from, to).
+func TxnRecordKeys(from uint64, to uint64) []string {
+	var keys []string
+	for seq := from; seq < to; seq++ {
+		keys = append(keys, TxnRecordKey(seq))
+	}
+	return keys
+}
+
+// IsTxnRecordKey returns true if key is the key of a txn log record.
+func IsTxnRecordKey(key string) bool {
+	return strings.HasPrefix(key, txnRecordPrefix)
+}
+
+// NewTxnRecord returns the record of the update of a contract from state
+// from to state to by plan at block index. The opcode at opIdx applied the
+// writeset of input, whose receipt is one of receipts (see TxnRecord).
+func NewTxnRecord(plan *ExecutionPlan, opIdx int,
+	receipts map[string]*OpcodeReceipt, index int, from string, to string,
+	input string, wsHash []byte) TxnRecord {
+	rec := TxnRecord{
+		BlockIndex:   index,
+		PlanCID:      plan.CID,
+		PlanID:       plan.PlanID,
+		PlanHash:     plan.Hash(),
+		PlanSig:      plan.Sig,
+		HashVersion:  plan.Version,
+		WfName:       plan.WfName,
+		TxnName:      plan.TxnName,
+		FromState:    from,
+		ToState:      to,
+		OpIdx:        opIdx,
+		Input:        input,
+		WritesetHash: wsHash,
+	}
+	if plan.Txn == nil || opIdx < 0 || opIdx >= len(plan.Txn.Opcodes) {
+		return rec
+	}
+	dep, ok := plan.Txn.Opcodes[opIdx].Dependencies[input]
+	if !ok || dep.Src != OPCODE {
+		return rec
+	}
+	receipt, ok := receipts[ReceiptKey(dep.Idx, dep.SrcName)]
+	if !ok {
+		receipt, ok = receipts[dep.SrcName]
+	}
+	if ok {
+		rec.WritesetSig = receipt.Sig
+	}
+	return rec
+}
+
+// TxnLogLen returns the number of records in the txn log of a contract. A
+// contract that has not been updated yet has an empty log.
+func TxnLogLen(s *Storage) (uint64, error) {
+	buf, ok := s.Get(KeyTxnLog)
+	if !ok {
+		return 0, nil
+	}
+	head := &TxnLogHead{}
+	err := protobuf.Decode(buf, head)
+	if err != nil {
+		return 0, xerrors.Errorf("decoding txn log: %v", err)
+	}
+	return head.Len, nil
+}
+
+// AppendTxnRecord adds rec at the end of the txn log of a contract.
+func AppendTxnRecord(s *Storage, rec TxnRecord) error {
+	n, err := TxnLogLen(s)
+	if err != nil {
+		return err
+	}
+	rec.Seq = n
+	buf, err := protobuf.Encode(&rec)
+	if err != nil {
+		return xerrors.Errorf("encoding txn record: %v", err)
+	}
+	s.Set(TxnRecordKey(n), buf)
+	buf, err = protobuf.Encode(&TxnLogHead{Len: n + 1})
+	if err != nil {
+		return xerrors.Errorf("encoding txn log: %v", err)
+	}
+	s.Set(KeyTxnLog, buf)
+	return nil
+}
+
+// GetTxnRecords returns the records with a sequence number in [from, to).
+// If to is 0 or beyond the end of the log, the records up to the end are
+// returned. It returns an error if s does not have one of the records, such
+// as a storage that was proven without their keys.
+func GetTxnRecords(s *Storage, from uint64, to uint64) ([]TxnRecord,
+	error) {
+	n, err := TxnLogLen(s)
+	if err != nil {
+		return nil, err
+	}
+	if to == 0 || to > n {
+		to = n
+	}
+	var recs []TxnRecord
+	for seq := from; seq < to; seq++ {
+		buf, ok := s.Get(TxnRecordKey(seq))
+		if !ok {
+			return nil, xerrors.Errorf("missing txn record %d", seq)
+		}
+		rec := TxnRecord{}
+		err = protobuf.Decode(buf, &rec)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding txn record %d: %v", seq, err)
+		}
+		if rec.Seq != seq {
+			return nil, xerrors.Errorf("txn record %d has sequence number "+
+				"%d", seq, rec.Seq)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// Verify checks that the update of the record was authorized by the DFUs in
+// the registry. txn is the transaction TxnName of the contract at the time
+// of the update, which can be read from the contract state (see
+// HistoricalProof). It checks the hash version of the record against the
+// hashing configuration cfg of the verifier, the signature of the CEU on the
+// plan hash and the signature of the DFU that produced the writeset on its
+// receipt.
+func (r *TxnRecord) Verify(reg *DFURegistry, txn *Transaction,
+	cfg HashConfig) error {
+	err := cfg.CheckVersion(r.HashVersion)
+	if err != nil {
+		return err
+	}
+	ceu, ok := reg.Units[CEUID]
+	if !ok {
+		return xerrors.Errorf("cannot find dfu info for %s", CEUID)
+	}
+	err = r.PlanSig.VerifyWithPolicy(suite, r.PlanHash, ceu.Keys,
+		sign.NewThresholdPolicy(ceu.Threshold))
+	if err != nil {
+		return xerrors.Errorf("cannot verify signature on the execution "+
+			"plan: %v", err)
+	}
+	if r.OpIdx < 0 || r.OpIdx >= len(txn.Opcodes) {
+		return xerrors.Errorf("invalid opcode index %d", r.OpIdx)
+	}
+	dep, ok := txn.Opcodes[r.OpIdx].Dependencies[r.Input]
+	if !ok || dep.Src != OPCODE {
+		return xerrors.Errorf("%s is not an opcode input of the update",
+			r.Input)
+	}
+	if dep.Idx < 0 || dep.Idx >= len(txn.Opcodes) {
+		return xerrors.Errorf("invalid opcode index %d for input %s",
+			dep.Idx, r.Input)
+	}
+	dfuid := txn.Opcodes[dep.Idx].DFUID
+	dfu, ok := reg.Units[dfuid]
+	if !ok {
+		return xerrors.Errorf("cannot find dfu info for %s", dfuid)
+	}
+	// The receipt of the writeset input is rebuilt from the plan hash and
+	// the writeset hash, so a record that does not match the signed receipt
+	// fails the verification.
+	receipt := &OpcodeReceipt{Version: r.HashVersion, EPID: r.PlanHash,
+		OpIdx: dep.Idx, Name: dep.SrcName, HashBytes: r.WritesetHash}
+	err = r.WritesetSig.VerifyWithPolicy(suite, receipt.Hash(), dfu.Keys,
+		sign.NewThresholdPolicy(dfu.Threshold))
+	if err != nil {
+		return xerrors.Errorf("cannot verify signature on the receipt of "+
+			"the writeset: %v", err)
+	}
+	return nil
+}
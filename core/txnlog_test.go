@@ -0,0 +1,101 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core/coretest"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/blscosi/bdnproto"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/bdn"
+	"go.dedis.ch/kyber/v3/util/random"
+)
+
+// testSign returns the signature of a new key on msg and the DFU that holds
+// it.
+func testSign(t *testing.T, msg []byte) (bdnproto.BdnSignature, *DFU) {
+	priv, pub := bdn.NewKeyPair(suite, random.New())
+	return coretest.BdnSign(t, priv, pub, msg), &DFU{Threshold: 1,
+		Keys: []kyber.Point{pub}}
+}
+
+func Test_TxnRecords(t *testing.T) {
+	s := &Storage{}
+	for _, txn := range []string{"setup", "vote", "close"} {
+		require.NoError(t, AppendTxnRecord(s, TxnRecord{TxnName: txn}))
+	}
+	n, err := TxnLogLen(s)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n)
+	_, ok := s.Get(TxnRecordKey(2))
+	require.True(t, ok)
+	require.Equal(t, []string{TxnRecordKey(1), TxnRecordKey(2)},
+		TxnRecordKeys(1, 3))
+
+	recs, err := GetTxnRecords(s, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	require.Equal(t, uint64(1), recs[0].Seq)
+	require.Equal(t, "vote", recs[0].TxnName)
+	recs, err = GetTxnRecords(s, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	recs, err = GetTxnRecords(s, 1, 2)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	recs, err = GetTxnRecords(s, 3, 0)
+	require.NoError(t, err)
+	require.Empty(t, recs)
+	recs, err = GetTxnRecords(s, 2, 1)
+	require.NoError(t, err)
+	require.Empty(t, recs)
+
+	// A storage without the keys of the records cannot give them
+	s.Delete(TxnRecordKey(1))
+	_, err = GetTxnRecords(s, 0, 0)
+	require.Error(t, err)
+}
+
+func Test_TxnRecordVerify(t *testing.T) {
+	txn := &Transaction{Opcodes: []*Opcode{
+		{Name: "exec", DFUID: "execunit"},
+		{Name: "update_state", DFUID: "state",
+			Dependencies: map[string]*DataDependency{
+				"ws": {Src: OPCODE, SrcName: "writeset", Idx: 0}}},
+	}}
+	plan := &ExecutionPlan{Version: CurrentHashVersion, CID: []byte("cid"),
+		PlanID: []byte("plan"), TxnName: "vote", Txn: txn}
+	var ceu *DFU
+	plan.Sig, ceu = testSign(t, plan.Hash())
+	receipt := &OpcodeReceipt{Version: plan.Version, EPID: plan.Hash(),
+		OpIdx: 0, Name: "writeset", HashBytes: []byte("ws hash")}
+	var exec *DFU
+	receipt.Sig, exec = testSign(t, receipt.Hash())
+	reg := &DFURegistry{Units: map[string]*DFU{CEUID: ceu,
+		"execunit": exec}}
+
+	cfg := HashConfig{}
+	receipts := map[string]*OpcodeReceipt{ReceiptKey(0, "writeset"): receipt}
+	rec := NewTxnRecord(plan, 1, receipts, 10, "open", "open", "ws",
+		[]byte("ws hash"))
+	require.NoError(t, rec.Verify(reg, txn, cfg))
+
+	// Records of legacy plans are rejected unless explicitly enabled
+	bad := rec
+	bad.HashVersion = HashVersionLegacy
+	require.Error(t, bad.Verify(reg, txn, cfg))
+
+	// The writeset hash must be the one of the signed receipt
+	bad = rec
+	bad.WritesetHash = []byte("other hash")
+	require.Error(t, bad.Verify(reg, txn, cfg))
+
+	// The input must be an opcode input of the update
+	bad = rec
+	bad.Input = "other"
+	require.Error(t, bad.Verify(reg, txn, cfg))
+
+	// The receipt must be signed by the DFU of the opcode
+	reg.Units["execunit"] = ceu
+	require.Error(t, rec.Verify(reg, txn, cfg))
+}
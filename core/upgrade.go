@@ -0,0 +1,234 @@
+package core
+
+import (
+	"sort"
+
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"golang.org/x/xerrors"
+)
+
+// Hash returns the message that is signed by the contract admins. The
+// contract and the FSM are hashed field by field with their maps in sorted
+// key order, since their protobuf encoding is not deterministic.
+func (u *Upgrade) Hash() []byte {
+	hr := NewHasher(DomainUpgrade)
+	hr.WriteBytes(u.CID.Slice())
+	hr.WriteInt(u.Seq)
+	hr.WriteBytes(u.OldCodeHash)
+	hr.WriteBytes(u.CodeHash)
+	hashContract(hr, u.Contract)
+	hashFSM(hr, u.FSM)
+	return hr.Sum()
+}
+
+func hashContract(hr *Hasher, c *Contract) {
+	if c == nil {
+		hr.WriteInt(0)
+		return
+	}
+	hr.WriteInt(1)
+	wfNames := make([]string, 0, len(c.Workflows))
+	for k := range c.Workflows {
+		wfNames = append(wfNames, k)
+	}
+	sort.Strings(wfNames)
+	hr.WriteLen(len(wfNames))
+	for _, wfName := range wfNames {
+		hr.WriteString(wfName)
+		var txns map[string]*Transaction
+		if wf := c.Workflows[wfName]; wf != nil {
+			txns = wf.Txns
+		}
+		txnNames := make([]string, 0, len(txns))
+		for k := range txns {
+			txnNames = append(txnNames, k)
+		}
+		sort.Strings(txnNames)
+		hr.WriteLen(len(txnNames))
+		for _, txnName := range txnNames {
+			hr.WriteString(txnName)
+			var opcodes []*Opcode
+			if txn := txns[txnName]; txn != nil {
+				opcodes = txn.Opcodes
+			}
+			hr.WriteLen(len(opcodes))
+			for _, op := range opcodes {
+				hashOpcode(hr, op)
+			}
+		}
+	}
+	hashStrings(hr, c.DFUs)
+	hashStrings(hr, c.CommutativeKeys)
+}
+
+func hashOpcode(hr *Hasher, op *Opcode) {
+	if op == nil {
+		op = &Opcode{}
+	}
+	hr.WriteString(op.Name)
+	hr.WriteString(op.DFUID)
+	names := make([]string, 0, len(op.Dependencies))
+	for k := range op.Dependencies {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	hr.WriteLen(len(names))
+	for _, name := range names {
+		dep := op.Dependencies[name]
+		if dep == nil {
+			dep = &DataDependency{}
+		}
+		hr.WriteString(name)
+		hr.WriteString(dep.Src)
+		hr.WriteString(dep.SrcName)
+		hr.WriteInt(dep.Idx)
+		hr.WriteBytes(dep.Value.Encode())
+		hr.WriteString(dep.CID)
+		hr.WriteString(dep.UnitID)
+	}
+}
+
+func hashFSM(hr *Hasher, f *FSM) {
+	if f == nil {
+		hr.WriteInt(0)
+		return
+	}
+	hr.WriteInt(1)
+	hr.WriteString(f.InitialState)
+	hashStrings(hr, f.States)
+	names := make([]string, 0, len(f.Transitions))
+	for k := range f.Transitions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	hr.WriteLen(len(names))
+	for _, name := range names {
+		t := f.Transitions[name]
+		if t == nil {
+			t = &Transition{}
+		}
+		hr.WriteString(name)
+		hr.WriteString(t.From)
+		hr.WriteString(t.To)
+		hashGuards(hr, t.Guards)
+		hr.WriteLen(len(t.Branches))
+		for _, b := range t.Branches {
+			if b == nil {
+				b = &Branch{}
+			}
+			hashStrings(hr, b.From)
+			hr.WriteString(b.To)
+			hashGuards(hr, b.Guards)
+		}
+	}
+}
+
+func hashGuards(hr *Hasher, guards []*Guard) {
+	hr.WriteLen(len(guards))
+	for _, g := range guards {
+		if g == nil {
+			g = &Guard{}
+		}
+		hr.WriteString(g.Key)
+		hr.WriteString(g.Field)
+		hr.WriteLen(len(g.FieldPath))
+		for _, num := range g.FieldPath {
+			hr.WriteInt(num)
+		}
+		hr.WriteString(g.Op)
+		hr.WriteString(g.Value)
+	}
+}
+
+func hashStrings(hr *Hasher, ss []string) {
+	hr.WriteLen(len(ss))
+	for _, s := range ss {
+		hr.WriteString(s)
+	}
+}
+
+// Sign adds the signature of the admin at index idx to the upgrade.
+func (u *Upgrade) Sign(idx int, private kyber.Scalar) error {
+	sig, err := schnorr.Sign(cothority.Suite, private, u.Hash())
+	if err != nil {
+		return xerrors.Errorf("signing upgrade: %v", err)
+	}
+	u.Sigs = append(u.Sigs, AdminSignature{Index: idx, Sig: sig})
+	return nil
+}
+
+// Verify checks that the upgrade is signed by at least AdminThreshold
+// distinct admins of the contract. It returns the indices of the admins
+// whose signatures are valid.
+func (u *Upgrade) Verify(hdr *ContractHeader) ([]int, error) {
+	signers, err := verifyAdminSigs(hdr, u.Hash(), u.Sigs)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying upgrade: %v", err)
+	}
+	return signers, nil
+}
+
+// Hash returns the message that is signed by the contract admins.
+func (d *Deletion) Hash() []byte {
+	hr := NewHasher(DomainDeletion)
+	hr.WriteBytes(d.CID.Slice())
+	return hr.Sum()
+}
+
+// Sign adds the signature of the admin at index idx to the deletion.
+func (d *Deletion) Sign(idx int, private kyber.Scalar) error {
+	sig, err := schnorr.Sign(cothority.Suite, private, d.Hash())
+	if err != nil {
+		return xerrors.Errorf("signing deletion: %v", err)
+	}
+	d.Sigs = append(d.Sigs, AdminSignature{Index: idx, Sig: sig})
+	return nil
+}
+
+// Verify checks that the deletion is signed by at least AdminThreshold
+// distinct admins of the contract. A contract without admins can be deleted
+// without signatures, as its terminal state is the only requirement (see
+// Storage.VerifyTerminal).
+func (d *Deletion) Verify(hdr *ContractHeader) error {
+	if !hdr.CID.Equal(d.CID) {
+		return xerrors.Errorf("deletion is for contract %s instead of %s",
+			d.CID, hdr.CID)
+	}
+	if len(hdr.Admins) == 0 {
+		return nil
+	}
+	_, err := verifyAdminSigs(hdr, d.Hash(), d.Sigs)
+	if err != nil {
+		return xerrors.Errorf("verifying deletion: %v", err)
+	}
+	return nil
+}
+
+// verifyAdminSigs checks that at least AdminThreshold distinct admins of
+// the contract signed msg and returns their indices.
+func verifyAdminSigs(hdr *ContractHeader, msg []byte,
+	sigs []AdminSignature) ([]int, error) {
+	if len(hdr.Admins) == 0 || hdr.AdminThreshold <= 0 {
+		return nil, xerrors.New("contract does not have admins")
+	}
+	seen := make(map[int]bool)
+	var signers []int
+	for _, s := range sigs {
+		if s.Index < 0 || s.Index >= len(hdr.Admins) || seen[s.Index] {
+			continue
+		}
+		err := schnorr.Verify(cothority.Suite, hdr.Admins[s.Index], msg, s.Sig)
+		if err != nil {
+			continue
+		}
+		seen[s.Index] = true
+		signers = append(signers, s.Index)
+	}
+	if len(signers) < hdr.AdminThreshold {
+		return nil, xerrors.Errorf("%d valid signatures but %d are "+
+			"required", len(signers), hdr.AdminThreshold)
+	}
+	return signers, nil
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/key"
+)
+
+func testAdmins(n int) ([]kyber.Point, []kyber.Scalar) {
+	pubs := make([]kyber.Point, n)
+	privs := make([]kyber.Scalar, n)
+	for i := range pubs {
+		kp := key.NewKeyPair(cothority.Suite)
+		pubs[i] = kp.Public
+		privs[i] = kp.Private
+	}
+	return pubs, privs
+}
+
+func Test_DeletionVerify(t *testing.T) {
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	pubs, privs := testAdmins(3)
+	hdr := &ContractHeader{CID: cid, Admins: pubs, AdminThreshold: 2}
+
+	del := &Deletion{CID: cid}
+	require.NoError(t, del.Sign(0, privs[0]))
+	require.Error(t, del.Verify(hdr))
+	// A duplicate signature does not count twice
+	require.NoError(t, del.Sign(0, privs[0]))
+	require.Error(t, del.Verify(hdr))
+	// A signature by a key that is not the admin at that index
+	require.NoError(t, del.Sign(1, privs[2]))
+	require.Error(t, del.Verify(hdr))
+	require.NoError(t, del.Sign(2, privs[2]))
+	require.NoError(t, del.Verify(hdr))
+
+	// The signatures are bound to the contract
+	other := &Deletion{CID: byzcoin.NewInstanceID([]byte("other")),
+		Sigs: del.Sigs}
+	hdr.CID = other.CID
+	require.Error(t, other.Verify(hdr))
+	hdr.CID = cid
+	require.Error(t, other.Verify(hdr))
+
+	// Contracts without admins only need to be in a terminal state
+	require.NoError(t, (&Deletion{CID: cid}).Verify(&ContractHeader{CID: cid}))
+	require.Error(t, other.Verify(&ContractHeader{CID: cid}))
+}
+
+func testUpgrade(cid byzcoin.InstanceID) *Upgrade {
+	return &Upgrade{CID: cid, Seq: 0, OldCodeHash: []byte("old"),
+		CodeHash: []byte("new"),
+		Contract: &Contract{
+			Workflows: map[string]*Workflow{
+				"wf": {Txns: map[string]*Transaction{
+					"join": {Opcodes: []*Opcode{{Name: "exec",
+						DFUID: CEUID, Dependencies: map[string]*DataDependency{
+							"fn":  {Src: CONST, Value: NewStringValue("join")},
+							"kvs": {Src: KEYVALUE, SrcName: "tickets"},
+						}}}},
+					"close": {Opcodes: []*Opcode{{Name: "update_state",
+						DFUID: SUID}}},
+				}},
+			},
+			DFUs: []string{CEUID, SUID},
+		},
+		FSM: &FSM{
+			InitialState: "open",
+			States:       []string{"open", "closed"},
+			Transitions: map[string]*Transition{
+				"join": {From: "open", To: "open"},
+				"close": {From: "open", To: "closed",
+					Guards: []*Guard{{Key: "tickets", Field: FieldLen,
+						Op: GuardGe, Value: "1"}}},
+			},
+		},
+	}
+}
+
+func Test_UpgradeHash(t *testing.T) {
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	h := testUpgrade(cid).Hash()
+	for i := 0; i < 20; i++ {
+		require.Equal(t, h, testUpgrade(cid).Hash())
+	}
+
+	u := testUpgrade(cid)
+	u.FSM.Transitions["close"].Guards[0].Value = "2"
+	require.NotEqual(t, h, u.Hash())
+	u = testUpgrade(cid)
+	u.FSM.Transitions["close"].Guards[0].FieldPath = []int{2}
+	require.NotEqual(t, h, u.Hash())
+	u = testUpgrade(cid)
+	u.Contract.Workflows["wf"].Txns["join"].Opcodes[0].
+		Dependencies["fn"].Value = NewStringValue("vote")
+	require.NotEqual(t, h, u.Hash())
+	u = testUpgrade(cid)
+	u.FSM = nil
+	require.NotEqual(t, h, u.Hash())
+	u = testUpgrade(cid)
+	u.FSM = &FSM{}
+	require.NotEqual(t, h, u.Hash())
+}
+
+func Test_UpgradeVerify(t *testing.T) {
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	pubs, privs := testAdmins(3)
+	hdr := &ContractHeader{CID: cid, Admins: pubs, AdminThreshold: 2}
+
+	u := testUpgrade(cid)
+	require.NoError(t, u.Sign(0, privs[0]))
+	_, err := u.Verify(hdr)
+	require.Error(t, err)
+	require.NoError(t, u.Sign(2, privs[2]))
+	signers, err := u.Verify(hdr)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 2}, signers)
+
+	// Changing the upgrade invalidates the signatures
+	u.FSM.Transitions["close"].To = "open"
+	_, err = u.Verify(hdr)
+	require.Error(t, err)
+
+	_, err = testUpgrade(cid).Verify(&ContractHeader{CID: cid})
+	require.Error(t, err)
+}
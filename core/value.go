@@ -0,0 +1,357 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"go.dedis.ch/kyber/v3"
+	"golang.org/x/xerrors"
+)
+
+type ValueType int
+
+const (
+	NilType ValueType = iota
+	StringType
+	Uint64Type
+	Int64Type
+	BoolType
+	BytesType
+	ListType
+	PointType
+)
+
+var valueTypeNames = map[ValueType]string{
+	StringType: "string",
+	Uint64Type: "uint64",
+	Int64Type:  "int64",
+	BoolType:   "bool",
+	BytesType:  "bytes",
+	ListType:   "list",
+	PointType:  "point",
+}
+
+// Value is a typed constant that is passed to an opcode as a CONST
+// dependency or used to name the keys of a KEYVALUE or PRECOMMIT dependency.
+// Only the field that corresponds to Type is set. Points are stored in their
+// marshaled form so that the encoding of a value never fails.
+type Value struct {
+	Type  ValueType
+	Str   string
+	Uint  uint64
+	Int   int64
+	Bool  bool
+	Bytes []byte
+	List  []*Value
+	Point []byte
+}
+
+func NewStringValue(s string) *Value {
+	return &Value{Type: StringType, Str: s}
+}
+
+func NewUint64Value(u uint64) *Value {
+	return &Value{Type: Uint64Type, Uint: u}
+}
+
+func NewInt64Value(i int64) *Value {
+	return &Value{Type: Int64Type, Int: i}
+}
+
+func NewBoolValue(b bool) *Value {
+	return &Value{Type: BoolType, Bool: b}
+}
+
+func NewBytesValue(b []byte) *Value {
+	return &Value{Type: BytesType, Bytes: b}
+}
+
+func NewListValue(vs ...*Value) *Value {
+	return &Value{Type: ListType, List: vs}
+}
+
+func NewPointValue(p kyber.Point) (*Value, error) {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("marshaling point: %v", err)
+	}
+	return &Value{Type: PointType, Point: buf}, nil
+}
+
+// GetPoint unmarshals the point using the given group.
+func (v *Value) GetPoint(g kyber.Group) (kyber.Point, error) {
+	if v == nil || v.Type != PointType {
+		return nil, xerrors.New("value is not a point")
+	}
+	p := g.Point()
+	err := p.UnmarshalBinary(v.Point)
+	if err != nil {
+		return nil, xerrors.Errorf("unmarshaling point: %v", err)
+	}
+	return p, nil
+}
+
+// Keys returns the key names that are referred to by a KEYVALUE or a
+// PRECOMMIT dependency. The keys are either given as a comma-separated
+// string or as a list of strings.
+func (v *Value) Keys() ([]string, error) {
+	if v == nil {
+		return nil, xerrors.New("missing key names")
+	}
+	switch v.Type {
+	case StringType:
+		return strings.Split(v.Str, ","), nil
+	case ListType:
+		keys := make([]string, len(v.List))
+		for i, elem := range v.List {
+			if elem == nil || elem.Type != StringType {
+				return nil, xerrors.New("key names must be strings")
+			}
+			keys[i] = elem.Str
+		}
+		return keys, nil
+	default:
+		return nil, xerrors.Errorf("cannot read key names from a %s value",
+			v.Type)
+	}
+}
+
+// Encode returns the canonical encoding of the value: a one-byte type tag
+// followed by the payload. Variable-length payloads are prefixed with their
+// length and lists with their element count, so two different values never
+// have the same encoding. A nil value is encoded as NilType.
+func (v *Value) Encode() []byte {
+	buf := new(bytes.Buffer)
+	v.encode(buf)
+	return buf.Bytes()
+}
+
+func (v *Value) encode(buf *bytes.Buffer) {
+	if v == nil {
+		buf.WriteByte(byte(NilType))
+		return
+	}
+	buf.WriteByte(byte(v.Type))
+	switch v.Type {
+	case StringType:
+		writeLengthPrefixed(buf, []byte(v.Str))
+	case Uint64Type:
+		writeUint64(buf, v.Uint)
+	case Int64Type:
+		writeUint64(buf, uint64(v.Int))
+	case BoolType:
+		if v.Bool {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case BytesType:
+		writeLengthPrefixed(buf, v.Bytes)
+	case ListType:
+		writeUint64(buf, uint64(len(v.List)))
+		for _, elem := range v.List {
+			elem.encode(buf)
+		}
+	case PointType:
+		writeLengthPrefixed(buf, v.Point)
+	}
+}
+
+// Hash returns the hash of the value with the given hash version, which is
+// the version of the execution plan. DFUs use it to compute the input hashes
+// of CONST dependencies. The hash covers the canonical encoding of the
+// value, except with HashVersionLegacy, with which strings and uint64s are
+// hashed as the nodes that predate typed values do.
+func (v *Value) Hash(version int) []byte {
+	hr := NewVersionedHasher(version, DomainValue)
+	if version == HashVersionLegacy && v != nil {
+		switch v.Type {
+		case StringType:
+			hr.WriteString(v.Str)
+			return hr.Sum()
+		case Uint64Type:
+			hr.WriteUint64(v.Uint)
+			return hr.Sum()
+		}
+	}
+	hr.WriteBytes(v.Encode())
+	return hr.Sum()
+}
+
+func (v *Value) Equal(other *Value) bool {
+	return bytes.Equal(v.Encode(), other.Encode())
+}
+
+func (t ValueType) String() string {
+	name, ok := valueTypeNames[t]
+	if !ok {
+		return "nil"
+	}
+	return name
+}
+
+type typedJSON struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// UnmarshalJSON reads a value from the contract JSON. Strings, booleans,
+// integers and lists can be written as plain JSON values. Negative integers
+// are read as int64 and non-negative integers as uint64; numbers with a
+// fractional part are rejected. Other types are written as an object of the
+// form {"type": "bytes", "value": "<hex>"}.
+func (v *Value) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	val, err := valueFromJSON(raw)
+	if err != nil {
+		return err
+	}
+	*v = *val
+	return nil
+}
+
+func valueFromJSON(raw interface{}) (*Value, error) {
+	switch r := raw.(type) {
+	case string:
+		return NewStringValue(r), nil
+	case bool:
+		return NewBoolValue(r), nil
+	case json.Number:
+		return numberValue(string(r))
+	case []interface{}:
+		list := make([]*Value, len(r))
+		for i, elem := range r {
+			val, err := valueFromJSON(elem)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = val
+		}
+		return NewListValue(list...), nil
+	case map[string]interface{}:
+		return typedValueFromJSON(r)
+	default:
+		return nil, xerrors.Errorf("unsupported value: %v", raw)
+	}
+}
+
+func numberValue(s string) (*Value, error) {
+	if strings.HasPrefix(s, "-") {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid int64 value %s: %v", s, err)
+		}
+		return NewInt64Value(i), nil
+	}
+	u, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid uint64 value %s: %v", s, err)
+	}
+	return NewUint64Value(u), nil
+}
+
+func typedValueFromJSON(obj map[string]interface{}) (*Value, error) {
+	typ, ok := obj["type"].(string)
+	if !ok {
+		return nil, xerrors.New("missing value type")
+	}
+	raw, ok := obj["value"]
+	if !ok {
+		return nil, xerrors.New("missing value")
+	}
+	var val *Value
+	var err error
+	switch typ {
+	case "string", "bool", "list":
+		val, err = valueFromJSON(raw)
+	case "uint64", "int64":
+		num, ok := raw.(json.Number)
+		if !ok {
+			return nil, xerrors.Errorf("expected a number for %s", typ)
+		}
+		if typ == "uint64" {
+			val, err = numberValue(string(num))
+		} else {
+			var i int64
+			i, err = strconv.ParseInt(string(num), 10, 64)
+			val = NewInt64Value(i)
+		}
+	case "bytes", "point":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, xerrors.Errorf("expected a hex string for %s", typ)
+		}
+		var buf []byte
+		buf, err = hex.DecodeString(s)
+		if typ == "bytes" {
+			val = NewBytesValue(buf)
+		} else {
+			val = &Value{Type: PointType, Point: buf}
+		}
+	default:
+		return nil, xerrors.Errorf("unknown value type: %s", typ)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("invalid %s value: %v", typ, err)
+	}
+	if val.Type.String() != typ {
+		return nil, xerrors.Errorf("expected a %s value but got %s", typ,
+			val.Type)
+	}
+	return val, nil
+}
+
+// MarshalJSON writes the value in the format that is read by UnmarshalJSON.
+func (v *Value) MarshalJSON() ([]byte, error) {
+	switch v.Type {
+	case StringType:
+		return json.Marshal(v.Str)
+	case Uint64Type:
+		return json.Marshal(v.Uint)
+	case BoolType:
+		return json.Marshal(v.Bool)
+	case ListType:
+		if v.List == nil {
+			return []byte("[]"), nil
+		}
+		return json.Marshal(v.List)
+	case Int64Type:
+		num, err := json.Marshal(v.Int)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(typedJSON{Type: v.Type.String(), Value: num})
+	case BytesType, PointType:
+		buf := v.Bytes
+		if v.Type == PointType {
+			buf = v.Point
+		}
+		s, err := json.Marshal(hex.EncodeToString(buf))
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(typedJSON{Type: v.Type.String(), Value: s})
+	default:
+		return []byte("null"), nil
+	}
+}
+
+func writeUint64(buf *bytes.Buffer, u uint64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, u)
+	buf.Write(b)
+}
+
+func writeLengthPrefixed(buf *bytes.Buffer, data []byte) {
+	writeUint64(buf, uint64(len(data)))
+	buf.Write(data)
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ValueJSON(t *testing.T) {
+	input := `{
+		"str": {"src": "CONST", "value": "join_randlot"},
+		"uint": {"src": "CONST", "value": 2},
+		"int": {"src": "CONST", "value": -2},
+		"bool": {"src": "CONST", "value": true},
+		"list": {"src": "CONST", "value": ["a", 1]},
+		"bytes": {"src": "CONST", "value": {"type": "bytes", "value": "0102"}},
+		"typed": {"src": "CONST", "value": {"type": "int64", "value": 7}}
+	}`
+	var deps map[string]*DataDependency
+	require.NoError(t, json.Unmarshal([]byte(input), &deps))
+	require.Equal(t, StringType, deps["str"].Value.Type)
+	require.Equal(t, "join_randlot", deps["str"].Value.Str)
+	require.Equal(t, uint64(2), deps["uint"].Value.Uint)
+	require.Equal(t, int64(-2), deps["int"].Value.Int)
+	require.True(t, deps["bool"].Value.Bool)
+	require.Len(t, deps["list"].Value.List, 2)
+	require.Equal(t, []byte{1, 2}, deps["bytes"].Value.Bytes)
+	require.Equal(t, Int64Type, deps["typed"].Value.Type)
+
+	for name, dep := range deps {
+		buf, err := json.Marshal(dep)
+		require.NoError(t, err)
+		var decoded DataDependency
+		require.NoError(t, json.Unmarshal(buf, &decoded))
+		require.True(t, dep.Value.Equal(decoded.Value), name)
+	}
+
+	var dep DataDependency
+	require.Error(t, json.Unmarshal([]byte(`{"value": 1.5}`), &dep))
+	require.Error(t, json.Unmarshal([]byte(`{"value": {"type": "uint64", "value": -1}}`), &dep))
+}
+
+func Test_ValueEncoding(t *testing.T) {
+	v := CurrentHashVersion
+	require.NotEqual(t, NewStringValue("").Hash(v), NewUint64Value(0).Hash(v))
+	require.NotEqual(t, NewStringValue("ab").Hash(v),
+		NewListValue(NewStringValue("a"), NewStringValue("b")).Hash(v))
+	require.NotEqual(t,
+		NewListValue(NewStringValue("ab"), NewStringValue("")).Hash(v),
+		NewListValue(NewStringValue("a"), NewStringValue("b")).Hash(v))
+	require.NotEqual(t, NewUint64Value(1).Hash(v), NewInt64Value(1).Hash(v))
+
+	// Legacy plans hash strings and uint64s without any framing
+	h := sha256.Sum256([]byte("ab"))
+	require.Equal(t, h[:], NewStringValue("ab").Hash(HashVersionLegacy))
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 2)
+	h = sha256.Sum256(buf)
+	require.Equal(t, h[:], NewUint64Value(2).Hash(HashVersionLegacy))
+
+	keys, err := NewStringValue("tickets,header").Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"tickets", "header"}, keys)
+	keys, err = NewListValue(NewStringValue("tickets")).Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"tickets"}, keys)
+	_, err = NewUint64Value(1).Keys()
+	require.Error(t, err)
+}
+
+func Test_Hasher(t *testing.T) {
+	hash := func(domain string, fields ...string) []byte {
+		hr := NewHasher(domain)
+		for _, f := range fields {
+			hr.WriteString(f)
+		}
+		return hr.Sum()
+	}
+	require.Equal(t, hash(DomainWriteset, "a", "b"),
+		hash(DomainWriteset, "a", "b"))
+	require.NotEqual(t, hash(DomainWriteset, "ab", ""),
+		hash(DomainWriteset, "a", "b"))
+	require.NotEqual(t, hash(DomainWriteset, "a", "b"),
+		hash(DomainPoints, "a", "b"))
+
+	receipt := &OpcodeReceipt{EPID: []byte("ep"), Name: "ab",
+		HashBytes: []byte("c")}
+	legacy := receipt.Hash()
+	receipt.Version = HashVersion1
+	require.NotEqual(t, legacy, receipt.Hash())
+	other := &OpcodeReceipt{Version: HashVersion1, EPID: []byte("ep"),
+		Name: "a", HashBytes: []byte("bc")}
+	require.NotEqual(t, receipt.Hash(), other.Hash())
+}
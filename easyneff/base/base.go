@@ -1,7 +1,7 @@
 package base
 
 import (
-	"crypto/sha256"
+	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/utils"
 	"go.dedis.ch/kyber/v3"
 )
@@ -27,14 +27,17 @@ type Proof struct {
 	Signature []byte // on the Proof
 }
 
-func (shInput *ShuffleInput) PrepareHashes() (map[string][]byte, error) {
+// PrepareHashes returns the input hashes with the hash version of the
+// execution plan.
+func (shInput *ShuffleInput) PrepareHashes(version int) (map[string][]byte,
+	error) {
 	inputHashes := make(map[string][]byte)
-	hash, err := shInput.Pairs.Hash()
+	hash, err := shInput.Pairs.Hash(version)
 	if err != nil {
 		return nil, err
 	}
 	inputHashes["pairs"] = hash
-	hash, err = utils.HashPoint(shInput.H)
+	hash, err = utils.HashPoint(version, shInput.H)
 	if err != nil {
 		return nil, err
 	}
@@ -42,9 +45,13 @@ func (shInput *ShuffleInput) PrepareHashes() (map[string][]byte, error) {
 	return inputHashes, nil
 }
 
-func (shOut *ShuffleOutput) Hash() ([]byte, error) {
-	h := sha256.New()
+// Hash returns the hash of the output with the hash version of the
+// execution plan.
+func (shOut *ShuffleOutput) Hash(version int) ([]byte, error) {
+	hr := core.NewVersionedHasher(version, core.DomainShuffle)
+	hr.WriteLen(len(shOut.Proofs))
 	for _, pr := range shOut.Proofs {
+		hr.WriteLen(len(pr.Pairs.Pairs))
 		for _, pair := range pr.Pairs.Pairs {
 			kbuf, err := pair.K.MarshalBinary()
 			if err != nil {
@@ -54,11 +61,11 @@ func (shOut *ShuffleOutput) Hash() ([]byte, error) {
 			if err != nil {
 				return nil, err
 			}
-			h.Write(kbuf)
-			h.Write(cbuf)
+			hr.WriteBytes(kbuf)
+			hr.WriteBytes(cbuf)
 		}
-		h.Write(pr.Proof)
-		h.Write(pr.Signature)
+		hr.WriteBytes(pr.Proof)
+		hr.WriteBytes(pr.Signature)
 	}
-	return h.Sum(nil), nil
+	return hr.Sum(), nil
 }
@@ -37,6 +37,8 @@ type ShuffleVerify struct {
 	InputHashes map[string][]byte
 
 	KP             *key.Pair
+	Replay         *core.ReplayCache
+	Hashes         core.HashConfig
 	InputReceipts  map[string]*core.OpcodeReceipt
 	OutputReceipts map[string]*core.OpcodeReceipt
 
@@ -128,8 +130,15 @@ func (s *ShuffleVerify) verifyProofs(r structVerifyProofs) error {
 	s.ShufInput = r.ShufInput
 	s.ShufOutput = r.ShufOutput
 	s.ExecReq = r.ExecReq
-	s.InputHashes, err = s.ShufInput.PrepareHashes()
-	err = s.runVerification()
+	if s.ExecReq == nil || s.ExecReq.EP == nil {
+		log.Errorf("%s received no execution request", s.Name())
+		s.finish(false)
+		return xerrors.New("missing execution request")
+	}
+	s.InputHashes, err = s.ShufInput.PrepareHashes(s.ExecReq.EP.Version)
+	if err == nil {
+		err = s.runVerification()
+	}
 	if err != nil {
 		log.Errorf("%s couldn't verify the execution request: %v", s.Name(), err)
 		s.finish(false)
@@ -218,11 +227,12 @@ func (s *ShuffleVerify) generateResponse() (*VerifyProofsResponse, error) {
 	outSigs := make(map[string]bdnproto.BdnSignature)
 	epid := s.ExecReq.EP.Hash()
 	opIdx := s.ExecReq.Index
-	hash, err := s.ShufOutput.Hash()
+	hash, err := s.ShufOutput.Hash(s.ExecReq.EP.Version)
 	if err != nil {
 		return &VerifyProofsResponse{}, err
 	}
 	r := &core.OpcodeReceipt{
+		Version:   s.ExecReq.EP.Version,
 		EPID:      epid,
 		OpIdx:     opIdx,
 		Name:      "proofs",
@@ -239,6 +249,7 @@ func (s *ShuffleVerify) generateResponse() (*VerifyProofsResponse, error) {
 	// Input receipts
 	for inputName, inputHash := range s.InputHashes {
 		r := core.OpcodeReceipt{
+			Version:   s.ExecReq.EP.Version,
 			EPID:      epid,
 			OpIdx:     opIdx,
 			Name:      inputName,
@@ -274,6 +285,8 @@ func (s *ShuffleVerify) runVerification() error {
 		UID:         base.UID,
 		OpcodeName:  base.SHUFFLE,
 		InputHashes: s.InputHashes,
+		Replay:      s.Replay,
+		Hashes:      s.Hashes,
 	}
 	return s.ExecReq.Verify(vData)
 }
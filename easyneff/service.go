@@ -1,6 +1,7 @@
 package easyneff
 
 import (
+	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/easyneff/base"
 	"github.com/dedis/protean/easyneff/protocol"
 	protean "github.com/dedis/protean/utils"
@@ -37,6 +38,14 @@ type EasyNeff struct {
 	roster     *onet.Roster
 	threshold  int
 	blsService *blscosi.Service
+	replay     *core.ReplayCache
+	hashes     core.HashConfig
+}
+
+// SetHashConfig sets which plan hash versions the service accepts. It must
+// be called before the service handles any request.
+func (s *EasyNeff) SetHashConfig(cfg core.HashConfig) {
+	s.hashes = cfg
 }
 
 func (s *EasyNeff) InitUnit(req *InitUnitRequest) (*InitUnitReply, error) {
@@ -76,7 +85,10 @@ func (s *EasyNeff) Shuffle(req *ShuffleRequest) (*ShuffleReply, error) {
 		shufVerify.ShufOutput = &shufProof
 		shufVerify.ExecReq = &req.ExecReq
 		shufVerify.KP = protean.GetBLSKeyPair(s.ServerIdentity())
-		shufVerify.InputHashes, err = req.Input.PrepareHashes()
+		shufVerify.Replay = s.replay
+		shufVerify.Hashes = s.hashes
+		shufVerify.InputHashes, err = req.Input.PrepareHashes(
+			req.ExecReq.EP.Version)
 		if err != nil {
 			log.Errorf("failed to prepare the input hashes: %v", err)
 			return nil, err
@@ -156,6 +168,8 @@ func (s *EasyNeff) NewProtocol(tn *onet.TreeNodeInstance,
 		}
 		proto := pi.(*protocol.ShuffleVerify)
 		proto.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+		proto.Replay = s.replay
+		proto.Hashes = s.hashes
 		proto.ShufVerify = s.ShuffleVerify
 		return proto, nil
 	}
@@ -165,6 +179,7 @@ func (s *EasyNeff) NewProtocol(tn *onet.TreeNodeInstance,
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &EasyNeff{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		replay:           core.NewReplayCache(core.DefaultReplayCacheSize),
 		blsService:       c.Service(blscosi.ServiceName).(*blscosi.Service)}
 	err := s.RegisterHandlers(s.InitUnit, s.Shuffle)
 	if err != nil {
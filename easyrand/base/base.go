@@ -1,8 +1,7 @@
 package base
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/utils"
 	"go.dedis.ch/kyber/v3"
 )
@@ -24,23 +23,26 @@ type RandomnessOutput struct {
 	Value []byte
 }
 
-func (randInput *RandomnessInput) PrepareHashes() (map[string][]byte, error) {
+// PrepareHashes returns the input hashes with the hash version of the
+// execution plan.
+func (randInput *RandomnessInput) PrepareHashes(version int) (
+	map[string][]byte, error) {
 	inputHashes := make(map[string][]byte)
-	inputHashes["round"] = utils.HashUint64(randInput.Round)
+	inputHashes["round"] = utils.HashUint64(version, randInput.Round)
 	return inputHashes, nil
 }
 
-func (randOutput *RandomnessOutput) Hash() ([]byte, error) {
-	h := sha256.New()
+// Hash returns the hash of the output with the hash version of the
+// execution plan.
+func (randOutput *RandomnessOutput) Hash(version int) ([]byte, error) {
 	buf, err := randOutput.Public.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
-	h.Write(buf)
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(randOutput.Round))
-	h.Write(b)
-	h.Write(randOutput.Prev)
-	h.Write(randOutput.Value)
-	return h.Sum(nil), nil
+	hr := core.NewVersionedHasher(version, core.DomainRandomness)
+	hr.WriteBytes(buf)
+	hr.WriteUint64(randOutput.Round)
+	hr.WriteBytes(randOutput.Prev)
+	hr.WriteBytes(randOutput.Value)
+	return hr.Sum(), nil
 }
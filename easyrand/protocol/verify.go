@@ -37,6 +37,8 @@ type RandomnessVerify struct {
 
 	RandOutput *base.RandomnessOutput
 	KP         *key.Pair
+	Replay     *core.ReplayCache
+	Hashes     core.HashConfig
 	Receipts   map[string]*core.OpcodeReceipt
 
 	Threshold int
@@ -113,7 +115,12 @@ func (rv *RandomnessVerify) verifyRandomness(r structVerifyRand) error {
 	var err error
 	rv.Input = r.Input
 	rv.ExecReq = r.ExecReq
-	rv.InputHashes, err = rv.Input.PrepareHashes()
+	if rv.ExecReq == nil || rv.ExecReq.EP == nil {
+		log.Errorf("%s received no execution request", rv.Name())
+		return cothority.ErrorOrNil(rv.SendToParent(&VerifyResponse{}),
+			"sending VerifyResponse to parent")
+	}
+	rv.InputHashes, err = rv.Input.PrepareHashes(rv.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("%s couldn't prepare input hashes: %v", rv.Name(), err)
 		return cothority.ErrorOrNil(rv.SendToParent(&VerifyResponse{}),
@@ -176,11 +183,12 @@ func (rv *RandomnessVerify) verifyResponse(r structVerifyResponse) error {
 }
 
 func (rv *RandomnessVerify) generateResponse() (*VerifyResponse, error) {
-	hash, err := rv.RandOutput.Hash()
+	hash, err := rv.RandOutput.Hash(rv.ExecReq.EP.Version)
 	if err != nil {
 		return &VerifyResponse{}, err
 	}
 	r := &core.OpcodeReceipt{
+		Version:   rv.ExecReq.EP.Version,
 		EPID:      rv.ExecReq.EP.Hash(),
 		OpIdx:     rv.ExecReq.Index,
 		Name:      "randomness",
@@ -203,6 +211,8 @@ func (rv *RandomnessVerify) runVerification() error {
 		UID:         base.UID,
 		OpcodeName:  base.GET_RAND,
 		InputHashes: rv.InputHashes,
+		Replay:      rv.Replay,
+		Hashes:      rv.Hashes,
 	}
 	return rv.ExecReq.Verify(vData)
 }
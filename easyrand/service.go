@@ -3,6 +3,7 @@ package easyrand
 import (
 	"bytes"
 	"encoding/binary"
+	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/easyrand/base"
 	"github.com/dedis/protean/easyrand/protocol"
 	protean "github.com/dedis/protean/utils"
@@ -48,6 +49,14 @@ type EasyRand struct {
 	distKeyStore *dkg.DistKeyShare
 	pubPoly      *share.PubPoly
 	blocks       [][]byte
+	replay       *core.ReplayCache
+	hashes       core.HashConfig
+}
+
+// SetHashConfig sets which plan hash versions the service accepts. It must
+// be called before the service handles any request.
+func (s *EasyRand) SetHashConfig(cfg core.HashConfig) {
+	s.hashes = cfg
 }
 
 func (s *EasyRand) InitUnit(req *InitUnitRequest) (*InitUnitReply, error) {
@@ -117,6 +126,9 @@ func (s *EasyRand) CreateRandomness(req *CreateRandomnessRequest) (*CreateRandom
 }
 
 func (s *EasyRand) GetRandomness(req *GetRandomnessRequest) (*GetRandomnessReply, error) {
+	if req.ExecReq.EP == nil {
+		return nil, xerrors.New("missing execution plan")
+	}
 	if req.Input.Round > uint64(len(s.blocks)-1) {
 		return nil, xerrors.Errorf("round %d has not been reached yet",
 			req.Input.Round)
@@ -134,7 +146,8 @@ func (s *EasyRand) GetRandomness(req *GetRandomnessRequest) (*GetRandomnessReply
 	}
 	verifyPi := pi.(*protocol.RandomnessVerify)
 	verifyPi.Threshold = s.threshold
-	verifyPi.InputHashes, err = req.Input.PrepareHashes()
+	verifyPi.InputHashes, err = req.Input.PrepareHashes(
+		req.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("failed to prepare the input hashes: %v", err)
 		return nil, err
@@ -146,6 +159,8 @@ func (s *EasyRand) GetRandomness(req *GetRandomnessRequest) (*GetRandomnessReply
 		Round: round, Prev: prev, Value: s.blocks[round]}
 	verifyPi.RandOutput = &randOutput
 	verifyPi.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+	verifyPi.Replay = s.replay
+	verifyPi.Hashes = s.hashes
 	err = verifyPi.SetConfig(&onet.GenericConfig{Data: rBuf})
 	if err != nil {
 		return nil, xerrors.Errorf(
@@ -256,6 +271,8 @@ func (s *EasyRand) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConf
 		proto.RandOutput = &base.RandomnessOutput{Public: s.pubPoly.Commit(), Round: round,
 			Prev: prev, Value: value}
 		proto.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+		proto.Replay = s.replay
+		proto.Hashes = s.hashes
 		return proto, nil
 	default:
 		return nil, nil
@@ -266,6 +283,7 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s := &EasyRand{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		keypair:          key.NewKeyPair(vssSuite),
+		replay:           core.NewReplayCache(core.DefaultReplayCacheSize),
 		blsService:       c.Service(blscosi.ServiceName).(*blscosi.Service),
 	}
 	_, err := s.ProtocolRegister(protocol.DKGProtoName, func(n *onet.TreeNodeInstance) (
@@ -56,39 +56,82 @@ func SetupStateUnit(roster *onet.Roster, blockTime int) (skipchain.SkipBlockID,
 	return byzID, nil
 }
 
+// Registry is the DFU registry of a simulation. The simulations set up a
+// new state unit in every round, so the ledger of the state unit is pinned
+// again in its registry entry (see PinStateUnit).
+type Registry struct {
+	adminCl   *registry.AdminClient
+	bc        *byzcoin.Client
+	iid       byzcoin.InstanceID
+	units     *core.DFURegistry
+	blockTime int
+}
+
 func SetupRegistry(regRoster *onet.Roster, dfile *string,
-	keyMap map[string][]kyber.Point, blockTime int) (*execbase.ByzData,
-	map[string]int, error) {
+	keyMap map[string][]kyber.Point, blockTime int) (*Registry,
+	*execbase.ByzData, map[string]int, error) {
 	threshMap := make(map[string]int)
 	dfuReg, err := libclient.ReadDFUJSON(dfile)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	for dfuName, keys := range keyMap {
 		dfuReg.Units[dfuName].Keys = keys
 		threshMap[dfuName] = dfuReg.Units[dfuName].Threshold
 	}
-	adminCl, _, err := registry.SetupByzcoin(regRoster, blockTime)
+	adminCl, byzID, err := registry.SetupByzcoin(regRoster, blockTime)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	reply, err := adminCl.InitRegistry(dfuReg, 5)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	_, err = adminCl.Cl.WaitProof(reply.IID, time.Duration(blockTime)*time.Second, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	reg := &Registry{adminCl: adminCl, bc: byzcoin.NewClient(byzID,
+		*regRoster), iid: reply.IID, units: dfuReg, blockTime: blockTime}
+	rdata, err := reg.byzData()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return reg, rdata, threshMap, nil
+}
+
+// PinStateUnit sets the ledger of state unit unitID to byzID and returns
+// the new proof of the registry.
+func (r *Registry) PinStateUnit(unitID string,
+	byzID skipchain.SkipBlockID) (*execbase.ByzData, error) {
+	dfu, ok := r.units.Units[unitID]
+	if !ok {
+		return nil, fmt.Errorf("cannot find dfu %s", unitID)
+	}
+	dfu.SkipchainID = byzID
+	_, err := r.adminCl.UpdateDFU(r.iid, unitID, dfu, 5)
+	if err != nil {
+		return nil, err
 	}
-	pr, err := adminCl.Cl.WaitProof(reply.IID, time.Duration(blockTime)*time.Second, nil)
+	return r.byzData()
+}
+
+func (r *Registry) byzData() (*execbase.ByzData, error) {
+	proof, err := core.GetStorageProof(r.bc, r.iid, nil)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	genesis, err := adminCl.Cl.FetchGenesisBlock(pr.Latest.SkipChainID())
+	genesis, err := r.adminCl.Cl.FetchGenesisBlock(proof.Proof.Latest.
+		SkipChainID())
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	return &execbase.ByzData{
-		IID:     reply.IID,
-		Proof:   pr,
-		Genesis: genesis,
-	}, threshMap, nil
+		IID:       r.iid,
+		Proof:     proof.Proof,
+		Genesis:   genesis,
+		KeyProofs: proof.KeyProofs,
+	}, nil
 }
 
 func GenerateBallots(numCandidates int, count int) []string {
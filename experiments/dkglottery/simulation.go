@@ -13,6 +13,7 @@ import (
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/experiments/commons"
 	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/driver"
 	"github.com/dedis/protean/libexec"
 	"github.com/dedis/protean/libexec/apps/dkglottery"
 	execbase "github.com/dedis/protean/libexec/base"
@@ -51,6 +52,7 @@ type SimulationService struct {
 
 	threshMap   map[string]int
 	rdata       *execbase.ByzData
+	reg         *commons.Registry
 	CID         byzcoin.InstanceID
 	contractGen *skipchain.SkipBlock
 	X           kyber.Point
@@ -151,9 +153,21 @@ func (s *SimulationService) initContract() error {
 	return nil
 }
 
-func (s *SimulationService) executeSetup() error {
-	inReceipts := make(map[int]map[string]*core.OpcodeReceipt)
+// newDriver returns a driver that executes the txns of the contract with
+// the given clients.
+func (s *SimulationService) newDriver(execCl *libexec.Client,
+	stCl *libstate.Client) *driver.Driver {
+	return &driver.Driver{
+		ExecCl:   execCl,
+		StateCl:  stCl,
+		ThreshCl: s.thCl,
+		RData:    s.rdata,
+		Genesis:  s.contractGen,
+		Wait:     commons.UPDATE_WAIT,
+	}
+}
 
+func (s *SimulationService) executeSetup() error {
 	// Get state
 	gcs, err := s.stCl.GetState(s.CID)
 	if err != nil {
@@ -164,73 +178,59 @@ func (s *SimulationService) executeSetup() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("setup_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "setupwf", "setup")
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: init_dkg
-	m2 := monitor.NewTimeMeasure("setup_initdkg")
-	dkgReply, err := s.thCl.InitDKG(execReq)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: exec
-	m3 := monitor.NewTimeMeasure("setup_exec")
-	setupInput := dkglottery.SetupInput{Pk: dkgReply.Output.X}
-	data, err := protobuf.Encode(&setupInput)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "setup_dkglot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = dkgReply.Receipts
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
-	m3.Record()
-
-	// Step 3: update_state
-	m4 := monitor.NewTimeMeasure("setup_update")
-	var setupOut dkglottery.SetupOutput
-	err = protobuf.Decode(execReply.Output.Data, &setupOut)
-	if err != nil {
-		log.Error(err)
-		return err
+	var X kyber.Point
+	var m2, m3, m4 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: init_dkg
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("setup_initdkg")
+			return nil, nil
+		},
+		// Step 2: exec
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("setup_exec")
+			dkgReply := res.Reply(0).(*threshold.InitDKGReply)
+			X = dkgReply.Output.X
+			setupInput := dkglottery.SetupInput{Pk: X}
+			data, err := protobuf.Encode(&setupInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "setup_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 3: update_state
+		2: func(res *driver.Results) (interface{}, error) {
+			m3.Record()
+			m4 = monitor.NewTimeMeasure("setup_update")
+			var setupOut dkglottery.SetupOutput
+			execReply := res.Reply(1).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &setupOut)
+			return setupOut.WS, err
+		},
 	}
-	inReceipts[execReq.Index] = execReply.InputReceipts
-	execReq.Index = 2
-	execReq.OpReceipts = execReply.OutputReceipts
-
-	_, err = s.stCl.UpdateState(setupOut.WS, execReq, inReceipts, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Error(err)
 	}
-	s.X = dkgReply.Output.X
+	s.X = X
 	m4.Record()
 	return err
 }
@@ -247,8 +247,6 @@ func (s *SimulationService) executeBatchJoin(idx int) error {
 		log.Errorf("getting state: %v", err)
 		return err
 	}
-	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
 	lastRoot := gcs.Proof.Proof.InclusionProof.GetRoot()
 
 	joinMonitor := monitor.NewTimeMeasure(fmt.Sprintf("batch_join_%d", idx))
@@ -266,42 +264,25 @@ func (s *SimulationService) executeBatchJoin(idx int) error {
 		log.Errorf("encoding input: %v", err)
 		return err
 	}
-	itReply, err := execCl.InitTransaction(s.rdata, cdata, "joinwf", "join")
-	if err != nil {
-		log.Errorf("initializing txn: %v", err)
-		return err
-	}
-
-	// Step 1: execute
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "batch_join_dkglot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-	execReply, err := execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing batch_join_dkglot: %v", err)
-		return err
-	}
-
-	// Step 2: update_state
-	var joinOut dkglottery.JoinOutput
-	err = protobuf.Decode(execReply.Output.Data, &joinOut)
-	if err != nil {
-		log.Errorf("decoding join output: %v", err)
-		return err
+	inputs := map[int]driver.InputProvider{
+		// Step 1: execute
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "batch_join_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var joinOut dkglottery.JoinOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &joinOut)
+			return joinOut.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = stCl.UpdateState(joinOut.WS, execReq, nil, commons.UPDATE_WAIT)
+	_, err = s.newDriver(execCl, stCl).Run(s.CID, "joinwf", "join", inputs)
 	if err != nil {
-		log.Error(err)
+		log.Errorf("executing join: %v", err)
 		return err
 	}
 	_, err = stCl.WaitProof(s.CID[:], lastRoot, commons.PROOF_WAIT)
@@ -325,8 +306,6 @@ func (s *SimulationService) executeJoin(idx int) error {
 		log.Errorf("getting state: %v", err)
 		return err
 	}
-	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
 	lastRoot := gcs.Proof.Proof.InclusionProof.GetRoot()
 
 	label := fmt.Sprintf("p%d_join", idx)
@@ -345,50 +324,33 @@ func (s *SimulationService) executeJoin(idx int) error {
 		return err
 	}
 
-	done := false
-	for !done {
-		itReply, err := execCl.InitTransaction(s.rdata, cdata, "joinwf", "join")
-		if err != nil {
-			log.Errorf("initializing txn: %v", err)
-			return err
-		}
-
+	inputs := map[int]driver.InputProvider{
 		// Step 1: execute
-		sp := make(map[string]*core.StateProof)
-		sp["readset"] = &gcs.Proof
-		execInput := execbase.ExecuteInput{
-			FnName:      "join_dkglot",
-			Data:        data,
-			StateProofs: sp,
-		}
-		execReq := &core.ExecutionRequest{
-			Index: 0,
-			EP:    &itReply.Plan,
-		}
-		execReply, err := execCl.Execute(execInput, execReq)
-		if err != nil {
-			log.Errorf("executing join_dkglot: %v", err)
-			return err
-		}
-
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "join_dkglot",
+				Data:   data,
+			}, nil
+		},
 		// Step 2: update_state
-		var joinOut dkglottery.JoinOutput
-		err = protobuf.Decode(execReply.Output.Data, &joinOut)
-		if err != nil {
-			log.Errorf("decoding join output: %v", err)
-			return err
-		}
-		execReq.Index = 1
-		execReq.OpReceipts = execReply.OutputReceipts
-		_, err = stCl.UpdateState(joinOut.WS, execReq, nil, commons.UPDATE_WAIT)
+		1: func(res *driver.Results) (interface{}, error) {
+			var joinOut dkglottery.JoinOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &joinOut)
+			return joinOut.WS, err
+		},
+	}
+	dr := s.newDriver(execCl, stCl)
+	done := false
+	for !done {
+		_, err = dr.Run(s.CID, "joinwf", "join", inputs)
 		if err != nil {
-			pr, err := stCl.WaitProof(execReq.EP.CID, lastRoot, commons.PROOF_WAIT)
+			// Another join changed the state: retry on the new state
+			pr, err := stCl.WaitProof(s.CID[:], lastRoot, commons.PROOF_WAIT)
 			if err != nil {
 				log.Errorf("wait proof: %v", err)
 				return err
 			}
-			gcs.Proof.Proof = pr
-			cdata.Proof = gcs.Proof.Proof
 			lastRoot = pr.InclusionProof.GetRoot()
 			//log.Info("retry:", idx)
 		} else {
@@ -415,20 +377,14 @@ func (s *SimulationService) executeClose() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("close_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "closewf", "close")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: exec
-	m2 := monitor.NewTimeMeasure("close_exec")
 	closeInput := dkglottery.CloseInput{
 		Barrier: 0,
 	}
@@ -437,38 +393,34 @@ func (s *SimulationService) executeClose() error {
 		log.Errorf("encoding close input: %v", err)
 		return err
 	}
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "close_dkglot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing close_dkglot: %v", err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: update_state
-	m3 := monitor.NewTimeMeasure("close_update")
-	var closeOut dkglottery.CloseOutput
-	err = protobuf.Decode(execReply.Output.Data, &closeOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
+	var m2, m3 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("close_exec")
+			return execbase.ExecuteInput{
+				FnName: "close_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("close_update")
+			var closeOut dkglottery.CloseOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &closeOut)
+			return closeOut.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-
-	_, err = s.stCl.UpdateState(closeOut.WS, execReq, nil, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Errorf("updating state: %v", err)
+		log.Errorf("executing close: %v", err)
 		return err
 	}
 	// Wait for proof
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -477,8 +429,6 @@ func (s *SimulationService) executeClose() error {
 }
 
 func (s *SimulationService) executeFinalize() error {
-	inReceipts := make(map[int]map[string]*core.OpcodeReceipt)
-
 	// Get state
 	gcs, err := s.stCl.GetState(s.CID)
 	if err != nil {
@@ -489,93 +439,67 @@ func (s *SimulationService) executeFinalize() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("finalize_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "finalizewf",
 		"finalize")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: exec
-	m2 := monitor.NewTimeMeasure("finalize_exec_1")
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "prepare_decrypt_dkglot",
-		StateProofs: sp,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing prepare_decrypt_dkglot: %v", err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: decrypt
-	m3 := monitor.NewTimeMeasure("finalize_decrypt")
-	var prepOut dkglottery.PrepDecOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	decReply, err := s.thCl.Decrypt(&prepOut.Input, execReq)
-	if err != nil {
-		log.Errorf("decrypting: %v", err)
-		return err
-	}
-	m3.Record()
-
-	// Step 3: exec
-	m4 := monitor.NewTimeMeasure("finalize_exec_2")
-	finalInput := dkglottery.FinalizeInput{Ps: decReply.Output.Ps}
-	data, err := protobuf.Encode(&finalInput)
-	if err != nil {
-		log.Errorf("protobuf encode: %v", err)
-		return err
-	}
-	execInput = execbase.ExecuteInput{
-		FnName:      "finalize_dkglot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	inReceipts[execReq.Index] = decReply.InputReceipts
-	execReq.Index = 2
-	execReq.OpReceipts = decReply.OutputReceipts
-	execReply, err = s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing finalize_dkglot: %v", err)
-		return err
-	}
-	m4.Record()
-
-	// Step 4: update_state
-	m5 := monitor.NewTimeMeasure("finalize_update")
-	var finalOut dkglottery.FinalizeOutput
-	err = protobuf.Decode(execReply.Output.Data, &finalOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
+	var m2, m3, m4, m5 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("finalize_exec_1")
+			return execbase.ExecuteInput{
+				FnName: "prepare_decrypt_dkglot",
+			}, nil
+		},
+		// Step 2: decrypt
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("finalize_decrypt")
+			var prepOut dkglottery.PrepDecOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &prepOut)
+			return prepOut.Input, err
+		},
+		// Step 3: exec
+		2: func(res *driver.Results) (interface{}, error) {
+			m3.Record()
+			m4 = monitor.NewTimeMeasure("finalize_exec_2")
+			decReply := res.Reply(1).(*threshold.DecryptReply)
+			finalInput := dkglottery.FinalizeInput{Ps: decReply.Output.Ps}
+			data, err := protobuf.Encode(&finalInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "finalize_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 4: update_state
+		3: func(res *driver.Results) (interface{}, error) {
+			m4.Record()
+			m5 = monitor.NewTimeMeasure("finalize_update")
+			var finalOut dkglottery.FinalizeOutput
+			execReply := res.Reply(2).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &finalOut)
+			return finalOut.WS, err
+		},
 	}
-	inReceipts[execReq.Index] = execReply.InputReceipts
-	execReq.Index = 3
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = s.stCl.UpdateState(finalOut.WS, execReq, inReceipts, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Errorf("updating state: %v", err)
+		log.Errorf("executing finalize: %v", err)
 		return err
 	}
 
 	// Wait for proof
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -607,6 +531,10 @@ func (s *SimulationService) runDKGLottery() error {
 		if err != nil {
 			log.Error(err)
 		}
+		s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+		if err != nil {
+			return err
+		}
 		s.stCl = libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
 
 		var wg sync.WaitGroup
@@ -677,6 +605,10 @@ func (s *SimulationService) runBatchedLottery() error {
 		if err != nil {
 			log.Error(err)
 		}
+		s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+		if err != nil {
+			return err
+		}
 		s.stCl = libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
 
 		// Initialize contract
@@ -736,7 +668,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	keyMap[statebase.UID] = s.stRoster.ServicePublics(skipchain.ServiceName)
 	keyMap[execbase.UID] = s.execRoster.ServicePublics(libexec.ServiceName)
 	keyMap[thbase.UID] = s.threshRoster.ServicePublics(blscosi.ServiceName)
-	s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
+	s.reg, s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
 		keyMap, s.BlockTime)
 	if err != nil {
 		log.Error(err)
@@ -17,6 +17,7 @@ import (
 	neffbase "github.com/dedis/protean/easyneff/base"
 	"github.com/dedis/protean/experiments/commons"
 	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/driver"
 	"github.com/dedis/protean/libexec"
 	evotingpc "github.com/dedis/protean/libexec/apps/evoting_pc"
 	execbase "github.com/dedis/protean/libexec/base"
@@ -34,6 +35,13 @@ import (
 	"go.dedis.ch/protobuf"
 )
 
+// precommitBlocks is the number of blocks after the latest block at the
+// time the contract is created until the precommit round of h closes:
+// InitContract adds two blocks, and the setup update and the precommit of
+// h add one block each. The round has closed once the first vote is
+// applied.
+const precommitBlocks = 5
+
 type SimulationService struct {
 	onet.SimulationBFTree
 	ContractFile      string
@@ -60,9 +68,14 @@ type SimulationService struct {
 
 	threshMap   map[string]int
 	rdata       *execbase.ByzData
+	reg         *commons.Registry
 	CID         byzcoin.InstanceID
 	contractGen *skipchain.SkipBlock
 	X           kyber.Point
+	// pcKey is the key of the client that commits to h and pcDeadline is
+	// the block at which the precommit round closes
+	pcKey      kyber.Scalar
+	pcDeadline int
 }
 
 func init() {
@@ -138,10 +151,20 @@ func (s *SimulationService) initContract() error {
 		Contract: contract,
 		FSM:      fsm,
 	}
+	chain, err := skipchain.NewClient().GetUpdateChain(s.stRoster, s.byzID)
+	if err != nil {
+		log.Errorf("getting latest block: %v", err)
+		return err
+	}
+	s.pcDeadline = chain.Update[len(chain.Update)-1].Index + precommitBlocks
+	s.pcKey = cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
 	hdr := &core.ContractHeader{
-		CodeHash:  utils.GetCodeHash(),
-		Lock:      false,
-		CurrState: fsm.InitialState,
+		CodeHash:          utils.GetCodeHash(),
+		Lock:              false,
+		CurrState:         fsm.InitialState,
+		PrecommitDeadline: s.pcDeadline,
+		Precommitters: []core.Precommitter{{Key: "h",
+			Public: cothority.Suite.Point().Mul(s.pcKey, nil)}},
 	}
 	encBallots := evotingpc.EncBallots{}
 	buf, err := protobuf.Encode(&encBallots)
@@ -166,9 +189,22 @@ func (s *SimulationService) initContract() error {
 	return nil
 }
 
-func (s *SimulationService) executeSetup() error {
-	inReceipts := make(map[int]map[string]*core.OpcodeReceipt)
+// newDriver returns a driver that executes the txns of the contract with
+// the given clients.
+func (s *SimulationService) newDriver(execCl *libexec.Client,
+	stCl *libstate.Client) *driver.Driver {
+	return &driver.Driver{
+		ExecCl:   execCl,
+		StateCl:  stCl,
+		ThreshCl: s.thCl,
+		ShufCl:   s.shCl,
+		RData:    s.rdata,
+		Genesis:  s.contractGen,
+		Wait:     commons.UPDATE_WAIT,
+	}
+}
 
+func (s *SimulationService) executeSetup() error {
 	// Get state
 	gcs, err := s.stCl.GetState(s.CID)
 	if err != nil {
@@ -179,74 +215,76 @@ func (s *SimulationService) executeSetup() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("setup_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "setupwf", "setup")
 	if err != nil {
-		log.Error(err)
+		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: init_dkg
-	m2 := monitor.NewTimeMeasure("setup_initdkg")
-	dkgReply, err := s.thCl.InitDKG(execReq)
-	if err != nil {
-		log.Error(err)
-		return err
+	var X kyber.Point
+	var m2, m3, m4 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: init_dkg
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("setup_initdkg")
+			return nil, nil
+		},
+		// Step 2: exec
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("setup_exec")
+			dkgReply := res.Reply(0).(*threshold.InitDKGReply)
+			X = dkgReply.Output.X
+			setupInput := evotingpc.SetupInput{Pk: X}
+			data, err := protobuf.Encode(&setupInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "setup_vote_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 3: update_state
+		2: func(res *driver.Results) (interface{}, error) {
+			m3.Record()
+			m4 = monitor.NewTimeMeasure("setup_update")
+			var out evotingpc.SetupOutput
+			execReply := res.Reply(1).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	m2.Record()
-
-	// Step 2: exec
-	m3 := monitor.NewTimeMeasure("setup_exec")
-	setupInput := evotingpc.SetupInput{Pk: dkgReply.Output.X}
-	data, err := protobuf.Encode(&setupInput)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Error(err)
+		log.Errorf("executing setup: %v", err)
 		return err
 	}
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "setup_vote_pc",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = dkgReply.Receipts
-	execReply, err := s.execCl.Execute(execInput, execReq)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	m3.Record()
-
-	// Step 3: update_state
-	m4 := monitor.NewTimeMeasure("setup_update")
-	var setupOut evotingpc.SetupOutput
-	err = protobuf.Decode(execReply.Output.Data, &setupOut)
+	s.X = X
+	m4.Record()
+	// Commit to h, which is revealed by the lock txn
+	hBuf, err := s.X.MarshalBinary()
 	if err != nil {
-		log.Error(err)
+		log.Errorf("marshaling point: %v", err)
 		return err
 	}
-	inReceipts[execReq.Index] = execReply.InputReceipts
-	execReq.Index = 2
-	execReq.OpReceipts = execReply.OutputReceipts
-
-	_, err = s.stCl.UpdateState(setupOut.WS, execReq, inReceipts, commons.UPDATE_WAIT)
+	pc, err := core.NewPrecommit(s.CID, "h", hBuf, s.pcDeadline, s.pcKey)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.Precommit(pc, commons.UPDATE_WAIT)
 	if err != nil {
-		log.Error(err)
+		log.Errorf("submitting precommit: %v", err)
 	}
-	s.X = dkgReply.Output.X
-	m4.Record()
 	return err
 }
 
@@ -262,8 +300,6 @@ func (s *SimulationService) executeBatchVote(ballots []string, idx int) error {
 		log.Errorf("getting state: %v", err)
 		return err
 	}
-	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
 	lastRoot := gcs.Proof.Proof.InclusionProof.GetRoot()
 
 	voteMonitor := monitor.NewTimeMeasure(fmt.Sprintf("batch_vote_%d", idx))
@@ -282,41 +318,25 @@ func (s *SimulationService) executeBatchVote(ballots []string, idx int) error {
 		log.Errorf("encoding input: %v", err)
 		return err
 	}
-
-	itReply, err := execCl.InitTransaction(s.rdata, cdata, "votewf", "vote")
-	if err != nil {
-		log.Errorf("initializing txn: %v", err)
-		return err
-	}
-	// Step 1: execute
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "batch_vote_pc",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-	execReply, err := execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing batch_vote_pc: %v", err)
-		return err
-	}
-	// Step 2: update_state
-	var voteOut evotingpc.VoteOutput
-	err = protobuf.Decode(execReply.Output.Data, &voteOut)
-	if err != nil {
-		log.Errorf("decoding vote output: %v", err)
-		return err
+	inputs := map[int]driver.InputProvider{
+		// Step 1: execute
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "batch_vote_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var voteOut evotingpc.VoteOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &voteOut)
+			return voteOut.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = stCl.UpdateState(voteOut.WS, execReq, nil, commons.UPDATE_WAIT)
+	_, err = s.newDriver(execCl, stCl).Run(s.CID, "votewf", "vote", inputs)
 	if err != nil {
-		log.Error(err)
+		log.Errorf("executing vote: %v", err)
 		return err
 	}
 	_, err = stCl.WaitProof(s.CID[:], lastRoot, commons.PROOF_WAIT)
@@ -340,8 +360,6 @@ func (s *SimulationService) executeVote(ballot string, idx int) error {
 		log.Errorf("getting state: %v", err)
 		return err
 	}
-	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
 	lastRoot := gcs.Proof.Proof.InclusionProof.GetRoot()
 
 	label := fmt.Sprintf("p%d_vote", idx)
@@ -357,51 +375,33 @@ func (s *SimulationService) executeVote(ballot string, idx int) error {
 		log.Errorf("encoding input: %v", err)
 		return err
 	}
-
-	done := false
-	for !done {
-		itReply, err := execCl.InitTransaction(s.rdata, cdata, "votewf", "vote")
-		if err != nil {
-			log.Errorf("initializing txn: %v", err)
-			return err
-		}
-
+	inputs := map[int]driver.InputProvider{
 		// Step 1: execute
-		sp := make(map[string]*core.StateProof)
-		sp["readset"] = &gcs.Proof
-		execInput := execbase.ExecuteInput{
-			FnName:      "vote_pc",
-			Data:        data,
-			StateProofs: sp,
-		}
-		execReq := &core.ExecutionRequest{
-			Index: 0,
-			EP:    &itReply.Plan,
-		}
-		execReply, err := execCl.Execute(execInput, execReq)
-		if err != nil {
-			log.Errorf("executing vote_pc: %v", err)
-			return err
-		}
-
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "vote_pc",
+				Data:   data,
+			}, nil
+		},
 		// Step 2: update_state
-		var voteOut evotingpc.VoteOutput
-		err = protobuf.Decode(execReply.Output.Data, &voteOut)
-		if err != nil {
-			log.Errorf("decoding vote output: %v", err)
-			return err
-		}
-		execReq.Index = 1
-		execReq.OpReceipts = execReply.OutputReceipts
-		_, err = stCl.UpdateState(voteOut.WS, execReq, nil, commons.UPDATE_WAIT)
+		1: func(res *driver.Results) (interface{}, error) {
+			var voteOut evotingpc.VoteOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &voteOut)
+			return voteOut.WS, err
+		},
+	}
+	dr := s.newDriver(execCl, stCl)
+	done := false
+	for !done {
+		_, err = dr.Run(s.CID, "votewf", "vote", inputs)
 		if err != nil {
+			// Another vote changed the state: retry on the new state
 			pr, err := stCl.WaitProof(s.CID[:], lastRoot, commons.PROOF_WAIT)
 			if err != nil {
 				log.Errorf("wait proof: %v", err)
 				return err
 			}
-			gcs.Proof.Proof = pr
-			cdata.Proof = gcs.Proof.Proof
 			lastRoot = pr.InclusionProof.GetRoot()
 			//log.Info("retry:", idx)
 		} else {
@@ -428,20 +428,14 @@ func (s *SimulationService) executeLock() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("lock_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "finalizewf", "lock")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: exec
-	m2 := monitor.NewTimeMeasure("lock_exec")
 	lockInput := evotingpc.LockInput{
 		Barrier: 0,
 	}
@@ -455,41 +449,38 @@ func (s *SimulationService) executeLock() error {
 		log.Errorf("marshaling point: %v", err)
 		return err
 	}
-	pc := &core.KVDict{Data: make(map[string][]byte)}
-	pc.Data["h"] = hBuf
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "lock",
-		Data:        data,
-		StateProofs: sp,
-		Precommits:  pc,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
+	reveals := &core.KVDict{Data: make(map[string][]byte)}
+	reveals.Data["h"] = hBuf
+	var m2, m3 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("lock_exec")
+			return execbase.ExecuteInput{
+				FnName:     "lock",
+				Data:       data,
+				Precommits: reveals,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("lock_update")
+			var out evotingpc.LockOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
+	}
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
 		log.Errorf("executing lock: %v", err)
 		return err
 	}
-	m2.Record()
-
-	// Step 2: update_state
-	m3 := monitor.NewTimeMeasure("lock_update")
-	var lockOut evotingpc.LockOutput
-	err = protobuf.Decode(execReply.Output.Data, &lockOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = s.stCl.UpdateState(lockOut.WS, execReq, nil, commons.UPDATE_WAIT)
-	if err != nil {
-		log.Errorf("updating state: %v", err)
-		return err
-	}
 
 	// Wait for proof
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -498,8 +489,6 @@ func (s *SimulationService) executeLock() error {
 }
 
 func (s *SimulationService) executeShuffle() error {
-	inReceipts := make(map[int]map[string]*core.OpcodeReceipt)
-
 	// Get state
 	gcs, err := s.stCl.GetState(s.CID)
 	if err != nil {
@@ -510,91 +499,66 @@ func (s *SimulationService) executeShuffle() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("shuffle_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "finalizewf", "shuffle")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: exec
-	m2 := monitor.NewTimeMeasure("shuffle_exec_1")
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "prepare_shuffle_pc",
-		StateProofs: sp,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing prepare_shuffle_pc: %v", err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: shuffle
-	m3 := monitor.NewTimeMeasure("shuffle_shuffle")
-	var prepShOut evotingpc.PrepShufOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepShOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	shReply, err := s.shCl.Shuffle(prepShOut.Input.Pairs, prepShOut.Input.H, execReq)
-	if err != nil {
-		log.Errorf("shuffle: %v", err)
-		return err
-	}
-	m3.Record()
-
-	// Step 3: exec
-	m4 := monitor.NewTimeMeasure("shuffle_exec_2")
-	prepPrInput := evotingpc.PrepProofsInput{ShProofs: shReply.Proofs}
-	data, err := protobuf.Encode(&prepPrInput)
-	if err != nil {
-		log.Errorf("protobuf encode: %v", err)
-		return err
-	}
-	execInput = execbase.ExecuteInput{
-		FnName:      "prepare_proofs_pc",
-		Data:        data,
-		StateProofs: sp,
-	}
-	inReceipts[execReq.Index] = shReply.InputReceipts
-	execReq.Index = 2
-	execReq.OpReceipts = shReply.OutputReceipts
-	execReply, err = s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing prepare_proofs_pc: %v", err)
-		return err
-	}
-	m4.Record()
-
-	// Step 4: update_state
-	m5 := monitor.NewTimeMeasure("shuffle_update")
-	var prepPrOut evotingpc.PrepProofsOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepPrOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
+	var m2, m3, m4, m5 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("shuffle_exec_1")
+			return execbase.ExecuteInput{
+				FnName: "prepare_shuffle_pc",
+			}, nil
+		},
+		// Step 2: shuffle
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("shuffle_shuffle")
+			var prepShOut evotingpc.PrepShufOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &prepShOut)
+			return prepShOut.Input, err
+		},
+		// Step 3: exec
+		2: func(res *driver.Results) (interface{}, error) {
+			m3.Record()
+			m4 = monitor.NewTimeMeasure("shuffle_exec_2")
+			shReply := res.Reply(1).(*easyneff.ShuffleReply)
+			prepPrInput := evotingpc.PrepProofsInput{ShProofs: shReply.Proofs}
+			data, err := protobuf.Encode(&prepPrInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "prepare_proofs_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 4: update_state
+		3: func(res *driver.Results) (interface{}, error) {
+			m4.Record()
+			m5 = monitor.NewTimeMeasure("shuffle_update")
+			var out evotingpc.PrepProofsOutput
+			execReply := res.Reply(2).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	inReceipts[execReq.Index] = execReply.InputReceipts
-	execReq.Index = 3
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = s.stCl.UpdateState(prepPrOut.WS, execReq, inReceipts, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Errorf("updating state: %v", err)
+		log.Errorf("executing shuffle: %v", err)
 		return err
 	}
 
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	// Wait for proof
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -603,8 +567,6 @@ func (s *SimulationService) executeShuffle() error {
 }
 
 func (s *SimulationService) executeTally() error {
-	inReceipts := make(map[int]map[string]*core.OpcodeReceipt)
-
 	// Get state
 	gcs, err := s.stCl.GetState(s.CID)
 	if err != nil {
@@ -615,95 +577,69 @@ func (s *SimulationService) executeTally() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("tally_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "finalizewf", "tally")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: exec
-	m2 := monitor.NewTimeMeasure("tally_exec_1")
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "prepare_decrypt_vote_pc",
-		StateProofs: sp,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing prepare_decrypt_vote_pc: %v", err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: decrypt
-	m3 := monitor.NewTimeMeasure("tally_decrypt")
-	var prepDecOut evotingpc.PrepDecOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepDecOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	decReply, err := s.thCl.Decrypt(&prepDecOut.Input, execReq)
-	if err != nil {
-		log.Errorf("decrypting: %v", err)
-		return err
-	}
-	m3.Record()
-
-	// Step 3: exec
-	m4 := monitor.NewTimeMeasure("tally_exec_2")
-	tallyIn := evotingpc.TallyInput{
-		CandCount: s.NumCandidates,
-		Ps:        decReply.Output.Ps,
-	}
-	data, err := protobuf.Encode(&tallyIn)
-	if err != nil {
-		log.Errorf("protobuf encode: %v", err)
-		return err
-	}
-	execInput = execbase.ExecuteInput{
-		FnName:      "tally_pc",
-		Data:        data,
-		StateProofs: sp,
-	}
-	inReceipts[execReq.Index] = decReply.InputReceipts
-	execReq.Index = 2
-	execReq.OpReceipts = decReply.OutputReceipts
-	execReply, err = s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing tally_pc: %v", err)
-		return err
-	}
-	m4.Record()
-
-	// Step 4: update_state
-	m5 := monitor.NewTimeMeasure("tally_update")
-	var tallyOut evotingpc.TallyOutput
-	err = protobuf.Decode(execReply.Output.Data, &tallyOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
+	var m2, m3, m4, m5 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("tally_exec_1")
+			return execbase.ExecuteInput{
+				FnName: "prepare_decrypt_vote_pc",
+			}, nil
+		},
+		// Step 2: decrypt
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("tally_decrypt")
+			var prepDecOut evotingpc.PrepDecOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &prepDecOut)
+			return prepDecOut.Input, err
+		},
+		// Step 3: exec
+		2: func(res *driver.Results) (interface{}, error) {
+			m3.Record()
+			m4 = monitor.NewTimeMeasure("tally_exec_2")
+			decReply := res.Reply(1).(*threshold.DecryptReply)
+			tallyIn := evotingpc.TallyInput{
+				CandCount: s.NumCandidates,
+				Ps:        decReply.Output.Ps,
+			}
+			data, err := protobuf.Encode(&tallyIn)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "tally_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 4: update_state
+		3: func(res *driver.Results) (interface{}, error) {
+			m4.Record()
+			m5 = monitor.NewTimeMeasure("tally_update")
+			var out evotingpc.TallyOutput
+			execReply := res.Reply(2).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	inReceipts[execReq.Index] = execReply.InputReceipts
-	execReq.Index = 3
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = s.stCl.UpdateState(tallyOut.WS, execReq, inReceipts, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Errorf("updating state: %v", err)
+		log.Errorf("executing tally: %v", err)
 		return err
 	}
 
 	// Wait for proof
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -747,6 +683,10 @@ func (s *SimulationService) runEvoting() error {
 		if err != nil {
 			log.Error(err)
 		}
+		s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+		if err != nil {
+			return err
+		}
 		s.stCl = libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
 
 		var wg sync.WaitGroup
@@ -832,6 +772,10 @@ func (s *SimulationService) runBatchedEvoting() error {
 		if err != nil {
 			log.Error(err)
 		}
+		s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+		if err != nil {
+			return err
+		}
 		s.stCl = libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
 
 		// Initialize contract
@@ -899,7 +843,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	keyMap[execbase.UID] = s.execRoster.ServicePublics(libexec.ServiceName)
 	keyMap[neffbase.UID] = s.shufRoster.ServicePublics(blscosi.ServiceName)
 	keyMap[thbase.UID] = s.threshRoster.ServicePublics(blscosi.ServiceName)
-	s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
+	s.reg, s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
 		keyMap, s.BlockTime)
 	if err != nil {
 		log.Error(err)
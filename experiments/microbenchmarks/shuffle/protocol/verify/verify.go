@@ -172,7 +172,7 @@ func (s *ShuffleVerify) verifyResponse(r structVerifyProofsResponse) error {
 
 func (s *ShuffleVerify) generateResponse() (*VerifyProofsResponse, error) {
 	sigs := make(map[string]bdnproto.BdnSignature)
-	hash, err := s.ShufOutput.Hash()
+	hash, err := s.ShufOutput.Hash(core.CurrentHashVersion)
 	if err != nil {
 		return &VerifyProofsResponse{}, err
 	}
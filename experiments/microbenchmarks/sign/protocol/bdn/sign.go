@@ -168,6 +168,7 @@ func (s *BDNSign) generateResponse() (*BDNSignResponse, error) {
 		h.Write(data)
 		dataHash := h.Sum(nil)
 		r := core.OpcodeReceipt{
+			Version:   s.ExecReq.EP.Version,
 			EPID:      s.ExecReq.EP.Hash(),
 			OpIdx:     s.ExecReq.Index,
 			Name:      varName,
@@ -156,6 +156,7 @@ func (s *Sign) generateResponse() (*BLSSignResponse, error) {
 		h.Write(data)
 		dataHash := h.Sum(nil)
 		r := core.OpcodeReceipt{
+			Version:   s.ExecReq.EP.Version,
 			EPID:      s.ExecReq.EP.Hash(),
 			OpIdx:     s.ExecReq.Index,
 			Name:      varName,
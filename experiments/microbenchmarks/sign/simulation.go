@@ -49,6 +49,7 @@ type SimulationService struct {
 
 	threshMap   map[string]int
 	rdata       *execbase.ByzData
+	reg         *commons.Registry
 	CID         byzcoin.InstanceID
 	contractGen *skipchain.SkipBlock
 }
@@ -98,6 +99,10 @@ func (s *SimulationService) initDFUs() error {
 	if err != nil {
 		log.Error(err)
 	}
+	s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+	if err != nil {
+		log.Error(err)
+	}
 	return err
 }
 
@@ -148,7 +153,7 @@ func (s *SimulationService) executeBLSSign(config *onet.SimulationConfig) error
 		return err
 	}
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := execCl.InitTransaction(s.rdata, cdata, "signwf", "sign")
 	execReq := &core.ExecutionRequest{
 		Index: 0,
@@ -230,7 +235,7 @@ func (s *SimulationService) executeBDNSign(config *onet.SimulationConfig) error
 		return err
 	}
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := execCl.InitTransaction(s.rdata, cdata, "signwf", "sign")
 	execReq := &core.ExecutionRequest{
 		Index: 0,
@@ -273,7 +278,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	keyMap[service.UID] = s.signerRoster.ServicePublics(service.ServiceName)
 	keyMap[statebase.UID] = s.stRoster.ServicePublics(blscosi.ServiceName)
 	keyMap[execbase.UID] = s.execRoster.ServicePublics(libexec.ServiceName)
-	s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
+	s.reg, s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
 		keyMap, s.BlockTime)
 	if err != nil {
 		log.Error(err)
@@ -274,7 +274,7 @@ func (d *ThreshDecrypt) reconstructResponse(r structReconstructResponse) error {
 
 func (d *ThreshDecrypt) generateResponse() (*ReconstructResponse, error) {
 	sigs := make(map[string]bdnproto.BdnSignature)
-	hash, err := utils.HashPoints(d.Ps)
+	hash, err := utils.HashPoints(core.CurrentHashVersion, d.Ps)
 	if err != nil {
 		log.Errorf("calculating the hash of points: %v", err)
 		return &ReconstructResponse{}, err
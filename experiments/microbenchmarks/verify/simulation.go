@@ -58,6 +58,7 @@ type SimulationService struct {
 
 	threshMap   map[string]int
 	rdata       *execbase.ByzData
+	reg         *commons.Registry
 	CID         byzcoin.InstanceID
 	contractGen *skipchain.SkipBlock
 }
@@ -107,6 +108,10 @@ func (s *SimulationService) initDFUs() error {
 	if err != nil {
 		log.Error(err)
 	}
+	s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+	if err != nil {
+		log.Error(err)
+	}
 	return err
 }
 
@@ -187,7 +192,7 @@ func (s *SimulationService) generateVerifyOPCData(config *onet.SimulationConfig)
 		return err
 	}
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	for _, ni := range s.NumInputs {
 		txnName := fmt.Sprintf("verify_%d", ni)
 		itReply, err := execCl.InitTransaction(s.rdata, cdata, "verifywf", txnName)
@@ -342,7 +347,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	keyMap[verifysvc.UID] = s.verifierRoster.ServicePublics(verifysvc.ServiceName)
 	keyMap[signsvc.UID] = s.signerRoster.ServicePublics(blscosi.ServiceName)
 
-	s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
+	s.reg, s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
 		keyMap, s.BlockTime)
 	if err != nil {
 		log.Error(err)
@@ -15,6 +15,7 @@ import (
 	randbase "github.com/dedis/protean/easyrand/base"
 	"github.com/dedis/protean/experiments/commons"
 	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/driver"
 	"github.com/dedis/protean/libexec"
 	"github.com/dedis/protean/libexec/apps/randlottery"
 	execbase "github.com/dedis/protean/libexec/base"
@@ -52,6 +53,7 @@ type SimulationService struct {
 
 	threshMap   map[string]int
 	rdata       *execbase.ByzData
+	reg         *commons.Registry
 	CID         byzcoin.InstanceID
 	contractGen *skipchain.SkipBlock
 }
@@ -137,7 +139,7 @@ func (s *SimulationService) initContract() error {
 		Lock:      false,
 		CurrState: fsm.InitialState,
 	}
-	tickets := randlottery.Tickets{}
+	tickets := core.ItemList{}
 	buf, err := protobuf.Encode(&tickets)
 	if err != nil {
 		log.Error(err)
@@ -160,6 +162,20 @@ func (s *SimulationService) initContract() error {
 	return nil
 }
 
+// newDriver returns a driver that executes the txns of the contract with
+// the given clients.
+func (s *SimulationService) newDriver(execCl *libexec.Client,
+	stCl *libstate.Client) *driver.Driver {
+	return &driver.Driver{
+		ExecCl:  execCl,
+		StateCl: stCl,
+		RandCl:  s.randCl,
+		RData:   s.rdata,
+		Genesis: s.contractGen,
+		Wait:    commons.UPDATE_WAIT,
+	}
+}
+
 func (s *SimulationService) executeBatchJoin(signers []darc.Signer, idx int) error {
 	execCl := libexec.NewClient(s.execRoster)
 	stCl := libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
@@ -172,15 +188,14 @@ func (s *SimulationService) executeBatchJoin(signers []darc.Signer, idx int) err
 		log.Errorf("getting state: %v", err)
 		return err
 	}
-	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
 	lastRoot := gcs.Proof.Proof.InclusionProof.GetRoot()
 
 	joinMonitor := monitor.NewTimeMeasure(fmt.Sprintf("batch_join_%d", idx))
 
 	var tickets randlottery.Tickets
 	for _, signer := range signers {
-		pkHash, err := utils.HashPoint(signer.Ed25519.Point)
+		pkHash, err := utils.HashPoint(core.CurrentHashVersion,
+			signer.Ed25519.Point)
 		if err != nil {
 			log.Errorf("hashing point: %v", err)
 			return err
@@ -202,40 +217,25 @@ func (s *SimulationService) executeBatchJoin(signers []darc.Signer, idx int) err
 		return err
 	}
 
-	itReply, err := execCl.InitTransaction(s.rdata, cdata, "joinwf", "join")
-	if err != nil {
-		log.Errorf("initializing txn: %v", err)
-		return err
-	}
-	// Step 1: execute
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "batch_join_randlot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing batch_join_randlot: %v", err)
-		return err
-	}
-	// Step 2: update_state
-	var joinOut randlottery.JoinOutput
-	err = protobuf.Decode(execReply.Output.Data, &joinOut)
-	if err != nil {
-		log.Errorf("decoding join output: %v", err)
-		return err
+	inputs := map[int]driver.InputProvider{
+		// Step 1: execute
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "batch_join_randlot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var joinOut randlottery.JoinOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &joinOut)
+			return joinOut.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = stCl.UpdateState(joinOut.WS, execReq, nil, commons.UPDATE_WAIT)
+	_, err = s.newDriver(execCl, stCl).Run(s.CID, "joinwf", "join", inputs)
 	if err != nil {
-		log.Error(err)
+		log.Errorf("executing join: %v", err)
 		return err
 	}
 	_, err = stCl.WaitProof(s.CID[:], lastRoot, commons.PROOF_WAIT)
@@ -259,15 +259,14 @@ func (s *SimulationService) executeJoin(signer darc.Signer, idx int) error {
 		log.Errorf("getting state: %v", err)
 		return err
 	}
-	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
 	lastRoot := gcs.Proof.Proof.InclusionProof.GetRoot()
 
 	label := fmt.Sprintf("p%d_join", idx)
 	joinMonitor := monitor.NewTimeMeasure(label)
 
 	// Prepare ticket
-	pkHash, err := utils.HashPoint(signer.Ed25519.Point)
+	pkHash, err := utils.HashPoint(core.CurrentHashVersion,
+		signer.Ed25519.Point)
 	if err != nil {
 		log.Errorf("hashing point: %v", err)
 		return err
@@ -289,48 +288,33 @@ func (s *SimulationService) executeJoin(signer darc.Signer, idx int) error {
 		return err
 	}
 
-	done := false
-	for !done {
-		itReply, err := execCl.InitTransaction(s.rdata, cdata, "joinwf", "join")
-		if err != nil {
-			log.Errorf("initializing txn: %v", err)
-			return err
-		}
+	inputs := map[int]driver.InputProvider{
 		// Step 1: execute
-		sp := make(map[string]*core.StateProof)
-		sp["readset"] = &gcs.Proof
-		execInput := execbase.ExecuteInput{
-			FnName:      "join_randlot",
-			Data:        data,
-			StateProofs: sp,
-		}
-		execReq := &core.ExecutionRequest{
-			Index: 0,
-			EP:    &itReply.Plan,
-		}
-		execReply, err := s.execCl.Execute(execInput, execReq)
-		if err != nil {
-			log.Errorf("executing join_randlot: %v", err)
-			return err
-		}
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "join_randlot",
+				Data:   data,
+			}, nil
+		},
 		// Step 2: update_state
-		var joinOut randlottery.JoinOutput
-		err = protobuf.Decode(execReply.Output.Data, &joinOut)
-		if err != nil {
-			log.Errorf("decoding join output: %v", err)
-			return err
-		}
-		execReq.Index = 1
-		execReq.OpReceipts = execReply.OutputReceipts
-		_, err = stCl.UpdateState(joinOut.WS, execReq, nil, commons.UPDATE_WAIT)
+		1: func(res *driver.Results) (interface{}, error) {
+			var joinOut randlottery.JoinOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &joinOut)
+			return joinOut.WS, err
+		},
+	}
+	dr := s.newDriver(execCl, stCl)
+	done := false
+	for !done {
+		_, err = dr.Run(s.CID, "joinwf", "join", inputs)
 		if err != nil {
+			// Another join changed the state: retry on the new state
 			pr, err := stCl.WaitProof(s.CID[:], lastRoot, commons.PROOF_WAIT)
 			if err != nil {
 				log.Errorf("wait proof: %v", err)
 				return err
 			}
-			gcs.Proof.Proof = pr
-			cdata.Proof = gcs.Proof.Proof
 			lastRoot = pr.InclusionProof.GetRoot()
 			//log.Info("retry:", idx)
 		} else {
@@ -357,20 +341,14 @@ func (s *SimulationService) executeClose() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("close_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "closewf", "close")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: exec
-	m2 := monitor.NewTimeMeasure("close_exec")
 	closeInput := randlottery.CloseInput{
 		Barrier: 0,
 	}
@@ -379,38 +357,35 @@ func (s *SimulationService) executeClose() error {
 		log.Errorf("encoding close input: %v", err)
 		return err
 	}
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "close_randlot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing close_randlot: %v", err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: update_state
-	m3 := monitor.NewTimeMeasure("close_update")
-	var closeOut randlottery.CloseOutput
-	err = protobuf.Decode(execReply.Output.Data, &closeOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
+	var m2, m3 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("close_exec")
+			return execbase.ExecuteInput{
+				FnName: "close_randlot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("close_update")
+			var closeOut randlottery.CloseOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &closeOut)
+			return closeOut.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = s.stCl.UpdateState(closeOut.WS, execReq, nil, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Errorf("updating state: %v", err)
+		log.Errorf("executing close: %v", err)
 		return err
 	}
 
 	// Wait for proof
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -419,8 +394,6 @@ func (s *SimulationService) executeClose() error {
 }
 
 func (s *SimulationService) executeFinalize() error {
-	inReceipts := make(map[int]map[string]*core.OpcodeReceipt)
-
 	// Get state
 	gcs, err := s.stCl.GetState(s.CID)
 	if err != nil {
@@ -431,75 +404,60 @@ func (s *SimulationService) executeFinalize() error {
 	// Initialize transaction
 	m1 := monitor.NewTimeMeasure("finalize_inittxn")
 	cdata := &execbase.ByzData{IID: s.CID, Proof: gcs.Proof.Proof,
-		Genesis: s.contractGen}
+		Genesis: s.contractGen, KeyProofs: gcs.Proof.KeyProofs}
 	itReply, err := s.execCl.InitTransaction(s.rdata, cdata, "finalizewf",
 		"finalize")
 	if err != nil {
 		log.Errorf("initializing txn: %v", err)
 		return err
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
 	m1.Record()
 
-	// Step 1: randomness
 	round := uint64(2)
-	m2 := monitor.NewTimeMeasure("finalize_getrand")
-	randReply, err := s.randCl.GetRandomness(round, execReq)
-	if err != nil {
-		log.Errorf("getting randomness: %v", err)
-		return err
-	}
-	m2.Record()
-
-	// Step 2: exec
-	m3 := monitor.NewTimeMeasure("finalize_exec")
-	finalizeInput := randlottery.FinalizeInput{
-		Round:      round,
-		Randomness: randReply.Output,
-	}
-	data, err := protobuf.Encode(&finalizeInput)
-	if err != nil {
-		log.Errorf("protobuf encode: %v", err)
-		return err
-	}
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "finalize_randlot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = randReply.Receipts
-	execReply, err := s.execCl.Execute(execInput, execReq)
-	if err != nil {
-		log.Errorf("executing finalize_randlot: %v", err)
-		return err
-	}
-	m3.Record()
-
-	// Step 3: update_state
-	m4 := monitor.NewTimeMeasure("finalize_update")
-	var finalOut randlottery.FinalizeOutput
-	err = protobuf.Decode(execReply.Output.Data, &finalOut)
-	if err != nil {
-		log.Errorf("protobuf decode: %v", err)
-		return err
+	var m2, m3, m4 *monitor.TimeMeasure
+	inputs := map[int]driver.InputProvider{
+		// Step 1: randomness
+		0: func(*driver.Results) (interface{}, error) {
+			m2 = monitor.NewTimeMeasure("finalize_getrand")
+			return randbase.RandomnessInput{Round: round}, nil
+		},
+		// Step 2: exec
+		1: func(res *driver.Results) (interface{}, error) {
+			m2.Record()
+			m3 = monitor.NewTimeMeasure("finalize_exec")
+			randReply := res.Reply(0).(*easyrand.GetRandomnessReply)
+			finalizeInput := randlottery.FinalizeInput{
+				Round:      round,
+				Randomness: randReply.Output,
+			}
+			data, err := protobuf.Encode(&finalizeInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "finalize_randlot",
+				Data:   data,
+			}, nil
+		},
+		// Step 3: update_state
+		2: func(res *driver.Results) (interface{}, error) {
+			m3.Record()
+			m4 = monitor.NewTimeMeasure("finalize_update")
+			var finalOut randlottery.FinalizeOutput
+			execReply := res.Reply(1).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &finalOut)
+			return finalOut.WS, err
+		},
 	}
-	inReceipts[execReq.Index] = execReply.InputReceipts
-	execReq.Index = 2
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = s.stCl.UpdateState(finalOut.WS, execReq, inReceipts, commons.UPDATE_WAIT)
+	_, err = s.newDriver(s.execCl, s.stCl).Execute(&itReply.Plan, &gcs.Proof,
+		inputs)
 	if err != nil {
-		log.Errorf("updating state: %v", err)
+		log.Errorf("executing finalize: %v", err)
 		return err
 	}
 
 	// Wait for proof
-	_, err = s.stCl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, commons.PROOF_WAIT)
+	_, err = s.stCl.WaitProof(s.CID[:], itReply.Plan.StateRoot, commons.PROOF_WAIT)
 	if err != nil {
 		log.Errorf("wait proof: %v", err)
 	}
@@ -528,6 +486,10 @@ func (s *SimulationService) runRandLottery() error {
 		if err != nil {
 			log.Error(err)
 		}
+		s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+		if err != nil {
+			return err
+		}
 		s.stCl = libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
 
 		var wg sync.WaitGroup
@@ -590,6 +552,10 @@ func (s *SimulationService) runBatchedLottery() error {
 		if err != nil {
 			log.Error(err)
 		}
+		s.rdata, err = s.reg.PinStateUnit(statebase.UID, s.byzID)
+		if err != nil {
+			return err
+		}
 		s.stCl = libstate.NewClient(byzcoin.NewClient(s.byzID, *s.stRoster))
 
 		// Initialize contract
@@ -644,7 +610,7 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	keyMap[statebase.UID] = s.stRoster.ServicePublics(skipchain.ServiceName)
 	keyMap[execbase.UID] = s.execRoster.ServicePublics(libexec.ServiceName)
 	keyMap[randbase.UID] = s.randRoster.ServicePublics(blscosi.ServiceName)
-	s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
+	s.reg, s.rdata, s.threshMap, err = commons.SetupRegistry(regRoster, &s.DFUFile,
 		keyMap, s.BlockTime)
 	if err != nil {
 		log.Error(err)
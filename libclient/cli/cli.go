@@ -0,0 +1,253 @@
+// The Protean command-line tool for contract developers. It validates a
+// contract before it is deployed:
+//
+//	./cli validate --contract contract.json --fsm fsm.json --registry units.json
+//
+// fetches the history of a deployed contract from the nodes of its state
+// unit and of the DFU registry (see verifier.Fetch):
+//
+//	./cli fetch --cid <hex> --state-group state.toml --state-id <hex> \
+//		--registry-group registry.toml --registry-id <hex> \
+//		--registry-iid <hex> --history history.bin
+//
+// and verifies the history against the skipchain IDs of the state unit and
+// of the DFU registry:
+//
+//	./cli history --history history.bin --state-id <hex> --registry-id <hex>
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/verifier"
+	"github.com/dedis/protean/libstate"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/log"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+func main() {
+	cliApp := cli.NewApp()
+	cliApp.Name = "protean-cli"
+	cliApp.Usage = "tools for Protean contract developers"
+	cliApp.Version = "0.1"
+
+	cliApp.Commands = []cli.Command{
+		{
+			Name:    "validate",
+			Aliases: []string{"v"},
+			Usage:   "Validate a contract against its FSM and the DFU registry",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "contract",
+					Usage: "contract JSON file",
+				},
+				cli.StringFlag{
+					Name:  "fsm",
+					Usage: "FSM JSON file",
+				},
+				cli.StringFlag{
+					Name:  "registry",
+					Usage: "DFU registry JSON file",
+				},
+				cli.StringFlag{
+					Name:  "keys",
+					Usage: "comma-separated keys that are given to InitContract",
+				},
+			},
+			Action: validate,
+		},
+		{
+			Name:    "fetch",
+			Aliases: []string{"f"},
+			Usage:   "Fetch the history of a contract for the history command",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "cid",
+					Usage: "hex-encoded contract ID",
+				},
+				cli.StringFlag{
+					Name:  "state-group",
+					Usage: "group TOML file of the state unit",
+				},
+				cli.StringFlag{
+					Name:  "state-id",
+					Usage: "hex-encoded skipchain ID of the state unit",
+				},
+				cli.StringFlag{
+					Name:  "registry-group",
+					Usage: "group TOML file of the DFU registry",
+				},
+				cli.StringFlag{
+					Name:  "registry-id",
+					Usage: "hex-encoded skipchain ID of the DFU registry",
+				},
+				cli.StringFlag{
+					Name:  "registry-iid",
+					Usage: "hex-encoded instance ID of the DFU registry",
+				},
+				cli.StringFlag{
+					Name:  "history",
+					Usage: "output file",
+				},
+			},
+			Action: fetch,
+		},
+		{
+			Name:    "history",
+			Aliases: []string{"h"},
+			Usage:   "Verify the updates of a contract from its txn log",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "history",
+					Usage: "history file that is written by the fetch command",
+				},
+				cli.StringFlag{
+					Name:  "state-id",
+					Usage: "hex-encoded skipchain ID of the state unit",
+				},
+				cli.StringFlag{
+					Name:  "registry-id",
+					Usage: "hex-encoded skipchain ID of the DFU registry",
+				},
+			},
+			Action: history,
+		},
+	}
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+
+	log.ErrFatal(cliApp.Run(os.Args))
+}
+
+func validate(c *cli.Context) error {
+	for _, name := range []string{"contract", "fsm", "registry"} {
+		if c.String(name) == "" {
+			return fmt.Errorf("missing --%s", name)
+		}
+	}
+	contractFile := c.String("contract")
+	contract, err := libclient.ReadContractJSON(&contractFile)
+	if err != nil {
+		return err
+	}
+	fsmFile := c.String("fsm")
+	fsm, err := libclient.ReadFSMJSON(&fsmFile)
+	if err != nil {
+		return err
+	}
+	regFile := c.String("registry")
+	registry, err := libclient.ReadDFUJSON(&regFile)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if c.String("keys") != "" {
+		keys = strings.Split(c.String("keys"), ",")
+	}
+	err = libclient.ValidateContract(contract, fsm, registry, keys...)
+	if err != nil {
+		return err
+	}
+	fmt.Println("contract is valid")
+	return nil
+}
+
+func fetch(c *cli.Context) error {
+	for _, name := range []string{"cid", "state-group", "state-id",
+		"registry-group", "registry-id", "registry-iid", "history"} {
+		if c.String(name) == "" {
+			return fmt.Errorf("missing --%s", name)
+		}
+	}
+	ids := make(map[string][]byte)
+	for _, name := range []string{"cid", "state-id", "registry-id",
+		"registry-iid"} {
+		id, err := hex.DecodeString(c.String(name))
+		if err != nil {
+			return fmt.Errorf("invalid --%s: %v", name, err)
+		}
+		ids[name] = id
+	}
+	stGroup, err := readGroup(c.String("state-group"))
+	if err != nil {
+		return err
+	}
+	regGroup, err := readGroup(c.String("registry-group"))
+	if err != nil {
+		return err
+	}
+	stCl := libstate.NewClient(byzcoin.NewClient(ids["state-id"],
+		*stGroup.Roster))
+	regCl := byzcoin.NewClient(ids["registry-id"], *regGroup.Roster)
+	h, err := verifier.Fetch(stCl, regCl, byzcoin.NewInstanceID(ids["cid"]),
+		byzcoin.NewInstanceID(ids["registry-iid"]))
+	if err != nil {
+		return err
+	}
+	err = verifier.WriteHistory(c.String("history"), h)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("history of contract %s written to %s\n", h.CID,
+		c.String("history"))
+	return nil
+}
+
+func readGroup(file string) (*app.Group, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening group file: %v", err)
+	}
+	defer f.Close()
+	group, err := app.ReadGroupDescToml(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading group file: %v", err)
+	}
+	return group, nil
+}
+
+func history(c *cli.Context) error {
+	for _, name := range []string{"history", "state-id", "registry-id"} {
+		if c.String(name) == "" {
+			return fmt.Errorf("missing --%s", name)
+		}
+	}
+	h, err := verifier.ReadHistory(c.String("history"))
+	if err != nil {
+		return err
+	}
+	stateID, err := hex.DecodeString(c.String("state-id"))
+	if err != nil {
+		return fmt.Errorf("invalid --state-id: %v", err)
+	}
+	registryID, err := hex.DecodeString(c.String("registry-id"))
+	if err != nil {
+		return fmt.Errorf("invalid --registry-id: %v", err)
+	}
+	report, err := verifier.Verify(h, skipchain.SkipBlockID(stateID),
+		skipchain.SkipBlockID(registryID))
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+	if !report.OK() {
+		return fmt.Errorf("history of contract %s is not valid", h.CID)
+	}
+	return nil
+}
@@ -0,0 +1,824 @@
+// Package driver executes the transactions of a Protean contract. Given a
+// contract, a workflow and a txn name, the driver obtains an execution plan
+// from the code-execution unit, invokes the DFUs in the order that is given
+// by the opcode dependencies, and passes the opcode receipts and the state
+// proofs from one opcode to the next.
+package driver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/protean/core"
+	"github.com/dedis/protean/easyneff"
+	neffbase "github.com/dedis/protean/easyneff/base"
+	"github.com/dedis/protean/easyrand"
+	randbase "github.com/dedis/protean/easyrand/base"
+	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libexec"
+	execbase "github.com/dedis/protean/libexec/base"
+	"github.com/dedis/protean/libstate"
+	statebase "github.com/dedis/protean/libstate/base"
+	"github.com/dedis/protean/threshold"
+	threshbase "github.com/dedis/protean/threshold/base"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"golang.org/x/xerrors"
+)
+
+// stateAttempts is the number of times that Run requests the state of the
+// contracts that are updated by a txn until the proofs have the same root.
+const stateAttempts = 5
+
+// decisionAttempts is the number of times that the decision of the
+// coordinator of a cross-unit plan is sent to another state unit.
+const decisionAttempts = 5
+
+// InputProvider returns the input of an opcode. It is called once all the
+// opcodes that the opcode depends on have been executed, so it can use their
+// replies to build the input. Providers of independent opcodes may be called
+// concurrently. The type of the returned value depends on the
+// DFU that executes the opcode:
+//   - codeexec: execbase.ExecuteInput
+//   - state: byzcoin.Arguments (the writeset), or statebase.UpdateInput if
+//     the txn updates several contracts
+//   - easyrand: randbase.RandomnessInput
+//   - threshold: threshbase.DecryptInput (not needed for init_dkg)
+//   - easyneff: neffbase.ShuffleInput
+type InputProvider func(res *Results) (interface{}, error)
+
+// Results holds the execution plan and the DFU replies of the opcodes that
+// have been executed so far. It is safe for concurrent use.
+type Results struct {
+	Plan  *core.ExecutionPlan
+	Proof *core.StateProof
+	// ExtProofs holds the proofs of the contracts that are read by KEYVALUE
+	// dependencies with a CID, keyed by core.DataDependency.ContractKey
+	ExtProofs map[string]*core.StateProof
+
+	sync.Mutex
+	replies     map[int]interface{}
+	outReceipts map[int]map[string]*core.OpcodeReceipt
+	inReceipts  map[int]map[string]*core.OpcodeReceipt
+}
+
+// Reply returns the reply of the DFU that executed opcode idx (e.g.,
+// *libexec.ExecuteReply). An input provider can read the reply of every
+// opcode that its opcode depends on.
+func (res *Results) Reply(idx int) interface{} {
+	res.Lock()
+	defer res.Unlock()
+	return res.replies[idx]
+}
+
+// Driver holds the DFU clients that are used to execute the opcodes. Only
+// the clients of the DFUs that are used by the contract need to be set.
+type Driver struct {
+	ExecCl   *libexec.Client
+	StateCl  *libstate.Client
+	RandCl   *easyrand.Client
+	ThreshCl *threshold.Client
+	ShufCl   *easyneff.Client
+	// ExtStateCls holds the clients of the state units other than StateCl
+	// that store contracts that are read by KEYVALUE dependencies, keyed by
+	// their DFU ID.
+	ExtStateCls map[string]*libstate.Client
+	// ContractUnits holds the DFU IDs of the state units that host the
+	// contracts that are updated by a txn, keyed by their hex-encoded CID.
+	// It only needs to be set for contracts that are not hosted by the
+	// state unit of StateCl. Their clients are taken from ExtStateCls.
+	ContractUnits map[string]string
+
+	// RData is the registry proof that is given to the code-execution unit.
+	RData *execbase.ByzData
+	// Genesis is the genesis block of the state unit's ledger.
+	Genesis *skipchain.SkipBlock
+	// Wait is the number of blocks to wait for the update_state opcode.
+	Wait int
+	// LockBlocks is the number of blocks for which the execution plan of
+	// Run locks the contract. The lock is taken when the plan is generated
+	// and released by its update; if Run fails, the lock expires. If it is
+	// zero, the contract is not locked and concurrent clients of the
+	// contract may invalidate each other's plans.
+	LockBlocks int
+}
+
+// Run executes the txn txnName of workflow wfName on the contract cid.
+// inputs maps opcode indices to their input providers. It returns the reply
+// of the update_state opcode.
+func (d *Driver) Run(cid byzcoin.InstanceID, wfName string, txnName string,
+	inputs map[int]InputProvider) (*libstate.UpdateStateReply, error) {
+	keys, txn, unit, err := d.stateKeys(cid, wfName, txnName)
+	if err != nil {
+		return nil, err
+	}
+	gcs, extData, err := d.updatedState(cid, keys, txn)
+	if err != nil {
+		return nil, err
+	}
+	// The proofs of the contracts that are read are requested after the
+	// proof of the contract, which bounds their staleness (see
+	// core.CheckExtFreshness)
+	readData, err := d.extState(txn, unit)
+	if err != nil {
+		return nil, err
+	}
+	if extData == nil {
+		extData = readData
+	} else {
+		for key, data := range readData {
+			extData[key] = data
+		}
+	}
+	cdata := &execbase.ByzData{
+		IID:       cid,
+		Proof:     gcs.Proof.Proof,
+		Genesis:   d.Genesis,
+		KeyProofs: gcs.Proof.KeyProofs,
+	}
+	itReply, err := d.ExecCl.InitTransactionWithExtData(d.RData, cdata,
+		extData, wfName, txnName, d.LockBlocks, d.Wait)
+	if err != nil {
+		return nil, xerrors.Errorf("initializing transaction: %v", err)
+	}
+	proof := &core.StateProof{Proof: gcs.Proof.Proof, Genesis: d.Genesis,
+		KeyProofs: gcs.Proof.KeyProofs}
+	extProofs := make(map[string]*core.StateProof)
+	for cidStr, data := range extData {
+		extProofs[cidStr] = &core.StateProof{Proof: data.Proof,
+			Genesis: data.Genesis, KeyProofs: data.KeyProofs}
+	}
+	return d.execute(&itReply.Plan, proof, extProofs, inputs)
+}
+
+// stateKeys returns the keys of the contract that the txn reads: the keys
+// that the code-execution unit needs to generate the execution plan, the
+// keys of the FSM guards, the keys of the KEYVALUE inputs and the
+// precommits of the PRECOMMIT inputs. It also returns the txn and the
+// state unit that hosts the contract.
+func (d *Driver) stateKeys(cid byzcoin.InstanceID, wfName string,
+	txnName string) ([]string, *core.Transaction, string, error) {
+	gcs, err := d.StateCl.GetStateKeys(cid, []string{core.KeyRaw,
+		core.KeyHeader})
+	if err != nil {
+		return nil, nil, "", xerrors.Errorf("getting raw contract: %v", err)
+	}
+	store, err := gcs.Proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, nil, "", err
+	}
+	raw, err := store.GetRaw()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	hdr, err := store.GetHeader()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	wf, ok := raw.Contract.Workflows[wfName]
+	if !ok {
+		return nil, nil, "", xerrors.Errorf("cannot find workflow %s",
+			wfName)
+	}
+	txn, ok := wf.Txns[txnName]
+	if !ok {
+		return nil, nil, "", xerrors.Errorf("cannot find txn %s in "+
+			"workflow %s", txnName, wfName)
+	}
+	keys := []string{core.KeyRaw, core.KeyHeader, core.RebaseLogKey}
+	keys = append(keys, raw.FSM.GuardKeys(txnName)...)
+	for _, opcode := range txn.Opcodes {
+		for _, dep := range opcode.Dependencies {
+			if dep.Src == core.PRECOMMIT {
+				keys = append(keys, core.KeyPrecommits)
+				continue
+			}
+			if dep.Src != core.KEYVALUE || dep.CID != "" {
+				continue
+			}
+			kvKeys, err := dep.Value.Keys()
+			if err != nil {
+				return nil, nil, "", err
+			}
+			keys = append(keys, kvKeys...)
+		}
+	}
+	return uniqueKeys(keys), txn, hdr.StateUnit(), nil
+}
+
+// extState returns the proofs of the contracts that are read by the KEYVALUE
+// dependencies of txn that name a CID, keyed by
+// core.DataDependency.ContractKey. A proof only
+// covers the keys that are read. planUnit is the state unit of StateCl,
+// which stores the contracts whose dependency does not name a unit.
+func (d *Driver) extState(txn *core.Transaction, planUnit string) (
+	map[string]*execbase.ByzData, error) {
+	keys := make(map[string][]string)
+	units := make(map[string]string)
+	for _, opcode := range txn.Opcodes {
+		for _, dep := range opcode.Dependencies {
+			if dep.Src != core.KEYVALUE || dep.CID == "" {
+				continue
+			}
+			kvKeys, err := dep.Value.Keys()
+			if err != nil {
+				return nil, err
+			}
+			key, err := dep.ContractKey()
+			if err != nil {
+				return nil, err
+			}
+			keys[key] = append(keys[key], kvKeys...)
+			units[key] = dep.StateUnit(planUnit)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	extData := make(map[string]*execbase.ByzData)
+	for cidStr, kvKeys := range keys {
+		cl := d.StateCl
+		if unit := units[cidStr]; unit != planUnit {
+			cl = d.ExtStateCls[unit]
+			if cl == nil {
+				return nil, xerrors.Errorf("missing client for state "+
+					"unit %s", unit)
+			}
+		}
+		buf, err := hex.DecodeString(cidStr)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid contract ID %s: %v",
+				cidStr, err)
+		}
+		cid := byzcoin.NewInstanceID(buf)
+		gcs, err := cl.GetStateKeys(cid, uniqueKeys(kvKeys))
+		if err != nil {
+			return nil, xerrors.Errorf("getting state of contract %s: %v",
+				cidStr, err)
+		}
+		extData[cidStr] = &execbase.ByzData{
+			IID:       cid,
+			Proof:     gcs.Proof.Proof,
+			Genesis:   gcs.Proof.Genesis,
+			KeyProofs: gcs.Proof.KeyProofs,
+		}
+	}
+	return extData, nil
+}
+
+// updatedState returns the state of the contract and the proofs of the
+// other contracts that are updated by txn. The state unit applies the
+// writesets of all contracts that it hosts in one transaction, so the
+// proofs of the contracts on the unit of StateCl are requested again until
+// they have the same root.
+func (d *Driver) updatedState(cid byzcoin.InstanceID, keys []string,
+	txn *core.Transaction) (*libstate.GetStateReply,
+	map[string]*execbase.ByzData, error) {
+	cids, err := txn.UpdatedContracts()
+	if err != nil {
+		return nil, nil, err
+	}
+	var extData map[string]*execbase.ByzData
+	if len(cids) > 0 {
+		extData = make(map[string]*execbase.ByzData)
+	}
+	for i := 0; i < stateAttempts; i++ {
+		gcs, err := d.StateCl.GetStateKeys(cid, keys)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("getting contract state: %v", err)
+		}
+		root := gcs.Proof.Proof.InclusionProof.GetRoot()
+		same := true
+		for _, other := range cids {
+			iid := byzcoin.NewInstanceID(other)
+			cl := d.StateCl
+			unit, remote := d.ContractUnits[hex.EncodeToString(other)]
+			if remote {
+				cl = d.ExtStateCls[unit]
+				if cl == nil {
+					return nil, nil, xerrors.Errorf("missing client for "+
+						"state unit %s", unit)
+				}
+			}
+			ogcs, err := cl.GetState(iid)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("getting state of contract "+
+					"%s: %v", iid, err)
+			}
+			if !remote &&
+				!bytes.Equal(ogcs.Proof.Proof.InclusionProof.GetRoot(), root) {
+				same = false
+				break
+			}
+			extData[hex.EncodeToString(other)] = &execbase.ByzData{
+				IID:       iid,
+				Proof:     ogcs.Proof.Proof,
+				Genesis:   ogcs.Proof.Genesis,
+				KeyProofs: ogcs.Proof.KeyProofs,
+			}
+		}
+		if same {
+			return gcs, extData, nil
+		}
+	}
+	return nil, nil, xerrors.New("state changed while getting the contract " +
+		"states")
+}
+
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool)
+	unique := keys[:0]
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// Execute executes the opcodes of an execution plan. proof is the state
+// proof that the plan is generated from. It is given to every opcode that
+// has a KEYVALUE dependency on the contract; the proofs of other contracts
+// have to be set in the opcode input (Run fetches them). An opcode is
+// started as soon as the opcodes that it depends on have finished, so
+// independent opcodes run concurrently. The update_state opcode is started
+// after all other opcodes have finished, because it needs their input
+// receipts.
+func (d *Driver) Execute(plan *core.ExecutionPlan, proof *core.StateProof,
+	inputs map[int]InputProvider) (*libstate.UpdateStateReply, error) {
+	return d.execute(plan, proof, nil, inputs)
+}
+
+func (d *Driver) execute(plan *core.ExecutionPlan, proof *core.StateProof,
+	extProofs map[string]*core.StateProof,
+	inputs map[int]InputProvider) (*libstate.UpdateStateReply, error) {
+	_, err := libclient.SortOpcodes(plan.Txn)
+	if err != nil {
+		return nil, xerrors.Errorf("sorting opcodes: %v", err)
+	}
+	res := &Results{
+		Plan:        plan,
+		Proof:       proof,
+		ExtProofs:   extProofs,
+		replies:     make(map[int]interface{}),
+		outReceipts: make(map[int]map[string]*core.OpcodeReceipt),
+		inReceipts:  make(map[int]map[string]*core.OpcodeReceipt),
+	}
+	parents, err := getParents(plan.Txn)
+	if err != nil {
+		return nil, err
+	}
+	count := len(plan.Txn.Opcodes)
+	done := make([]chan struct{}, count)
+	errs := make([]error, count)
+	for idx := range done {
+		done[idx] = make(chan struct{})
+	}
+	var wg sync.WaitGroup
+	for idx := 0; idx < count; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			defer close(done[idx])
+			for _, p := range parents[idx] {
+				<-done[p]
+				if errs[p] != nil {
+					errs[idx] = xerrors.Errorf("opcode %d failed", p)
+					return
+				}
+			}
+			_, err := d.executeOpcode(res, idx, inputs[idx])
+			if err != nil {
+				errs[idx] = xerrors.Errorf("executing opcode %d (%s): %v",
+					idx, plan.Txn.Opcodes[idx].Name, err)
+			}
+		}(idx)
+	}
+	wg.Wait()
+	var reply *libstate.UpdateStateReply
+	for idx := 0; idx < count; idx++ {
+		if errs[idx] != nil {
+			return nil, errs[idx]
+		}
+		if usReply, ok := res.replies[idx].(*libstate.UpdateStateReply); ok {
+			reply = usReply
+		}
+	}
+	if reply == nil {
+		return nil, xerrors.New("txn does not have an update_state opcode")
+	}
+	return reply, nil
+}
+
+// updateCrossUnit applies a plan whose contracts are hosted by several state
+// units with a two-phase commit: the plan is prepared on every unit, the
+// coordinator commits it with the prepare proofs of the other units, and
+// the other units commit it with the proof of the decision of the
+// coordinator. If a unit fails to prepare the plan, the coordinator aborts
+// it, and the units that prepared it abort it with its decision. It returns
+// the commit reply of the unit of the plan.
+func (d *Driver) updateCrossUnit(input statebase.UpdateInput,
+	execReq *core.ExecutionRequest,
+	inReceipts map[int]map[string]*core.OpcodeReceipt) (
+	*libstate.UpdateStateReply, error) {
+	plan := execReq.EP
+	tpc := &twoPC{plan: plan, clients: make(map[string]unitClient),
+		wait: d.Wait, delay: time.Second}
+	for _, unit := range plan.StateUnits() {
+		cl, err := d.stateClient(plan, unit)
+		if err != nil {
+			return nil, err
+		}
+		tpc.clients[unit] = cl
+	}
+	return tpc.run(input, execReq, inReceipts)
+}
+
+// unitClient is the part of libstate.Client that runs the two-phase commit
+// of a plan on a state unit.
+type unitClient interface {
+	PrepareState(input statebase.UpdateInput, execReq *core.ExecutionRequest,
+		inReceipts map[int]map[string]*core.OpcodeReceipt, wait int) (
+		*libstate.PrepareStateReply, error)
+	CommitState(cid byzcoin.InstanceID, planID []byte,
+		ev core.PrepareEvidence, wait int) (*libstate.CommitStateReply, error)
+	AbortState(cid byzcoin.InstanceID, planID []byte,
+		ev core.PrepareEvidence, wait int) (*libstate.AbortStateReply, error)
+	GetStateKeys(cid byzcoin.InstanceID, keys []string) (
+		*libstate.GetStateReply, error)
+}
+
+// twoPC runs the two-phase commit of a plan with the clients of its state
+// units. A decision of the coordinator is final, so the commands that pass
+// it to the other units are retried up to decisionAttempts times, delay
+// apart.
+type twoPC struct {
+	plan    *core.ExecutionPlan
+	clients map[string]unitClient
+	wait    int
+	delay   time.Duration
+}
+
+func (tpc *twoPC) run(input statebase.UpdateInput,
+	execReq *core.ExecutionRequest,
+	inReceipts map[int]map[string]*core.OpcodeReceipt) (
+	*libstate.UpdateStateReply, error) {
+	plan := tpc.plan
+	// The coordinator prepares the plan first, so that it can abort the plan
+	// if another unit fails to prepare it
+	units := []string{plan.Coordinator()}
+	for _, unit := range plan.StateUnits() {
+		if unit != plan.Coordinator() {
+			units = append(units, unit)
+		}
+	}
+	var proofs []core.PrepareProof
+	var prepared []string
+	for _, unit := range units {
+		r, err := tpc.clients[unit].PrepareState(input, execReq, inReceipts,
+			tpc.wait)
+		if err != nil {
+			err = xerrors.Errorf("preparing plan on unit %s: %v", unit, err)
+			if len(prepared) == 0 {
+				return nil, err
+			}
+			abortErr := tpc.abort(prepared, unit)
+			if abortErr != nil {
+				return nil, xerrors.Errorf("%v; aborting plan: %v", err,
+					abortErr)
+			}
+			return nil, err
+		}
+		prepared = append(prepared, unit)
+		proofs = append(proofs, r.Proofs...)
+	}
+	cid := byzcoin.NewInstanceID(plan.CID)
+	r, err := tpc.clients[plan.Coordinator()].CommitState(cid, plan.PlanID,
+		core.PrepareEvidence{Proofs: proofs}, tpc.wait)
+	if err != nil {
+		// The lock of the coordinator may have expired before the commit,
+		// in which case the plan can only be aborted
+		err = xerrors.Errorf("committing plan on unit %s: %v",
+			plan.Coordinator(), err)
+		abortErr := tpc.abort(prepared, "")
+		if abortErr != nil {
+			return nil, xerrors.Errorf("%v; aborting plan: %v", err, abortErr)
+		}
+		return nil, err
+	}
+	err = tpc.sendDecision(prepared, &r.Decision, true)
+	if err != nil {
+		return nil, err
+	}
+	return &libstate.UpdateStateReply{TxResp: r.TxResp}, nil
+}
+
+// abort aborts the plan on the coordinator and then on the other prepared
+// units with the proof of its decision. If failed is set, the coordinator is
+// given the proof that the unit failed to prepare the plan. Without that
+// proof, or if the coordinator rejects it because the ledger of the unit has
+// not moved since the plan was generated, the coordinator only aborts the
+// plan once its lock has expired. A rejected abort returns after the client
+// waited for its inclusion, so the abort is retried until core.PrepareBlocks
+// blocks have passed.
+func (tpc *twoPC) abort(prepared []string, failed string) error {
+	plan := tpc.plan
+	var ev core.PrepareEvidence
+	if failed != "" {
+		ev.Failed = tpc.failedProof(failed)
+	}
+	wait := tpc.wait
+	if wait < 1 {
+		wait = 1
+	}
+	cid := byzcoin.NewInstanceID(plan.CID)
+	var r *libstate.AbortStateReply
+	var err error
+	for blocks := 0; ; blocks += wait {
+		r, err = tpc.clients[plan.Coordinator()].AbortState(cid, plan.PlanID,
+			ev, wait)
+		if err == nil {
+			break
+		}
+		if blocks > core.PrepareBlocks {
+			return xerrors.Errorf("aborting plan on unit %s: %v",
+				plan.Coordinator(), err)
+		}
+		ev.Failed = nil
+	}
+	return tpc.sendDecision(prepared, &r.Decision, false)
+}
+
+// failedProof returns the proof that the contracts of the plan on unit are
+// not prepared for it, or nil if the unit does not return it.
+func (tpc *twoPC) failedProof(unit string) *core.PrepareProof {
+	cid := tpc.plan.HostedContracts(unit)[0].CID
+	r, err := tpc.clients[unit].GetStateKeys(byzcoin.NewInstanceID(cid),
+		[]string{core.KeyPending})
+	if err != nil {
+		return nil
+	}
+	return &core.PrepareProof{UnitID: unit, CID: cid, Proof: r.Proof}
+}
+
+// sendDecision commits or aborts the plan on the prepared units other than
+// the coordinator with the proof of the decision of the coordinator. Every
+// unit is tried, even if the decision fails on another one.
+func (tpc *twoPC) sendDecision(prepared []string, decision *core.StateProof,
+	commit bool) error {
+	plan := tpc.plan
+	ev := core.PrepareEvidence{Decision: decision}
+	var failed []string
+	var lastErr error
+	for _, unit := range prepared {
+		if unit == plan.Coordinator() {
+			continue
+		}
+		cl := tpc.clients[unit]
+		cid := byzcoin.NewInstanceID(plan.HostedContracts(unit)[0].CID)
+		var err error
+		for i := 0; i < decisionAttempts; i++ {
+			if i > 0 {
+				time.Sleep(tpc.delay)
+			}
+			if commit {
+				_, err = cl.CommitState(cid, plan.PlanID, ev, tpc.wait)
+			} else {
+				_, err = cl.AbortState(cid, plan.PlanID, ev, tpc.wait)
+			}
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			failed = append(failed, unit)
+			lastErr = err
+		}
+	}
+	if len(failed) > 0 {
+		return xerrors.Errorf("passing decision (commit=%v) to units %v: %v",
+			commit, failed, lastErr)
+	}
+	return nil
+}
+
+// stateClient returns the client of a state unit that hosts contracts of
+// the plan. StateCl is the client of the unit of the plan.
+func (d *Driver) stateClient(plan *core.ExecutionPlan, unit string) (
+	*libstate.Client, error) {
+	if unit == plan.StateUnit() {
+		return d.StateCl, nil
+	}
+	cl, ok := d.ExtStateCls[unit]
+	if !ok {
+		return nil, xerrors.Errorf("missing client for state unit %s", unit)
+	}
+	return cl, nil
+}
+
+// getParents returns the indices of the opcodes that each opcode has to
+// wait for. A state opcode waits for every other opcode, so no opcode can
+// take the output of a state opcode as input.
+func getParents(txn *core.Transaction) ([][]int, error) {
+	count := len(txn.Opcodes)
+	parents := make([][]int, count)
+	for idx, opcode := range txn.Opcodes {
+		seen := make(map[int]bool)
+		for inputName, dep := range opcode.Dependencies {
+			if dep.Src != core.OPCODE {
+				continue
+			}
+			if dep.Idx < 0 || dep.Idx >= count || dep.Idx == idx {
+				return nil, xerrors.Errorf("invalid opcode index %d for "+
+					"input %s", dep.Idx, inputName)
+			}
+			if txn.Opcodes[dep.Idx].DFUID == statebase.UID {
+				return nil, xerrors.Errorf("input %s of opcode %d depends "+
+					"on state opcode %d", inputName, idx, dep.Idx)
+			}
+			seen[dep.Idx] = true
+		}
+		if opcode.DFUID == statebase.UID {
+			for other, op := range txn.Opcodes {
+				if op.DFUID != statebase.UID {
+					seen[other] = true
+				}
+			}
+		}
+		for parent := range seen {
+			parents[idx] = append(parents[idx], parent)
+		}
+		sort.Ints(parents[idx])
+	}
+	return parents, nil
+}
+
+func (d *Driver) executeOpcode(res *Results, idx int,
+	provider InputProvider) (interface{}, error) {
+	opcode := res.Plan.Txn.Opcodes[idx]
+	execReq := &core.ExecutionRequest{
+		Index: idx,
+		EP:    res.Plan,
+	}
+	err := res.addOpReceipts(execReq, opcode)
+	if err != nil {
+		return nil, err
+	}
+	var input interface{}
+	if provider != nil {
+		input, err = provider(res)
+		if err != nil {
+			return nil, xerrors.Errorf("preparing input: %v", err)
+		}
+	}
+	var reply interface{}
+	var inReceipts, outReceipts map[string]*core.OpcodeReceipt
+	switch opcode.DFUID {
+	case execbase.UID:
+		in, ok := input.(execbase.ExecuteInput)
+		if !ok {
+			return nil, xerrors.New("expected execbase.ExecuteInput")
+		}
+		if in.StateProofs == nil {
+			in.StateProofs = make(map[string]*core.StateProof)
+		}
+		for inputName, dep := range opcode.Dependencies {
+			if _, ok := in.StateProofs[inputName]; ok ||
+				(dep.Src != core.KEYVALUE && dep.Src != core.PRECOMMIT) {
+				continue
+			}
+			if dep.CID == "" {
+				in.StateProofs[inputName] = res.Proof
+				continue
+			}
+			key, err := dep.ContractKey()
+			if err != nil {
+				return nil, err
+			}
+			if p, ok := res.ExtProofs[key]; ok {
+				in.StateProofs[inputName] = p
+			}
+		}
+		r, err := d.ExecCl.Execute(in, execReq)
+		if err != nil {
+			return nil, err
+		}
+		reply, inReceipts, outReceipts = r, r.InputReceipts, r.OutputReceipts
+	case statebase.UID:
+		var in statebase.UpdateInput
+		switch v := input.(type) {
+		case byzcoin.Arguments:
+			in.Args = v
+		case statebase.UpdateInput:
+			in = v
+		default:
+			return nil, xerrors.New("expected byzcoin.Arguments or " +
+				"statebase.UpdateInput")
+		}
+		receipts := res.stateReceipts()
+		var r *libstate.UpdateStateReply
+		if res.Plan.IsCrossUnit() {
+			r, err = d.updateCrossUnit(in, execReq, receipts)
+		} else {
+			r, err = d.StateCl.UpdateStateWithInput(in, execReq, receipts,
+				d.Wait)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply = r
+	case randbase.UID:
+		in, ok := input.(randbase.RandomnessInput)
+		if !ok {
+			return nil, xerrors.New("expected randbase.RandomnessInput")
+		}
+		r, err := d.RandCl.GetRandomness(in.Round, execReq)
+		if err != nil {
+			return nil, err
+		}
+		reply, outReceipts = r, r.Receipts
+	case threshbase.UID:
+		if opcode.Name == threshbase.DKG {
+			r, err := d.ThreshCl.InitDKG(execReq)
+			if err != nil {
+				return nil, err
+			}
+			reply, outReceipts = r, r.Receipts
+			break
+		}
+		in, ok := input.(threshbase.DecryptInput)
+		if !ok {
+			return nil, xerrors.New("expected threshbase.DecryptInput")
+		}
+		r, err := d.ThreshCl.Decrypt(&in, execReq)
+		if err != nil {
+			return nil, err
+		}
+		reply, inReceipts, outReceipts = r, r.InputReceipts, r.OutputReceipts
+	case neffbase.UID:
+		in, ok := input.(neffbase.ShuffleInput)
+		if !ok {
+			return nil, xerrors.New("expected neffbase.ShuffleInput")
+		}
+		r, err := d.ShufCl.Shuffle(in.Pairs, in.H, execReq)
+		if err != nil {
+			return nil, err
+		}
+		reply, inReceipts, outReceipts = r, r.InputReceipts, r.OutputReceipts
+	default:
+		return nil, xerrors.Errorf("unknown dfu: %s", opcode.DFUID)
+	}
+	res.Lock()
+	res.replies[idx] = reply
+	res.inReceipts[idx] = inReceipts
+	res.outReceipts[idx] = outReceipts
+	res.Unlock()
+	return reply, nil
+}
+
+// stateReceipts returns the input receipts of the opcodes that have been
+// executed, keyed by opcode index, which the state unit verifies for the
+// update. The maps are copies, so that they are not modified while they are
+// sent.
+func (res *Results) stateReceipts() map[int]map[string]*core.OpcodeReceipt {
+	res.Lock()
+	defer res.Unlock()
+	receipts := make(map[int]map[string]*core.OpcodeReceipt)
+	for idx, r := range res.inReceipts {
+		if len(r) == 0 {
+			continue
+		}
+		receipts[idx] = make(map[string]*core.OpcodeReceipt, len(r))
+		for name, receipt := range r {
+			receipts[idx][name] = receipt
+		}
+	}
+	return receipts
+}
+
+// addOpReceipts adds the receipts of the opcode outputs that are used as
+// inputs by the given opcode to the execution request.
+func (res *Results) addOpReceipts(execReq *core.ExecutionRequest,
+	opcode *core.Opcode) error {
+	res.Lock()
+	defer res.Unlock()
+	for inputName, dep := range opcode.Dependencies {
+		if dep.Src != core.OPCODE {
+			continue
+		}
+		receipt, ok := res.outReceipts[dep.Idx][dep.SrcName]
+		if !ok {
+			return xerrors.Errorf("missing receipt for input %s", inputName)
+		}
+		err := execReq.AddReceipts(map[string]*core.OpcodeReceipt{
+			dep.SrcName: receipt})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
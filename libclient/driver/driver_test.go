@@ -0,0 +1,213 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/dedis/protean/libstate"
+	statebase "github.com/dedis/protean/libstate/base"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"golang.org/x/xerrors"
+)
+
+func Test_GetParents(t *testing.T) {
+	txn := &core.Transaction{Opcodes: []*core.Opcode{
+		{Name: "get_randomness", DFUID: "threshold"},
+		{Name: "exec", DFUID: "codeexec",
+			Dependencies: map[string]*core.DataDependency{
+				"rand": {Src: core.OPCODE, SrcName: "output", Idx: 0},
+			}},
+		{Name: "update_state", DFUID: statebase.UID,
+			Dependencies: map[string]*core.DataDependency{
+				"ws": {Src: core.OPCODE, SrcName: "writeset", Idx: 1},
+			}},
+	}}
+	parents, err := getParents(txn)
+	require.NoError(t, err)
+	require.Empty(t, parents[0])
+	require.Equal(t, []int{0}, parents[1])
+	// The state opcode waits for every other opcode
+	require.Equal(t, []int{0, 1}, parents[2])
+
+	// An opcode cannot wait for the state opcode, which waits for it
+	txn.Opcodes[0].Dependencies = map[string]*core.DataDependency{
+		"in": {Src: core.OPCODE, SrcName: "output", Idx: 2},
+	}
+	_, err = getParents(txn)
+	require.Error(t, err)
+
+	txn.Opcodes[0].Dependencies = map[string]*core.DataDependency{
+		"in": {Src: core.OPCODE, SrcName: "output", Idx: 3},
+	}
+	_, err = getParents(txn)
+	require.Error(t, err)
+	txn.Opcodes[0].Dependencies = map[string]*core.DataDependency{
+		"in": {Src: core.OPCODE, SrcName: "output", Idx: 0},
+	}
+	_, err = getParents(txn)
+	require.Error(t, err)
+}
+
+func Test_StateReceipts(t *testing.T) {
+	execReceipt := &core.OpcodeReceipt{OpIdx: 1, Name: "rand",
+		HashBytes: []byte("rand hash")}
+	res := &Results{inReceipts: map[int]map[string]*core.OpcodeReceipt{
+		0: nil,
+		1: {"rand": execReceipt},
+	}}
+	receipts := res.stateReceipts()
+	// Only the opcodes that returned input receipts are sent
+	require.Len(t, receipts, 1)
+	require.Equal(t, execReceipt, receipts[1]["rand"])
+
+	// The receipts that are sent are not modified by later opcodes
+	res.inReceipts[1]["other"] = &core.OpcodeReceipt{OpIdx: 1, Name: "other"}
+	delete(res.inReceipts[1], "rand")
+	require.Len(t, receipts, 1)
+	require.Len(t, receipts[1], 1)
+	require.Equal(t, execReceipt, receipts[1]["rand"])
+}
+
+// fakeUnit is a unitClient that records the two-phase commit commands that
+// it receives.
+type fakeUnit struct {
+	unit string
+	// failPrepare makes PrepareState fail, and failCommit and failAbort make
+	// the first CommitState and AbortState calls fail
+	failPrepare bool
+	failCommit  int
+	failAbort   int
+	calls       []string
+	aborts      []core.PrepareEvidence
+}
+
+func (f *fakeUnit) PrepareState(statebase.UpdateInput, *core.ExecutionRequest,
+	map[int]map[string]*core.OpcodeReceipt, int) (*libstate.PrepareStateReply,
+	error) {
+	f.calls = append(f.calls, "prepare")
+	if f.failPrepare {
+		return nil, xerrors.New("prepare failed")
+	}
+	return &libstate.PrepareStateReply{Proofs: []core.PrepareProof{
+		{UnitID: f.unit}}}, nil
+}
+
+func (f *fakeUnit) CommitState(byzcoin.InstanceID, []byte,
+	core.PrepareEvidence, int) (*libstate.CommitStateReply, error) {
+	f.calls = append(f.calls, "commit")
+	if f.failCommit > 0 {
+		f.failCommit--
+		return nil, xerrors.New("commit failed")
+	}
+	return &libstate.CommitStateReply{}, nil
+}
+
+func (f *fakeUnit) AbortState(_ byzcoin.InstanceID, _ []byte,
+	ev core.PrepareEvidence, _ int) (*libstate.AbortStateReply, error) {
+	f.calls = append(f.calls, "abort")
+	f.aborts = append(f.aborts, ev)
+	if f.failAbort > 0 {
+		f.failAbort--
+		return nil, xerrors.New("abort failed")
+	}
+	return &libstate.AbortStateReply{}, nil
+}
+
+func (f *fakeUnit) GetStateKeys(byzcoin.InstanceID, []string) (
+	*libstate.GetStateReply, error) {
+	return &libstate.GetStateReply{}, nil
+}
+
+func newTwoPC() (*twoPC, map[string]*fakeUnit) {
+	// The coordinator is not the first unit in the order of StateUnits
+	plan := &core.ExecutionPlan{PlanID: []byte("plan"), CID: []byte("b"),
+		UnitID: "state_b", Contracts: []core.ContractRoot{
+			{CID: []byte("a"), UnitID: "state_a"},
+			{CID: []byte("c"), UnitID: "state_c"},
+		}}
+	units := make(map[string]*fakeUnit)
+	tpc := &twoPC{plan: plan, clients: make(map[string]unitClient), wait: 2}
+	for _, unit := range plan.StateUnits() {
+		units[unit] = &fakeUnit{unit: unit}
+		tpc.clients[unit] = units[unit]
+	}
+	return tpc, units
+}
+
+func Test_TwoPCAbort(t *testing.T) {
+	execReq := &core.ExecutionRequest{}
+
+	// A unit that fails to prepare makes the coordinator abort the plan
+	// with the proof of the failure, and the prepared units abort it with
+	// the decision
+	tpc, units := newTwoPC()
+	units["state_c"].failPrepare = true
+	_, err := tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"prepare", "abort"}, units["state_b"].calls)
+	require.Len(t, units["state_b"].aborts, 1)
+	require.NotNil(t, units["state_b"].aborts[0].Failed)
+	require.Equal(t, "state_c", units["state_b"].aborts[0].Failed.UnitID)
+	require.Equal(t, []string{"prepare", "abort"}, units["state_a"].calls)
+	require.NotNil(t, units["state_a"].aborts[0].Decision)
+	require.Equal(t, []string{"prepare"}, units["state_c"].calls)
+
+	// If the coordinator rejects the proof, it aborts once its lock expires
+	tpc, units = newTwoPC()
+	units["state_c"].failPrepare = true
+	units["state_b"].failAbort = 3
+	_, err = tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.Error(t, err)
+	require.Len(t, units["state_b"].aborts, 4)
+	require.NotNil(t, units["state_b"].aborts[0].Failed)
+	require.Nil(t, units["state_b"].aborts[3].Failed)
+	require.Equal(t, []string{"prepare", "abort"}, units["state_a"].calls)
+
+	// The abort is not retried past the lock of the coordinator
+	tpc, units = newTwoPC()
+	units["state_c"].failPrepare = true
+	units["state_b"].failAbort = core.PrepareBlocks
+	_, err = tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"prepare"}, units["state_a"].calls)
+
+	// Nothing is prepared if the coordinator fails to prepare the plan
+	tpc, units = newTwoPC()
+	units["state_b"].failPrepare = true
+	_, err = tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.Error(t, err)
+	require.Empty(t, units["state_a"].calls)
+	require.Empty(t, units["state_c"].calls)
+}
+
+func Test_TwoPCCommit(t *testing.T) {
+	execReq := &core.ExecutionRequest{}
+
+	// The decision is retried on a unit whose commit fails
+	tpc, units := newTwoPC()
+	units["state_a"].failCommit = 2
+	_, err := tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"prepare", "commit", "commit", "commit"},
+		units["state_a"].calls)
+	require.Equal(t, []string{"prepare", "commit"}, units["state_c"].calls)
+
+	// Every unit is given the decision even if one keeps failing
+	tpc, units = newTwoPC()
+	units["state_a"].failCommit = decisionAttempts
+	_, err = tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"prepare", "commit"}, units["state_c"].calls)
+
+	// A failed commit on the coordinator aborts the plan
+	tpc, units = newTwoPC()
+	units["state_b"].failCommit = 1
+	_, err = tpc.run(statebase.UpdateInput{}, execReq, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"prepare", "commit", "abort"},
+		units["state_b"].calls)
+	require.Nil(t, units["state_b"].aborts[0].Failed)
+	require.Equal(t, []string{"prepare", "abort"}, units["state_a"].calls)
+	require.Equal(t, []string{"prepare", "abort"}, units["state_c"].calls)
+}
@@ -9,6 +9,7 @@ import (
 	"golang.org/x/xerrors"
 	"io/ioutil"
 	"os"
+	"sort"
 )
 
 func ReadContractJSON(file *string) (*core.Contract, error) {
@@ -26,7 +27,6 @@ func ReadContractJSON(file *string) (*core.Contract, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("Cannot unmarshal json value: %v", err)
 	}
-	muxDependencyValue(&contract)
 	err = verifyDag(&contract)
 	if err != nil {
 		log.Error(err)
@@ -80,7 +80,7 @@ func StoreDependencyValue(c *core.Contract, wf string, txn string, input string,
 	if src != core.CONST && src != core.KEYVALUE {
 		return xerrors.Errorf("wrong dependency type: expected const")
 	}
-	c.Workflows[wf].Txns[txn].Opcodes[idx].Dependencies[input].Value = value
+	c.Workflows[wf].Txns[txn].Opcodes[idx].Dependencies[input].Value = core.NewStringValue(value)
 	fmt.Println(c.Workflows[wf].Txns[txn].Opcodes[idx].Dependencies)
 	content, err := json.Marshal(c)
 	if err != nil {
@@ -95,25 +95,6 @@ func StoreDependencyValue(c *core.Contract, wf string, txn string, input string,
 	return err
 }
 
-func muxDependencyValue(contract *core.Contract) {
-	for _, wf := range contract.Workflows {
-		for _, txn := range wf.Txns {
-			for _, opcode := range txn.Opcodes {
-				for _, dep := range opcode.Dependencies {
-					switch v := dep.Value.(type) {
-					case float64:
-						dep.UintValue = uint64(v)
-					case string:
-						dep.StringValue = v
-					default:
-					}
-					dep.Value = nil
-				}
-			}
-		}
-	}
-}
-
 type edge struct {
 	parent  int
 	child   int
@@ -123,43 +104,53 @@ type edge struct {
 func verifyDag(contract *core.Contract) error {
 	for wfName, wf := range contract.Workflows {
 		for txnName, txn := range wf.Txns {
-			var edges []*edge
-			nodes := make(map[int]bool)
-			for idx, opcode := range txn.Opcodes {
-				nodes[idx] = true
-				for _, dep := range opcode.Dependencies {
-					if dep.Src == core.OPCODE {
-						edges = append(edges, &edge{parent: dep.Idx,
-							child: idx, removed: false})
-					}
-				}
+			_, err := SortOpcodes(txn)
+			if err != nil {
+				return xerrors.Errorf("%s:%s has circular dependency",
+					wfName, txnName)
 			}
-			var sorted []int
-			idx := 0
-			noIncoming := findNoIncoming(nodes, edges)
-			for idx < len(noIncoming) {
-				curr := noIncoming[idx]
-				sorted = append(sorted, curr)
-				for i := 0; i < len(edges); i++ {
-					tmp := edges[i]
-					if curr == tmp.parent && tmp.removed == false {
-						tmp.removed = true
-						if !hasIncomingEdge(tmp.child, edges) {
-							noIncoming = append(noIncoming, tmp.child)
-						}
-					}
-				}
-				idx++
+		}
+	}
+	return nil
+}
+
+// SortOpcodes returns the indices of the opcodes in txn in topological
+// order, i.e., every opcode comes after the opcodes whose outputs it uses.
+func SortOpcodes(txn *core.Transaction) ([]int, error) {
+	var edges []*edge
+	nodes := make(map[int]bool)
+	for idx, opcode := range txn.Opcodes {
+		nodes[idx] = true
+		for _, dep := range opcode.Dependencies {
+			if dep.Src == core.OPCODE {
+				edges = append(edges, &edge{parent: dep.Idx,
+					child: idx, removed: false})
 			}
-			for _, edge := range edges {
-				if edge.removed == false {
-					return xerrors.Errorf("%s:%s has circular dependency",
-						wfName, txnName)
+		}
+	}
+	var sorted []int
+	idx := 0
+	noIncoming := findNoIncoming(nodes, edges)
+	for idx < len(noIncoming) {
+		curr := noIncoming[idx]
+		sorted = append(sorted, curr)
+		for i := 0; i < len(edges); i++ {
+			tmp := edges[i]
+			if curr == tmp.parent && tmp.removed == false {
+				tmp.removed = true
+				if !hasIncomingEdge(tmp.child, edges) {
+					noIncoming = append(noIncoming, tmp.child)
 				}
 			}
 		}
+		idx++
 	}
-	return nil
+	for _, edge := range edges {
+		if edge.removed == false {
+			return nil, xerrors.New("circular dependency")
+		}
+	}
+	return sorted, nil
 }
 
 func hasIncomingEdge(node int, edges []*edge) bool {
@@ -181,5 +172,6 @@ func findNoIncoming(nodes map[int]bool, edges []*edge) []int {
 			noIncoming = append(noIncoming, k)
 		}
 	}
+	sort.Ints(noIncoming)
 	return noIncoming
 }
@@ -141,41 +141,30 @@ func Test_ReadDFUJson(t *testing.T) {
 	require.NoError(t, err)
 	reply, err := adminCl.InitRegistry(dfuReg, 3)
 	require.NoError(t, err)
-	pr, err := adminCl.Cl.WaitProof(reply.IID, 2*time.Second, nil)
+	_, err = adminCl.Cl.WaitProof(reply.IID, 2*time.Second, nil)
 	require.NoError(t, err)
-	v, _, _, err := pr.Get(reply.IID.Slice())
-	kvStore := &core.Storage{}
-	err = protobuf.Decode(v, kvStore)
+	bc := byzcoin.NewClient(byzID, *roster)
+	pr, err := core.GetStorageProof(bc, reply.IID, nil)
 	require.NoError(t, err)
-	for _, kv := range kvStore.Store {
-		if kv.Key == "registry" {
-			reg := &core.DFURegistry{}
-			err = protobuf.Decode(kv.Value, reg)
-			require.NoError(t, err)
-			for name, data := range reg.Units {
-				fmt.Println(name, data)
-			}
-		}
+	kvStore, err := pr.Storage(reply.IID.Slice())
+	require.NoError(t, err)
+	reg, err := core.GetDFURegistry(kvStore)
+	require.NoError(t, err)
+	for name, data := range reg.Units {
+		fmt.Println(name, data)
 	}
 
-	bc := byzcoin.NewClient(byzID, *roster)
 	cl := registry.NewClient(bc)
-	pr2, err := cl.WaitProof(reply.IID, 1*time.Second, nil)
+	_, err = cl.WaitProof(reply.IID, 1*time.Second, nil)
 	require.NoError(t, err)
-	v, _, _, err = pr2.Get(reply.IID.Slice())
-
-	kvStore = &core.Storage{}
-	err = protobuf.Decode(v, kvStore)
+	pr, err = core.GetStorageProof(bc, reply.IID, nil)
 	require.NoError(t, err)
-	for _, kv := range kvStore.Store {
-		if kv.Key == "registry" {
-			reg := &core.DFURegistry{}
-			err = protobuf.Decode(kv.Value, reg)
-			require.NoError(t, err)
-			for name, data := range reg.Units {
-				fmt.Println(name, data)
-			}
-		}
+	kvStore, err = pr.Storage(reply.IID.Slice())
+	require.NoError(t, err)
+	reg, err = core.GetDFURegistry(kvStore)
+	require.NoError(t, err)
+	for name, data := range reg.Units {
+		fmt.Println(name, data)
 	}
 }
 
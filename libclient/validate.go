@@ -0,0 +1,214 @@
+package libclient
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dedis/protean/core"
+)
+
+// ValidationError lists the problems that ValidateContract found in a
+// contract.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("contract has %d problem(s):\n%s", len(e.Problems),
+		strings.Join(e.Problems, "\n"))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// ValidateContract statically checks a contract against its FSM and the DFU
+// registry. initKeys are the names of the arguments that are given to
+// InitContract; the core.KeyRaw and core.KeyHeader keys are always
+// initialized. Keys that are first written by the writeset of a txn cannot
+// be found statically, so they have to be listed in initKeys as well.
+// Instead of stopping at the first problem, it reports every problem it
+// finds in a *ValidationError. It returns nil if the contract is valid.
+func ValidateContract(contract *core.Contract, fsm *core.FSM,
+	registry *core.DFURegistry, initKeys ...string) error {
+	verr := &ValidationError{}
+	if registry == nil {
+		verr.add("missing DFU registry")
+	}
+	keys := map[string]bool{core.KeyRaw: true, core.KeyHeader: true}
+	for _, k := range initKeys {
+		keys[k] = true
+	}
+	for _, wfName := range sortedWorkflows(contract) {
+		wf := contract.Workflows[wfName]
+		for _, txnName := range sortedTxns(wf) {
+			prefix := wfName + ":" + txnName
+			if fsm != nil {
+				if _, ok := fsm.Transitions[txnName]; !ok {
+					verr.add("%s: no FSM transition for txn", prefix)
+				}
+			}
+			validateTxn(verr, prefix, wf.Txns[txnName], registry, keys)
+		}
+	}
+	if fsm != nil {
+		validateFSM(verr, fsm)
+	}
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func validateTxn(verr *ValidationError, prefix string, txn *core.Transaction,
+	registry *core.DFURegistry, keys map[string]bool) {
+	for idx, opcode := range txn.Opcodes {
+		opPrefix := fmt.Sprintf("%s: opcode %d (%s)", prefix, idx, opcode.Name)
+		if registry != nil {
+			dfu, ok := registry.Units[opcode.DFUID]
+			if !ok {
+				verr.add("%s: DFU %s is not in the registry", opPrefix,
+					opcode.DFUID)
+			} else if !hasString(dfu.Opcodes, opcode.Name) {
+				verr.add("%s: opcode is not supported by DFU %s", opPrefix,
+					opcode.DFUID)
+			}
+		}
+		for _, inputName := range sortedInputs(opcode) {
+			dep := opcode.Dependencies[inputName]
+			switch dep.Src {
+			case core.OPCODE:
+				if dep.Idx < 0 || dep.Idx >= len(txn.Opcodes) {
+					verr.add("%s: input %s refers to opcode %d, which is "+
+						"out of range", opPrefix, inputName, dep.Idx)
+				} else if dep.Idx >= idx {
+					verr.add("%s: input %s refers to opcode %d, which does "+
+						"not precede it", opPrefix, inputName, dep.Idx)
+				}
+			case core.KEYVALUE:
+				kvKeys, err := dep.Value.Keys()
+				if err != nil {
+					verr.add("%s: input %s: %v", opPrefix, inputName, err)
+					continue
+				}
+				// The keys of other contracts are not initialized by the
+				// InitContract of this contract
+				if dep.CID != "" {
+					if _, err := dep.ContractKey(); err != nil {
+						verr.add("%s: input %s: %v", opPrefix, inputName,
+							err)
+					}
+					continue
+				}
+				for _, k := range kvKeys {
+					if !keys[k] {
+						verr.add("%s: input %s reads key %s, which is not "+
+							"initialized by InitContract", opPrefix,
+							inputName, k)
+					}
+				}
+			case core.PRECOMMIT:
+				if _, err := dep.Value.Keys(); err != nil {
+					verr.add("%s: input %s: %v", opPrefix, inputName, err)
+				}
+			case core.CONST:
+			default:
+				verr.add("%s: input %s has unknown src %q", opPrefix,
+					inputName, dep.Src)
+			}
+		}
+	}
+}
+
+func validateFSM(verr *ValidationError, fsm *core.FSM) {
+	states := make(map[string]bool)
+	for _, s := range fsm.States {
+		states[s] = true
+	}
+	if !states[fsm.InitialState] {
+		verr.add("fsm: initial state %s is not a state", fsm.InitialState)
+	}
+	edges := make(map[string][]string)
+	txnNames := make([]string, 0, len(fsm.Transitions))
+	for txnName := range fsm.Transitions {
+		txnNames = append(txnNames, txnName)
+	}
+	sort.Strings(txnNames)
+	for _, txnName := range txnNames {
+		t := fsm.Transitions[txnName]
+		var branches []*core.Branch
+		if len(t.From) > 0 {
+			branches = append(branches, &core.Branch{From: []string{t.From},
+				To: t.To})
+		}
+		branches = append(branches, t.Branches...)
+		for _, b := range branches {
+			if !states[b.To] {
+				verr.add("fsm: transition %s refers to unknown state %s",
+					txnName, b.To)
+			}
+			for _, from := range b.From {
+				if !states[from] {
+					verr.add("fsm: transition %s refers to unknown state %s",
+						txnName, from)
+				}
+				edges[from] = append(edges[from], b.To)
+			}
+		}
+	}
+	reached := map[string]bool{fsm.InitialState: true}
+	queue := []string{fsm.InitialState}
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+		for _, next := range edges[curr] {
+			if !reached[next] {
+				reached[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	for _, s := range fsm.States {
+		if !reached[s] {
+			verr.add("fsm: state %s is unreachable from %s", s,
+				fsm.InitialState)
+		}
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedWorkflows(c *core.Contract) []string {
+	names := make([]string, 0, len(c.Workflows))
+	for name := range c.Workflows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedTxns(wf *core.Workflow) []string {
+	names := make([]string, 0, len(wf.Txns))
+	for name := range wf.Txns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedInputs(opcode *core.Opcode) []string {
+	names := make([]string, 0, len(opcode.Dependencies))
+	for name := range opcode.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
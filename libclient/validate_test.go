@@ -0,0 +1,78 @@
+package libclient
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ValidateContract(t *testing.T) {
+	registry := &core.DFURegistry{Units: map[string]*core.DFU{
+		"codeexec": {Opcodes: []string{"init_txn", "exec"}},
+		"state":    {Opcodes: []string{"init_contract", "update_state"}},
+	}}
+	fsm := &core.FSM{
+		InitialState: "open",
+		States:       []string{"open", "closed"},
+		Transitions: map[string]*core.Transition{
+			"join":  {From: "open", To: "open"},
+			"close": {From: "open", To: "closed"},
+		},
+	}
+	newContract := func() *core.Contract {
+		return &core.Contract{Workflows: map[string]*core.Workflow{
+			"wf": {Txns: map[string]*core.Transaction{
+				"join": {Opcodes: []*core.Opcode{
+					{Name: "exec", DFUID: "codeexec",
+						Dependencies: map[string]*core.DataDependency{
+							"fnname": {Src: core.CONST,
+								Value: core.NewStringValue("join")},
+							"readset": {Src: core.KEYVALUE,
+								Value: core.NewStringValue("tickets,header")},
+						}},
+					{Name: "update_state", DFUID: "state",
+						Dependencies: map[string]*core.DataDependency{
+							"ws": {Src: core.OPCODE, SrcName: "writeset",
+								Idx: 0},
+						}},
+				}},
+			}},
+		}}
+	}
+	require.NoError(t, ValidateContract(newContract(), fsm, registry,
+		"tickets"))
+
+	// A read of another contract is not checked against the keys of this
+	// contract, but its CID has to be valid
+	contract := newContract()
+	ops := contract.Workflows["wf"].Txns["join"].Opcodes
+	ops[0].Dependencies["other"] = &core.DataDependency{Src: core.KEYVALUE,
+		Value: core.NewStringValue("votes"),
+		CID:   strings.Repeat("ab", 32)}
+	require.NoError(t, ValidateContract(contract, fsm, registry, "tickets"))
+	ops[0].Dependencies["other"].CID = "ab"
+	require.Error(t, ValidateContract(contract, fsm, registry, "tickets"))
+
+	contract = newContract()
+	ops = contract.Workflows["wf"].Txns["join"].Opcodes
+	ops[0].Name = "decrypt"
+	ops[1].DFUID = "unknown"
+	ops[1].Dependencies["ws"].Idx = 1
+	ops[1].Dependencies["x"] = &core.DataDependency{Src: "FOO"}
+	contract.Workflows["wf"].Txns["vote"] = &core.Transaction{}
+	fsm.States = append(fsm.States, "tallied")
+	err := ValidateContract(contract, fsm, registry)
+	require.Error(t, err)
+	verr, ok := err.(*ValidationError)
+	require.True(t, ok)
+	require.Len(t, verr.Problems, 7)
+
+	// A missing registry is reported instead of dereferenced
+	err = ValidateContract(newContract(), nil, nil, "tickets")
+	require.Error(t, err)
+	verr, ok = err.(*ValidationError)
+	require.True(t, ok)
+	require.Equal(t, []string{"missing DFU registry"}, verr.Problems)
+}
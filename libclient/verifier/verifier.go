@@ -0,0 +1,491 @@
+// Package verifier replays the history of a contract from its txn log
+// without trusting the Protean nodes. The data is fetched from the nodes
+// (see Fetch) and checked against the IDs of the ledgers of the state unit
+// and of the DFU registry (see Verify).
+package verifier
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dedis/protean/core"
+	"github.com/dedis/protean/libstate"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// historyKeys are the keys of the contract that the history covers, in
+// addition to the records of its txn log.
+var historyKeys = []string{core.KeyRaw, core.KeyHeader, core.KeyUpgrades,
+	core.KeyTxnLog}
+
+// History is the data that is needed to verify the updates of a contract.
+type History struct {
+	CID          byzcoin.InstanceID
+	StateGenesis *skipchain.SkipBlock
+	// State proves the historyKeys of the contract
+	State core.StateProof
+	// Snapshots prove the storage of the contract, and of the contracts of
+	// the plans that updated it together with another contract (see
+	// core.TxnRecord.PlanCID), as of the blocks of the records. They must
+	// be hosted by the same state unit.
+	Snapshots       []*core.HistoricalProof
+	RegistryGenesis *skipchain.SkipBlock
+	RegistryID      byzcoin.InstanceID
+	// Registry proves the whole storage of the registry instance
+	Registry *core.StateProof
+	// RegistryBlocks are the blocks that changed the registry instance, in
+	// order, linked to the latest block of Registry
+	RegistryBlocks []*core.BlockChange
+}
+
+// Report is the result of the verification of a history.
+type Report struct {
+	CID       byzcoin.InstanceID
+	CurrState string
+	// Upgrades is the number of upgrades that changed the contract or its
+	// FSM. Every record is checked against the contract as of its block.
+	Upgrades int
+	// Unlogged is true if the contract was updated before it kept a txn
+	// log, so that the first record does not start in the initial state
+	Unlogged bool
+	Records  []RecordResult
+	// Err is set if the current state does not match the txn log
+	Err error
+}
+
+// RecordResult is the result of the verification of a txn log record.
+type RecordResult struct {
+	Seq        uint64
+	BlockIndex int
+	TxnName    string
+	FromState  string
+	ToState    string
+	Err        error
+}
+
+// Fetch gets the history of contract cid from the state unit of stCl and
+// the proof of the registry instance regID from regCl.
+func Fetch(stCl *libstate.Client, regCl *byzcoin.Client, cid byzcoin.InstanceID,
+	regID byzcoin.InstanceID) (*History, error) {
+	gcs, err := stCl.GetStateKeys(cid, []string{core.KeyTxnLog})
+	if err != nil {
+		return nil, err
+	}
+	store, err := gcs.Proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	n, err := core.TxnLogLen(store)
+	if err != nil {
+		return nil, err
+	}
+	keys := append(append([]string{}, historyKeys...),
+		core.TxnRecordKeys(0, n)...)
+	gcs, err = stCl.GetStateKeys(cid, keys)
+	if err != nil {
+		return nil, err
+	}
+	h := &History{CID: cid, State: gcs.Proof, RegistryID: regID}
+	h.StateGenesis, err = stCl.FetchGenesisBlock(gcs.Proof.Proof.Latest.
+		SkipChainID())
+	if err != nil {
+		return nil, err
+	}
+	store, err = gcs.Proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	recs, err := core.GetTxnRecords(store, 0, n)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, rec := range recs {
+		for _, c := range [][]byte{cid.Slice(), rec.PlanCID} {
+			key := fmt.Sprintf("%x/%d", c, rec.BlockIndex)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			reply, err := stCl.GetStateAt(byzcoin.NewInstanceID(c),
+				rec.BlockIndex, []string{core.KeyRaw})
+			if err != nil {
+				return nil, err
+			}
+			h.Snapshots = append(h.Snapshots, &reply.Proof)
+		}
+	}
+	h.Registry, err = core.GetStorageProof(regCl, regID, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("getting registry proof: %v", err)
+	}
+	h.RegistryGenesis, err = skipchain.NewClient().GetSingleBlock(
+		&regCl.Roster, regCl.ID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting registry genesis block: %v", err)
+	}
+	h.RegistryBlocks, err = fetchChanges(regCl, regID)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// fetchChanges returns the blocks that changed instance iid, together with
+// their state changes and the update chain from each block to the latest
+// block.
+func fetchChanges(cl *byzcoin.Client, iid byzcoin.InstanceID) (
+	[]*core.BlockChange, error) {
+	versions, err := core.GetInstanceVersions(cl, iid)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*core.BlockChange
+	for _, v := range versions {
+		n := len(changes)
+		if n > 0 && changes[n-1].Block.Index == v.BlockIndex {
+			continue
+		}
+		change, err := core.GetBlockChange(cl, iid, v.StateChange.Version)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// ReadHistory reads a protobuf-encoded history from a file.
+func ReadHistory(file string) (*History, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, xerrors.Errorf("reading history: %v", err)
+	}
+	h := &History{}
+	err = protobuf.Decode(buf, h)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding history: %v", err)
+	}
+	return h, nil
+}
+
+// WriteHistory writes the protobuf-encoded history to a file.
+func WriteHistory(file string, h *History) error {
+	buf, err := protobuf.Encode(h)
+	if err != nil {
+		return xerrors.Errorf("encoding history: %v", err)
+	}
+	err = ioutil.WriteFile(file, buf, 0644)
+	if err != nil {
+		return xerrors.Errorf("writing history: %v", err)
+	}
+	return nil
+}
+
+// Verify checks the history against stateID and registryID, the trusted
+// skipchain IDs of the ledgers of the state unit and of the DFU registry.
+// It returns an error if the proofs are invalid. Otherwise, the report has
+// the result of every update of the contract: the signature of the CEU on
+// the plan, the signatures of the DFUs on the receipts, the writeset hash
+// and the legality of the FSM transition (see core.TxnRecord.Verify). Every
+// record is checked against the contract as of its block and against the
+// DFU registry as of the timestamp of its block, so that the upgrades of
+// the contract and the key changes of the DFUs do not affect the older
+// records. The guards of the transitions are not evaluated, since they
+// depend on the state before the update (see libstate.Client.GetStateAt).
+func Verify(h *History, stateID skipchain.SkipBlockID,
+	registryID skipchain.SkipBlockID) (*Report, error) {
+	epochs, err := h.verifyRegistry(registryID)
+	if err != nil {
+		return nil, err
+	}
+	store, err := verifyState(&h.State, h.StateGenesis, stateID, h.CID)
+	if err != nil {
+		return nil, err
+	}
+	err = h.State.CoversKeys(h.CID.Slice(), historyKeys)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := store.GetRaw()
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := store.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	recs, err := core.GetTxnRecords(store, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{CID: h.CID, CurrState: hdr.CurrState}
+	if buf, ok := store.Get(core.KeyUpgrades); ok {
+		history := &core.UpgradeHistory{}
+		err = protobuf.Decode(buf, history)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding upgrade history: %v", err)
+		}
+		for _, u := range history.Records {
+			if u.ContractChanged || u.FSMChanged {
+				report.Upgrades++
+			}
+		}
+	}
+	initial := raw.FSM.InitialState
+	if len(recs) > 0 {
+		first, _, err := h.snapshot(h.CID, recs[0].BlockIndex, stateID)
+		if err == nil {
+			initial = first.FSM.InitialState
+		}
+	}
+	var state string
+	report.Unlogged, state = startState(recs, initial, hdr.CurrState)
+	for i := range recs {
+		rec := &recs[i]
+		res := RecordResult{Seq: rec.Seq, BlockIndex: rec.BlockIndex,
+			TxnName: rec.TxnName, FromState: rec.FromState,
+			ToState: rec.ToState}
+		res.Err = h.verifyRecord(rec, state, epochs, stateID)
+		report.Records = append(report.Records, res)
+		state = rec.ToState
+	}
+	if state != hdr.CurrState {
+		report.Err = xerrors.Errorf("contract is in state %s but the txn "+
+			"log ends in state %s", hdr.CurrState, state)
+	}
+	return report, nil
+}
+
+// startState returns the state in which the txn log of a contract starts,
+// given the initial state of its FSM and its current state. The records are
+// appended by the contract itself, so a log that does not start in the
+// initial state belongs to a contract that was updated before it kept a
+// txn log. The first return value is true in that case.
+func startState(recs []core.TxnRecord, initial string,
+	curr string) (bool, string) {
+	if len(recs) > 0 {
+		return recs[0].FromState != initial, recs[0].FromState
+	}
+	return curr != initial, curr
+}
+
+// registryEpoch is the DFU registry after a block of the registry ledger.
+type registryEpoch struct {
+	timestamp int64
+	reg       *core.DFURegistry
+	err       error
+}
+
+// registryAt returns the registry of the last epoch that starts at or
+// before timestamp.
+func registryAt(epochs []registryEpoch, timestamp int64) (
+	*core.DFURegistry, error) {
+	var epoch *registryEpoch
+	for i := range epochs {
+		if epochs[i].timestamp > timestamp {
+			break
+		}
+		epoch = &epochs[i]
+	}
+	if epoch == nil {
+		return nil, xerrors.New("registry did not exist at the time of " +
+			"the update")
+	}
+	return epoch.reg, epoch.err
+}
+
+// verifyRegistry verifies the proof of the registry and the blocks that
+// changed it, and returns the registry after every block.
+func (h *History) verifyRegistry(registryID skipchain.SkipBlockID) (
+	[]registryEpoch, error) {
+	if h.RegistryGenesis == nil || h.Registry == nil {
+		return nil, xerrors.New("missing registry proof")
+	}
+	if !h.RegistryGenesis.CalculateHash().Equal(registryID) {
+		return nil, xerrors.New("registry genesis block does not match " +
+			"the registry ID")
+	}
+	if h.Registry.Proof == nil {
+		return nil, xerrors.New("missing registry proof")
+	}
+	err := h.Registry.Proof.VerifyFromBlock(h.RegistryGenesis)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying registry proof: %v", err)
+	}
+	version, err := h.Registry.Version(h.RegistryID)
+	if err != nil {
+		return nil, xerrors.Errorf("getting registry from proof: %v", err)
+	}
+	// Every update of the registry writes its instance, so the consecutive
+	// versions of the instance show that no block is left out.
+	head := &h.Registry.Proof.Latest
+	store := &core.Storage{}
+	var epochs []registryEpoch
+	var next uint64
+	for _, bc := range h.RegistryBlocks {
+		scs, err := bc.Verify(h.RegistryID, head)
+		if err != nil {
+			return nil, xerrors.Errorf("verifying registry change: %v", err)
+		}
+		if scs[0].Version != next {
+			return nil, xerrors.Errorf("missing version %d of the registry",
+				next)
+		}
+		next = scs[len(scs)-1].Version + 1
+		store, _, err = core.ApplyStateChanges(h.RegistryID, store,
+			bc.StateChanges)
+		if err != nil {
+			return nil, err
+		}
+		hdr := byzcoin.DataHeader{}
+		err = protobuf.Decode(bc.Block.Data, &hdr)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding block header: %v", err)
+		}
+		epoch := registryEpoch{timestamp: hdr.Timestamp}
+		epoch.reg, epoch.err = core.GetDFURegistry(store)
+		epochs = append(epochs, epoch)
+	}
+	if next != version+1 {
+		return nil, xerrors.Errorf("registry changes end at version %d "+
+			"instead of %d", next, version+1)
+	}
+	return epochs, nil
+}
+
+// verifyState verifies the state proof of contract cid against the genesis
+// block of stateID and returns the storage that it proves.
+func verifyState(proof *core.StateProof, genesis *skipchain.SkipBlock,
+	stateID skipchain.SkipBlockID, cid byzcoin.InstanceID) (*core.Storage,
+	error) {
+	if genesis == nil || !genesis.CalculateHash().Equal(stateID) {
+		return nil, xerrors.New("state genesis block does not match the " +
+			"state unit ID")
+	}
+	err := proof.VerifyGenesis(genesis)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying state proof of contract %s: "+
+			"%v", cid, err)
+	}
+	return proof.Storage(cid.Slice())
+}
+
+// snapshot returns the raw contract cid as of block index and the header of
+// the block.
+func (h *History) snapshot(cid byzcoin.InstanceID, index int,
+	stateID skipchain.SkipBlockID) (*core.ContractRaw, *byzcoin.DataHeader,
+	error) {
+	if h.StateGenesis == nil || !h.StateGenesis.CalculateHash().Equal(
+		stateID) {
+		return nil, nil, xerrors.New("state genesis block does not match " +
+			"the state unit ID")
+	}
+	for _, hp := range h.Snapshots {
+		if !hp.CID.Equal(cid) || hp.Index != index {
+			continue
+		}
+		store, hdr, err := hp.VerifyAt(h.StateGenesis)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("verifying contract %s at "+
+				"block %d: %v", cid, index, err)
+		}
+		raw, err := store.GetRaw()
+		if err != nil {
+			return nil, nil, err
+		}
+		return raw, hdr, nil
+	}
+	return nil, nil, xerrors.Errorf("missing contract %s at block %d", cid,
+		index)
+}
+
+// verifyRecord checks a record of the txn log, given that the previous
+// record left the contract in state prev.
+func (h *History) verifyRecord(rec *core.TxnRecord, prev string,
+	epochs []registryEpoch, stateID skipchain.SkipBlockID) error {
+	if rec.FromState != prev {
+		return xerrors.Errorf("update starts in state %s instead of %s",
+			rec.FromState, prev)
+	}
+	raw, hdr, err := h.snapshot(h.CID, rec.BlockIndex, stateID)
+	if err != nil {
+		return err
+	}
+	if !raw.FSM.Allows(rec.TxnName, rec.FromState, rec.ToState) {
+		return xerrors.Errorf("FSM does not allow %s from %s to %s",
+			rec.TxnName, rec.FromState, rec.ToState)
+	}
+	planRaw := raw
+	if !bytes.Equal(rec.PlanCID, h.CID.Slice()) {
+		planRaw, _, err = h.snapshot(byzcoin.NewInstanceID(rec.PlanCID),
+			rec.BlockIndex, stateID)
+		if err != nil {
+			return err
+		}
+	}
+	reg, err := registryAt(epochs, hdr.Timestamp)
+	if err != nil {
+		return err
+	}
+	wf, ok := planRaw.Contract.Workflows[rec.WfName]
+	if !ok {
+		return xerrors.Errorf("invalid workflow name: %s", rec.WfName)
+	}
+	txn, ok := wf.Txns[rec.TxnName]
+	if !ok {
+		return xerrors.Errorf("invalid txn name: %s", rec.TxnName)
+	}
+	return rec.Verify(reg, txn, core.HashConfig{})
+}
+
+// OK returns true if every update and the current state are verified.
+func (r *Report) OK() bool {
+	if r.Err != nil {
+		return false
+	}
+	for _, res := range r.Records {
+		if res.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes the report in a human-readable form.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "contract %s (state %s)\n", r.CID, r.CurrState)
+	if r.Upgrades > 0 {
+		fmt.Fprintf(w, "note: the contract was upgraded %d times\n",
+			r.Upgrades)
+	}
+	if r.Unlogged {
+		fmt.Fprintln(w, "note: the contract was updated before it kept a "+
+			"txn log")
+	}
+	for _, res := range r.Records {
+		status := "PASS"
+		if res.Err != nil {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s #%d block %d %s: %s -> %s", status, res.Seq,
+			res.BlockIndex, res.TxnName, res.FromState, res.ToState)
+		if res.Err != nil {
+			fmt.Fprintf(w, ": %v", res.Err)
+		}
+		fmt.Fprintln(w)
+	}
+	if r.Err != nil {
+		fmt.Fprintf(w, "FAIL %v\n", r.Err)
+	}
+	if r.OK() {
+		fmt.Fprintf(w, "PASS %d updates verified\n", len(r.Records))
+	} else {
+		fmt.Fprintln(w, "FAIL history is not valid")
+	}
+}
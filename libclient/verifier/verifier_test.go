@@ -0,0 +1,111 @@
+package verifier
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"golang.org/x/xerrors"
+)
+
+func Test_StartState(t *testing.T) {
+	recs := []core.TxnRecord{{FromState: "open", ToState: "closed"}}
+	unlogged, state := startState(recs, "open", "closed")
+	require.False(t, unlogged)
+	require.Equal(t, "open", state)
+
+	// The contract was updated before it kept a txn log
+	recs[0].FromState = "voting"
+	unlogged, state = startState(recs, "open", "closed")
+	require.True(t, unlogged)
+	require.Equal(t, "voting", state)
+	unlogged, state = startState(nil, "open", "closed")
+	require.True(t, unlogged)
+	require.Equal(t, "closed", state)
+	unlogged, _ = startState(nil, "open", "open")
+	require.False(t, unlogged)
+}
+
+func Test_RegistryAt(t *testing.T) {
+	reg1 := &core.DFURegistry{Units: map[string]*core.DFU{"a": {}}}
+	reg2 := &core.DFURegistry{Units: map[string]*core.DFU{"b": {}}}
+	epochs := []registryEpoch{{timestamp: 10, err: xerrors.New("empty")},
+		{timestamp: 20, reg: reg1}, {timestamp: 30, reg: reg2}}
+	_, err := registryAt(epochs, 5)
+	require.Error(t, err)
+	_, err = registryAt(epochs, 15)
+	require.Error(t, err)
+	reg, err := registryAt(epochs, 20)
+	require.NoError(t, err)
+	require.Equal(t, reg1, reg)
+	reg, err = registryAt(epochs, 29)
+	require.NoError(t, err)
+	require.Equal(t, reg1, reg)
+	reg, err = registryAt(epochs, 100)
+	require.NoError(t, err)
+	require.Equal(t, reg2, reg)
+}
+
+func Test_VerifyRegistryMissing(t *testing.T) {
+	genesis := skipchain.NewSkipBlock()
+	genesis.Hash = genesis.CalculateHash()
+	h := &History{}
+	_, err := h.verifyRegistry(genesis.Hash)
+	require.Error(t, err)
+	h = &History{RegistryGenesis: genesis, Registry: &core.StateProof{}}
+	_, err = h.verifyRegistry(genesis.Hash)
+	require.Error(t, err)
+	_, err = h.verifyRegistry(skipchain.SkipBlockID("other"))
+	require.Error(t, err)
+}
+
+func Test_VerifyRecordSnapshot(t *testing.T) {
+	genesis := skipchain.NewSkipBlock()
+	genesis.Hash = genesis.CalculateHash()
+	cid := byzcoin.NewInstanceID(bytes.Repeat([]byte{1}, 32))
+	h := &History{CID: cid, StateGenesis: genesis}
+	rec := &core.TxnRecord{PlanCID: cid.Slice(), BlockIndex: 3,
+		FromState: "open", ToState: "closed", TxnName: "close"}
+
+	// The record must start in the state that the previous record left
+	err := h.verifyRecord(rec, "voting", nil, genesis.Hash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "instead of voting")
+	// The contract must be proven as of the block of the record
+	err = h.verifyRecord(rec, "open", nil, genesis.Hash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "at block 3")
+	h.Snapshots = []*core.HistoricalProof{{CID: cid, Index: 3}}
+	err = h.verifyRecord(rec, "open", nil, genesis.Hash)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "verifying contract")
+	// The snapshots are checked against the state unit ID
+	err = h.verifyRecord(rec, "open", nil, skipchain.SkipBlockID("other"))
+	require.Error(t, err)
+}
+
+func Test_ReportPrint(t *testing.T) {
+	r := &Report{CurrState: "closed", Upgrades: 1, Unlogged: true,
+		Records: []RecordResult{{Seq: 0, TxnName: "vote"},
+			{Seq: 1, TxnName: "close"}}}
+	require.True(t, r.OK())
+	buf := &strings.Builder{}
+	r.Print(buf)
+	require.Contains(t, buf.String(), "upgraded 1 times")
+	require.Contains(t, buf.String(), "before it kept a txn log")
+	require.Contains(t, buf.String(), "PASS 2 updates verified")
+
+	r.Records[1].Err = xerrors.New("bad signature")
+	require.False(t, r.OK())
+	buf.Reset()
+	r.Print(buf)
+	require.Contains(t, buf.String(), "FAIL #1")
+	require.Contains(t, buf.String(), "FAIL history is not valid")
+	r.Records[1].Err = nil
+	r.Err = xerrors.New("state mismatch")
+	require.False(t, r.OK())
+}
@@ -1,9 +1,12 @@
 package libexec
 
 import (
+	"time"
+
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/libexec/base"
 	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/kyber/v3/util/random"
 	"go.dedis.ch/onet/v3"
 	"golang.org/x/xerrors"
 )
@@ -29,14 +32,42 @@ func (c *Client) InitUnit(threshold int) (*InitUnitReply, error) {
 
 func (c *Client) InitTransaction(rdata *base.ByzData, cdata *base.ByzData,
 	wf string, txn string) (*InitTransactionReply, error) {
+	return c.InitTransactionWithLock(rdata, cdata, wf, txn, 0, 0)
+}
+
+// InitTransactionWithLock requests an execution plan that locks the contract
+// for lockBlocks blocks. The contract is locked before the plan is returned,
+// waiting for wait blocks, and the lock is released when the state unit
+// applies the writeset of the plan or when it expires.
+func (c *Client) InitTransactionWithLock(rdata *base.ByzData,
+	cdata *base.ByzData, wf string, txn string, lockBlocks int,
+	wait int) (*InitTransactionReply, error) {
+	return c.InitTransactionWithExtData(rdata, cdata, nil, wf, txn,
+		lockBlocks, wait)
+}
+
+// InitTransactionWithExtData requests an execution plan for a txn that reads
+// other contracts. extData holds the proofs of these contracts, keyed by
+// the CID of the KEYVALUE dependencies that read them. lockBlocks and wait
+// are as in InitTransactionWithLock.
+func (c *Client) InitTransactionWithExtData(rdata *base.ByzData,
+	cdata *base.ByzData, extData map[string]*base.ByzData, wf string,
+	txn string, lockBlocks int, wait int) (*InitTransactionReply, error) {
 	reply := &InitTransactionReply{}
+	nonce := make([]byte, 32)
+	random.Bytes(nonce, random.New())
 	req := &InitTransaction{
 		Input: base.InitTxnInput{
-			RData:   rdata,
-			CData:   cdata,
-			WfName:  wf,
-			TxnName: txn,
+			RData:      rdata,
+			CData:      cdata,
+			WfName:     wf,
+			TxnName:    txn,
+			Nonce:      nonce,
+			Expiry:     time.Now().Add(core.DefaultPlanTTL).Unix(),
+			LockBlocks: lockBlocks,
+			ExtData:    extData,
 		},
+		Wait: wait,
 	}
 	err := c.SendProtobuf(c.roster.List[0], req, reply)
 	if err != nil {
@@ -137,6 +137,7 @@ func FinalizeLottery(genInput *base.GenericInput) (*base.GenericOutput, error) {
 		}
 		pdata[i] = msg
 	}
+	// The guard of the close txn ensures that there is at least one ticket
 	randBytes := generateRandomness(pdata)
 	rand := binary.LittleEndian.Uint64(randBytes)
 	winnerIdx := rand % uint64(len(pdata))
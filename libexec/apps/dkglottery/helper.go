@@ -10,7 +10,8 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
+func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData,
+	version int) (
 	base.ExecutionFn, *base.GenericInput, *core.VerificationData,
 	map[string][]byte, error) {
 	var opHashes map[string][]byte
@@ -22,7 +23,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 			return nil, nil, nil, nil, err
 		}
 		vdata.StateProofs = input.StateProofs
-		vdata.InputHashes, opHashes, err = getSetupHashes(input.FnName, &setupIn)
+		vdata.InputHashes, opHashes, err = getSetupHashes(version, input.FnName, &setupIn)
 		return Setup, &base.GenericInput{I: setupIn}, vdata, opHashes, nil
 	case "join_dkglot":
 		var joinIn JoinInput
@@ -32,7 +33,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		}
 		vdata.StateProofs = input.StateProofs
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		return JoinLottery, &base.GenericInput{I: joinIn}, vdata, nil, nil
 	case "batch_join_dkglot":
@@ -43,7 +44,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		}
 		vdata.StateProofs = input.StateProofs
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		return BatchJoinLottery, &base.GenericInput{I: batchJoinIn}, vdata, nil, nil
 	case "close_dkglot":
@@ -57,12 +58,12 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 			return nil, nil, nil, nil, xerrors.New("missing input: readset")
 		}
 		closeIn.BlkHeight = pr.Proof.Latest.Index
-		vdata.InputHashes = getCloseHashes(input.FnName, &closeIn)
+		vdata.InputHashes = getCloseHashes(version, input.FnName, &closeIn)
 		vdata.StateProofs = input.StateProofs
 		return CloseLottery, &base.GenericInput{I: closeIn}, vdata, nil, nil
 	case "prepare_decrypt_dkglot":
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		vdata.StateProofs = input.StateProofs
 		return PrepareDecrypt, &base.GenericInput{I: nil}, vdata, nil, nil
@@ -72,7 +73,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
-		vdata.InputHashes, opHashes, err = getFinalizeHashes(input.FnName, &finalizeIn)
+		vdata.InputHashes, opHashes, err = getFinalizeHashes(version, input.FnName, &finalizeIn)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
@@ -83,7 +84,8 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 	return nil, nil, nil, nil, nil
 }
 
-func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOutput, map[string][]byte, error) {
+func MuxRequest(fnName string, genericOut *base.GenericOutput,
+	version int) (*base.ExecuteOutput, map[string][]byte, error) {
 	switch fnName {
 	case "setup_dkglot":
 		setupOut, ok := genericOut.O.(SetupOutput)
@@ -95,7 +97,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(setupOut.WS)
+		wsHash := libstate.Hash(version, setupOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -109,7 +111,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(joinOut.WS)
+		wsHash := libstate.Hash(version, joinOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -123,7 +125,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(joinOut.WS)
+		wsHash := libstate.Hash(version, joinOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -137,7 +139,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(closeOut.WS)
+		wsHash := libstate.Hash(version, closeOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -151,7 +153,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		hash, err := prepDecOut.Input.Hash()
+		hash, err := prepDecOut.Input.Hash(version)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -168,7 +170,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(finalizeOut.WS)
+		wsHash := libstate.Hash(version, finalizeOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -177,11 +179,12 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 	return nil, nil, nil
 }
 
-func getSetupHashes(fnName string, input *SetupInput) (map[string][]byte, map[string][]byte, error) {
+func getSetupHashes(version int, fnName string,
+	input *SetupInput) (map[string][]byte, map[string][]byte, error) {
 	inputHashes := make(map[string][]byte)
 	receiptHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	buf, err := utils.HashPoint(input.Pk)
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	buf, err := utils.HashPoint(version, input.Pk)
 	if err != nil {
 		log.Errorf("calculating the public key hash: %v", err)
 		return nil, nil, err
@@ -191,18 +194,20 @@ func getSetupHashes(fnName string, input *SetupInput) (map[string][]byte, map[st
 	return inputHashes, receiptHashes, nil
 }
 
-func getCloseHashes(fnName string, input *CloseInput) map[string][]byte {
+func getCloseHashes(version int, fnName string,
+	input *CloseInput) map[string][]byte {
 	inputHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	inputHashes["barrier"] = utils.HashUint64(uint64(input.Barrier))
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	inputHashes["barrier"] = utils.HashUint64(version, uint64(input.Barrier))
 	return inputHashes
 }
 
-func getFinalizeHashes(fnName string, input *FinalizeInput) (map[string][]byte, map[string][]byte, error) {
+func getFinalizeHashes(version int, fnName string,
+	input *FinalizeInput) (map[string][]byte, map[string][]byte, error) {
 	inputHashes := make(map[string][]byte)
 	receiptHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	buf, err := utils.HashPoints(input.Ps)
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	buf, err := utils.HashPoints(version, input.Ps)
 	if err != nil {
 		log.Errorf("calculating the dec_tickets hash: %v", err)
 		return nil, nil, err
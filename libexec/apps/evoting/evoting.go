@@ -46,20 +46,13 @@ func Vote(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if !ok {
 		return nil, xerrors.New("missing input")
 	}
-	kvDict, ok := genInput.KVInput["readset"]
-	if !ok {
-		return nil, xerrors.New("missing keyvalue data")
-	}
-	ballots, err := getBallots(&kvDict)
+	// The ballot is appended to the stored ballots, so that concurrent
+	// votes do not conflict.
+	buf, err := protobuf.Encode(&input.Ballot)
 	if err != nil {
-		return nil, err
+		return nil, xerrors.Errorf("couldn't encode ballot: %v", err)
 	}
-	ballots.Data.Pairs = append(ballots.Data.Pairs, input.Ballot.Data)
-	buf, err := protobuf.Encode(ballots)
-	if err != nil {
-		return nil, xerrors.Errorf("couldn't encode ballots: %v", err)
-	}
-	args := byzcoin.Arguments{{Name: "enc_ballots", Value: buf}}
+	args := byzcoin.Arguments{core.AppendArg("enc_ballots", buf)}
 	return &base.GenericOutput{O: VoteOutput{WS: args}}, nil
 }
 
@@ -149,6 +142,7 @@ func PrepareDecrypt(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The guard of the tally txn ensures that there is at least one proof
 	sz := len(proofs)
 	pairs := proofs[sz-1].Pairs
 	input := threshold.DecryptInput{ElGamalPairs: pairs}
@@ -220,12 +214,20 @@ func getBallots(kvDict *core.KVDict) (*EncBallots, error) {
 	if !ok {
 		return nil, xerrors.New("missing key: enc_ballots")
 	}
-	tickets := &EncBallots{}
-	err := protobuf.Decode(buf, tickets)
+	list, err := core.DecodeItemList(buf)
 	if err != nil {
 		return nil, xerrors.Errorf("couldn't decode ballots: %v", err)
 	}
-	return tickets, nil
+	ballots := &EncBallots{}
+	for _, item := range list.Items {
+		ballot := Ballot{}
+		err = protobuf.Decode(item, &ballot)
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't decode ballot: %v", err)
+		}
+		ballots.Data.Pairs = append(ballots.Data.Pairs, ballot.Data)
+	}
+	return ballots, nil
 }
 
 func getPoint(kvDict *core.KVDict) (kyber.Point, error) {
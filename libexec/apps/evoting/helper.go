@@ -10,7 +10,8 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
+func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData,
+	version int) (
 	base.ExecutionFn, *base.GenericInput, *core.VerificationData,
 	map[string][]byte, error) {
 	var opHashes map[string][]byte
@@ -22,7 +23,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 			return nil, nil, nil, nil, err
 		}
 		vdata.StateProofs = input.StateProofs
-		vdata.InputHashes, opHashes, err = getSetupHashes(input.FnName, &setupIn)
+		vdata.InputHashes, opHashes, err = getSetupHashes(version, input.FnName, &setupIn)
 		return Setup, &base.GenericInput{I: setupIn}, vdata, opHashes, nil
 	case "vote":
 		var voteIn VoteInput
@@ -32,7 +33,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		}
 		vdata.StateProofs = input.StateProofs
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		return Vote, &base.GenericInput{I: voteIn}, vdata, nil, nil
 	case "close_vote":
@@ -46,12 +47,12 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 			return nil, nil, nil, nil, xerrors.New("missing input: readset")
 		}
 		closeIn.BlkHeight = pr.Proof.Latest.Index
-		vdata.InputHashes = getCloseHashes(input.FnName, &closeIn)
+		vdata.InputHashes = getCloseHashes(version, input.FnName, &closeIn)
 		vdata.StateProofs = input.StateProofs
 		return CloseVote, &base.GenericInput{I: closeIn}, vdata, nil, nil
 	case "prepare_shuffle":
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		vdata.StateProofs = input.StateProofs
 		return PrepareShuffle, &base.GenericInput{I: nil}, vdata, nil, nil
@@ -61,7 +62,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
-		vdata.InputHashes, opHashes, err = getPrepProofHashes(input.FnName, &storeIn)
+		vdata.InputHashes, opHashes, err = getPrepProofHashes(version, input.FnName, &storeIn)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
@@ -69,7 +70,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		return PrepareProofs, &base.GenericInput{I: storeIn}, vdata, opHashes, nil
 	case "prepare_decrypt_vote":
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		vdata.StateProofs = input.StateProofs
 		return PrepareDecrypt, &base.GenericInput{I: nil}, vdata, nil, nil
@@ -79,7 +80,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
-		vdata.InputHashes, opHashes, err = getTallyHashes(input.FnName, &tallyIn)
+		vdata.InputHashes, opHashes, err = getTallyHashes(version, input.FnName, &tallyIn)
 		if err != nil {
 			log.Errorf("calculating tally hashes: %v", err)
 			return nil, nil, nil, nil, err
@@ -91,7 +92,8 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 	return nil, nil, nil, nil, nil
 }
 
-func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOutput, map[string][]byte, error) {
+func MuxRequest(fnName string, genericOut *base.GenericOutput,
+	version int) (*base.ExecuteOutput, map[string][]byte, error) {
 	switch fnName {
 	case "setup_vote":
 		setupOut, ok := genericOut.O.(SetupOutput)
@@ -103,7 +105,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(setupOut.WS)
+		wsHash := libstate.Hash(version, setupOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -117,7 +119,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(voteOut.WS)
+		wsHash := libstate.Hash(version, voteOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -131,7 +133,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(closeOut.WS)
+		wsHash := libstate.Hash(version, closeOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -145,7 +147,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		outputHashes, err := prepShufOut.Input.PrepareHashes()
+		outputHashes, err := prepShufOut.Input.PrepareHashes(version)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -160,7 +162,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(prepProofsOut.WS)
+		wsHash := libstate.Hash(version, prepProofsOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -174,7 +176,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		hash, err := prepDecOut.Input.Hash()
+		hash, err := prepDecOut.Input.Hash(version)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -191,7 +193,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(tallyOut.WS)
+		wsHash := libstate.Hash(version, tallyOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -200,11 +202,12 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 	return nil, nil, nil
 }
 
-func getSetupHashes(fnName string, input *SetupInput) (map[string][]byte, map[string][]byte, error) {
+func getSetupHashes(version int, fnName string,
+	input *SetupInput) (map[string][]byte, map[string][]byte, error) {
 	inputHashes := make(map[string][]byte)
 	receiptHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	buf, err := utils.HashPoint(input.Pk)
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	buf, err := utils.HashPoint(version, input.Pk)
 	if err != nil {
 		log.Errorf("calculating the public key hash: %v", err)
 		return nil, nil, err
@@ -214,19 +217,21 @@ func getSetupHashes(fnName string, input *SetupInput) (map[string][]byte, map[st
 	return inputHashes, receiptHashes, nil
 }
 
-func getCloseHashes(fnName string, input *CloseInput) map[string][]byte {
+func getCloseHashes(version int, fnName string,
+	input *CloseInput) map[string][]byte {
 	inputHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	inputHashes["barrier"] = utils.HashUint64(uint64(input.Barrier))
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	inputHashes["barrier"] = utils.HashUint64(version, uint64(input.Barrier))
 	return inputHashes
 }
 
-func getPrepProofHashes(fnName string, input *PrepProofsInput) (map[string][]byte, map[string][]byte, error) {
+func getPrepProofHashes(version int, fnName string,
+	input *PrepProofsInput) (map[string][]byte, map[string][]byte, error) {
 	var err error
 	inputHashes := make(map[string][]byte)
 	receiptHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	inputHashes["proofs"], err = input.ShProofs.Hash()
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	inputHashes["proofs"], err = input.ShProofs.Hash(version)
 	if err != nil {
 		log.Errorf("calculating the proofs hash: %v", err)
 		return nil, nil, err
@@ -235,16 +240,17 @@ func getPrepProofHashes(fnName string, input *PrepProofsInput) (map[string][]byt
 	return inputHashes, receiptHashes, nil
 }
 
-func getTallyHashes(fnName string, input *TallyInput) (map[string][]byte, map[string][]byte, error) {
+func getTallyHashes(version int, fnName string,
+	input *TallyInput) (map[string][]byte, map[string][]byte, error) {
 	inputHashes := make(map[string][]byte)
 	receiptHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	buf, err := utils.HashPoints(input.Ps)
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	buf, err := utils.HashPoints(version, input.Ps)
 	if err != nil {
 		log.Errorf("calculating the dec_ballots hash: %v", err)
 		return nil, nil, err
 	}
-	inputHashes["candidate_count"] = utils.HashUint64(uint64(input.CandCount))
+	inputHashes["candidate_count"] = utils.HashUint64(version, uint64(input.CandCount))
 	inputHashes["plaintexts"] = buf
 	receiptHashes["plaintexts"] = buf
 	return inputHashes, receiptHashes, nil
@@ -103,7 +103,6 @@ func Lock(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if err != nil {
 		return nil, err
 	}
-	hdr.Lock = true
 	hdr.CurrState = "vote_closed"
 	buf, err := protobuf.Encode(hdr)
 	if err != nil {
@@ -175,6 +174,7 @@ func PrepareDecrypt(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The guard of the tally txn ensures that there is at least one proof
 	sz := len(proofs)
 	pairs := proofs[sz-1].Pairs
 	input := threshold.DecryptInput{ElGamalPairs: pairs}
@@ -206,7 +206,6 @@ func Tally(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if err != nil {
 		return nil, err
 	}
-	hdr.Lock = false
 	hdr.CurrState = "vote_finalized"
 	hdrBuf, err := protobuf.Encode(hdr)
 	if err != nil {
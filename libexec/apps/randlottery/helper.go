@@ -10,7 +10,8 @@ import (
 	"golang.org/x/xerrors"
 )
 
-func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
+func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData,
+	version int) (
 	base.ExecutionFn, *base.GenericInput, *core.VerificationData,
 	map[string][]byte, error) {
 	var opHashes map[string][]byte
@@ -23,7 +24,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		}
 		vdata.StateProofs = input.StateProofs
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		return JoinLottery, &base.GenericInput{I: joinIn}, vdata, nil, nil
 	case "batch_join_randlot":
@@ -34,7 +35,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		}
 		vdata.StateProofs = input.StateProofs
 		inputHashes := make(map[string][]byte)
-		inputHashes["fnname"] = utils.HashString(input.FnName)
+		inputHashes["fnname"] = utils.HashString(version, input.FnName)
 		vdata.InputHashes = inputHashes
 		return BatchJoinLottery, &base.GenericInput{I: batchJoinIn}, vdata, nil,
 			nil
@@ -49,7 +50,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 			return nil, nil, nil, nil, xerrors.New("missing input: readset")
 		}
 		closeIn.BlkHeight = pr.Proof.Latest.Index
-		vdata.InputHashes = getCloseHashes(input.FnName, &closeIn)
+		vdata.InputHashes = getCloseHashes(version, input.FnName, &closeIn)
 		vdata.StateProofs = input.StateProofs
 		return CloseLottery, &base.GenericInput{I: closeIn}, vdata, nil, nil
 	case "finalize_randlot":
@@ -58,7 +59,7 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
-		vdata.InputHashes, opHashes, err = getFinalizeHashes(input.FnName, &finalizeIn)
+		vdata.InputHashes, opHashes, err = getFinalizeHashes(version, input.FnName, &finalizeIn)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
@@ -69,7 +70,8 @@ func DemuxRequest(input *base.ExecuteInput, vdata *core.VerificationData) (
 	return nil, nil, nil, nil, nil
 }
 
-func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOutput, map[string][]byte, error) {
+func MuxRequest(fnName string, genericOut *base.GenericOutput,
+	version int) (*base.ExecuteOutput, map[string][]byte, error) {
 	switch fnName {
 	case "join_randlot":
 		joinOut, ok := genericOut.O.(JoinOutput)
@@ -81,7 +83,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(joinOut.WS)
+		wsHash := libstate.Hash(version, joinOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -95,7 +97,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, err
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(joinOut.WS)
+		wsHash := libstate.Hash(version, joinOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -109,7 +111,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(closeOut.WS)
+		wsHash := libstate.Hash(version, closeOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -123,7 +125,7 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 			return nil, nil, xerrors.Errorf("encoding output: %v", err)
 		}
 		output := &base.ExecuteOutput{Data: data}
-		wsHash := libstate.Hash(finalizeOut.WS)
+		wsHash := libstate.Hash(version, finalizeOut.WS)
 		outputHashes := make(map[string][]byte)
 		outputHashes["writeset"] = wsHash
 		return output, outputHashes, nil
@@ -132,19 +134,21 @@ func MuxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOut
 	return nil, nil, nil
 }
 
-func getCloseHashes(fnName string, input *CloseInput) map[string][]byte {
+func getCloseHashes(version int, fnName string,
+	input *CloseInput) map[string][]byte {
 	inputHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	inputHashes["barrier"] = utils.HashUint64(uint64(input.Barrier))
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	inputHashes["barrier"] = utils.HashUint64(version, uint64(input.Barrier))
 	return inputHashes
 }
 
-func getFinalizeHashes(fnName string, input *FinalizeInput) (map[string][]byte, map[string][]byte, error) {
+func getFinalizeHashes(version int, fnName string,
+	input *FinalizeInput) (map[string][]byte, map[string][]byte, error) {
 	inputHashes := make(map[string][]byte)
 	receiptHashes := make(map[string][]byte)
-	inputHashes["fnname"] = utils.HashString(fnName)
-	inputHashes["round"] = utils.HashUint64(input.Round)
-	buf, err := input.Randomness.Hash()
+	inputHashes["fnname"] = utils.HashString(version, fnName)
+	inputHashes["round"] = utils.HashUint64(version, input.Round)
+	buf, err := input.Randomness.Hash(version)
 	if err != nil {
 		log.Errorf("calculating the randomness hash: %v", err)
 		return nil, nil, err
@@ -21,7 +21,7 @@ func JoinLottery(genInput *base.GenericInput) (*base.GenericOutput, error) {
 		return nil, xerrors.New("missing input")
 	}
 	ticket := input.Ticket
-	pkHash, err := utils.HashPoint(ticket.Key)
+	pkHash, err := utils.HashPoint(core.CurrentHashVersion, ticket.Key)
 	if err != nil {
 		return nil, xerrors.Errorf("couldn't calculate the hash of pk: %v", err)
 	}
@@ -29,20 +29,13 @@ func JoinLottery(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("couldn't verify signature: %v", err)
 	}
-	kvDict, ok := genInput.KVInput["readset"]
-	if !ok {
-		return nil, xerrors.New("missing keyvalue data")
-	}
-	tickets, err := getTickets(&kvDict)
+	// The ticket is appended to the stored tickets, so that concurrent
+	// joins do not conflict.
+	buf, err := protobuf.Encode(&ticket)
 	if err != nil {
-		return nil, err
+		return nil, xerrors.Errorf("couldn't encode ticket: %v", err)
 	}
-	tickets.Data = append(tickets.Data, ticket)
-	buf, err := protobuf.Encode(tickets)
-	if err != nil {
-		return nil, xerrors.Errorf("couldn't encode tickets: %v", err)
-	}
-	args := byzcoin.Arguments{{Name: "tickets", Value: buf}}
+	args := byzcoin.Arguments{core.AppendArg("tickets", buf)}
 	return &base.GenericOutput{O: JoinOutput{WS: args}}, nil
 }
 
@@ -52,7 +45,7 @@ func BatchJoinLottery(genInput *base.GenericInput) (*base.GenericOutput, error)
 		return nil, xerrors.New("missing input")
 	}
 	for _, ticket := range input.Tickets.Data {
-		pkHash, err := utils.HashPoint(ticket.Key)
+		pkHash, err := utils.HashPoint(core.CurrentHashVersion, ticket.Key)
 		if err != nil {
 			return nil, xerrors.Errorf("couldn't calculate the hash of pk: %v", err)
 		}
@@ -61,20 +54,14 @@ func BatchJoinLottery(genInput *base.GenericInput) (*base.GenericOutput, error)
 			return nil, xerrors.Errorf("couldn't verify signature: %v", err)
 		}
 	}
-	kvDict, ok := genInput.KVInput["readset"]
-	if !ok {
-		return nil, xerrors.New("missing keyvalue data")
-	}
-	tickets, err := getTickets(&kvDict)
-	if err != nil {
-		return nil, err
-	}
-	tickets.Data = append(tickets.Data, input.Tickets.Data...)
-	buf, err := protobuf.Encode(tickets)
-	if err != nil {
-		return nil, xerrors.Errorf("couldn't encode tickets: %v", err)
+	args := make(byzcoin.Arguments, len(input.Tickets.Data))
+	for i := range input.Tickets.Data {
+		buf, err := protobuf.Encode(&input.Tickets.Data[i])
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't encode ticket: %v", err)
+		}
+		args[i] = core.AppendArg("tickets", buf)
 	}
-	args := byzcoin.Arguments{{Name: "tickets", Value: buf}}
 	return &base.GenericOutput{O: JoinOutput{WS: args}}, nil
 }
 
@@ -135,7 +122,8 @@ func FinalizeLottery(genInput *base.GenericInput) (*base.GenericOutput, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Find winner
+	// Find winner. The guard of the close txn ensures that there is at
+	// least one ticket.
 	winnerIdx := rand % uint64(len(tickets.Data))
 	winner := Winner{
 		Index: int(winnerIdx),
@@ -187,10 +175,16 @@ func getTickets(kvDict *core.KVDict) (*Tickets, error) {
 	if !ok {
 		return nil, xerrors.New("missing key: tickets")
 	}
-	tickets := &Tickets{}
-	err := protobuf.Decode(buf, tickets)
+	list, err := core.DecodeItemList(buf)
 	if err != nil {
 		return nil, xerrors.Errorf("couldn't decode tickets: %v", err)
 	}
+	tickets := &Tickets{Data: make([]Ticket, len(list.Items))}
+	for i, item := range list.Items {
+		err = protobuf.Decode(item, &tickets.Data[i])
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't decode ticket: %v", err)
+		}
+	}
 	return tickets, nil
 }
@@ -15,6 +15,9 @@ type ByzData struct {
 	IID     byzcoin.InstanceID
 	Proof   *byzcoin.Proof
 	Genesis *skipchain.SkipBlock
+	// KeyProofs are set if the proof only covers some keys of the contract
+	// (see core.StateProof)
+	KeyProofs []core.KeyProof
 }
 
 type InitTxnInput struct {
@@ -22,6 +25,17 @@ type InitTxnInput struct {
 	CData   *ByzData
 	WfName  string
 	TxnName string
+	// Nonce is chosen by the client to make the plan ID unique
+	Nonce []byte
+	// Expiry is the Unix time (in seconds) at which the plan expires
+	Expiry int64
+	// LockBlocks is the number of blocks for which the plan locks the
+	// contract. If it is zero, the contract is not locked.
+	LockBlocks int
+	// ExtData holds the proofs of the contracts other than CData that are
+	// read by KEYVALUE dependencies with a CID or updated by the txn, keyed
+	// by their lower-case hex-encoded CID (see core.DataDependency.ContractKey)
+	ExtData map[string]*ByzData
 }
 
 type ExecutionFn func(input *GenericInput) (*GenericOutput, error)
@@ -15,6 +15,9 @@ type InitUnitReply struct{}
 
 type InitTransaction struct {
 	Input base.InitTxnInput
+	// Wait is the number of blocks to wait for the transaction that locks
+	// the contract if Input.LockBlocks is positive
+	Wait int
 }
 
 type InitTransactionReply struct {
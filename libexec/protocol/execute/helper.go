@@ -9,41 +9,42 @@ import (
 	"github.com/dedis/protean/libexec/base"
 )
 
-func demuxRequest(input *base.ExecuteInput) (base.ExecutionFn,
+func demuxRequest(input *base.ExecuteInput, version int) (base.ExecutionFn,
 	*base.GenericInput, *core.VerificationData, map[string][]byte, error) {
 	vdata := &core.VerificationData{UID: base.UID, OpcodeName: base.EXEC}
 	switch input.FnName {
 	case "join_randlot", "close_randlot", "batch_join_randlot", "finalize_randlot":
-		return randlottery.DemuxRequest(input, vdata)
+		return randlottery.DemuxRequest(input, vdata, version)
 	case "setup_dkglot", "join_dkglot", "batch_join_dkglot", "close_dkglot",
 		"prepare_decrypt_dkglot", "finalize_dkglot":
-		return dkglottery.DemuxRequest(input, vdata)
+		return dkglottery.DemuxRequest(input, vdata, version)
 	case "setup_vote", "vote", "close_vote", "prepare_shuffle",
 		"prepare_proofs", "prepare_decrypt_vote", "tally":
-		return evoting.DemuxRequest(input, vdata)
+		return evoting.DemuxRequest(input, vdata, version)
 	case "setup_vote_pc", "vote_pc", "batch_vote_pc", "lock",
 		"prepare_shuffle_pc", "prepare_proofs_pc", "prepare_decrypt_vote_pc",
 		"tally_pc":
-		return evotingpc.DemuxRequest(input, vdata)
+		return evotingpc.DemuxRequest(input, vdata, version)
 	default:
 	}
 	return nil, nil, nil, nil, nil
 }
 
-func muxRequest(fnName string, genericOut *base.GenericOutput) (*base.ExecuteOutput, map[string][]byte, error) {
+func muxRequest(fnName string, genericOut *base.GenericOutput,
+	version int) (*base.ExecuteOutput, map[string][]byte, error) {
 	switch fnName {
 	case "join_randlot", "close_randlot", "batch_join_randlot", "finalize_randlot":
-		return randlottery.MuxRequest(fnName, genericOut)
+		return randlottery.MuxRequest(fnName, genericOut, version)
 	case "setup_dkglot", "join_dkglot", "batch_join_dkglot", "close_dkglot",
 		"prepare_decrypt_dkglot", "finalize_dkglot":
-		return dkglottery.MuxRequest(fnName, genericOut)
+		return dkglottery.MuxRequest(fnName, genericOut, version)
 	case "setup_vote", "vote", "close_vote", "prepare_shuffle",
 		"prepare_proofs", "prepare_decrypt_vote", "tally":
-		return evoting.MuxRequest(fnName, genericOut)
+		return evoting.MuxRequest(fnName, genericOut, version)
 	case "setup_vote_pc", "vote_pc", "batch_vote_pc", "lock",
 		"prepare_shuffle_pc", "prepare_proofs_pc", "prepare_decrypt_vote_pc",
 		"tally_pc":
-		return evotingpc.MuxRequest(fnName, genericOut)
+		return evotingpc.MuxRequest(fnName, genericOut, version)
 	default:
 	}
 	return nil, nil, nil
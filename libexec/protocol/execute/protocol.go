@@ -33,6 +33,8 @@ type Execute struct {
 
 	KP      *key.Pair
 	Publics []kyber.Point
+	Replay  *core.ReplayCache
+	Hashes  core.HashConfig
 
 	Failures  int
 	Success   int
@@ -71,13 +73,20 @@ func (p *Execute) Start() error {
 		p.finish(false)
 		return xerrors.New("missing input")
 	}
-	execFn, genInput, vdata, inHashes, err := demuxRequest(p.Input)
+	if p.ExecReq == nil || p.ExecReq.EP == nil {
+		p.finish(false)
+		return xerrors.New("missing execution request")
+	}
+	execFn, genInput, vdata, inHashes, err := demuxRequest(p.Input,
+		p.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("%s failed to demux request: %v", p.Name(), err)
 		p.finish(false)
 		return err
 	}
 	vdata.CodeHash = utils.GetCodeHash()
+	vdata.Replay = p.Replay
+	vdata.Hashes = p.Hashes
 	err = p.ExecReq.Verify(vdata)
 	if err != nil {
 		log.Errorf("%s failed to verify the execution request: %v", p.Name(), err)
@@ -91,7 +100,8 @@ func (p *Execute) Start() error {
 		p.finish(false)
 		return err
 	}
-	p.Output, p.outputHashes, err = muxRequest(p.Input.FnName, genericOut)
+	p.Output, p.outputHashes, err = muxRequest(p.Input.FnName, genericOut,
+		p.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("%s failed to prepare output: %v", p.Name(), err)
 		p.finish(false)
@@ -127,13 +137,21 @@ func (p *Execute) execute(r StructRequest) error {
 	defer p.Done()
 	p.Input = r.Input
 	p.ExecReq = r.ExecReq
-	execFn, genInput, vdata, inHashes, err := demuxRequest(p.Input)
+	if p.Input == nil || p.ExecReq == nil || p.ExecReq.EP == nil {
+		log.Errorf("%s received an incomplete request", p.Name())
+		return cothority.ErrorOrNil(p.SendToParent(&Response{}),
+			"sending Response to parent")
+	}
+	execFn, genInput, vdata, inHashes, err := demuxRequest(p.Input,
+		p.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("%s failed to demux request: %v", p.Name(), err)
 		return cothority.ErrorOrNil(p.SendToParent(&Response{}),
 			"sending Response to parent")
 	}
 	vdata.CodeHash = utils.GetCodeHash()
+	vdata.Replay = p.Replay
+	vdata.Hashes = p.Hashes
 	err = p.ExecReq.Verify(vdata)
 	if err != nil {
 		log.Errorf("%s failed to verify the execution request: %v", p.Name(), err)
@@ -147,7 +165,8 @@ func (p *Execute) execute(r StructRequest) error {
 		p.finish(false)
 		return err
 	}
-	p.Output, p.outputHashes, err = muxRequest(p.Input.FnName, genericOut)
+	p.Output, p.outputHashes, err = muxRequest(p.Input.FnName, genericOut,
+		p.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("%s failed to prepare output: %v:", p.Name(), err)
 		return cothority.ErrorOrNil(p.SendToParent(&Response{}),
@@ -231,6 +250,7 @@ func (p *Execute) generateResponse() (*Response, error) {
 	opIdx := p.ExecReq.Index
 	for outputName, outputHash := range p.outputHashes {
 		r := core.OpcodeReceipt{
+			Version:   p.ExecReq.EP.Version,
 			EPID:      epid,
 			OpIdx:     opIdx,
 			Name:      outputName,
@@ -250,6 +270,7 @@ func (p *Execute) generateResponse() (*Response, error) {
 		inSigs := make(map[string]bdnproto.BdnSignature)
 		for inputName, inputHash := range p.inHashes {
 			r := core.OpcodeReceipt{
+				Version:   p.ExecReq.EP.Version,
 				EPID:      epid,
 				OpIdx:     opIdx,
 				Name:      inputName,
@@ -1,16 +1,21 @@
 package libexec
 
 import (
+	"bytes"
+	"encoding/hex"
+	"time"
+
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/libexec/base"
 	"github.com/dedis/protean/libexec/protocol/execute"
 	"github.com/dedis/protean/libexec/protocol/inittxn"
+	statebase "github.com/dedis/protean/libstate/base"
+	"go.dedis.ch/cothority/v3"
 	"go.dedis.ch/kyber/v3/pairing"
 	"go.dedis.ch/kyber/v3/suites"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/network"
-	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
 )
 
@@ -36,6 +41,14 @@ type Service struct {
 	suite     pairing.SuiteBn256
 	roster    *onet.Roster
 	threshold int
+	replay    *core.ReplayCache
+	hashes    core.HashConfig
+}
+
+// SetHashConfig sets which plan hash versions the service accepts. It must
+// be called before the service handles any request.
+func (s *Service) SetHashConfig(cfg core.HashConfig) {
+	s.hashes = cfg
 }
 
 func (s *Service) InitUnit(req *InitUnit) (*InitUnitReply, error) {
@@ -67,11 +80,32 @@ func (s *Service) InitTransaction(req *InitTransaction) (*InitTransactionReply,
 	}
 	//proto.Plan.Sig = proto.FinalSignature
 	proto.Plan.Sig = proto.FinalSignature
+	if proto.Plan.LockBlocks > 0 {
+		err = lockContract(&req.Input, proto.Plan, req.Wait)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &InitTransactionReply{
 		Plan: *proto.Plan,
 	}, nil
 }
 
+// lockContract asks the state unit of the contract to lock it for the plan.
+// The state unit is reached through the roster of the latest block of the
+// contract proof, which has been verified when the plan was generated.
+func lockContract(input *base.InitTxnInput, plan *core.ExecutionPlan,
+	wait int) error {
+	roster := input.CData.Proof.Latest.Roster
+	req := &statebase.LockContractRequest{Plan: plan, Wait: wait}
+	cl := onet.NewClient(cothority.Suite, statebase.ServiceName)
+	err := cl.SendProtobuf(roster.List[0], req, &statebase.LockContractReply{})
+	if err != nil {
+		return xerrors.Errorf("locking contract: %v", err)
+	}
+	return nil
+}
+
 func (s *Service) Execute(req *Execute) (*ExecuteReply, error) {
 	nodeCount := len(s.roster.List)
 	//threshold := nodeCount - (nodeCount-1)/3
@@ -84,6 +118,8 @@ func (s *Service) Execute(req *Execute) (*ExecuteReply, error) {
 	proto.Input = &req.Input
 	proto.ExecReq = &req.ExecReq
 	proto.KP = s.getKeyPair()
+	proto.Replay = s.replay
+	proto.Hashes = s.hashes
 	proto.Publics = s.roster.ServicePublics(ServiceName)
 	proto.Threshold = s.threshold
 	err = proto.Start()
@@ -110,6 +146,26 @@ func (s *Service) generateExecutionPlan(input *base.InitTxnInput) (*core.Executi
 	if err != nil {
 		return nil, xerrors.Errorf("verification error -- %v", err)
 	}
+	err = verifyExpiry(input.Expiry, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(input.Nonce) == 0 {
+		return nil, xerrors.New("missing nonce")
+	}
+	// A new plan cannot hold the lock of the contract
+	err = header.CheckLock(nil, input.CData.Proof.Latest.Index)
+	if err != nil {
+		return nil, err
+	}
+	if input.LockBlocks < 0 || input.LockBlocks > core.MaxLockBlocks {
+		return nil, xerrors.Errorf("lock duration must be between 0 and %d "+
+			"blocks", core.MaxLockBlocks)
+	}
+	seq, err := getStateSeq(input.CData)
+	if err != nil {
+		return nil, err
+	}
 	root := input.CData.Proof.InclusionProof.GetRoot()
 	txn, ok := raw.Contract.Workflows[input.WfName].Txns[input.TxnName]
 	if !ok {
@@ -123,25 +179,276 @@ func (s *Service) generateExecutionPlan(input *base.InitTxnInput) (*core.Executi
 		}
 		_, ok = dfuData[opcode.DFUID]
 		if !ok {
-			dfuID := core.DFUIdentity{
-				Threshold: dfu.Threshold,
-				Keys:      dfu.Keys,
-			}
-			dfuData[opcode.DFUID] = &dfuID
+			dfuData[opcode.DFUID] = dfu.Identity()
 		}
 	}
+	// The KEYVALUE proofs of the contract are signed by its state unit
+	unit, ok := registry.Units[header.StateUnit()]
+	if !ok {
+		return nil, xerrors.Errorf("cannot find dfu information for dfu %s",
+			header.StateUnit())
+	}
+	if _, ok := dfuData[header.StateUnit()]; !ok {
+		dfuData[header.StateUnit()] = unit.Identity()
+	}
+	proof := core.StateProof{Proof: input.CData.Proof,
+		Genesis: input.CData.Genesis, KeyProofs: input.CData.KeyProofs}
+	err = proof.VerifyUnit(dfuData[header.StateUnit()])
+	if err != nil {
+		return nil, xerrors.Errorf("cannot verify byzcoin proof "+
+			"(contract): %v", err)
+	}
+	extRoots, err := verifyExtData(input, txn, registry, header, dfuData)
+	if err != nil {
+		return nil, err
+	}
+	contracts, err := verifyContracts(input, txn, registry, header, dfuData)
+	if err != nil {
+		return nil, err
+	}
+	if input.LockBlocks > 0 && len(contracts) > 0 {
+		return nil, xerrors.New("a plan that updates several contracts " +
+			"cannot lock them")
+	}
 	plan := &core.ExecutionPlan{
-		CID:       header.CID.Slice(),
-		StateRoot: root,
-		CodeHash:  header.CodeHash,
-		WfName:    input.WfName,
-		TxnName:   input.TxnName,
-		Txn:       txn,
-		DFUData:   dfuData,
+		Version: core.CurrentHashVersion,
+		PlanID: core.GeneratePlanID(header.CID.Slice(), root, input.WfName,
+			input.TxnName, input.Nonce),
+		CID:        header.CID.Slice(),
+		StateRoot:  root,
+		CodeHash:   header.CodeHash,
+		UnitID:     header.UnitID,
+		WfName:     input.WfName,
+		TxnName:    input.TxnName,
+		Txn:        txn,
+		DFUData:    dfuData,
+		Expiry:     input.Expiry,
+		LockBlocks: input.LockBlocks,
+		StateSeq:   seq,
+		ExtRoots:   extRoots,
+		Contracts:  contracts,
 	}
 	return plan, nil
 }
 
+// verifyExtData verifies the proofs of the contracts that are read by the
+// KEYVALUE dependencies of txn that name a CID and returns their state
+// roots, keyed by core.DataDependency.ContractKey. The proofs must be signed
+// by the state units that store the contracts, which are added to dfuData, and
+// must be fresh compared to the proof of the contract of the plan (see
+// core.CheckExtFreshness). A contract is stored by the unit of the contract
+// of the plan (planHdr) unless the dependency names a unit.
+func verifyExtData(input *base.InitTxnInput, txn *core.Transaction,
+	registry *core.DFURegistry, planHdr *core.ContractHeader,
+	dfuData map[string]*core.DFUIdentity) (map[string][]byte, error) {
+	units := make(map[string]string)
+	for _, opcode := range txn.Opcodes {
+		for _, dep := range opcode.Dependencies {
+			if dep.Src != core.KEYVALUE || dep.CID == "" {
+				continue
+			}
+			key, err := dep.ContractKey()
+			if err != nil {
+				return nil, err
+			}
+			unit := dep.StateUnit(planHdr.StateUnit())
+			if other, ok := units[key]; ok && other != unit {
+				return nil, xerrors.Errorf("contract %s is read from "+
+					"state units %s and %s", key, other, unit)
+			}
+			units[key] = unit
+		}
+	}
+	if len(units) == 0 {
+		return nil, nil
+	}
+	roots := make(map[string][]byte)
+	for key, unit := range units {
+		dfu, ok := registry.Units[unit]
+		if !ok {
+			return nil, xerrors.Errorf("cannot find dfu information "+
+				"for dfu %s", unit)
+		}
+		if _, ok := dfuData[unit]; !ok {
+			dfuData[unit] = dfu.Identity()
+		}
+		cdata, ok := input.ExtData[key]
+		if !ok {
+			return nil, xerrors.Errorf("missing proof of contract %s", key)
+		}
+		if hex.EncodeToString(cdata.IID.Slice()) != key {
+			return nil, xerrors.Errorf("proof is for contract %s "+
+				"instead of %s", cdata.IID, key)
+		}
+		proof := core.StateProof{Proof: cdata.Proof,
+			Genesis: cdata.Genesis, KeyProofs: cdata.KeyProofs}
+		err := proof.VerifyUnit(dfuData[unit])
+		if err != nil {
+			return nil, xerrors.Errorf("cannot verify byzcoin proof "+
+				"(contract %s): %v", key, err)
+		}
+		err = core.CheckExtFreshness(input.CData.Proof, cdata.Proof,
+			unit == planHdr.StateUnit())
+		if err != nil {
+			return nil, xerrors.Errorf("stale proof of contract %s: %v",
+				key, err)
+		}
+		_, err = proof.Storage(cdata.IID.Slice())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot get data from proof of "+
+				"contract %s: %v", key, err)
+		}
+		roots[key] = cdata.Proof.InclusionProof.GetRoot()
+	}
+	return roots, nil
+}
+
+// verifyContracts verifies the proofs of the contracts other than the
+// contract of the plan that are updated by txn and returns their states.
+// The proofs must be signed by the state units that host the contracts,
+// which are added to dfuData. A state unit applies the writesets of the
+// contracts that it hosts in one transaction, so the proofs of the
+// contracts on the unit of the plan must have the same root as the proof of
+// the contract of the plan.
+func verifyContracts(input *base.InitTxnInput, txn *core.Transaction,
+	registry *core.DFURegistry, planHdr *core.ContractHeader,
+	dfuData map[string]*core.DFUIdentity) ([]core.ContractRoot, error) {
+	cids, err := txn.UpdatedContracts()
+	if err != nil {
+		return nil, err
+	}
+	if len(cids) == 0 {
+		return nil, nil
+	}
+	root := input.CData.Proof.InclusionProof.GetRoot()
+	var roots []core.ContractRoot
+	for _, cid := range cids {
+		if bytes.Equal(cid, input.CData.IID.Slice()) {
+			return nil, xerrors.New("txn cannot update the contract of the " +
+				"plan as another contract")
+		}
+		cidStr := hex.EncodeToString(cid)
+		cdata, ok := input.ExtData[cidStr]
+		if !ok {
+			return nil, xerrors.Errorf("missing proof of contract %s", cidStr)
+		}
+		if !bytes.Equal(cdata.IID.Slice(), cid) {
+			return nil, xerrors.Errorf("proof is for contract %s instead "+
+				"of %s", cdata.IID, cidStr)
+		}
+		store, err := contractStorage(cdata)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := store.GetRaw()
+		if err != nil {
+			return nil, err
+		}
+		header, err := store.GetHeader()
+		if err != nil {
+			return nil, err
+		}
+		unit := header.StateUnit()
+		if unit == planHdr.StateUnit() &&
+			!bytes.Equal(cdata.Proof.InclusionProof.GetRoot(), root) {
+			return nil, xerrors.Errorf("proof of contract %s has a "+
+				"different root", cidStr)
+		}
+		for _, u := range []string{unit, planHdr.StateUnit()} {
+			dfu, ok := registry.Units[u]
+			if !ok {
+				return nil, xerrors.Errorf("cannot find dfu information "+
+					"for dfu %s", u)
+			}
+			if _, ok := dfuData[u]; !ok {
+				dfuData[u] = dfu.Identity()
+			}
+		}
+		proof := core.StateProof{Proof: cdata.Proof, Genesis: cdata.Genesis,
+			KeyProofs: cdata.KeyProofs}
+		err = proof.VerifyUnit(dfuData[unit])
+		if err != nil {
+			return nil, xerrors.Errorf("cannot verify byzcoin proof "+
+				"(contract %s): %v", cidStr, err)
+		}
+		if !(raw.CID.Equal(cdata.IID) && header.CID.Equal(cdata.IID)) {
+			return nil, xerrors.New("contract IDs do not match")
+		}
+		err = coversKeys(cdata, raw.FSM.GuardKeys(input.TxnName))
+		if err != nil {
+			return nil, err
+		}
+		_, err = raw.FSM.Resolve(input.TxnName, header.CurrState, store.Map())
+		if err != nil {
+			return nil, xerrors.Errorf("verifying state transition of "+
+				"contract %s: %v", cidStr, err)
+		}
+		err = header.CheckLock(nil, cdata.Proof.Latest.Index)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, core.ContractRoot{CID: cid,
+			StateRoot: cdata.Proof.InclusionProof.GetRoot(),
+			CodeHash:  header.CodeHash, UnitID: header.UnitID})
+	}
+	return roots, nil
+}
+
+// getStateSeq returns the number of updates that have been applied to the
+// contract in the state proof.
+func getStateSeq(cdata *base.ByzData) (uint64, error) {
+	err := coversKeys(cdata, []string{core.RebaseLogKey})
+	if err != nil {
+		return 0, err
+	}
+	store, err := contractStorage(cdata)
+	if err != nil {
+		return 0, err
+	}
+	rlog, err := core.GetRebaseLog(store)
+	if err != nil {
+		return 0, err
+	}
+	return rlog.Seq, nil
+}
+
+// contractStorage returns the contract storage that is proven by cdata.
+// cdata.Proof must have been verified.
+func contractStorage(cdata *base.ByzData) (*core.Storage, error) {
+	proof := core.StateProof{Proof: cdata.Proof, KeyProofs: cdata.KeyProofs}
+	store, err := proof.Storage(cdata.IID.Slice())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot get data from state proof: %v",
+			err)
+	}
+	return store, nil
+}
+
+// coversKeys returns an error if the state proof in cdata does not cover
+// keys (see core.StateProof.CoversKeys).
+func coversKeys(cdata *base.ByzData, keys []string) error {
+	proof := core.StateProof{Proof: cdata.Proof, KeyProofs: cdata.KeyProofs}
+	err := proof.CoversKeys(cdata.IID.Slice(), keys)
+	if err != nil {
+		return xerrors.Errorf("state proof of contract %s: %v", cdata.IID,
+			err)
+	}
+	return nil
+}
+
+// verifyExpiry checks that the expiry requested by the client is in the
+// future and within core.MaxPlanTTL.
+func verifyExpiry(expiry int64, now time.Time) error {
+	if expiry <= now.Unix() {
+		return xerrors.New("expiry is in the past")
+	}
+	if expiry > now.Add(core.MaxPlanTTL).Unix() {
+		return xerrors.Errorf("expiry exceeds the maximum validity period "+
+			"of %s", core.MaxPlanTTL)
+	}
+	return nil
+}
+
 func verifyInitTxn(input *base.InitTxnInput) (*core.DFURegistry, *core.ContractRaw, *core.ContractHeader, error) {
 	// Verify Byzcoin proofs
 	err := input.RData.Proof.VerifyFromBlock(input.RData.Genesis)
@@ -154,54 +461,44 @@ func verifyInitTxn(input *base.InitTxnInput) (*core.DFURegistry, *core.ContractR
 		return nil, nil, nil, xerrors.Errorf("cannot verify byzcoin proof (contract): %v", err)
 	}
 	// Get registry data
-	v, _, _, err := input.RData.Proof.Get(input.RData.IID.Slice())
+	store, err := contractStorage(input.RData)
 	if err != nil {
 		return nil, nil, nil, xerrors.Errorf("cannot get data from registry proof: %v", err)
 	}
-	store := core.Storage{}
-	err = protobuf.Decode(v, &store)
+	registry, err := core.GetDFURegistry(store)
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot decode registry contract storage: %v", err)
-	}
-	registry := core.DFURegistry{}
-	err = protobuf.Decode(store.Store[0].Value, &registry)
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot decode registry data: %v", err)
+		return nil, nil, nil, xerrors.Errorf("cannot get registry data: %v", err)
 	}
 	// Get contract header
-	v, _, _, err = input.CData.Proof.Get(input.CData.IID.Slice())
-	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot get data from state proof: %v", err)
-	}
-	store = core.Storage{}
-	err = protobuf.Decode(v, &store)
+	cstore, err := contractStorage(input.CData)
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot decode state contract storage: %v", err)
+		return nil, nil, nil, err
 	}
-	raw := core.ContractRaw{}
-	err = protobuf.Decode(store.Store[0].Value, &raw)
+	raw, err := cstore.GetRaw()
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot decode raw contract: %v", err)
+		return nil, nil, nil, err
 	}
-	header := core.ContractHeader{}
-	err = protobuf.Decode(store.Store[1].Value, &header)
+	header, err := cstore.GetHeader()
 	if err != nil {
-		return nil, nil, nil, xerrors.Errorf("cannot decode contract header: %v", err)
+		return nil, nil, nil, err
 	}
 	// Check if CIDs match
 	if !(raw.CID.Equal(input.CData.IID) && header.CID.Equal(input.CData.IID)) {
 		return nil, nil, nil, xerrors.New("contract IDs do not match")
 	}
-	// Check that this txn can be executed in the curr_state
-	transition, ok := raw.FSM.Transitions[input.TxnName]
-	if !ok {
-		return nil, nil, nil, xerrors.New("invalid txn name")
+	// Check that this txn can be executed in the curr_state and that the
+	// guards of the transition hold. The proof must cover the keys of the
+	// guards.
+	err = coversKeys(input.CData, raw.FSM.GuardKeys(input.TxnName))
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	if transition.From != header.CurrState {
-		return nil, nil, nil, xerrors.Errorf("cannot execute txn %s in curr_state %s",
-			input.TxnName, header.CurrState)
+	_, err = raw.FSM.Resolve(input.TxnName, header.CurrState,
+		cstore.Map())
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("verifying state transition: %v", err)
 	}
-	return &registry, &raw, &header, nil
+	return registry, raw, header, nil
 }
 
 func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
@@ -222,6 +519,8 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		}
 		proto := pi.(*execute.Execute)
 		proto.KP = s.getKeyPair()
+		proto.Replay = s.replay
+		proto.Hashes = s.hashes
 		return proto, nil
 	}
 	return nil, nil
@@ -231,6 +530,7 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		suite:            *suite,
+		replay:           core.NewReplayCache(core.DefaultReplayCacheSize),
 	}
 	if err := s.RegisterHandlers(s.InitUnit, s.InitTransaction, s.Execute); err != nil {
 		return nil, xerrors.New("couldn't register messages")
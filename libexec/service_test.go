@@ -0,0 +1,54 @@
+package libexec
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/dedis/protean/libexec/base"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+)
+
+func Test_VerifyExtData(t *testing.T) {
+	cid := byzcoin.NewInstanceID([]byte("ext contract"))
+	other := byzcoin.NewInstanceID([]byte("other contract"))
+	registry := &core.DFURegistry{Units: map[string]*core.DFU{
+		core.SUID: {Threshold: 1},
+		"state2":  {Threshold: 1},
+	}}
+	hdr := &core.ContractHeader{}
+	txnFor := func(deps ...*core.DataDependency) *core.Transaction {
+		inputs := make(map[string]*core.DataDependency)
+		for i, dep := range deps {
+			inputs[string(rune('a'+i))] = dep
+		}
+		return &core.Transaction{Opcodes: []*core.Opcode{
+			{Name: "exec", DFUID: base.UID, Dependencies: inputs},
+		}}
+	}
+	upper := &core.DataDependency{Src: core.KEYVALUE,
+		CID: strings.ToUpper(cid.String())}
+	input := &base.InitTxnInput{}
+
+	// The proof is looked up by the canonical CID
+	_, err := verifyExtData(input, txnFor(upper), registry, hdr,
+		make(map[string]*core.DFUIdentity))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing proof of contract "+
+		cid.String())
+
+	input.ExtData = map[string]*base.ByzData{cid.String(): {IID: other}}
+	_, err = verifyExtData(input, txnFor(upper), registry, hdr,
+		make(map[string]*core.DFUIdentity))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "proof is for contract")
+
+	// Different spellings of a CID refer to the same contract
+	lower := &core.DataDependency{Src: core.KEYVALUE, CID: cid.String(),
+		UnitID: "state2"}
+	_, err = verifyExtData(input, txnFor(upper, lower), registry, hdr,
+		make(map[string]*core.DFUIdentity))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is read from state units")
+}
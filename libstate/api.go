@@ -14,6 +14,7 @@ import (
 	"go.dedis.ch/cothority/v3/skipchain"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
 )
 
@@ -45,7 +46,13 @@ func SetupByzcoin(r *onet.Roster, blockTime int) (*AdminClient,
 	signer := darc.NewSignerEd25519(nil, nil)
 	gMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r,
 		[]string{"spawn:keyValue", "invoke:keyValue.init_contract",
-			"invoke:keyValue.update", "invoke:keyValue.dummy"},
+			"invoke:keyValue.update", "invoke:keyValue.upgrade",
+			"invoke:keyValue.lock",
+			"invoke:keyValue.precommit", "invoke:keyValue.migrate",
+			"invoke:keyValue.prepare",
+			"invoke:keyValue.commit", "invoke:keyValue.abort",
+			"invoke:keyValue.dummy",
+			"delete:keyValue"},
 		signer.Identity())
 	if err != nil {
 		return nil, nil, err
@@ -96,12 +103,166 @@ func (c *Client) GetState(cid byzcoin.InstanceID) (*GetStateReply,
 	return reply, nil
 }
 
+// GetStateKeys returns a state proof that only covers the given keys of
+// the contract (see core.StateProof.Storage).
+func (c *Client) GetStateKeys(cid byzcoin.InstanceID, keys []string) (
+	*GetStateReply, error) {
+	reply := &GetStateReply{}
+	req := &GetStateRequest{CID: cid, Keys: keys}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending get contract state message: %v", err)
+	}
+	return reply, nil
+}
+
+// GetStateAt returns a proof of the state of contract cid as of block index
+// (see core.HistoricalProof.Verify). The proof covers keys, or all the keys
+// that the contract had at the block if keys is empty. If keys are not all
+// main keys, it also covers the key index and the keys in it.
+func (c *Client) GetStateAt(cid byzcoin.InstanceID, index int,
+	keys []string) (*GetStateAtReply, error) {
+	reply := &GetStateAtReply{}
+	req := &GetStateAtRequest{CID: cid, Index: index, Keys: keys}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending get state at message: %v", err)
+	}
+	return reply, nil
+}
+
+// GetStateAtRoot returns a proof of the state of contract cid as of the
+// block whose state root is root, such as the StateRoot of an execution plan
+// (see core.HistoricalProof.VerifyRoot). Only the recent blocks of the
+// ledger are searched for root. The proof covers keys as in GetStateAt.
+func (c *Client) GetStateAtRoot(cid byzcoin.InstanceID, root []byte,
+	keys []string) (*GetStateAtReply, error) {
+	reply := &GetStateAtReply{}
+	req := &GetStateAtRequest{CID: cid, Root: root, Keys: keys}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending get state at message: %v", err)
+	}
+	return reply, nil
+}
+
+// GetKey returns the value of key of contract cid. The value is verified
+// against genesis, the trusted genesis block of the state unit's ledger, and
+// the proof only covers key.
+func (c *Client) GetKey(cid byzcoin.InstanceID, key string,
+	genesis *skipchain.SkipBlock) ([]byte, *core.StateProof, error) {
+	values, proof, err := c.GetKeys(cid, []string{key}, genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, ok := values[key]
+	if !ok {
+		return nil, nil, xerrors.Errorf("missing key: %s", key)
+	}
+	return value, proof, nil
+}
+
+// GetKeys returns the values of keys of contract cid, verified against
+// genesis (see GetKey). Keys that do not exist are left out of the values;
+// the proof shows their absence.
+func (c *Client) GetKeys(cid byzcoin.InstanceID, keys []string,
+	genesis *skipchain.SkipBlock) (map[string][]byte, *core.StateProof,
+	error) {
+	if len(keys) == 0 {
+		return nil, nil, xerrors.New("no keys are requested")
+	}
+	requested := make(map[string]bool)
+	var unique []string
+	for _, key := range keys {
+		if !requested[key] {
+			requested[key] = true
+			unique = append(unique, key)
+		}
+	}
+	reply, err := c.GetStateKeys(cid, unique)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof := &reply.Proof
+	err = proof.VerifyGenesis(genesis)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("verifying state proof: %v", err)
+	}
+	err = proof.CoversKeys(cid.Slice(), unique)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string][]byte)
+	for _, key := range unique {
+		if v, ok := store.Get(key); ok {
+			values[key] = v
+		}
+	}
+	return values, proof, nil
+}
+
+// GetTypedKey returns the value of key of contract cid (see GetKey),
+// decoded into the type that is registered for key in reg.
+func (c *Client) GetTypedKey(cid byzcoin.InstanceID, key string,
+	genesis *skipchain.SkipBlock, reg *DecoderRegistry) (interface{},
+	*core.StateProof, error) {
+	value, proof, err := c.GetKey(cid, key, genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := reg.Decode(key, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, proof, nil
+}
+
+// Subscribe streams the events of contract cid to handler until handler
+// returns false or the connection fails. An event is pushed when a block
+// changes the storage of the contract, so a client does not need to poll
+// the ledger (see WaitProof). The stream has its own connection, which is
+// closed on return so that the state unit ends the subscription.
+func (c *Client) Subscribe(cid byzcoin.InstanceID,
+	handler func(*ContractEvent) bool) error {
+	cl := onet.NewClient(cothority.Suite, ServiceName)
+	defer cl.Close()
+	conn, err := cl.Stream(c.bcClient.Roster.List[0],
+		&SubscribeRequest{CID: cid})
+	if err != nil {
+		return xerrors.Errorf("subscribing to contract events: %v", err)
+	}
+	for {
+		ev := &ContractEvent{}
+		err := conn.ReadMessage(ev)
+		if err != nil {
+			return xerrors.Errorf("reading contract event: %v", err)
+		}
+		if !handler(ev) {
+			return nil
+		}
+	}
+}
+
 func (c *Client) UpdateState(args byzcoin.Arguments,
+	execReq *core.ExecutionRequest, inReceipts map[int]map[string]*core.
+		OpcodeReceipt, wait int) (*UpdateStateReply, error) {
+	return c.UpdateStateWithInput(base.UpdateInput{Args: args}, execReq,
+		inReceipts, wait)
+}
+
+// UpdateStateWithInput applies the writesets of a plan that updates several
+// contracts. The writesets of the contracts other than the contract of the
+// plan are given in input.ExtArgs. Either all contracts are updated or none.
+func (c *Client) UpdateStateWithInput(input base.UpdateInput,
 	execReq *core.ExecutionRequest, inReceipts map[int]map[string]*core.
 		OpcodeReceipt, wait int) (*UpdateStateReply, error) {
 	reply := &UpdateStateReply{}
 	req := &UpdateStateRequest{
-		Input:         base.UpdateInput{Args: args},
+		Input:         input,
 		ExecReq:       *execReq,
 		Wait:          wait,
 		InputReceipts: inReceipts,
@@ -113,6 +274,210 @@ func (c *Client) UpdateState(args byzcoin.Arguments,
 	return reply, nil
 }
 
+// UpgradeContract replaces the code of a contract. The upgrade must be
+// signed by enough contract admins (see core.Upgrade.Sign).
+func (c *Client) UpgradeContract(upgrade *core.Upgrade, wait int) (
+	*UpgradeContractReply, error) {
+	reply := &UpgradeContractReply{}
+	req := &UpgradeContractRequest{Upgrade: upgrade, Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("upgrading contract: %v", err)
+	}
+	return reply, nil
+}
+
+// GetUpgradeHistory returns the upgrades that have been applied to a
+// contract.
+func (c *Client) GetUpgradeHistory(cid byzcoin.InstanceID) (
+	*core.UpgradeHistory, error) {
+	gcs, err := c.GetStateKeys(cid, []string{contracts.UpgradesKey})
+	if err != nil {
+		return nil, err
+	}
+	store, err := gcs.Proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	history := &core.UpgradeHistory{}
+	buf, ok := store.Map()[contracts.UpgradesKey]
+	if !ok {
+		return history, nil
+	}
+	err = protobuf.Decode(buf, history)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding upgrade history: %v", err)
+	}
+	return history, nil
+}
+
+// GetTxnLog returns the records of the txn log of a contract with a
+// sequence number in [from, to) (see core.GetTxnRecords). Each record is
+// fetched with its own key proof, so only the records in the range are
+// downloaded.
+func (c *Client) GetTxnLog(cid byzcoin.InstanceID, from uint64, to uint64) (
+	[]core.TxnRecord, error) {
+	if to == 0 {
+		gcs, err := c.GetStateKeys(cid, []string{core.KeyTxnLog})
+		if err != nil {
+			return nil, err
+		}
+		store, err := gcs.Proof.Storage(cid.Slice())
+		if err != nil {
+			return nil, err
+		}
+		to, err = core.TxnLogLen(store)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if from >= to {
+		return nil, nil
+	}
+	keys := append([]string{core.KeyTxnLog}, core.TxnRecordKeys(from, to)...)
+	gcs, err := c.GetStateKeys(cid, keys)
+	if err != nil {
+		return nil, err
+	}
+	err = gcs.Proof.CoversKeys(cid.Slice(), keys)
+	if err != nil {
+		return nil, err
+	}
+	store, err := gcs.Proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	return core.GetTxnRecords(store, from, to)
+}
+
+// Precommit submits a signed commitment to the value of a PRECOMMIT input
+// (see core.NewPrecommit). The value is revealed in the Precommits of the
+// execution input once the round has closed.
+func (c *Client) Precommit(pc *core.Precommit, wait int) (*PrecommitReply,
+	error) {
+	reply := &PrecommitReply{}
+	req := &PrecommitRequest{Precommit: pc, Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("submitting precommit: %v", err)
+	}
+	return reply, nil
+}
+
+// GetPrecommits returns the current precommit round of a contract.
+func (c *Client) GetPrecommits(cid byzcoin.InstanceID) (*core.PrecommitRound,
+	error) {
+	gcs, err := c.GetStateKeys(cid, []string{core.KeyPrecommits})
+	if err != nil {
+		return nil, err
+	}
+	store, err := gcs.Proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	round, err := core.GetPrecommits(store)
+	if err != nil {
+		return nil, err
+	}
+	if round == nil {
+		return &core.PrecommitRound{}, nil
+	}
+	return round, nil
+}
+
+// MigrateContract converts the storage of a contract that was created with
+// an older storage layout to the current one.
+func (c *Client) MigrateContract(cid byzcoin.InstanceID, wait int) (
+	*MigrateContractReply, error) {
+	reply := &MigrateContractReply{}
+	req := &MigrateContractRequest{CID: cid, Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("migrating contract: %v", err)
+	}
+	return reply, nil
+}
+
+// PrepareState prepares the contracts that are hosted by the state unit for
+// a plan whose contracts are hosted by several state units. The proofs in
+// the reply are the evidence that the other units need to commit the plan.
+func (c *Client) PrepareState(input base.UpdateInput,
+	execReq *core.ExecutionRequest, inReceipts map[int]map[string]*core.
+		OpcodeReceipt, wait int) (*PrepareStateReply, error) {
+	reply := &PrepareStateReply{}
+	req := &PrepareStateRequest{
+		Input:         input,
+		ExecReq:       *execReq,
+		Wait:          wait,
+		InputReceipts: inReceipts,
+	}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("prepare state: %v", err)
+	}
+	return reply, nil
+}
+
+// CommitState commits a prepared plan on the state unit. The coordinator of
+// the plan needs the prepare proofs of the other units and the other units
+// need the decision of the coordinator (see core.PrepareEvidence). cid is
+// the first contract of the plan that is hosted by the unit (see
+// core.ExecutionPlan.HostedContracts).
+func (c *Client) CommitState(cid byzcoin.InstanceID, planID []byte,
+	ev core.PrepareEvidence, wait int) (*CommitStateReply, error) {
+	reply := &CommitStateReply{}
+	req := &CommitStateRequest{CID: cid, PlanID: planID, Evidence: ev,
+		Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("commit state: %v", err)
+	}
+	return reply, nil
+}
+
+// AbortState aborts a prepared plan on the state unit. The coordinator of
+// the plan aborts it once its prepare lock has expired, or earlier given
+// ev.Failed; the other units need the decision of the coordinator.
+func (c *Client) AbortState(cid byzcoin.InstanceID, planID []byte,
+	ev core.PrepareEvidence, wait int) (*AbortStateReply, error) {
+	reply := &AbortStateReply{}
+	req := &AbortStateRequest{CID: cid, PlanID: planID, Evidence: ev,
+		Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("abort state: %v", err)
+	}
+	return reply, nil
+}
+
+// ArchiveContract deletes a contract that is in a terminal state and returns
+// its final state. The deletion must be signed by the admins of the
+// contract, if it has any. The snapshot can be verified with core.ContractSnapshot.Verify
+// after the contract is deleted.
+func (c *Client) ArchiveContract(del *core.Deletion, wait int) (
+	*ArchiveContractReply, error) {
+	reply := &ArchiveContractReply{}
+	req := &ArchiveContractRequest{Deletion: del, Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("archiving contract: %v", err)
+	}
+	return reply, nil
+}
+
+// DeleteContract deletes a contract that is in a terminal state. The
+// deletion must be signed by the admins of the contract, if it has any.
+func (c *Client) DeleteContract(del *core.Deletion, wait int) (
+	*DeleteContractReply, error) {
+	reply := &DeleteContractReply{}
+	req := &DeleteContractRequest{Deletion: del, Wait: wait}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("deleting contract: %v", err)
+	}
+	return reply, nil
+}
+
 // FetchGenesisBlock requires the hash of the genesis block. To retrieve,
 // use proof.Latest.SkipchainID()
 func (c *Client) FetchGenesisBlock(scID skipchain.SkipBlockID) (*skipchain.
@@ -134,8 +499,24 @@ func (c *AdminClient) SpawnDarc(newSigner darc.Signer, gDarc darc.Darc, wait int
 		"init_contract", expression.InitOrExpr(newSigner.Identity().String()))
 	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
 		"update", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"upgrade", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"lock", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"precommit", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"migrate", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"prepare", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"commit", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
+		"abort", expression.InitOrExpr(newSigner.Identity().String()))
 	d.Rules.AddRule("invoke:"+contracts.ContractKeyValueID+"."+
 		"dummy", expression.InitOrExpr(newSigner.Identity().String()))
+	d.Rules.AddRule("delete:"+contracts.ContractKeyValueID,
+		expression.InitOrExpr(newSigner.Identity().String()))
 	darcBuf, err := d.ToProto()
 	if err != nil {
 		log.Errorf("serializing darc to protobuf: %v", err)
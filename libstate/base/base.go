@@ -1,34 +1,61 @@
 package base
 
 import (
-	"crypto/sha256"
 	"github.com/dedis/protean/core"
 	"go.dedis.ch/cothority/v3/byzcoin"
 )
 
+// ServiceName is the name of the state unit service. It is defined here so
+// that other units can reach the service without importing libstate.
+const ServiceName = "StateService"
+
 const (
 	UID           string = "state"
 	INIT_CONTRACT string = "init_contract"
 	UPDATE_STATE  string = "update_state"
 )
 
+// LockContractRequest asks the state unit to lock the contract of Plan for
+// Plan.LockBlocks blocks. It is sent by the CEU when it generates a plan
+// that locks the contract.
+type LockContractRequest struct {
+	Plan *core.ExecutionPlan
+	Wait int
+}
+
+type LockContractReply struct {
+	TxResp *byzcoin.AddTxResponse
+}
+
 type VerifyFn func(*UpdateInput, *core.ExecutionRequest) bool
 
 type UpdateInput struct {
 	Args byzcoin.Arguments
+	// ExtArgs holds the writesets of the other contracts that are updated by
+	// the plan, keyed by the name of their input (see core.WritesetInput)
+	ExtArgs map[string]*core.Writeset
 }
 
-func (input *UpdateInput) PrepareHashes() map[string][]byte {
+// PrepareHashes returns the input hashes of the update with the hash
+// version of its execution plan.
+func (input *UpdateInput) PrepareHashes(version int) map[string][]byte {
 	inputHashes := make(map[string][]byte)
-	inputHashes["ws"] = Hash(input.Args)
+	inputHashes["ws"] = Hash(version, input.Args)
+	for name, ws := range input.ExtArgs {
+		inputHashes[name] = Hash(version, ws.Args)
+	}
 	return inputHashes
 }
 
-func Hash(args byzcoin.Arguments) []byte {
-	h := sha256.New()
+// Hash returns the hash of a writeset with the hash version of the execution
+// plan. It is used as the output hash of the writeset by codeexec and as the
+// input hash by the state unit.
+func Hash(version int, args byzcoin.Arguments) []byte {
+	hr := core.NewVersionedHasher(version, core.DomainWriteset)
+	hr.WriteLen(len(args))
 	for _, arg := range args {
-		h.Write([]byte(arg.Name))
-		h.Write(arg.Value)
+		hr.WriteString(arg.Name)
+		hr.WriteBytes(arg.Value)
 	}
-	return h.Sum(nil)
+	return hr.Sum()
 }
@@ -9,7 +9,6 @@ import (
 var storageKey = []byte("storage")
 
 type storage struct {
-	CurrState map[string]bool
 	sync.Mutex
 }
 
@@ -26,12 +25,6 @@ func (s *Service) save() error {
 
 func (s *Service) tryLoad() error {
 	s.storage = &storage{}
-	// Make sure we don't have any unallocated maps.
-	defer func() {
-		if len(s.storage.CurrState) == 0 {
-			s.storage.CurrState = make(map[string]bool)
-		}
-	}()
 	msg, err := s.Load(storageKey)
 	if err != nil {
 		return xerrors.Errorf("loading storage: %v", err)
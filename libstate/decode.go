@@ -0,0 +1,57 @@
+package libstate
+
+import (
+	"reflect"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// DecoderRegistry maps the keys of a contract to the types that their values
+// are decoded into. Contracts of different apps can use the same key for
+// different types (e.g., "winner"), so every app has its own registry. A new
+// registry knows the keys that the state unit reserves (see core.KeyHeader).
+type DecoderRegistry struct {
+	types map[string]reflect.Type
+}
+
+func NewDecoderRegistry() *DecoderRegistry {
+	r := &DecoderRegistry{types: make(map[string]reflect.Type)}
+	r.Register(core.KeyRaw, &core.ContractRaw{})
+	r.Register(core.KeyHeader, &core.ContractHeader{})
+	r.Register(core.KeyUpgrades, &core.UpgradeHistory{})
+	r.Register(core.RebaseLogKey, &core.RebaseLog{})
+	r.Register(core.KeyPending, &core.PendingUpdate{})
+	r.Register(core.KeyDecision, &core.Decision{})
+	r.Register(core.KeyPrecommits, &core.PrecommitRound{})
+	r.Register(core.KeyTxnLog, &core.TxnLogHead{})
+	r.Register(core.TxnRecordKey(0), &core.TxnRecord{})
+	return r
+}
+
+// Register sets the type of the values of key to the type that msg points
+// to.
+func (r *DecoderRegistry) Register(key string, msg interface{}) {
+	r.types[key] = reflect.TypeOf(msg).Elem()
+}
+
+// Decode decodes the value of key into a new struct of the registered type
+// and returns a pointer to it. All the records of the txn log have the type
+// of the first one.
+func (r *DecoderRegistry) Decode(key string, buf []byte) (interface{},
+	error) {
+	if core.IsTxnRecordKey(key) {
+		key = core.TxnRecordKey(0)
+	}
+	t, ok := r.types[key]
+	if !ok {
+		return nil, xerrors.Errorf("no decoder for key %s", key)
+	}
+	msg := reflect.New(t).Interface()
+	err := protobuf.Decode(buf, msg)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding value of key %s: %v", key, err)
+	}
+	return msg, nil
+}
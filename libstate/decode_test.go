@@ -0,0 +1,33 @@
+package libstate
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/protobuf"
+)
+
+type testWinner struct {
+	Index int
+}
+
+func Test_DecoderRegistry(t *testing.T) {
+	reg := NewDecoderRegistry()
+	reg.Register("winner", &testWinner{})
+
+	buf, err := protobuf.Encode(&testWinner{Index: 3})
+	require.NoError(t, err)
+	msg, err := reg.Decode("winner", buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, msg.(*testWinner).Index)
+
+	buf, err = protobuf.Encode(&core.ContractHeader{CurrState: "open"})
+	require.NoError(t, err)
+	msg, err = reg.Decode(core.KeyHeader, buf)
+	require.NoError(t, err)
+	require.Equal(t, "open", msg.(*core.ContractHeader).CurrState)
+
+	_, err = reg.Decode("tickets", buf)
+	require.Error(t, err)
+}
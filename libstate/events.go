@@ -0,0 +1,420 @@
+package libstate
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/dedis/protean/contracts"
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/protobuf"
+	"golang.org/x/xerrors"
+)
+
+// eventBuffer is the number of events that are buffered for a subscriber.
+// Events are dropped if a subscriber falls further behind.
+const eventBuffer = 16
+
+// eventHub keeps the subscriptions to contract events and the storage of
+// every subscribed contract as of the last block that changed it. The state
+// unit follows the blocks of its ledger with a single byzcoin stream, whose
+// client is closed when the last subscriber leaves.
+type eventHub struct {
+	sync.Mutex
+	subs    map[int]*subscription
+	nextID  int
+	last    map[string]*contractState
+	running bool
+	stream  *onet.Client
+}
+
+type subscription struct {
+	cid byzcoin.InstanceID
+	out chan *ContractEvent
+}
+
+// contractState is the storage of a contract and the version of its
+// instance that the storage is taken from.
+type contractState struct {
+	store   *core.Storage
+	version uint64
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[int]*subscription),
+		last: make(map[string]*contractState)}
+}
+
+// add registers a subscription to contract cid, whose current storage is
+// store at the given version of its instance.
+func (h *eventHub) add(cid byzcoin.InstanceID, store *core.Storage,
+	version uint64) (int, chan *ContractEvent) {
+	h.Lock()
+	defer h.Unlock()
+	id := h.nextID
+	h.nextID++
+	out := make(chan *ContractEvent, eventBuffer)
+	h.subs[id] = &subscription{cid: cid, out: out}
+	if _, ok := h.last[string(cid.Slice())]; !ok {
+		h.last[string(cid.Slice())] = &contractState{store: store,
+			version: version}
+	}
+	return id, out
+}
+
+// remove ends a subscription and closes its channel. The client of the
+// block stream is closed when no subscription is left, which ends the
+// stream.
+func (h *eventHub) remove(id int) {
+	h.Lock()
+	defer h.Unlock()
+	sub, ok := h.subs[id]
+	if !ok {
+		return
+	}
+	delete(h.subs, id)
+	close(sub.out)
+	if len(h.subs) == 0 && h.stream != nil {
+		err := h.stream.Close()
+		if err != nil {
+			log.Warnf("closing block stream: %v", err)
+		}
+		h.stream = nil
+		h.running = false
+	}
+	for _, other := range h.subs {
+		if other.cid.Equal(sub.cid) {
+			return
+		}
+	}
+	delete(h.last, string(sub.cid.Slice()))
+}
+
+// stop records that the block stream could not be started, so that the
+// next subscription starts it again.
+func (h *eventHub) stop() {
+	h.Lock()
+	defer h.Unlock()
+	h.running = false
+}
+
+// start returns true if the caller must start the block stream.
+func (h *eventHub) start() bool {
+	h.Lock()
+	defer h.Unlock()
+	if h.running {
+		return false
+	}
+	h.running = true
+	return true
+}
+
+// attach records cl as the client of the block stream. It returns false if
+// no subscription is left, in which case the stream is not needed.
+func (h *eventHub) attach(cl *onet.Client) bool {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.subs) == 0 {
+		h.running = false
+		return false
+	}
+	h.stream = cl
+	return true
+}
+
+// detach records that the block stream of client cl has stopped, unless it
+// was already closed by remove.
+func (h *eventHub) detach(cl *onet.Client) {
+	h.Lock()
+	defer h.Unlock()
+	if h.stream == cl {
+		h.stream = nil
+		h.running = false
+	}
+}
+
+// version returns the version of the instance of contract cid that its
+// last storage is taken from, or false if cid is not subscribed.
+func (h *eventHub) version(cid byzcoin.InstanceID) (uint64, bool) {
+	h.Lock()
+	defer h.Unlock()
+	st, ok := h.last[string(cid.Slice())]
+	if !ok {
+		return 0, false
+	}
+	return st.version, true
+}
+
+// diff applies the state changes scs of a block to the last storage of
+// contract cid and returns the event that describes the change, or nil if
+// the storage did not change. The block must contain the version that
+// follows the last one.
+func (h *eventHub) diff(cid byzcoin.InstanceID,
+	scs byzcoin.StateChanges) (*ContractEvent, error) {
+	h.Lock()
+	defer h.Unlock()
+	st, ok := h.last[string(cid.Slice())]
+	if !ok {
+		return nil, nil
+	}
+	for i := range scs {
+		if bytes.Equal(scs[i].InstanceID, cid.Slice()) {
+			if scs[i].Version != st.version+1 {
+				return nil, xerrors.Errorf("block has version %d of the "+
+					"contract after version %d", scs[i].Version, st.version)
+			}
+			break
+		}
+	}
+	store, version, err := core.ApplyStateChanges(cid, st.store, scs)
+	if err != nil {
+		return nil, err
+	}
+	prev := st.store
+	h.last[string(cid.Slice())] = &contractState{store: store,
+		version: version}
+	keys := updatedKeys(prev.Map(), store.Map())
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	ev := &ContractEvent{CID: cid, UpdatedKeys: keys}
+	if hdr, err := prev.GetHeader(); err == nil {
+		ev.PrevState = hdr.CurrState
+	}
+	if hdr, err := store.GetHeader(); err == nil {
+		ev.CurrState = hdr.CurrState
+	}
+	return ev, nil
+}
+
+// publish sends ev to the subscribers of its contract.
+func (h *eventHub) publish(ev *ContractEvent) {
+	h.Lock()
+	defer h.Unlock()
+	for id, sub := range h.subs {
+		if !sub.cid.Equal(ev.CID) {
+			continue
+		}
+		select {
+		case sub.out <- ev:
+		default:
+			log.Warnf("dropping event of contract %s for subscriber %d",
+				ev.CID, id)
+		}
+	}
+}
+
+// watchBlocks follows the blocks of the ledger and publishes the events of
+// the subscribed contracts until the byzcoin stream fails or is closed by
+// the last subscriber.
+func (s *Service) watchBlocks() {
+	cl := onet.NewClient(suite, byzcoin.ServiceName)
+	conn, err := cl.Stream(s.roster.List[0],
+		&byzcoin.StreamingRequest{ID: s.byzID})
+	if err != nil {
+		log.Warnf("streaming blocks: %v", err)
+		s.events.stop()
+		return
+	}
+	if !s.events.attach(cl) {
+		cl.Close()
+		return
+	}
+	for {
+		resp := byzcoin.StreamingResponse{}
+		err = conn.ReadMessage(&resp)
+		if err != nil {
+			break
+		}
+		s.publishEvents(resp.Block)
+	}
+	log.Lvlf2("contract event stream stopped: %v", err)
+	s.events.detach(cl)
+}
+
+// publishEvents publishes the events of the subscribed contracts that are
+// changed by block sb. Only the contracts of the instructions of the block
+// are looked up.
+func (s *Service) publishEvents(sb *skipchain.SkipBlock) {
+	cids, _ := blockContracts(sb)
+	for _, cid := range cids {
+		err := s.contractEvents(cid, sb)
+		if err != nil {
+			log.Warnf("publishing events of contract %s: %v", cid, err)
+		}
+	}
+}
+
+// contractEvents publishes the events of contract cid up to block sb. Every
+// event is derived from the state changes of the block that holds the next
+// version of the contract, so that two updates in consecutive blocks give
+// two events. The blocks that changed the contract between its subscription
+// and sb are published first.
+func (s *Service) contractEvents(cid byzcoin.InstanceID,
+	sb *skipchain.SkipBlock) error {
+	last, err := core.GetLastVersion(s.client(), cid)
+	if err != nil {
+		return err
+	}
+	for {
+		version, ok := s.events.version(cid)
+		if !ok || version >= last {
+			// The next version of the contract does not exist yet
+			return nil
+		}
+		change, err := core.GetBlockChange(s.client(), cid, version+1)
+		if err != nil {
+			return err
+		}
+		block := change.Block
+		if block.Index > sb.Index {
+			return nil
+		}
+		ev, err := s.events.diff(cid, change.StateChanges)
+		if err != nil {
+			return err
+		}
+		if ev != nil {
+			ev.Index = block.Index
+			err = s.proveEvent(ev, change)
+			if err != nil {
+				return err
+			}
+			_, reqs := blockContracts(block)
+			if req, ok := reqs[string(cid.Slice())]; ok {
+				ev.Plan = req.ExecReq.EP
+				ev.Receipts = req.ExecReq.OpReceipts
+			}
+			s.events.publish(ev)
+		}
+		if block.Hash.Equal(sb.Hash) {
+			return nil
+		}
+	}
+}
+
+// proveEvent sets the state proof of event ev, which covers the contract
+// instance and the instances of the updated keys, and its change, which is
+// linked to the latest block of the proof.
+func (s *Service) proveEvent(ev *ContractEvent,
+	change *core.BlockChange) error {
+	keys := []string{core.KeyRaw}
+	for _, key := range ev.UpdatedKeys {
+		if !core.IsMainKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	proof, err := core.GetStorageProof(s.client(), ev.CID, keys)
+	if err != nil {
+		return err
+	}
+	// The ledger may have grown since the update chain of the change was
+	// fetched
+	last := change.Links[len(change.Links)-1]
+	if last.Index < proof.Proof.Latest.Index {
+		chain, err := skipchain.NewClient().GetUpdateChain(s.roster,
+			change.Block.Hash)
+		if err != nil {
+			return xerrors.Errorf("getting update chain: %v", err)
+		}
+		change.Links = chain.Update
+	}
+	ev.Proof = *proof
+	ev.Change = *change
+	return nil
+}
+
+// Verify checks event ev against genesis, the trusted genesis block of the
+// state unit's ledger: the state proof must be valid and cover the updated
+// keys, and the change must be the block of the event, change the contract
+// and be linked to the latest block of the proof.
+func (ev *ContractEvent) Verify(genesis *skipchain.SkipBlock) error {
+	err := ev.Proof.VerifyGenesis(genesis)
+	if err != nil {
+		return xerrors.Errorf("verifying state proof: %v", err)
+	}
+	if ev.Change.Block == nil || ev.Change.Block.Index != ev.Index {
+		return xerrors.Errorf("change is not block %d", ev.Index)
+	}
+	_, err = ev.Change.Verify(ev.CID, &ev.Proof.Proof.Latest)
+	if err != nil {
+		return xerrors.Errorf("verifying change block: %v", err)
+	}
+	return ev.Proof.CoversKeys(ev.CID.Slice(), ev.UpdatedKeys)
+}
+
+// blockContracts returns the instances that are invoked or deleted by the
+// accepted transactions of block sb, together with the contracts of their
+// execution plans. It also returns the execution requests of the updates,
+// keyed by the CIDs of the contracts of their plans.
+func blockContracts(sb *skipchain.SkipBlock) ([]byzcoin.InstanceID,
+	map[string]*contracts.Request) {
+	var cids []byzcoin.InstanceID
+	seen := make(map[string]bool)
+	touch := func(cid byzcoin.InstanceID) {
+		if !seen[string(cid.Slice())] {
+			seen[string(cid.Slice())] = true
+			cids = append(cids, cid)
+		}
+	}
+	reqs := make(map[string]*contracts.Request)
+	body := &byzcoin.DataBody{}
+	err := protobuf.Decode(sb.Payload, body)
+	if err != nil {
+		log.Warnf("decoding block body: %v", err)
+		return nil, reqs
+	}
+	for _, tx := range body.TxResults {
+		if !tx.Accepted {
+			continue
+		}
+		for _, inst := range tx.ClientTransaction.Instructions {
+			if inst.Invoke == nil && inst.Delete == nil {
+				continue
+			}
+			touch(inst.InstanceID)
+			if inst.Invoke == nil ||
+				inst.Invoke.ContractID != contracts.ContractKeyValueID {
+				continue
+			}
+			buf := inst.Invoke.Args.Search(core.KeyRequest)
+			if buf == nil {
+				continue
+			}
+			req := &contracts.Request{}
+			err := protobuf.Decode(buf, req)
+			if err != nil || req.ExecReq == nil || req.ExecReq.EP == nil {
+				continue
+			}
+			reqs[string(req.ExecReq.EP.CID)] = req
+			touch(byzcoin.NewInstanceID(req.ExecReq.EP.CID))
+			for _, c := range req.ExecReq.EP.Contracts {
+				reqs[string(c.CID)] = req
+				touch(byzcoin.NewInstanceID(c.CID))
+			}
+		}
+	}
+	return cids, reqs
+}
+
+// updatedKeys returns the sorted keys whose values differ between prev and
+// curr, including the keys that are deleted.
+func updatedKeys(prev, curr map[string][]byte) []string {
+	var keys []string
+	for key, value := range curr {
+		if old, ok := prev[key]; !ok || !bytes.Equal(old, value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range prev {
+		if _, ok := curr[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
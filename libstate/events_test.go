@@ -0,0 +1,101 @@
+package libstate
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/protobuf"
+)
+
+// mainChange returns the state change of version of the instance of
+// contract cid, whose header is in state.
+func mainChange(t *testing.T, cid byzcoin.InstanceID, version uint64,
+	state string) byzcoin.StateChange {
+	hdr, err := protobuf.Encode(&core.ContractHeader{CID: cid,
+		CurrState: state})
+	require.NoError(t, err)
+	main := &core.Storage{Version: core.StorageVersionKeys}
+	main.Set(core.KeyHeader, hdr)
+	buf, err := protobuf.Encode(main)
+	require.NoError(t, err)
+	sc := byzcoin.NewStateChange(byzcoin.Update, cid, "keyValue", buf,
+		darc.ID{})
+	sc.Version = version
+	return sc
+}
+
+// keyChange returns the state change that sets key of contract cid to
+// value, or removes it if value is nil.
+func keyChange(cid byzcoin.InstanceID, key string,
+	value []byte) byzcoin.StateChange {
+	action := byzcoin.Update
+	if value == nil {
+		action = byzcoin.Remove
+	}
+	return byzcoin.NewStateChange(action, core.KeyInstanceID(cid.Slice(),
+		key), "keyEntry", value, darc.ID{})
+}
+
+func indexChange(t *testing.T, cid byzcoin.InstanceID,
+	keys ...string) byzcoin.StateChange {
+	buf, err := protobuf.Encode(&core.StorageIndex{Keys: keys})
+	require.NoError(t, err)
+	return keyChange(cid, core.KeyIndex, buf)
+}
+
+func Test_UpdatedKeys(t *testing.T) {
+	prev := map[string][]byte{"a": []byte("1"), "b": []byte("2"),
+		"c": []byte("3")}
+	curr := map[string][]byte{"a": []byte("1"), "b": []byte("4"),
+		"d": []byte("5")}
+	require.Equal(t, []string{"b", "c", "d"}, updatedKeys(prev, curr))
+	require.Empty(t, updatedKeys(prev, prev))
+}
+
+func Test_EventHubDiff(t *testing.T) {
+	cid := byzcoin.NewInstanceID(bytes.Repeat([]byte{1}, 32))
+	h := newEventHub()
+	sc := mainChange(t, cid, 1, "open")
+	prev := &core.Storage{}
+	require.NoError(t, protobuf.Decode(sc.Value, prev))
+	id, out := h.add(cid, prev, 1)
+
+	// Updates in consecutive blocks give one event each
+	ev, err := h.diff(cid, byzcoin.StateChanges{mainChange(t, cid, 2,
+		"voting"), keyChange(cid, "x", []byte("1")),
+		indexChange(t, cid, "x")})
+	require.NoError(t, err)
+	require.Equal(t, "open", ev.PrevState)
+	require.Equal(t, "voting", ev.CurrState)
+	require.Equal(t, []string{core.KeyHeader, "x"}, ev.UpdatedKeys)
+	ev, err = h.diff(cid, byzcoin.StateChanges{mainChange(t, cid, 3,
+		"closed")})
+	require.NoError(t, err)
+	require.Equal(t, "voting", ev.PrevState)
+	require.Equal(t, "closed", ev.CurrState)
+	require.Equal(t, []string{core.KeyHeader}, ev.UpdatedKeys)
+	version, ok := h.version(cid)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), version)
+
+	// A block that does not hold the next version is rejected
+	_, err = h.diff(cid, byzcoin.StateChanges{mainChange(t, cid, 5,
+		"closed")})
+	require.Error(t, err)
+
+	// A change that leaves the storage as it is gives no event
+	ev, err = h.diff(cid, byzcoin.StateChanges{mainChange(t, cid, 4,
+		"closed")})
+	require.NoError(t, err)
+	require.Nil(t, ev)
+
+	h.publish(&ContractEvent{CID: cid})
+	require.Len(t, out, 1)
+	h.remove(id)
+	_, ok = h.version(cid)
+	require.False(t, ok)
+}
@@ -18,6 +18,9 @@ type InitUnitRequest struct {
 	Roster *onet.Roster
 	Darc   *darc.Darc
 	Signer darc.Signer
+	// UnitID is the DFU ID of the state unit in the registry. It is
+	// core.SUID if it is empty.
+	UnitID string
 }
 
 type InitUnitReply struct{}
@@ -36,12 +39,59 @@ type InitContractReply struct {
 
 type GetStateRequest struct {
 	CID byzcoin.InstanceID
+	// Keys are the keys that the proof covers. If it is empty, the proof
+	// covers the whole contract storage.
+	Keys []string
 }
 
 type GetStateReply struct {
 	Proof core.StateProof
 }
 
+// GetStateAtRequest asks for the state of a contract as of block Index. If
+// Root is set, Index is the index of the block whose state root is Root. If
+// Keys is empty, the state has all the keys of the contract at the block.
+type GetStateAtRequest struct {
+	CID   byzcoin.InstanceID
+	Index int
+	Root  []byte
+	Keys  []string
+}
+
+type GetStateAtReply struct {
+	Proof core.HistoricalProof
+}
+
+type SubscribeRequest struct {
+	CID byzcoin.InstanceID
+}
+
+// ContractEvent is pushed to the subscribers of a contract when a block
+// changes its storage.
+type ContractEvent struct {
+	CID byzcoin.InstanceID
+	// Index is the index of the block that changes the storage
+	Index int
+	// PrevState and CurrState are the FSM states before and after the
+	// change
+	PrevState string
+	CurrState string
+	// UpdatedKeys are the keys whose values are set or deleted
+	UpdatedKeys []string
+	// Plan and Receipts are the execution plan of the update and the opcode
+	// receipts that were given to the update_state opcode, if the block
+	// contains the update
+	Plan     *core.ExecutionPlan
+	Receipts map[string]*core.OpcodeReceipt
+	// Change is the block and its state changes, from which the event is
+	// derived, linked to the latest block of Proof
+	Change core.BlockChange
+	// Proof proves the contract instance and the instances of the updated
+	// keys as of its latest block, which is the block of the event unless
+	// the ledger has grown since (see ContractEvent.Verify)
+	Proof core.StateProof
+}
+
 type UpdateStateRequest struct {
 	Input         base.UpdateInput
 	ExecReq       core.ExecutionRequest
@@ -53,6 +103,95 @@ type UpdateStateReply struct {
 	TxResp *byzcoin.AddTxResponse
 }
 
+type PrepareStateRequest struct {
+	Input         base.UpdateInput
+	ExecReq       core.ExecutionRequest
+	Wait          int
+	InputReceipts map[int]map[string]*core.OpcodeReceipt
+}
+
+type PrepareStateReply struct {
+	// Proofs show that the contracts that are hosted by the unit are
+	// prepared for the plan.
+	Proofs []core.PrepareProof
+	TxResp *byzcoin.AddTxResponse
+}
+
+type CommitStateRequest struct {
+	CID      byzcoin.InstanceID
+	PlanID   []byte
+	Evidence core.PrepareEvidence
+	Wait     int
+}
+
+// CommitStateReply has the proof of core.KeyDecision of the contract, which
+// the other units need if the unit is the coordinator of the plan (see
+// core.ExecutionPlan.VerifyDecision).
+type CommitStateReply struct {
+	Decision core.StateProof
+	TxResp   *byzcoin.AddTxResponse
+}
+
+type AbortStateRequest struct {
+	CID      byzcoin.InstanceID
+	PlanID   []byte
+	Evidence core.PrepareEvidence
+	Wait     int
+}
+
+// AbortStateReply has the proof of core.KeyDecision of the contract (see
+// CommitStateReply).
+type AbortStateReply struct {
+	Decision core.StateProof
+	TxResp   *byzcoin.AddTxResponse
+}
+
+type UpgradeContractRequest struct {
+	Upgrade *core.Upgrade
+	Wait    int
+}
+
+type UpgradeContractReply struct {
+	TxResp *byzcoin.AddTxResponse
+}
+
+type PrecommitRequest struct {
+	Precommit *core.Precommit
+	Wait      int
+}
+
+type PrecommitReply struct {
+	TxResp *byzcoin.AddTxResponse
+}
+
+type MigrateContractRequest struct {
+	CID  byzcoin.InstanceID
+	Wait int
+}
+
+type MigrateContractReply struct {
+	TxResp *byzcoin.AddTxResponse
+}
+
+type ArchiveContractRequest struct {
+	Deletion *core.Deletion
+	Wait     int
+}
+
+type ArchiveContractReply struct {
+	Snapshot *core.ContractSnapshot
+	TxResp   *byzcoin.AddTxResponse
+}
+
+type DeleteContractRequest struct {
+	Deletion *core.Deletion
+	Wait     int
+}
+
+type DeleteContractReply struct {
+	TxResp *byzcoin.AddTxResponse
+}
+
 type DummyRequest struct {
 	CID   byzcoin.InstanceID
 	Input base.UpdateInput
@@ -1,10 +1,11 @@
 package libstate
 
 import (
-	"encoding/hex"
+	"bytes"
 	"github.com/dedis/protean/contracts"
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/libstate/base"
+	"go.dedis.ch/cothority/v3"
 	"go.dedis.ch/cothority/v3/byzcoin"
 	"go.dedis.ch/cothority/v3/darc"
 	"go.dedis.ch/cothority/v3/skipchain"
@@ -15,11 +16,14 @@ import (
 	"go.dedis.ch/onet/v3/network"
 	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
+	"sort"
+	"sync"
+	"time"
 )
 
 var stateID onet.ServiceID
 
-const ServiceName = "StateService"
+const ServiceName = base.ServiceName
 
 var suite = suites.MustFind("bn256.adapter").(*pairing.SuiteBn256)
 
@@ -28,12 +32,26 @@ func init() {
 	stateID, err = onet.RegisterNewServiceWithSuite(ServiceName, suite, newService)
 	network.RegisterMessages(&InitUnitRequest{}, &InitUnitReply{},
 		&InitContractRequest{}, &InitContractReply{}, &GetStateRequest{},
-		&GetStateReply{}, &UpdateStateRequest{}, &UpdateStateReply{},
+		&GetStateReply{}, &GetStateAtRequest{}, &GetStateAtReply{},
+		&SubscribeRequest{}, &ContractEvent{},
+		&UpdateStateRequest{}, &UpdateStateReply{},
+		&UpgradeContractRequest{}, &UpgradeContractReply{},
+		&ArchiveContractRequest{}, &ArchiveContractReply{},
+		&DeleteContractRequest{}, &DeleteContractReply{},
+		&base.LockContractRequest{}, &base.LockContractReply{},
+		&MigrateContractRequest{}, &MigrateContractReply{},
+		&PrecommitRequest{}, &PrecommitReply{},
+		&PrepareStateRequest{}, &PrepareStateReply{},
+		&CommitStateRequest{}, &CommitStateReply{},
+		&AbortStateRequest{}, &AbortStateReply{},
 		&DummyRequest{}, &DummyReply{}, &storage{})
 	if err != nil {
 		panic(err)
 	}
-	err = byzcoin.RegisterGlobalContract(contracts.ContractKeyValueID, contracts.ContractKeyValueFromBytes)
+	err = contracts.RegisterGlobalContracts()
+	if err != nil {
+		panic(err)
+	}
 }
 
 type Service struct {
@@ -41,27 +59,56 @@ type Service struct {
 	storage *storage
 	suite   pairing.SuiteBn256
 	bc      *byzcoin.Client
+	bcLock  sync.Mutex
 	byzID   skipchain.SkipBlockID
 	signer  darc.Signer
 	darc    *darc.Darc
+	// ctrLock serializes the transactions of signer, as byzcoin rejects a
+	// transaction whose counter is not the next one of the signer.
+	ctrLock sync.Mutex
 	ctr     uint64
 	roster  *onet.Roster
+	unitID  string
+	events  *eventHub
 }
 
 func (s *Service) InitUnit(req *InitUnitRequest) (*InitUnitReply, error) {
+	s.bcLock.Lock()
 	s.bc = nil
+	s.bcLock.Unlock()
 	s.byzID = req.ByzID
 	s.roster = req.Roster
 	s.signer = req.Signer
 	s.darc = req.Darc
+	s.unitID = req.UnitID
+	s.ctrLock.Lock()
 	s.ctr = uint64(1)
+	s.ctrLock.Unlock()
 	return &InitUnitReply{}, nil
 }
 
-func (s *Service) InitContract(req *InitContractRequest) (*InitContractReply, error) {
+// client returns the byzcoin client of the ledger of the state unit. The
+// client is created on first use, as the handlers and the event stream may
+// run concurrently.
+func (s *Service) client() *byzcoin.Client {
+	s.bcLock.Lock()
+	defer s.bcLock.Unlock()
 	if s.bc == nil {
 		s.bc = byzcoin.NewClient(s.byzID, *s.roster)
 	}
+	return s.bc
+}
+
+// stateUnit returns the DFU ID of the state unit.
+func (s *Service) stateUnit() string {
+	if s.unitID == "" {
+		return core.SUID
+	}
+	return s.unitID
+}
+
+func (s *Service) InitContract(req *InitContractRequest) (*InitContractReply, error) {
+	req.Header.UnitID = s.unitID
 	rawBuf, err := protobuf.Encode(req.Raw)
 	if err != nil {
 		return nil, xerrors.Errorf("encoding raw contract: %v", err)
@@ -70,27 +117,19 @@ func (s *Service) InitContract(req *InitContractRequest) (*InitContractReply, er
 	if err != nil {
 		return nil, xerrors.Errorf("encoding contract header: %v", err)
 	}
-	args := byzcoin.Arguments{{Name: "raw", Value: rawBuf},
-		{Name: "header", Value: hdrBuf}}
-	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
-		byzcoin.Instruction{
-			InstanceID: byzcoin.NewInstanceID(s.darc.GetBaseID()),
-			Spawn: &byzcoin.Spawn{
-				ContractID: contracts.ContractKeyValueID,
-				Args:       args,
-			},
-			SignerCounter: []uint64{s.ctr},
-		})
-	err = ctx.FillSignersAndSignWith(s.signer)
-	if err != nil {
-		return nil, xerrors.Errorf("signing transaction: %v", err)
-	}
-	cid := ctx.Instructions[0].DeriveID("")
-	_, err = s.bc.AddTransactionAndWait(ctx, req.Wait)
+	args := byzcoin.Arguments{{Name: core.KeyRaw, Value: rawBuf},
+		{Name: core.KeyHeader, Value: hdrBuf}}
+	ctx, _, err := s.addTransaction(byzcoin.Instruction{
+		InstanceID: byzcoin.NewInstanceID(s.darc.GetBaseID()),
+		Spawn: &byzcoin.Spawn{
+			ContractID: contracts.ContractKeyValueID,
+			Args:       args,
+		},
+	}, req.Wait)
 	if err != nil {
-		return nil, xerrors.Errorf("adding transaction: %v", err)
+		return nil, err
 	}
-	s.ctr++
+	cid := ctx.Instructions[0].DeriveID("")
 	// Store CID in header
 	req.Raw.CID = cid
 	req.Header.CID = cid
@@ -107,117 +146,750 @@ func (s *Service) InitContract(req *InitContractRequest) (*InitContractReply, er
 	if req.InitArgs != nil {
 		args = append(args, req.InitArgs...)
 	}
-	ctx = byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
-		byzcoin.Instruction{
-			InstanceID: cid,
-			Invoke: &byzcoin.Invoke{
-				ContractID: contracts.ContractKeyValueID,
-				Command:    "init_contract",
-				Args:       args,
-			},
-			SignerCounter: []uint64{s.ctr},
-		})
-	err = ctx.FillSignersAndSignWith(s.signer)
-	if err != nil {
-		return nil, xerrors.Errorf("adding update transaction: %v", err)
-	}
 	reply := &InitContractReply{CID: cid}
-	reply.TxResp, err = s.bc.AddTransactionAndWait(ctx, req.Wait)
+	reply.TxResp, err = s.invoke(cid, "init_contract", args, req.Wait)
 	if err != nil {
-		return nil, xerrors.Errorf("adding transaction: %v", err)
+		return nil, err
 	}
-	s.ctr++
-	return reply, err
+	return reply, nil
 }
 
 func (s *Service) GetState(req *GetStateRequest) (*GetStateReply, error) {
-	if s.bc == nil {
-		s.bc = byzcoin.NewClient(s.byzID, *s.roster)
+	proof, err := core.GetStorageProof(s.client(), req.CID, req.Keys)
+	if err != nil {
+		return nil, err
 	}
-	pr, err := s.bc.GetProof(req.CID.Slice())
+	return &GetStateReply{Proof: *proof}, nil
+}
+
+// GetStateAt returns a proof of the state of a contract as of a past block
+// (see core.HistoricalProof). The proof covers the requested keys, or all
+// the keys that the contract had at the block if none are requested. A
+// proof of keys that are not main keys also covers the key index and all
+// the keys in it.
+func (s *Service) GetStateAt(req *GetStateAtRequest) (*GetStateAtReply,
+	error) {
+	bc := s.client()
+	pr, err := bc.GetProof(req.CID.Slice())
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get proof from byzcoin: %v", err)
 	}
-	proof := core.StateProof{Proof: &pr.Proof, Genesis: s.bc.Genesis}
-	return &GetStateReply{Proof: proof}, nil
+	latest := &pr.Proof.Latest
+	var at *skipchain.SkipBlock
+	if req.Root != nil {
+		at, err = s.findRoot(req.Root, latest)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if req.Index < 0 || req.Index > latest.Index {
+			return nil, xerrors.Errorf("invalid block index: %d", req.Index)
+		}
+		at, err = s.getBlock(req.Index, latest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	index := at.Index
+	keys := req.Keys
+	if !onlyMainKeys(keys) || len(keys) == 0 {
+		// Only the key index proves that a key did not exist at the block,
+		// and a proof of the key index covers all the keys in it (see
+		// core.HistoricalProof.Verify)
+		indexed, err := s.keysAt(req.CID, index)
+		if err != nil {
+			return nil, err
+		}
+		keys = mergeKeys(indexed, keys)
+	}
+	if len(keys) == 0 {
+		// Only the main keys: GetStorageProof covers all the keys if none
+		// are given
+		keys = []string{core.KeyHeader}
+	}
+	head, err := core.GetStorageProof(bc, req.CID, keys)
+	if err != nil {
+		return nil, err
+	}
+	headIndex := head.Proof.Latest.Index
+	change, next, err := s.instanceChanges(req.CID, index, headIndex)
+	if err != nil {
+		return nil, err
+	}
+	if change == nil {
+		return nil, xerrors.Errorf("contract did not exist at block %d",
+			index)
+	}
+	proof := core.HistoricalProof{CID: req.CID, Index: index,
+		Change: *change, Next: next, Head: *head}
+	// A contract that predates StorageVersionKeys has all its keys in its
+	// instance
+	if len(head.KeyProofs) > 0 {
+		for _, key := range keys {
+			if core.IsMainKey(key) {
+				continue
+			}
+			kh := core.KeyHistory{Key: key}
+			kh.Change, kh.Next, err = s.instanceChanges(
+				core.KeyInstanceID(req.CID.Slice(), key), index, headIndex)
+			if err != nil {
+				return nil, err
+			}
+			proof.Keys = append(proof.Keys, kh)
+		}
+	}
+	proof.At = []*skipchain.SkipBlock{at}
+	if !at.Hash.Equal(head.Proof.Latest.Hash) {
+		chain, err := skipchain.NewClient().GetUpdateChain(s.roster, at.Hash)
+		if err != nil {
+			return nil, xerrors.Errorf("getting update chain: %v", err)
+		}
+		proof.At = chain.Update
+	}
+	return &GetStateAtReply{Proof: proof}, nil
+}
+
+// onlyMainKeys returns true if keys are all stored in the contract
+// instance.
+func onlyMainKeys(keys []string) bool {
+	for _, key := range keys {
+		if !core.IsMainKey(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeKeys returns keys followed by the keys of other that are not in
+// keys.
+func mergeKeys(keys []string, other []string) []string {
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for _, key := range other {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keysAt returns the key index of contract cid and the keys in it as of
+// block index, or nil if the contract had no key index then.
+func (s *Service) keysAt(cid byzcoin.InstanceID, index int) ([]string,
+	error) {
+	id := core.KeyInstanceID(cid.Slice(), core.KeyIndex)
+	change, _, err := s.instanceChanges(id, index, index)
+	if err != nil {
+		return nil, err
+	}
+	if change == nil {
+		return nil, nil
+	}
+	// The last change of the block is the one that is current after it
+	var sc *byzcoin.StateChange
+	for i := range change.StateChanges {
+		if bytes.Equal(change.StateChanges[i].InstanceID, id.Slice()) {
+			sc = &change.StateChanges[i]
+		}
+	}
+	if sc == nil || sc.StateAction == byzcoin.Remove {
+		return nil, nil
+	}
+	keyIndex, err := core.DecodeStorageIndex(sc.Value)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{core.KeyIndex}, keyIndex.Keys...), nil
+}
+
+// instanceChanges returns the block that wrote the version of instance iid
+// that was current at block index and the block that wrote the following
+// version, leaving out the blocks after block head. Either is nil if there
+// is no such version.
+func (s *Service) instanceChanges(iid byzcoin.InstanceID, index int,
+	head int) (*core.BlockChange, *core.BlockChange, error) {
+	bc := s.client()
+	versions, err := core.GetInstanceVersions(bc, iid)
+	if err != nil {
+		return nil, nil, err
+	}
+	var curr, next *byzcoin.GetInstanceVersionResponse
+	for i := range versions {
+		v := &versions[i]
+		if v.BlockIndex > head {
+			continue
+		}
+		if v.BlockIndex <= index {
+			curr = v
+		} else if next == nil {
+			next = v
+		}
+	}
+	var change, nextChange *core.BlockChange
+	if curr != nil {
+		change, err = core.GetBlockChange(bc, iid, curr.StateChange.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if next != nil {
+		nextChange, err = core.GetBlockChange(bc, iid,
+			next.StateChange.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return change, nextChange, nil
+}
+
+// rootSearchDepth is the number of blocks before the latest one that are
+// searched for a state root.
+const rootSearchDepth = 1000
+
+// findRoot returns the latest block whose state root is root, searching
+// backwards from latest for at most rootSearchDepth blocks.
+func (s *Service) findRoot(root []byte, latest *skipchain.SkipBlock) (
+	*skipchain.SkipBlock, error) {
+	sb := latest
+	for {
+		hdr := byzcoin.DataHeader{}
+		err := protobuf.Decode(sb.Data, &hdr)
+		if err != nil {
+			return nil, xerrors.Errorf("decoding block header: %v", err)
+		}
+		if bytes.Equal(hdr.TrieRoot, root) {
+			return sb, nil
+		}
+		if sb.Index == 0 || latest.Index-sb.Index >= rootSearchDepth {
+			return nil, xerrors.Errorf("none of the last %d blocks has the "+
+				"state root", latest.Index-sb.Index+1)
+		}
+		sb, err = s.getBlock(sb.Index-1, latest)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// getBlock returns the block at index of the ledger whose latest block is
+// latest.
+func (s *Service) getBlock(index int, latest *skipchain.SkipBlock) (
+	*skipchain.SkipBlock, error) {
+	if index == latest.Index {
+		return latest, nil
+	}
+	reply, err := skipchain.NewClient().GetSingleBlockByIndex(s.roster,
+		s.byzID, index)
+	if err != nil {
+		return nil, xerrors.Errorf("getting block %d: %v", index, err)
+	}
+	return reply.SkipBlock, nil
+}
+
+// Subscribe streams the events of a contract until the client closes the
+// connection. The first event is sent after the next change of the contract
+// storage.
+func (s *Service) Subscribe(req *SubscribeRequest) (chan *ContractEvent,
+	chan bool, error) {
+	store, proof, err := s.getStorage(req.CID)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := proof.Version(req.CID)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, out := s.events.add(req.CID, store, version)
+	stop := make(chan bool)
+	go func() {
+		<-stop
+		s.events.remove(id)
+	}()
+	if s.events.start() {
+		go s.watchBlocks()
+	}
+	return out, stop, nil
 }
 
 func (s *Service) UpdateState(req *UpdateStateRequest) (*UpdateStateReply, error) {
-	root := hex.EncodeToString(req.ExecReq.EP.StateRoot)
-	s.storage.Lock()
-	_, ok := s.storage.CurrState[root]
-	if ok {
-		s.storage.Unlock()
-		return nil, xerrors.New("another update state request is in progress")
-	}
-	s.storage.CurrState[root] = true
-	s.storage.Unlock()
-	r := contracts.Request{ExecReq: &req.ExecReq,
-		InReceipts: req.InputReceipts, UID: base.UID,
-		OpcodeName: base.UPDATE_STATE}
+	// The byzcoin contract cannot use the local clock, so the expiry of the
+	// plan is checked before the transaction is submitted. A plan cannot be
+	// replayed after the update because the state root changes.
+	err := req.ExecReq.EP.CheckExpiry(time.Now())
+	if err != nil {
+		return nil, xerrors.Errorf("verifying execution plan: %v", err)
+	}
+	if req.ExecReq.EP.IsCrossUnit() {
+		return nil, xerrors.New("plan spans several state units and must " +
+			"be prepared")
+	}
+	// Reject requests that the contract would reject anyway: plans that
+	// are generated from an old state and cannot be rebased, and plans that
+	// do not hold the contract lock while another plan does.
+	cid := byzcoin.NewInstanceID(req.ExecReq.EP.CID)
+	proof, err := core.GetStorageProof(s.client(), cid,
+		[]string{core.KeyRaw, core.RebaseLogKey})
+	if err != nil {
+		return nil, err
+	}
+	store, err := proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := store.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	index := proof.Proof.Latest.Index
+	if !bytes.Equal(proof.Proof.InclusionProof.GetRoot(),
+		req.ExecReq.EP.StateRoot) &&
+		!hdr.HeldBy(req.ExecReq.EP.PlanID, index) {
+		if len(req.ExecReq.EP.Contracts) > 0 {
+			return nil, xerrors.New("stale state root: the state has " +
+				"changed since the execution plan was generated")
+		}
+		err = contracts.VerifyRebase(store, req.ExecReq.EP, req.Input.Args)
+		if err != nil {
+			return nil, xerrors.Errorf("stale state root: the contract "+
+				"state has changed since the execution plan was "+
+				"generated: %v", err)
+		}
+	}
+	err = hdr.CheckLock(req.ExecReq.EP.PlanID, index)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying contract lock: %v", err)
+	}
+	args, err := updateArgs(req.Input, &req.ExecReq, req.InputReceipts)
+	if err != nil {
+		return nil, err
+	}
+	txResp, err := s.invoke(cid, "update", args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdateStateReply{TxResp: txResp}, nil
+}
+
+// updateArgs returns the arguments of the instruction that applies the
+// writesets of input. The writesets of the other contracts of the plan are
+// applied by the same instruction, so that either all contracts are updated
+// or none.
+func updateArgs(input base.UpdateInput, execReq *core.ExecutionRequest,
+	inReceipts map[int]map[string]*core.OpcodeReceipt) (byzcoin.Arguments,
+	error) {
+	r := contracts.Request{ExecReq: execReq, InReceipts: inReceipts,
+		UID: base.UID, OpcodeName: base.UPDATE_STATE}
 	reqBuf, err := protobuf.Encode(&r)
 	if err != nil {
 		return nil, err
 	}
-	req.Input.Args = append(req.Input.Args, byzcoin.Argument{Name: "request",
+	args := append(byzcoin.Arguments{}, input.Args...)
+	args = append(args, byzcoin.Argument{Name: core.KeyRequest,
 		Value: reqBuf})
-	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
-		byzcoin.Instruction{
-			InstanceID: byzcoin.NewInstanceID(req.ExecReq.EP.CID),
-			Invoke: &byzcoin.Invoke{
-				ContractID: contracts.ContractKeyValueID,
-				Command:    "update",
-				Args:       req.Input.Args,
-			},
-			SignerCounter: []uint64{s.ctr},
-		})
-	err = ctx.FillSignersAndSignWith(s.signer)
+	names := make([]string, 0, len(input.ExtArgs))
+	for name := range input.ExtArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		wsBuf, err := protobuf.Encode(input.ExtArgs[name])
+		if err != nil {
+			return nil, xerrors.Errorf("encoding writeset %s: %v", name, err)
+		}
+		args = append(args, byzcoin.Argument{Name: name, Value: wsBuf})
+	}
+	return args, nil
+}
+
+// PrepareState prepares the contracts that are hosted by this unit for a
+// plan that spans several state units (see core.PrepareProof). The
+// instruction is sent to the first of these contracts. The returned proofs
+// are taken after the transaction is included, so req.Wait must be
+// positive.
+func (s *Service) PrepareState(req *PrepareStateRequest) (*PrepareStateReply, error) {
+	err := req.ExecReq.EP.CheckExpiry(time.Now())
 	if err != nil {
-		return nil, xerrors.Errorf("signing transaction: %v", err)
+		return nil, xerrors.Errorf("verifying execution plan: %v", err)
+	}
+	if req.Wait <= 0 {
+		return nil, xerrors.New("prepare must wait for the transaction")
 	}
-	txResp, err := s.bc.AddTransactionAndWait(ctx, req.Wait)
+	hosted := req.ExecReq.EP.HostedContracts(s.stateUnit())
+	if len(hosted) == 0 {
+		return nil, xerrors.Errorf("plan has no contracts on unit %s",
+			s.stateUnit())
+	}
+	args, err := updateArgs(req.Input, &req.ExecReq, req.InputReceipts)
 	if err != nil {
 		return nil, err
 	}
-	s.ctr++
-	return &UpdateStateReply{TxResp: txResp}, nil
+	txResp, err := s.invoke(byzcoin.NewInstanceID(hosted[0].CID), "prepare",
+		args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	reply := &PrepareStateReply{TxResp: txResp}
+	for _, c := range hosted {
+		proof, err := core.GetStorageProof(s.client(),
+			byzcoin.NewInstanceID(c.CID),
+			[]string{core.KeyPending})
+		if err != nil {
+			return nil, err
+		}
+		reply.Proofs = append(reply.Proofs, core.PrepareProof{
+			UnitID: s.stateUnit(), CID: c.CID, Proof: *proof})
+	}
+	return reply, nil
 }
 
-func (s *Service) DummyUpdate(req *DummyRequest) (*DummyReply, error) {
-	if s.bc == nil {
-		s.bc = byzcoin.NewClient(s.byzID, *s.roster)
+// CommitState applies the pending writesets of a prepared plan to the
+// contracts that are hosted by this unit. req.CID is the first of these
+// contracts.
+func (s *Service) CommitState(req *CommitStateRequest) (*CommitStateReply, error) {
+	buf, err := protobuf.Encode(&req.Evidence)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding prepare evidence: %v", err)
 	}
-	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
-		byzcoin.Instruction{
-			InstanceID: req.CID,
-			Invoke: &byzcoin.Invoke{
-				ContractID: contracts.ContractKeyValueID,
-				Command:    "dummy",
-				Args:       req.Input.Args,
-			},
-			SignerCounter: []uint64{s.ctr},
-		})
-	err := ctx.FillSignersAndSignWith(s.signer)
+	args := byzcoin.Arguments{{Name: "plan_id", Value: req.PlanID},
+		{Name: "evidence", Value: buf}}
+	txResp, err := s.invoke(req.CID, "commit", args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := core.GetStorageProof(s.client(), req.CID,
+		[]string{core.KeyDecision})
+	if err != nil {
+		return nil, err
+	}
+	return &CommitStateReply{Decision: *proof, TxResp: txResp}, nil
+}
+
+// AbortState drops the pending writesets of a prepared plan. The
+// coordinator of the plan aborts it after its prepare lock has expired or
+// with a proof that another unit failed to prepare it; the other units
+// need the decision of the coordinator.
+func (s *Service) AbortState(req *AbortStateRequest) (*AbortStateReply, error) {
+	buf, err := protobuf.Encode(&req.Evidence)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding abort evidence: %v", err)
+	}
+	args := byzcoin.Arguments{{Name: "plan_id", Value: req.PlanID},
+		{Name: "evidence", Value: buf}}
+	txResp, err := s.invoke(req.CID, "abort", args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := core.GetStorageProof(s.client(), req.CID,
+		[]string{core.KeyDecision})
+	if err != nil {
+		return nil, err
+	}
+	return &AbortStateReply{Decision: *proof, TxResp: txResp}, nil
+}
+
+func (s *Service) UpgradeContract(req *UpgradeContractRequest) (*UpgradeContractReply, error) {
+	if req.Upgrade == nil {
+		return nil, xerrors.New("missing upgrade")
+	}
+	buf, err := protobuf.Encode(req.Upgrade)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding upgrade: %v", err)
+	}
+	args := byzcoin.Arguments{{Name: "upgrade", Value: buf}}
+	txResp, err := s.invoke(req.Upgrade.CID, "upgrade", args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	return &UpgradeContractReply{TxResp: txResp}, nil
+}
+
+// LockContract locks the contract of req.Plan for req.Plan.LockBlocks
+// blocks, so that only the writeset of the plan can update it. The lock is
+// released when the plan updates the contract or when it expires.
+func (s *Service) LockContract(req *base.LockContractRequest) (
+	*base.LockContractReply, error) {
+	if req.Plan == nil {
+		return nil, xerrors.New("missing execution plan")
+	}
+	err := req.Plan.CheckExpiry(time.Now())
 	if err != nil {
-		return nil, xerrors.Errorf("signing transaction: %v", err)
+		return nil, xerrors.Errorf("verifying execution plan: %v", err)
 	}
-	txResp, err := s.bc.AddTransactionAndWait(ctx, req.Wait)
+	buf, err := protobuf.Encode(req.Plan)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding execution plan: %v", err)
+	}
+	args := byzcoin.Arguments{{Name: "plan", Value: buf}}
+	txResp, err := s.invoke(byzcoin.NewInstanceID(req.Plan.CID), "lock",
+		args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	return &base.LockContractReply{TxResp: txResp}, nil
+}
+
+// MigrateContract converts the storage of the contract to
+// core.CurrentStorageVersion.
+func (s *Service) MigrateContract(req *MigrateContractRequest) (*MigrateContractReply, error) {
+	txResp, err := s.invoke(req.CID, "migrate", nil, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	return &MigrateContractReply{TxResp: txResp}, nil
+}
+
+// Precommit stores a signed commitment in the precommit round of the
+// contract.
+func (s *Service) Precommit(req *PrecommitRequest) (*PrecommitReply, error) {
+	if req.Precommit == nil {
+		return nil, xerrors.New("missing precommit")
+	}
+	buf, err := protobuf.Encode(req.Precommit)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding precommit: %v", err)
+	}
+	args := byzcoin.Arguments{{Name: "precommit", Value: buf}}
+	txResp, err := s.invoke(req.Precommit.CID, "precommit", args, req.Wait)
 	if err != nil {
 		return nil, err
 	}
+	return &PrecommitReply{TxResp: txResp}, nil
+}
+
+func (s *Service) invoke(cid byzcoin.InstanceID, cmd string,
+	args byzcoin.Arguments, wait int) (*byzcoin.AddTxResponse, error) {
+	_, txResp, err := s.addTransaction(byzcoin.Instruction{
+		InstanceID: cid,
+		Invoke: &byzcoin.Invoke{
+			ContractID: contracts.ContractKeyValueID,
+			Command:    cmd,
+			Args:       args,
+		},
+	}, wait)
+	return txResp, err
+}
+
+// addTransaction signs the instruction with the signer of the unit and adds
+// it to the ledger. The handlers run concurrently, so the signer counter is
+// read and incremented under ctrLock. The lock is only held while the
+// transaction is signed and submitted, and the wait for its inclusion
+// happens after releasing it, so that the transactions of the handlers can
+// go into the same block.
+func (s *Service) addTransaction(instr byzcoin.Instruction, wait int) (
+	byzcoin.ClientTransaction, *byzcoin.AddTxResponse, error) {
+	s.ctrLock.Lock()
+	ctr := s.ctr
+	instr.SignerCounter = []uint64{ctr}
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion, instr)
+	err := ctx.FillSignersAndSignWith(s.signer)
+	if err != nil {
+		s.ctrLock.Unlock()
+		return ctx, nil, xerrors.Errorf("signing transaction: %v", err)
+	}
+	txResp, err := s.client().AddTransactionAndWait(ctx, 0)
+	if err != nil {
+		s.ctrLock.Unlock()
+		return ctx, nil, xerrors.Errorf("adding transaction: %v", err)
+	}
 	s.ctr++
+	s.ctrLock.Unlock()
+	if wait > 0 {
+		err = s.waitCounter(ctr, wait)
+		if err != nil {
+			return ctx, nil, xerrors.Errorf("adding transaction: %v", err)
+		}
+	}
+	return ctx, txResp, nil
+}
+
+// waitCounter waits for at most wait blocks until the transaction with the
+// signer counter ctr is included in the ledger. Only the state unit signs
+// with its signer, so the ledger counter reaching ctr means that the
+// transaction is included. If it is not, the transaction was rejected and
+// the counters that are handed out after it cannot be used either, so the
+// counter of the unit is reset to the ledger counter.
+func (s *Service) waitCounter(ctr uint64, wait int) error {
+	interval, err := s.blockInterval()
+	if err != nil {
+		return err
+	}
+	id := s.signer.Identity().String()
+	deadline := time.Now().Add(time.Duration(wait) * interval)
+	for {
+		resp, err := s.client().GetSignerCounters(id)
+		if err != nil {
+			return xerrors.Errorf("getting signer counter: %v", err)
+		}
+		if len(resp.Counters) != 1 {
+			return xerrors.New("missing signer counter")
+		}
+		if resp.Counters[0] >= ctr {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			s.ctrLock.Lock()
+			if s.ctr > resp.Counters[0]+1 {
+				s.ctr = resp.Counters[0] + 1
+			}
+			s.ctrLock.Unlock()
+			return xerrors.Errorf("transaction with counter %d is not "+
+				"included after %d blocks", ctr, wait)
+		}
+		time.Sleep(interval / 10)
+	}
+}
+
+// blockInterval returns the block interval in the chain config of the
+// ledger.
+func (s *Service) blockInterval() (time.Duration, error) {
+	pr, err := s.client().GetProof(byzcoin.ConfigInstanceID.Slice())
+	if err != nil {
+		return 0, xerrors.Errorf("getting chain config proof: %v", err)
+	}
+	val, _, _, err := pr.Proof.Get(byzcoin.ConfigInstanceID.Slice())
+	if err != nil {
+		return 0, xerrors.Errorf("reading chain config: %v", err)
+	}
+	config := &byzcoin.ChainConfig{}
+	err = protobuf.DecodeWithConstructors(val, config,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return 0, xerrors.Errorf("decoding chain config: %v", err)
+	}
+	return config.BlockInterval, nil
+}
+
+// ArchiveContract takes a snapshot of the contract state and then deletes
+// the contract. The contract must be in a terminal state of its FSM, in
+// which it can no longer be invoked, so the snapshot is its final state.
+func (s *Service) ArchiveContract(req *ArchiveContractRequest) (*ArchiveContractReply, error) {
+	store, proof, err := s.verifyDeletion(req.Deletion)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &core.ContractSnapshot{CID: req.Deletion.CID,
+		Storage: *store, Proof: *proof}
+	txResp, err := s.deleteContract(req.Deletion.CID, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveContractReply{Snapshot: snapshot, TxResp: txResp}, nil
+}
+
+// DeleteContract removes the contract instance. The contract must be in a
+// terminal state of its FSM.
+func (s *Service) DeleteContract(req *DeleteContractRequest) (*DeleteContractReply, error) {
+	_, _, err := s.verifyDeletion(req.Deletion)
+	if err != nil {
+		return nil, err
+	}
+	txResp, err := s.deleteContract(req.Deletion.CID, req.Wait)
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteContractReply{TxResp: txResp}, nil
+}
+
+// verifyDeletion returns the storage and the proof of the contract of del
+// after checking that it can be deleted (see checkDeletion).
+func (s *Service) verifyDeletion(del *core.Deletion) (*core.Storage,
+	*core.StateProof, error) {
+	if del == nil {
+		return nil, nil, xerrors.New("missing deletion")
+	}
+	store, proof, err := s.getStorage(del.CID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = checkDeletion(store, del)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, proof, nil
+}
+
+// checkDeletion checks that the deletion is signed by the admins of the
+// contract, if it has any (see core.Deletion.Verify), and that the contract
+// is in a terminal state and not prepared for a plan. The darc of the
+// contract only lets the signer of the unit delete it, so the unit is the
+// one that checks the signatures of the admins; the contract checks its
+// state again when it is deleted.
+func checkDeletion(store *core.Storage, del *core.Deletion) error {
+	hdr, err := store.GetHeader()
+	if err != nil {
+		return err
+	}
+	err = del.Verify(hdr)
+	if err != nil {
+		return err
+	}
+	err = store.VerifyTerminal()
+	if err != nil {
+		return xerrors.Errorf("cannot delete contract: %v", err)
+	}
+	pending, err := core.GetPending(store)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		return xerrors.Errorf("cannot delete contract: it is prepared for "+
+			"plan %x", pending.Plan.PlanID)
+	}
+	return nil
+}
+
+func (s *Service) deleteContract(cid byzcoin.InstanceID, wait int) (
+	*byzcoin.AddTxResponse, error) {
+	_, txResp, err := s.addTransaction(byzcoin.Instruction{
+		InstanceID: cid,
+		Delete: &byzcoin.Delete{
+			ContractID: contracts.ContractKeyValueID,
+		},
+	}, wait)
+	return txResp, err
+}
+
+func (s *Service) DummyUpdate(req *DummyRequest) (*DummyReply, error) {
+	txResp, err := s.invoke(req.CID, "dummy", req.Input.Args, req.Wait)
+	if err != nil {
+		return nil, err
+	}
 	return &DummyReply{TxResp: txResp}, nil
 }
 
+// getStorage returns the whole storage of contract cid and its proof.
+func (s *Service) getStorage(cid byzcoin.InstanceID) (*core.Storage,
+	*core.StateProof, error) {
+	proof, err := core.GetStorageProof(s.client(), cid, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := proof.Storage(cid.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, proof, nil
+}
+
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		suite:            *suite,
+		events:           newEventHub(),
 	}
 	if err := s.RegisterHandlers(s.InitUnit, s.InitContract, s.GetState,
-		s.UpdateState, s.DummyUpdate); err != nil {
+		s.GetStateAt, s.UpdateState, s.UpgradeContract, s.ArchiveContract,
+		s.DeleteContract, s.LockContract,
+		s.MigrateContract, s.Precommit, s.PrepareState, s.CommitState, s.AbortState,
+		s.DummyUpdate); err != nil {
 		return nil, xerrors.New("couldn't register messages")
 	}
+	if err := s.RegisterStreamingHandlers(s.Subscribe); err != nil {
+		return nil, xerrors.New("couldn't register streaming handlers")
+	}
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 		return nil, xerrors.Errorf("loading configuration: %v", err)
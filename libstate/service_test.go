@@ -0,0 +1,71 @@
+package libstate
+
+import (
+	"testing"
+
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/key"
+	"go.dedis.ch/protobuf"
+)
+
+func deletionStorage(t *testing.T, state string,
+	admins []kyber.Point) *core.Storage {
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+	raw := &core.ContractRaw{CID: cid, FSM: &core.FSM{
+		InitialState: "open",
+		States:       []string{"open", "closed"},
+		Transitions: map[string]*core.Transition{
+			"close": {From: "open", To: "closed"},
+		},
+	}}
+	rawBuf, err := protobuf.Encode(raw)
+	require.NoError(t, err)
+	hdrBuf, err := protobuf.Encode(&core.ContractHeader{CID: cid,
+		CurrState: state, Admins: admins, AdminThreshold: 1})
+	require.NoError(t, err)
+	cs := &core.Storage{Version: core.CurrentStorageVersion}
+	cs.Set(core.KeyRaw, rawBuf)
+	cs.Set(core.KeyHeader, hdrBuf)
+	return cs
+}
+
+func Test_CheckDeletion(t *testing.T) {
+	kp := key.NewKeyPair(cothority.Suite)
+	admins := []kyber.Point{kp.Public}
+	cid := byzcoin.NewInstanceID([]byte("contract"))
+
+	// Unsigned deletions are rejected
+	store := deletionStorage(t, "closed", admins)
+	del := &core.Deletion{CID: cid}
+	require.Error(t, checkDeletion(store, del))
+
+	require.NoError(t, del.Sign(0, kp.Private))
+	require.NoError(t, checkDeletion(store, del))
+
+	// Contracts without admins can be deleted from a terminal state only
+	unsigned := &core.Deletion{CID: cid}
+	require.NoError(t, checkDeletion(deletionStorage(t, "closed", nil),
+		unsigned))
+	require.Error(t, checkDeletion(deletionStorage(t, "open", nil),
+		unsigned))
+
+	// The contract must be in a terminal state
+	store = deletionStorage(t, "open", admins)
+	err := checkDeletion(store, del)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a terminal state")
+
+	// The contract must not be prepared for a plan
+	store = deletionStorage(t, "closed", admins)
+	buf, err := protobuf.Encode(&core.PendingUpdate{
+		Plan: &core.ExecutionPlan{PlanID: []byte("plan")}})
+	require.NoError(t, err)
+	store.Set(core.KeyPending, buf)
+	err = checkDeletion(store, del)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "prepared for plan")
+}
@@ -163,13 +163,9 @@ func Test_AddKV(t *testing.T) {
 
 	gcs, err := stateCl.Cl.GetState(cid)
 	require.NoError(t, err)
-	v, _, _, err := gcs.Proof.Proof.Get(cid.Slice())
-	require.NoError(t, err)
-
 	fmt.Println("After gcs:", gcs.Proof.Proof.InclusionProof.GetRoot())
 
-	kvStore := &core.Storage{}
-	err = protobuf.Decode(v, kvStore)
+	kvStore, err := gcs.Proof.Storage(cid.Slice())
 	require.NoError(t, err)
 	for _, kv := range kvStore.Store {
 		fmt.Println(kv.Key)
@@ -3,16 +3,15 @@ package dkglottery
 import (
 	"crypto/rand"
 	"flag"
-	"fmt"
 	"testing"
 	"time"
 
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/driver"
 	"github.com/dedis/protean/libexec"
 	"github.com/dedis/protean/libexec/apps/dkglottery"
 	execbase "github.com/dedis/protean/libexec/base"
-	"github.com/dedis/protean/libstate"
 	"github.com/dedis/protean/libtest"
 	"github.com/dedis/protean/threshold"
 	"github.com/dedis/protean/utils"
@@ -38,14 +37,6 @@ func init() {
 	flag.StringVar(&dfuFile, "dfu", "", "JSON file")
 }
 
-type JoinData struct {
-	adminCl *libstate.AdminClient
-	execCl  *libexec.Client
-	rdata   *execbase.ByzData
-	cdata   *execbase.ByzData
-	cid     byzcoin.InstanceID
-}
-
 func TestMain(m *testing.M) {
 	log.MainTest(m)
 }
@@ -57,14 +48,17 @@ func Test_DKGLottery(t *testing.T) {
 	regRoster := onet.NewRoster(all.List[0:4])
 	dfuRoster := onet.NewRoster(all.List[4:])
 
-	regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster, dfuRoster)
+	// The registry pins the ledger of the state unit
+	adminCl, byzID, err := libtest.SetupStateUnit(dfuRoster, 5)
+	require.NoError(t, err)
+	regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster,
+		dfuRoster, byzID)
 	require.NoError(t, err)
-	regGenesis, err := regCl.FetchGenesisBlock(regPr.Latest.SkipChainID())
+	regGenesis, err := regCl.FetchGenesisBlock(regPr.Proof.Latest.
+		SkipChainID())
 	require.NoError(t, err)
 
 	// Initialize DFUs
-	adminCl, byzID, err := libtest.SetupStateUnit(dfuRoster, 5)
-	require.NoError(t, err)
 	execCl := libexec.NewClient(dfuRoster)
 	_, err = execCl.InitUnit()
 	require.NoError(t, err)
@@ -105,184 +99,134 @@ func Test_DKGLottery(t *testing.T) {
 	gcs, err := adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
 	rdata := &execbase.ByzData{
-		IID:     rid,
-		Proof:   regPr,
-		Genesis: regGenesis,
+		IID:       rid,
+		Proof:     regPr.Proof,
+		KeyProofs: regPr.KeyProofs,
+		Genesis:   regGenesis,
 	}
-	cdata := &execbase.ByzData{
-		IID:     cid,
-		Proof:   gcs.Proof.Proof,
-		Genesis: stGenesis,
+
+	dr := &driver.Driver{
+		ExecCl:   execCl,
+		StateCl:  adminCl.Cl,
+		ThreshCl: thCl,
+		RData:    rdata,
+		Genesis:  stGenesis,
+		Wait:     5,
 	}
 
 	// Execute setup txn
-	itReply, err := execCl.InitTransaction(rdata, cdata, "setupwf", "setup")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-	// Step 1: init_dkg
-	dkgReply, err := thCl.InitDKG(execReq)
-	require.NoError(t, err)
-	// Step 2: exec
-	setupInput := dkglottery.SetupInput{Pk: dkgReply.Output.X}
-	data, err := protobuf.Encode(&setupInput)
-	require.NoError(t, err)
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "setup_dkglot",
-		Data:        data,
-		StateProofs: sp,
+	var X kyber.Point
+	inputs := map[int]driver.InputProvider{
+		// Step 1: init_dkg (no input)
+		// Step 2: exec
+		1: func(res *driver.Results) (interface{}, error) {
+			dkgReply := res.Reply(0).(*threshold.InitDKGReply)
+			X = dkgReply.Output.X
+			setupInput := dkglottery.SetupInput{Pk: X}
+			data, err := protobuf.Encode(&setupInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "setup_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 3: update_state
+		2: func(res *driver.Results) (interface{}, error) {
+			var setupOut dkglottery.SetupOutput
+			execReply := res.Reply(1).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &setupOut)
+			return setupOut.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = dkgReply.Receipts
-	execReply, err := execCl.Execute(execInput, execReq)
+	_, err = dr.Run(cid, "setupwf", "setup", inputs)
 	require.NoError(t, err)
-	// Step 3: update_state
-	var setupOut dkglottery.SetupOutput
-	err = protobuf.Decode(execReply.Output.Data, &setupOut)
-	require.NoError(t, err)
-
-	execReq.Index = 2
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(setupOut.WS, execReq, 5)
-	require.NoError(t, err)
-	_, err = adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	_, err = adminCl.Cl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 
 	// execute join txns
-	d := JoinData{
-		adminCl: adminCl,
-		execCl:  execCl,
-		rdata:   rdata,
-		cdata:   cdata,
-		cid:     cid,
-	}
-	tickets := generateTickets(dkgReply.Output.X, 10)
+	tickets := generateTickets(X, 10)
 	for _, ticket := range tickets {
-		executeJoin(t, &d, ticket)
+		executeJoin(t, dr, cid, ticket)
 	}
 
 	// execute close txn
 	gcs, err = adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
-	cdata.Proof = gcs.Proof.Proof
-
-	itReply, err = execCl.InitTransaction(rdata, cdata, "closewf", "close")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-
-	// Step 1: exec
 	closeInput := dkglottery.CloseInput{
 		Barrier: 0,
 	}
-	data, err = protobuf.Encode(&closeInput)
-	require.NoError(t, err)
-	sp = make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput = execbase.ExecuteInput{
-		FnName:      "close_dkglot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq = &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	data, err := protobuf.Encode(&closeInput)
+	require.NoError(t, err)
+	inputs = map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "close_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var closeOut dkglottery.CloseOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &closeOut)
+			return closeOut.WS, err
+		},
 	}
-	execReply, err = execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: update_state
-	var closeOut dkglottery.CloseOutput
-	err = protobuf.Decode(execReply.Output.Data, &closeOut)
+	_, err = dr.Run(cid, "closewf", "close", inputs)
 	require.NoError(t, err)
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-
-	// CEY
-	adminCl.Cl.Close()
-	newCl := libstate.NewClient(byzcoin.NewClient(byzID, *dfuRoster))
-
-	//_, err = adminCl.Cl.UpdateState(closeOut.WS, execReq, 5)
-	_, err = newCl.UpdateState(closeOut.WS, execReq, 5)
-	require.NoError(t, err)
-
-	pr, err := adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	_, err = adminCl.Cl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 
 	// execute finalize txn
-	//gcs, err = adminCl.Cl.GetState(cid)
-	//require.NoError(t, err)
-	//cdata.Proof = gcs.Proof.Proof
-	cdata.Proof = pr
-
-	itReply, err = execCl.InitTransaction(rdata, cdata, "finalizewf", "finalize")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-	execReq = &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-
-	// Step 1: exec
-	sp = make(map[string]*core.StateProof)
-	gcs.Proof.Proof = pr
-	sp["readset"] = &gcs.Proof
-	execInput = execbase.ExecuteInput{
-		FnName:      "prepare_decrypt_dkglot",
-		StateProofs: sp,
-	}
-	execReply, err = execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-	// Step 2: decrypt
-	var prepOut dkglottery.PrepDecOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepOut)
-	require.NoError(t, err)
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	decReply, err := thCl.Decrypt(&prepOut.Input, execReq)
-	require.NoError(t, err)
-	// Step 3: exec
-	finalInput := dkglottery.FinalizeInput{Ps: decReply.Output.Ps}
-	data, err = protobuf.Encode(&finalInput)
-	require.NoError(t, err)
-	execInput = execbase.ExecuteInput{
-		FnName:      "finalize_dkglot",
-		Data:        data,
-		StateProofs: sp,
+	inputs = map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "prepare_decrypt_dkglot",
+			}, nil
+		},
+		// Step 2: decrypt
+		1: func(res *driver.Results) (interface{}, error) {
+			var prepOut dkglottery.PrepDecOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &prepOut)
+			return prepOut.Input, err
+		},
+		// Step 3: exec
+		2: func(res *driver.Results) (interface{}, error) {
+			decReply := res.Reply(1).(*threshold.DecryptReply)
+			finalInput := dkglottery.FinalizeInput{Ps: decReply.Output.Ps}
+			data, err := protobuf.Encode(&finalInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "finalize_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 4: update_state
+		3: func(res *driver.Results) (interface{}, error) {
+			var finalOut dkglottery.FinalizeOutput
+			execReply := res.Reply(2).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &finalOut)
+			return finalOut.WS, err
+		},
 	}
-	execReq.Index = 2
-	execReq.OpReceipts = decReply.OutputReceipts
-	execReply, err = execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-	// Step 4: update_state
-	var finalOut dkglottery.FinalizeOutput
-	err = protobuf.Decode(execReply.Output.Data, &finalOut)
-	require.NoError(t, err)
-
-	execReq.Index = 3
-	execReq.OpReceipts = execReply.OutputReceipts
-	//_, err = adminCl.Cl.UpdateState(finalOut.WS, execReq, 5)
-	_, err = newCl.UpdateState(finalOut.WS, execReq, 5)
+	_, err = dr.Run(cid, "finalizewf", "finalize", inputs)
 	require.NoError(t, err)
 }
 
-func executeJoin(t *testing.T, d *JoinData, ticket utils.ElGamalPair) {
-	gcs, err := d.adminCl.Cl.GetState(d.cid)
-	require.NoError(t, err)
-
-	fmt.Printf("after gs: %x\n", gcs.Proof.Proof.InclusionProof.GetRoot())
-
-	d.cdata.Proof = gcs.Proof.Proof
-	itReply, err := d.execCl.InitTransaction(d.rdata, d.cdata, "joinwf", "join")
+func executeJoin(t *testing.T, dr *driver.Driver, cid byzcoin.InstanceID,
+	ticket utils.ElGamalPair) {
+	gcs, err := dr.StateCl.GetState(cid)
 	require.NoError(t, err)
-	require.NotNil(t, itReply)
 
-	// Step 1: execute
 	input := dkglottery.JoinInput{
 		Ticket: dkglottery.Ticket{
 			Data: ticket,
@@ -290,33 +234,28 @@ func executeJoin(t *testing.T, d *JoinData, ticket utils.ElGamalPair) {
 	}
 	data, err := protobuf.Encode(&input)
 	require.NoError(t, err)
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "join_dkglot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	inputs := map[int]driver.InputProvider{
+		// Step 1: execute
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "join_dkglot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var joinOut dkglottery.JoinOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &joinOut)
+			return joinOut.WS, err
+		},
 	}
-	execReply, err := d.execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: update_state
-	var joinOut dkglottery.JoinOutput
-	err = protobuf.Decode(execReply.Output.Data, &joinOut)
-	require.NoError(t, err)
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = d.adminCl.Cl.UpdateState(joinOut.WS, execReq, 5)
+	_, err = dr.Run(cid, "joinwf", "join", inputs)
 	require.NoError(t, err)
 
-	wp, err := d.adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 10)
+	_, err = dr.StateCl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 10)
 	require.NoError(t, err)
-	fmt.Printf("after wp: %x\n", wp.InclusionProof.GetRoot())
 }
 
 func generateTickets(X kyber.Point, count int) []utils.ElGamalPair {
@@ -5,10 +5,10 @@ import (
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/easyneff"
 	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/driver"
 	"github.com/dedis/protean/libexec"
 	evotingpc "github.com/dedis/protean/libexec/apps/evoting_pc"
 	execbase "github.com/dedis/protean/libexec/base"
-	"github.com/dedis/protean/libstate"
 	"github.com/dedis/protean/libtest"
 	"github.com/dedis/protean/threshold"
 	"github.com/dedis/protean/utils"
@@ -36,15 +36,6 @@ func init() {
 	flag.StringVar(&dfuFile, "dfu", "", "JSON file")
 }
 
-type JoinData struct {
-	adminCl *libstate.AdminClient
-	execCl  *libexec.Client
-	rdata   *execbase.ByzData
-	cdata   *execbase.ByzData
-	cid     byzcoin.InstanceID
-	X       kyber.Point
-}
-
 func TestMain(m *testing.M) {
 	log.MainTest(m)
 }
@@ -69,9 +60,14 @@ func Test_VotingPC(t *testing.T) {
 	rosters["easyneff"] = smallRoster
 
 	//regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster, dfuRoster)
-	regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster, rosters)
+	// The registry pins the ledger of the state unit
+	adminCl, stateID, err := libtest.SetupStateUnit(byzRoster, 5)
+	require.NoError(t, err)
+	regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster,
+		rosters, stateID)
 	require.NoError(t, err)
-	regGenesis, err := regCl.FetchGenesisBlock(regPr.Latest.SkipChainID())
+	regGenesis, err := regCl.FetchGenesisBlock(regPr.Proof.Latest.
+		SkipChainID())
 	require.NoError(t, err)
 
 	// Initialize DFUs
@@ -84,8 +80,6 @@ func Test_VotingPC(t *testing.T) {
 	//neffCl.InitUnit()
 	//thCl := threshold.NewClient(dfuRoster)
 	//thCl.InitUnit()
-	adminCl, _, err := libtest.SetupStateUnit(byzRoster, 5)
-	require.NoError(t, err)
 	execCl := libexec.NewClient(smallRoster)
 	_, err = execCl.InitUnit(7)
 	require.NoError(t, err)
@@ -104,10 +98,16 @@ func Test_VotingPC(t *testing.T) {
 		Contract: contract,
 		FSM:      fsm,
 	}
+	// The ledger is new, so the precommit of h below is submitted before
+	// the round closes. Only the holder of pcKey can commit to h.
+	pcKey := cothority.Suite.Scalar().Pick(cothority.Suite.RandomStream())
 	hdr := &core.ContractHeader{
-		CodeHash:  utils.GetCodeHash(),
-		Lock:      false,
-		CurrState: fsm.InitialState,
+		CodeHash:          utils.GetCodeHash(),
+		Lock:              false,
+		CurrState:         fsm.InitialState,
+		PrecommitDeadline: 20,
+		Precommitters: []core.Precommitter{{Key: "h",
+			Public: cothority.Suite.Point().Mul(pcKey, nil)}},
 	}
 
 	// Initialize contract (state unit)
@@ -128,297 +128,228 @@ func Test_VotingPC(t *testing.T) {
 	gcs, err := adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
 	rdata := &execbase.ByzData{
-		IID:     rid,
-		Proof:   regPr,
-		Genesis: regGenesis,
-	}
-	cdata := &execbase.ByzData{
-		IID:     cid,
-		Proof:   gcs.Proof.Proof,
-		Genesis: stGenesis,
+		IID:       rid,
+		Proof:     regPr.Proof,
+		KeyProofs: regPr.KeyProofs,
+		Genesis:   regGenesis,
 	}
 
-	// Execute setup txn
-	itReply, err := execCl.InitTransaction(rdata, cdata, "setupwf", "setup")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	dr := &driver.Driver{
+		ExecCl:   execCl,
+		StateCl:  adminCl.Cl,
+		ThreshCl: thCl,
+		ShufCl:   neffCl,
+		RData:    rdata,
+		Genesis:  stGenesis,
+		Wait:     5,
 	}
 
-	// Step 1: init_dkg
-	dkgReply, err := thCl.InitDKG(execReq)
-	require.NoError(t, err)
-	// Step 2: exec
-	setupInput := evotingpc.SetupInput{Pk: dkgReply.Output.X}
-	data, err := protobuf.Encode(&setupInput)
-	require.NoError(t, err)
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "setup_vote_pc",
-		Data:        data,
-		StateProofs: sp,
+	// Execute setup txn
+	var X kyber.Point
+	inputs := map[int]driver.InputProvider{
+		// Step 1: init_dkg (no input)
+		// Step 2: exec
+		1: func(res *driver.Results) (interface{}, error) {
+			dkgReply := res.Reply(0).(*threshold.InitDKGReply)
+			X = dkgReply.Output.X
+			setupInput := evotingpc.SetupInput{Pk: X}
+			data, err := protobuf.Encode(&setupInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "setup_vote_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 3: update_state
+		2: func(res *driver.Results) (interface{}, error) {
+			var out evotingpc.SetupOutput
+			execReply := res.Reply(1).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	execReq.Index = 1
-	execReq.OpReceipts = dkgReply.Receipts
-	execReply, err := execCl.Execute(execInput, execReq)
+	_, err = dr.Run(cid, "setupwf", "setup", inputs)
 	require.NoError(t, err)
-	// Step 3: update_state
-	var setupOut evotingpc.SetupOutput
-	err = protobuf.Decode(execReply.Output.Data, &setupOut)
+	_, err = adminCl.Cl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 
-	execReq.Index = 2
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(setupOut.WS, execReq, nil, 5)
+	// Commit to h, which is revealed by the lock txn
+	hBuf, err := X.MarshalBinary()
 	require.NoError(t, err)
-
-	_, err = adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	pc, err := core.NewPrecommit(cid, "h", hBuf, hdr.PrecommitDeadline,
+		pcKey)
+	require.NoError(t, err)
+	_, err = adminCl.Cl.Precommit(pc, 5)
 	require.NoError(t, err)
-
-	d := JoinData{
-		adminCl: adminCl,
-		execCl:  execCl,
-		rdata:   rdata,
-		cdata:   cdata,
-		cid:     cid,
-		X:       dkgReply.Output.X,
-	}
 
 	for i := 0; i < 100; i++ {
-		executeVote(t, &d, "0010000000")
+		executeVote(t, dr, cid, X, "0010000000")
 	}
-	//executeVote(t, &d, "00100")
-	//executeVote(t, &d, "01000")
-	//executeVote(t, &d, "00001")
-	//executeVote(t, &d, "00001")
-	//executeVote(t, &d, "00100")
-	//executeVote(t, &d, "10000")
-	//executeVote(t, &d, "10000")
-	//executeVote(t, &d, "01000")
-	//executeVote(t, &d, "00100")
-	//executeVote(t, &d, "00010")
+	//executeVote(t, dr, cid, X, "00100")
+	//executeVote(t, dr, cid, X, "01000")
+	//executeVote(t, dr, cid, X, "00001")
+	//executeVote(t, dr, cid, X, "00001")
+	//executeVote(t, dr, cid, X, "00100")
+	//executeVote(t, dr, cid, X, "10000")
+	//executeVote(t, dr, cid, X, "10000")
+	//executeVote(t, dr, cid, X, "01000")
+	//executeVote(t, dr, cid, X, "00100")
+	//executeVote(t, dr, cid, X, "00010")
 
 	// execute lock txn
 	gcs, err = adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
-	cdata.Proof = gcs.Proof.Proof
-
-	itReply, err = execCl.InitTransaction(rdata, cdata, "finalizewf", "lock")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-
-	// Step 1: exec
 	lockInput := evotingpc.LockInput{
 		Barrier: 0,
 	}
-	data, err = protobuf.Encode(&lockInput)
-	require.NoError(t, err)
-	hBuf, err := dkgReply.Output.X.MarshalBinary()
-	require.NoError(t, err)
-	pc := &core.KVDict{Data: make(map[string][]byte)}
-	pc.Data["h"] = hBuf
-	sp = make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput = execbase.ExecuteInput{
-		FnName:      "lock",
-		Data:        data,
-		StateProofs: sp,
-		Precommits:  pc,
-	}
-	execReq = &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	data, err := protobuf.Encode(&lockInput)
+	require.NoError(t, err)
+	reveals := &core.KVDict{Data: make(map[string][]byte)}
+	reveals.Data["h"] = hBuf
+	inputs = map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName:     "lock",
+				Data:       data,
+				Precommits: reveals,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var out evotingpc.LockOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	execReply, err = execCl.Execute(execInput, execReq)
+	_, err = dr.Run(cid, "finalizewf", "lock", inputs)
 	require.NoError(t, err)
-
-	// Step 2: update_state
-	var lockOut evotingpc.LockOutput
-	err = protobuf.Decode(execReply.Output.Data, &lockOut)
-	require.NoError(t, err)
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(lockOut.WS, execReq, nil, 5)
-	require.NoError(t, err)
-
-	pr, err := adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	_, err = adminCl.Cl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 
 	// execute shuffle txn
-	//gcs, err = adminCl.Cl.GetState(cid)
-	//require.NoError(t, err)
-	//cdata.Proof = gcs.Proof.Proof
-	cdata.Proof = pr
-	gcs.Proof.Proof = pr
-
-	itReply, err = execCl.InitTransaction(rdata, cdata, "finalizewf", "shuffle")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-	execReq = &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-
-	// Step 1: exec
-	sp = make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput = execbase.ExecuteInput{
-		FnName:      "prepare_shuffle_pc",
-		StateProofs: sp,
-	}
-	execReply, err = execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: shuffle
-	var prepShOut evotingpc.PrepShufOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepShOut)
-	require.NoError(t, err)
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	shReply, err := neffCl.Shuffle(prepShOut.Input.Pairs, prepShOut.Input.H, execReq)
-	require.NoError(t, err)
-
-	// Step 3: exec
-	prepPrInput := evotingpc.PrepProofsInput{ShProofs: shReply.Proofs}
-	data, err = protobuf.Encode(&prepPrInput)
+	gcs, err = adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
-	execInput = execbase.ExecuteInput{
-		FnName:      "prepare_proofs_pc",
-		Data:        data,
-		StateProofs: sp,
+	inputs = map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "prepare_shuffle_pc",
+			}, nil
+		},
+		// Step 2: shuffle
+		1: func(res *driver.Results) (interface{}, error) {
+			var prepShOut evotingpc.PrepShufOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &prepShOut)
+			return prepShOut.Input, err
+		},
+		// Step 3: exec
+		2: func(res *driver.Results) (interface{}, error) {
+			shReply := res.Reply(1).(*easyneff.ShuffleReply)
+			prepPrInput := evotingpc.PrepProofsInput{ShProofs: shReply.Proofs}
+			data, err := protobuf.Encode(&prepPrInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "prepare_proofs_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 4: update_state
+		3: func(res *driver.Results) (interface{}, error) {
+			var out evotingpc.PrepProofsOutput
+			execReply := res.Reply(2).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	log.Info("Size of shuffle proofs:", len(data))
-	execReq.Index = 2
-	execReq.OpReceipts = shReply.OutputReceipts
-	execReply, err = execCl.Execute(execInput, execReq)
+	_, err = dr.Run(cid, "finalizewf", "shuffle", inputs)
 	require.NoError(t, err)
-
-	// Step 4: update_state
-	var prepPrOut evotingpc.PrepProofsOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepPrOut)
-	require.NoError(t, err)
-
-	execReq.Index = 3
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(prepPrOut.WS, execReq, nil, 5)
-
-	pr, err = adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	_, err = adminCl.Cl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 
 	// execute tally txn
-	//gcs, err = adminCl.Cl.GetState(cid)
-	//require.NoError(t, err)
-	//cdata.Proof = gcs.Proof.Proof
-	cdata.Proof = pr
-	gcs.Proof.Proof = pr
-
-	itReply, err = execCl.InitTransaction(rdata, cdata, "finalizewf", "tally")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-	execReq = &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-
-	// Step 1: exec
-	sp = make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput = execbase.ExecuteInput{
-		FnName:      "prepare_decrypt_vote_pc",
-		StateProofs: sp,
-	}
-	execReply, err = execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: decrypt
-	var prepDecOut evotingpc.PrepDecOutput
-	err = protobuf.Decode(execReply.Output.Data, &prepDecOut)
-	require.NoError(t, err)
-	log.Info("Input to decrypt size:", len(execReply.Output.Data),
-		len(prepDecOut.Input.Pairs), prepDecOut.Input.Pairs[0].C.MarshalSize(), prepDecOut.Input.Pairs[0].K.MarshalSize())
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	decReply, err := thCl.Decrypt(&prepDecOut.Input, execReq)
-	require.NoError(t, err)
-
-	// Step 3: exec
-	tallyIn := evotingpc.TallyInput{
-		CandCount: 10,
-		Ps:        decReply.Output.Ps,
-	}
-	data, err = protobuf.Encode(&tallyIn)
-	require.NoError(t, err)
-	execInput = execbase.ExecuteInput{
-		FnName:      "tally_pc",
-		Data:        data,
-		StateProofs: sp,
+	inputs = map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "prepare_decrypt_vote_pc",
+			}, nil
+		},
+		// Step 2: decrypt
+		1: func(res *driver.Results) (interface{}, error) {
+			var prepDecOut evotingpc.PrepDecOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &prepDecOut)
+			return prepDecOut.Input, err
+		},
+		// Step 3: exec
+		2: func(res *driver.Results) (interface{}, error) {
+			decReply := res.Reply(1).(*threshold.DecryptReply)
+			tallyIn := evotingpc.TallyInput{
+				CandCount: 10,
+				Ps:        decReply.Output.Ps,
+			}
+			data, err := protobuf.Encode(&tallyIn)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "tally_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 4: update_state
+		3: func(res *driver.Results) (interface{}, error) {
+			var out evotingpc.TallyOutput
+			execReply := res.Reply(2).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	execReq.Index = 2
-	execReq.OpReceipts = decReply.OutputReceipts
-	execReply, err = execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-	log.Info("decrypt output size:", len(data), len(tallyIn.Ps), tallyIn.Ps[0].MarshalSize())
-
-	// Step 4: update_state
-	var tallyOut evotingpc.TallyOutput
-	err = protobuf.Decode(execReply.Output.Data, &tallyOut)
-	require.NoError(t, err)
-
-	log.Info("Final size:", len(execReply.Output.Data))
-
-	execReq.Index = 3
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(tallyOut.WS, execReq, nil, 5)
+	_, err = dr.Run(cid, "finalizewf", "tally", inputs)
 	require.NoError(t, err)
 }
 
-func executeVote(t *testing.T, d *JoinData, ballot string) {
-	gcs, err := d.adminCl.Cl.GetState(d.cid)
-	require.NoError(t, err)
-
-	d.cdata.Proof = gcs.Proof.Proof
-	itReply, err := d.execCl.InitTransaction(d.rdata, d.cdata, "votewf",
-		"vote")
+func executeVote(t *testing.T, dr *driver.Driver, cid byzcoin.InstanceID,
+	X kyber.Point, ballot string) {
+	gcs, err := dr.StateCl.GetState(cid)
 	require.NoError(t, err)
-	require.NotNil(t, itReply)
 
-	// Step 1: execute
-	encBallot := utils.ElGamalEncrypt(d.X, []byte(ballot))
+	encBallot := utils.ElGamalEncrypt(X, []byte(ballot))
 	input := evotingpc.VoteInput{
 		Ballot: evotingpc.Ballot{Data: encBallot},
 	}
 	data, err := protobuf.Encode(&input)
 	require.NoError(t, err)
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "vote_pc",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	inputs := map[int]driver.InputProvider{
+		// Step 1: execute
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "vote_pc",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var out evotingpc.VoteOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &out)
+			return out.WS, err
+		},
 	}
-	execReply, err := d.execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: update_state
-	var voteOut evotingpc.VoteOutput
-	err = protobuf.Decode(execReply.Output.Data, &voteOut)
-	require.NoError(t, err)
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = d.adminCl.Cl.UpdateState(voteOut.WS, execReq, nil, 5)
+	_, err = dr.Run(cid, "votewf", "vote", inputs)
 	require.NoError(t, err)
 
-	_, err = d.adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 10)
+	_, err = dr.StateCl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 10)
 	require.NoError(t, err)
 }
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/easyrand"
+	randbase "github.com/dedis/protean/easyrand/base"
 	"github.com/dedis/protean/libclient"
+	"github.com/dedis/protean/libclient/driver"
 	"github.com/dedis/protean/libexec"
 	"github.com/dedis/protean/libexec/apps/randlottery"
 	execbase "github.com/dedis/protean/libexec/base"
@@ -55,15 +57,18 @@ func Test_RandLottery(t *testing.T) {
 	regRoster := onet.NewRoster(all.List[0:4])
 	dfuRoster := onet.NewRoster(all.List[4:])
 
-	regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster, dfuRoster)
+	// The registry pins the ledger of the state unit
+	adminCl, stateID, err := libtest.SetupStateUnit(dfuRoster, 5)
 	require.NoError(t, err)
-	regGenesis, err := regCl.FetchGenesisBlock(regPr.Latest.SkipChainID())
+	regCl, rid, regPr, err := libtest.SetupRegistry(&dfuFile, regRoster,
+		dfuRoster, stateID)
+	require.NoError(t, err)
+	regGenesis, err := regCl.FetchGenesisBlock(regPr.Proof.Latest.
+		SkipChainID())
 	require.NoError(t, err)
 	participants := libtest.GenerateWriters(10)
 
 	// Initialize DFUs
-	adminCl, _, err := libtest.SetupStateUnit(dfuRoster, 5)
-	require.NoError(t, err)
 	execCl := libexec.NewClient(dfuRoster)
 	_, err = execCl.InitUnit()
 	require.NoError(t, err)
@@ -96,7 +101,7 @@ func Test_RandLottery(t *testing.T) {
 	}
 
 	// Initialize contract (state unit)
-	tickets := randlottery.Tickets{}
+	tickets := core.ItemList{}
 	buf, err := protobuf.Encode(&tickets)
 	require.NoError(t, err)
 	args := byzcoin.Arguments{{Name: "tickets", Value: buf}}
@@ -113,14 +118,16 @@ func Test_RandLottery(t *testing.T) {
 	gcs, err := adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
 	rdata := &execbase.ByzData{
-		IID:     rid,
-		Proof:   regPr,
-		Genesis: regGenesis,
+		IID:       rid,
+		Proof:     regPr.Proof,
+		KeyProofs: regPr.KeyProofs,
+		Genesis:   regGenesis,
 	}
 	cdata := &execbase.ByzData{
-		IID:     cid,
-		Proof:   gcs.Proof.Proof,
-		Genesis: stGenesis,
+		IID:       cid,
+		Proof:     gcs.Proof.Proof,
+		KeyProofs: gcs.Proof.KeyProofs,
+		Genesis:   stGenesis,
 	}
 	d := JoinData{
 		adminCl: adminCl,
@@ -135,108 +142,96 @@ func Test_RandLottery(t *testing.T) {
 		executeJoin(t, &d, p)
 	}
 
+	dr := &driver.Driver{
+		ExecCl:  execCl,
+		StateCl: adminCl.Cl,
+		RandCl:  randCl,
+		RData:   rdata,
+		Genesis: stGenesis,
+		Wait:    10,
+	}
+
 	// execute close txn
 	gcs, err = adminCl.Cl.GetState(cid)
 	require.NoError(t, err)
-	cdata.Proof = gcs.Proof.Proof
-
-	itReply, err := execCl.InitTransaction(rdata, cdata, "closewf", "close")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-
-	// Step 1: exec
 	closeInput := randlottery.CloseInput{
 		Barrier: 0,
 	}
 	data, err := protobuf.Encode(&closeInput)
 	require.NoError(t, err)
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "close_randlot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	inputs := map[int]driver.InputProvider{
+		// Step 1: exec
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "close_randlot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var closeOut randlottery.CloseOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &closeOut)
+			return closeOut.WS, err
+		},
 	}
-	execReply, err := execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: update_state
-	var closeOut randlottery.CloseOutput
-	err = protobuf.Decode(execReply.Output.Data, &closeOut)
+	_, err = dr.Run(cid, "closewf", "close", inputs)
 	require.NoError(t, err)
 
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(closeOut.WS, execReq, 10)
-	require.NoError(t, err)
-
-	pr, err := adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	_, err = adminCl.Cl.WaitProof(cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 
 	//finalize txn
-	cdata.Proof = pr
-	gcs.Proof.Proof = pr
-
-	itReply, err = execCl.InitTransaction(rdata, cdata, "finalizewf", "finalize")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-
-	execReq = &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
-	}
-
-	// Step 1: randomness
 	round := uint64(2)
-	randReply, err := randCl.GetRandomness(round, execReq)
-	require.NoError(t, err)
-
-	// Step 2: exec
-	finalizeInput := randlottery.FinalizeInput{
-		Round:      round,
-		Randomness: randReply.Output,
+	inputs = map[int]driver.InputProvider{
+		// Step 1: randomness
+		0: func(*driver.Results) (interface{}, error) {
+			return randbase.RandomnessInput{Round: round}, nil
+		},
+		// Step 2: exec
+		1: func(res *driver.Results) (interface{}, error) {
+			randReply := res.Reply(0).(*easyrand.GetRandomnessReply)
+			finalizeInput := randlottery.FinalizeInput{
+				Round:      round,
+				Randomness: randReply.Output,
+			}
+			data, err := protobuf.Encode(&finalizeInput)
+			if err != nil {
+				return nil, err
+			}
+			return execbase.ExecuteInput{
+				FnName: "finalize_randlot",
+				Data:   data,
+			}, nil
+		},
+		// Step 3: update_state
+		2: func(res *driver.Results) (interface{}, error) {
+			var finalOut randlottery.FinalizeOutput
+			execReply := res.Reply(1).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &finalOut)
+			return finalOut.WS, err
+		},
 	}
-	data, err = protobuf.Encode(&finalizeInput)
+	_, err = dr.Run(cid, "finalizewf", "finalize", inputs)
 	require.NoError(t, err)
-	sp = make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput = execbase.ExecuteInput{
-		FnName:      "finalize_randlot",
-		Data:        data,
-		StateProofs: sp,
-	}
-	execReq.Index = 1
-	execReq.OpReceipts = randReply.Receipts
 
-	execReply, err = execCl.Execute(execInput, execReq)
+	// The finalized lottery has no admins, so it can be archived without
+	// signatures
+	archive, err := adminCl.Cl.ArchiveContract(&core.Deletion{CID: cid}, 5)
 	require.NoError(t, err)
-
-	// Step 3: update_state
-	var finalOut randlottery.FinalizeOutput
-	err = protobuf.Decode(execReply.Output.Data, &finalOut)
-	require.NoError(t, err)
-
-	execReq.Index = 2
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = adminCl.Cl.UpdateState(finalOut.WS, execReq, 10)
+	finalHdr, err := archive.Snapshot.Storage.GetHeader()
 	require.NoError(t, err)
+	require.Equal(t, "lottery_finalized", finalHdr.CurrState)
+	_, err = adminCl.Cl.GetState(cid)
+	require.Error(t, err)
 }
 
 func executeJoin(t *testing.T, d *JoinData, p darc.Signer) {
 	gcs, err := d.adminCl.Cl.GetState(d.cid)
 	require.NoError(t, err)
 
-	d.cdata.Proof = gcs.Proof.Proof
-	itReply, err := d.execCl.InitTransaction(d.rdata, d.cdata, "joinwf", "join")
-	require.NoError(t, err)
-	require.NotNil(t, itReply)
-
-	// Step 1: execute
-	pkHash, err := utils.HashPoint(p.Ed25519.Point)
+	pkHash, err := utils.HashPoint(core.CurrentHashVersion, p.Ed25519.Point)
 	require.NoError(t, err)
 	sig, err := p.Ed25519.Sign(pkHash)
 	require.NoError(t, err)
@@ -246,30 +241,33 @@ func executeJoin(t *testing.T, d *JoinData, p darc.Signer) {
 	}}
 	data, err := protobuf.Encode(&input)
 	require.NoError(t, err)
-	sp := make(map[string]*core.StateProof)
-	sp["readset"] = &gcs.Proof
-	execInput := execbase.ExecuteInput{
-		FnName:      "join_randlot",
-		Data:        data,
-		StateProofs: sp,
+	inputs := map[int]driver.InputProvider{
+		// Step 1: execute
+		0: func(*driver.Results) (interface{}, error) {
+			return execbase.ExecuteInput{
+				FnName: "join_randlot",
+				Data:   data,
+			}, nil
+		},
+		// Step 2: update_state
+		1: func(res *driver.Results) (interface{}, error) {
+			var joinOut randlottery.JoinOutput
+			execReply := res.Reply(0).(*libexec.ExecuteReply)
+			err := protobuf.Decode(execReply.Output.Data, &joinOut)
+			return joinOut.WS, err
+		},
 	}
-	execReq := &core.ExecutionRequest{
-		Index: 0,
-		EP:    &itReply.Plan,
+	dr := &driver.Driver{
+		ExecCl:  d.execCl,
+		StateCl: d.adminCl.Cl,
+		RData:   d.rdata,
+		Genesis: d.cdata.Genesis,
+		Wait:    5,
 	}
-	execReply, err := d.execCl.Execute(execInput, execReq)
-	require.NoError(t, err)
-
-	// Step 2: update_state
-	var joinOut randlottery.JoinOutput
-	err = protobuf.Decode(execReply.Output.Data, &joinOut)
-	require.NoError(t, err)
-
-	execReq.Index = 1
-	execReq.OpReceipts = execReply.OutputReceipts
-	_, err = d.adminCl.Cl.UpdateState(joinOut.WS, execReq, 5)
+	_, err = dr.Run(d.cid, "joinwf", "join", inputs)
 	require.NoError(t, err)
 
-	_, err = d.adminCl.Cl.WaitProof(execReq.EP.CID, execReq.EP.StateRoot, 5)
+	_, err = d.adminCl.Cl.WaitProof(d.cid.Slice(),
+		gcs.Proof.Proof.InclusionProof.GetRoot(), 5)
 	require.NoError(t, err)
 }
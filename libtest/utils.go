@@ -1,6 +1,7 @@
 package libtest
 
 import (
+	"github.com/dedis/protean/core"
 	"github.com/dedis/protean/libclient"
 	"github.com/dedis/protean/libexec"
 	"github.com/dedis/protean/libstate"
@@ -14,9 +15,11 @@ import (
 	"time"
 )
 
+// SetupRegistry creates a DFU registry in which the state unit has the
+// ledger stateID (see core.DFU.SkipchainID).
 func SetupRegistry(dfuFile *string, regRoster *onet.Roster,
-	rosters map[string]*onet.Roster) (*registry.Client, byzcoin.InstanceID,
-	*byzcoin.Proof, error) {
+	rosters map[string]*onet.Roster, stateID skipchain.SkipBlockID) (
+	*registry.Client, byzcoin.InstanceID, *core.StateProof, error) {
 	var id byzcoin.InstanceID
 	dfuReg, err := libclient.ReadDFUJSON(dfuFile)
 	if err != nil {
@@ -29,6 +32,7 @@ func SetupRegistry(dfuFile *string, regRoster *onet.Roster,
 			dfuReg.Units[k].Keys = rosters[k].ServicePublics(libexec.ServiceName)
 		} else if k == "state" {
 			dfuReg.Units[k].Keys = rosters[k].ServicePublics(skipchain.ServiceName)
+			dfuReg.Units[k].SkipchainID = stateID
 		} else {
 			os.Exit(1)
 		}
@@ -42,12 +46,16 @@ func SetupRegistry(dfuFile *string, regRoster *onet.Roster,
 	if err != nil {
 		return nil, id, nil, err
 	}
-	pr, err := adminCl.Cl.WaitProof(reply.IID, 2*time.Second, nil)
+	_, err = adminCl.Cl.WaitProof(reply.IID, 2*time.Second, nil)
 	if err != nil {
 		return nil, id, nil, err
 	}
 
 	bc := byzcoin.NewClient(byzID, *regRoster)
+	pr, err := core.GetStorageProof(bc, reply.IID, nil)
+	if err != nil {
+		return nil, id, nil, err
+	}
 	cl := registry.NewClient(bc)
 	return cl, reply.IID, pr, nil
 }
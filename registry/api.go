@@ -11,6 +11,7 @@ import (
 	"go.dedis.ch/protobuf"
 	"golang.org/x/xerrors"
 
+	"sort"
 	"time"
 )
 
@@ -46,7 +47,10 @@ func SetupByzcoin(r *onet.Roster, blockTime int) (*AdminClient,
 	skipchain.SkipBlockID, error) {
 	signer := darc.NewSignerEd25519(nil, nil)
 	gMsg, err := byzcoin.DefaultGenesisMsg(byzcoin.CurrentVersion, r,
-		[]string{"spawn:keyValue", "invoke:keyValue.update"}, signer.Identity())
+		[]string{"spawn:keyValue", "invoke:keyValue.update",
+			"invoke:keyValue.update_registry", "invoke:keyValue.register_dfu",
+			"invoke:keyValue.update_dfu", "invoke:keyValue.retire_dfu"},
+		signer.Identity())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -59,23 +63,33 @@ func SetupByzcoin(r *onet.Roster, blockTime int) (*AdminClient,
 	return cl, c.ID, nil
 }
 
+// InitRegistry spawns the registry instance. Every DFU is stored under its
+// own key (see core.DFUKey).
 func (c *AdminClient) InitRegistry(registry *core.DFURegistry, wait int) (*InitRegistryReply, error) {
-	buf, err := protobuf.Encode(registry)
-	if err != nil {
-		return nil, xerrors.Errorf("encoding DFU registry: %v", err)
+	ids := make([]string, 0, len(registry.Units))
+	for id := range registry.Units {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	args := make(byzcoin.Arguments, len(ids))
+	for i, id := range ids {
+		buf, err := protobuf.Encode(registry.Units[id])
+		if err != nil {
+			return nil, xerrors.Errorf("encoding DFU %s: %v", id, err)
+		}
+		args[i] = byzcoin.Argument{Name: core.DFUKey(id), Value: buf}
 	}
 	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
 		byzcoin.Instruction{
 			InstanceID: byzcoin.NewInstanceID(c.GMsg.GenesisDarc.GetBaseID()),
 			Spawn: &byzcoin.Spawn{
 				ContractID: contracts.ContractKeyValueID,
-				Args: []byzcoin.Argument{{
-					Name: "registry", Value: buf}},
+				Args:       args,
 			},
 			SignerCounter: []uint64{c.ctr},
 		},
 	)
-	err = ctx.FillSignersAndSignWith(c.signer)
+	err := ctx.FillSignersAndSignWith(c.signer)
 	if err != nil {
 		return nil, xerrors.Errorf("signing txn: %v", err)
 	}
@@ -84,9 +98,195 @@ func (c *AdminClient) InitRegistry(registry *core.DFURegistry, wait int) (*InitR
 	if err != nil {
 		return nil, xerrors.Errorf("adding txn: %v", err)
 	}
+	c.ctr++
+	return reply, nil
+}
+
+// UpdateRegistry replaces the registry that is stored in instance iid. It is
+// used to update the keys of a unit after its roster changes.
+func (c *AdminClient) UpdateRegistry(iid byzcoin.InstanceID,
+	registry *core.DFURegistry, wait int) (*byzcoin.AddTxResponse, error) {
+	buf, err := protobuf.Encode(registry)
+	if err != nil {
+		return nil, xerrors.Errorf("encoding DFU registry: %v", err)
+	}
+	ctx, err := c.signInvoke(iid, "update_registry", byzcoin.Arguments{{
+		Name: core.KeyRegistry, Value: buf}})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Cl.bcClient.AddTransactionAndWait(*ctx, wait)
+	if err != nil {
+		return nil, xerrors.Errorf("adding txn: %v", err)
+	}
+	c.ctr++
+	return resp, nil
+}
+
+// InitService sets up the registry service to serve the DFUs of instance
+// iid. The request is signed by the admin, whom the darc of the instance
+// must let register DFUs. The service never holds the admin signer: the
+// changes to the DFUs are signed by the admin client (see RegisterDFU).
+func (c *AdminClient) InitService(iid byzcoin.InstanceID) (*InitServiceReply,
+	error) {
+	req := &InitServiceRequest{ByzID: c.Cl.bcClient.ID,
+		Roster: &c.Cl.bcClient.Roster, IID: iid, Identity: c.signer.Identity()}
+	sig, err := c.signer.Sign(req.Hash())
+	if err != nil {
+		return nil, xerrors.Errorf("signing InitService request: %v", err)
+	}
+	req.Signature = sig
+	reply := &InitServiceReply{}
+	err = c.Cl.c.SendProtobuf(c.Cl.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("send InitService message: %v", err)
+	}
+	return reply, nil
+}
+
+// RegisterDFU adds DFU id to registry instance iid.
+func (c *AdminClient) RegisterDFU(iid byzcoin.InstanceID, id string,
+	dfu *core.DFU, wait int) (*DFUReply, error) {
+	ctx, err := c.signDFU(iid, "register_dfu", id, dfu)
+	if err != nil {
+		return nil, err
+	}
+	req := &RegisterDFURequest{Tx: *ctx, Wait: wait}
+	reply := &DFUReply{}
+	err = c.Cl.c.SendProtobuf(c.Cl.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending register DFU message: %v", err)
+	}
+	c.ctr++
+	return reply, nil
+}
+
+// UpdateDFU replaces the entry of DFU id in registry instance iid, e.g.
+// after its roster, keys or threshold change.
+func (c *AdminClient) UpdateDFU(iid byzcoin.InstanceID, id string,
+	dfu *core.DFU, wait int) (*DFUReply, error) {
+	ctx, err := c.signDFU(iid, "update_dfu", id, dfu)
+	if err != nil {
+		return nil, err
+	}
+	req := &UpdateDFURequest{Tx: *ctx, Wait: wait}
+	reply := &DFUReply{}
+	err = c.Cl.c.SendProtobuf(c.Cl.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending update DFU message: %v", err)
+	}
+	c.ctr++
+	return reply, nil
+}
+
+// RetireDFU removes DFU id from registry instance iid.
+func (c *AdminClient) RetireDFU(iid byzcoin.InstanceID, id string,
+	wait int) (*DFUReply, error) {
+	ctx, err := c.signDFU(iid, "retire_dfu", id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req := &RetireDFURequest{Tx: *ctx, Wait: wait}
+	reply := &DFUReply{}
+	err = c.Cl.c.SendProtobuf(c.Cl.bcClient.Roster.List[0], req, reply)
+	if err != nil {
+		return nil, xerrors.Errorf("sending retire DFU message: %v", err)
+	}
+	c.ctr++
 	return reply, nil
 }
 
+// signDFU returns the signed transaction of a DFU command. dfu is nil for
+// retire_dfu.
+func (c *AdminClient) signDFU(iid byzcoin.InstanceID, cmd string, id string,
+	dfu *core.DFU) (*byzcoin.ClientTransaction, error) {
+	args := byzcoin.Arguments{{Name: "id", Value: []byte(id)}}
+	if dfu != nil {
+		buf, err := protobuf.Encode(dfu)
+		if err != nil {
+			return nil, xerrors.Errorf("encoding DFU: %v", err)
+		}
+		args = append(args, byzcoin.Argument{Name: "dfu", Value: buf})
+	}
+	return c.signInvoke(iid, cmd, args)
+}
+
+func (c *AdminClient) signInvoke(iid byzcoin.InstanceID, cmd string,
+	args byzcoin.Arguments) (*byzcoin.ClientTransaction, error) {
+	ctx := byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+		byzcoin.Instruction{
+			InstanceID: iid,
+			Invoke: &byzcoin.Invoke{
+				ContractID: contracts.ContractKeyValueID,
+				Command:    cmd,
+				Args:       args,
+			},
+			SignerCounter: []uint64{c.ctr},
+		},
+	)
+	err := ctx.FillSignersAndSignWith(c.signer)
+	if err != nil {
+		return nil, xerrors.Errorf("signing txn: %v", err)
+	}
+	return &ctx, nil
+}
+
+// GetDFU returns DFU id of registry instance iid, verified against genesis.
+// The proof only covers the entry of the DFU, so it can be cited on its own.
+func (c *Client) GetDFU(iid byzcoin.InstanceID, id string,
+	genesis *skipchain.SkipBlock) (*core.DFU, *core.StateProof, error) {
+	reply := &GetDFUReply{}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0],
+		&GetDFURequest{ID: id}, reply)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("sending get DFU message: %v", err)
+	}
+	store, err := verifyProof(&reply.Proof, iid, genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = reply.Proof.CoversKeys(iid.Slice(), []string{core.DFUKey(id)})
+	if err != nil {
+		return nil, nil, err
+	}
+	dfu, err := core.GetDFU(store, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dfu, &reply.Proof, nil
+}
+
+// ListDFUs returns the DFUs of registry instance iid, verified against
+// genesis.
+func (c *Client) ListDFUs(iid byzcoin.InstanceID,
+	genesis *skipchain.SkipBlock) (*core.DFURegistry, *core.StateProof,
+	error) {
+	reply := &ListDFUsReply{}
+	err := c.c.SendProtobuf(c.bcClient.Roster.List[0], &ListDFUsRequest{},
+		reply)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("sending list DFUs message: %v", err)
+	}
+	store, err := verifyProof(&reply.Proof, iid, genesis)
+	if err != nil {
+		return nil, nil, err
+	}
+	reg, err := core.GetDFURegistry(store)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reg, &reply.Proof, nil
+}
+
+func verifyProof(proof *core.StateProof, iid byzcoin.InstanceID,
+	genesis *skipchain.SkipBlock) (*core.Storage, error) {
+	err := proof.VerifyGenesis(genesis)
+	if err != nil {
+		return nil, xerrors.Errorf("verifying registry proof: %v", err)
+	}
+	return proof.Storage(iid.Slice())
+}
+
 func (c *Client) WaitProof(id byzcoin.InstanceID, interval time.Duration,
 	value []byte) (*byzcoin.Proof, error) {
 	return c.bcClient.WaitProof(id, interval, value)
@@ -1,9 +1,17 @@
 package registry
 
 import (
+	"encoding/hex"
+	"strings"
+
 	"github.com/dedis/protean/contracts"
+	"github.com/dedis/protean/core"
 	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/cothority/v3/skipchain"
 	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
 )
 
 var registryID onet.ServiceID
@@ -13,19 +21,206 @@ const ServiceName = "RegistryService"
 func init() {
 	var err error
 	registryID, err = onet.RegisterNewService(ServiceName, newService)
+	network.RegisterMessages(&InitServiceRequest{}, &InitServiceReply{},
+		&RegisterDFURequest{}, &UpdateDFURequest{}, &RetireDFURequest{},
+		&DFUReply{}, &GetDFURequest{}, &GetDFUReply{}, &ListDFUsRequest{},
+		&ListDFUsReply{})
+	if err != nil {
+		panic(err)
+	}
+	err = contracts.RegisterGlobalContracts()
 	if err != nil {
 		panic(err)
 	}
-	err = byzcoin.RegisterGlobalContract(contracts.ContractKeyValueID, contracts.ContractKeyValueFromBytes)
 }
 
 type Service struct {
 	*onet.ServiceProcessor
+	bc     *byzcoin.Client
+	byzID  skipchain.SkipBlockID
+	roster *onet.Roster
+	iid    byzcoin.InstanceID
+}
+
+// InitService sets up the service with the registry instance of the
+// request. Only an admin of the registry can do it, so the request must be
+// signed by an identity that the darc of the instance lets register DFUs,
+// and the ledger must be run by this conode.
+func (s *Service) InitService(req *InitServiceRequest) (*InitServiceReply, error) {
+	if s.bc != nil {
+		return nil, xerrors.New("service is already initialized")
+	}
+	if req.Roster == nil {
+		return nil, xerrors.New("missing roster")
+	}
+	if i, _ := req.Roster.Search(s.ServerIdentity().ID); i < 0 {
+		return nil, xerrors.New("conode is not in the roster of the ledger")
+	}
+	bc := byzcoin.NewClient(req.ByzID, *req.Roster)
+	err := verifyAdmin(bc, req)
+	if err != nil {
+		return nil, err
+	}
+	s.byzID = req.ByzID
+	s.roster = req.Roster
+	s.iid = req.IID
+	s.bc = bc
+	return &InitServiceReply{}, nil
+}
+
+// verifyAdmin checks that the signer of the request can register DFUs in
+// the registry instance of the request, which must be a keyValue instance.
+func verifyAdmin(bc *byzcoin.Client, req *InitServiceRequest) error {
+	err := req.Identity.Verify(req.Hash(), req.Signature)
+	if err != nil {
+		return xerrors.Errorf("verifying signature: %v", err)
+	}
+	_, cid, darcID, err := getInstance(bc, req.IID.Slice())
+	if err != nil {
+		return xerrors.Errorf("getting registry instance: %v", err)
+	}
+	if cid != contracts.ContractKeyValueID {
+		return xerrors.Errorf("instance %s is not a registry", req.IID)
+	}
+	d, err := getDarc(bc, darcID)
+	if err != nil {
+		return err
+	}
+	action := darc.Action("invoke:" + contracts.ContractKeyValueID +
+		".register_dfu")
+	expr := d.Rules.Get(action)
+	if len(expr) == 0 {
+		return xerrors.Errorf("darc of the registry has no rule for %s",
+			action)
+	}
+	getDarcByID := func(id string, latest bool) *darc.Darc {
+		if !strings.HasPrefix(id, "darc:") {
+			return nil
+		}
+		buf, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+		if err != nil {
+			return nil
+		}
+		d, err := getDarc(bc, buf)
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+	err = darc.EvalExpr(expr, getDarcByID, req.Identity.String())
+	if err != nil {
+		return xerrors.Errorf("signer is not an admin of the registry: %v",
+			err)
+	}
+	return nil
+}
+
+// getInstance returns the value, the contract ID and the darc ID of
+// instance id, verified against the ledger of bc.
+func getInstance(bc *byzcoin.Client, id []byte) ([]byte, string, darc.ID,
+	error) {
+	reply, err := bc.GetProof(id)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	err = reply.Proof.Verify(bc.ID)
+	if err != nil {
+		return nil, "", nil, xerrors.Errorf("verifying proof: %v", err)
+	}
+	ok, err := reply.Proof.InclusionProof.Exists(id)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if !ok {
+		return nil, "", nil, xerrors.Errorf("instance %x does not exist", id)
+	}
+	return reply.Proof.Get(id)
+}
+
+func getDarc(bc *byzcoin.Client, id darc.ID) (*darc.Darc, error) {
+	buf, cid, _, err := getInstance(bc, id)
+	if err != nil {
+		return nil, xerrors.Errorf("getting darc: %v", err)
+	}
+	if cid != byzcoin.ContractDarcID {
+		return nil, xerrors.Errorf("instance %x is not a darc", []byte(id))
+	}
+	d, err := darc.NewFromProtobuf(buf)
+	if err != nil {
+		return nil, xerrors.Errorf("decoding darc: %v", err)
+	}
+	return d, nil
+}
+
+func (s *Service) RegisterDFU(req *RegisterDFURequest) (*DFUReply, error) {
+	return s.submit("register_dfu", &req.Tx, req.Wait)
+}
+
+func (s *Service) UpdateDFU(req *UpdateDFURequest) (*DFUReply, error) {
+	return s.submit("update_dfu", &req.Tx, req.Wait)
+}
+
+// RetireDFU removes the entry of the DFU. Plans that cite the DFU can no
+// longer be verified against the latest registry.
+func (s *Service) RetireDFU(req *RetireDFURequest) (*DFUReply, error) {
+	return s.submit("retire_dfu", &req.Tx, req.Wait)
+}
+
+// submit forwards a transaction that invokes cmd on the registry instance.
+// The service does not sign it: byzcoin only accepts it if it is signed by
+// the darc of the registry instance.
+func (s *Service) submit(cmd string, tx *byzcoin.ClientTransaction,
+	wait int) (*DFUReply, error) {
+	if s.bc == nil {
+		return nil, xerrors.New("service is not initialized")
+	}
+	if len(tx.Instructions) != 1 {
+		return nil, xerrors.New("transaction must have one instruction")
+	}
+	inst := tx.Instructions[0]
+	if !inst.InstanceID.Equal(s.iid) || inst.Invoke == nil ||
+		inst.Invoke.ContractID != contracts.ContractKeyValueID ||
+		inst.Invoke.Command != cmd {
+		return nil, xerrors.Errorf("transaction does not invoke %s on the "+
+			"registry", cmd)
+	}
+	txResp, err := s.bc.AddTransactionAndWait(*tx, wait)
+	if err != nil {
+		return nil, xerrors.Errorf("adding transaction: %v", err)
+	}
+	return &DFUReply{TxResp: txResp}, nil
+}
+
+func (s *Service) GetDFU(req *GetDFURequest) (*GetDFUReply, error) {
+	if s.bc == nil {
+		return nil, xerrors.New("service is not initialized")
+	}
+	proof, err := core.GetStorageProof(s.bc, s.iid,
+		[]string{core.DFUKey(req.ID)})
+	if err != nil {
+		return nil, err
+	}
+	return &GetDFUReply{Proof: *proof}, nil
+}
+
+func (s *Service) ListDFUs(req *ListDFUsRequest) (*ListDFUsReply, error) {
+	if s.bc == nil {
+		return nil, xerrors.New("service is not initialized")
+	}
+	proof, err := core.GetStorageProof(s.bc, s.iid, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ListDFUsReply{Proof: *proof}, nil
 }
 
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 	}
+	if err := s.RegisterHandlers(s.InitService, s.RegisterDFU, s.UpdateDFU,
+		s.RetireDFU, s.GetDFU, s.ListDFUs); err != nil {
+		return nil, xerrors.New("couldn't register messages")
+	}
 	return s, nil
 }
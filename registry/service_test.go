@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/protean/contracts"
+	"github.com/dedis/protean/core"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/cothority/v3"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func Test_SubmitRejects(t *testing.T) {
+	iid := byzcoin.NewInstanceID([]byte("registry"))
+	s := &Service{bc: byzcoin.NewClient(nil, onet.Roster{}), iid: iid}
+	newTx := func(id byzcoin.InstanceID, cmd string) byzcoin.ClientTransaction {
+		return byzcoin.NewClientTransaction(byzcoin.CurrentVersion,
+			byzcoin.Instruction{
+				InstanceID: id,
+				Invoke: &byzcoin.Invoke{
+					ContractID: contracts.ContractKeyValueID,
+					Command:    cmd,
+				},
+			})
+	}
+
+	// The command of the transaction must be the one of the handler
+	_, err := s.RegisterDFU(&RegisterDFURequest{
+		Tx: newTx(iid, "update_dfu")})
+	require.Error(t, err)
+	_, err = s.UpdateDFU(&UpdateDFURequest{Tx: newTx(iid, "retire_dfu")})
+	require.Error(t, err)
+	_, err = s.RetireDFU(&RetireDFURequest{Tx: newTx(iid, "register_dfu")})
+	require.Error(t, err)
+
+	// The transaction must invoke the registry instance
+	other := byzcoin.NewInstanceID([]byte("other"))
+	_, err = s.RegisterDFU(&RegisterDFURequest{
+		Tx: newTx(other, "register_dfu")})
+	require.Error(t, err)
+
+	// The transaction must have a single instruction
+	tx := newTx(iid, "register_dfu")
+	tx.Instructions = append(tx.Instructions, tx.Instructions[0])
+	_, err = s.RegisterDFU(&RegisterDFURequest{Tx: tx})
+	require.Error(t, err)
+
+	// An uninitialized service does not forward transactions
+	s = &Service{}
+	_, err = s.RegisterDFU(&RegisterDFURequest{
+		Tx: newTx(iid, "register_dfu")})
+	require.Error(t, err)
+}
+
+func Test_GetDFU(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	_, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	dfu := func() *core.DFU {
+		return &core.DFU{NumNodes: 1, Threshold: 1,
+			Opcodes: []string{"exec"}, Keys: roster.Publics()[:1]}
+	}
+	reg := &core.DFURegistry{Units: map[string]*core.DFU{
+		"codeexec": dfu(),
+		"state":    dfu(),
+	}}
+	adminCl, byzID, err := SetupByzcoin(roster, 1)
+	require.NoError(t, err)
+	reply, err := adminCl.InitRegistry(reg, 3)
+	require.NoError(t, err)
+	_, err = adminCl.Cl.WaitProof(reply.IID, time.Second, nil)
+	require.NoError(t, err)
+	_, err = adminCl.InitService(reply.IID)
+	require.NoError(t, err)
+	_, err = adminCl.RegisterDFU(reply.IID, "easyrand", dfu(), 3)
+	require.NoError(t, err)
+
+	genesis, err := adminCl.Cl.FetchGenesisBlock(byzID)
+	require.NoError(t, err)
+	got, proof, err := adminCl.Cl.GetDFU(reply.IID, "easyrand", genesis)
+	require.NoError(t, err)
+	require.Equal(t, 1, got.Threshold)
+	// The proof covers the header and the entry of the DFU, but not the
+	// entries of the other DFUs
+	keys := make([]string, len(proof.KeyProofs))
+	for i, kp := range proof.KeyProofs {
+		keys[i] = kp.Key
+	}
+	require.ElementsMatch(t, []string{core.KeyHeader,
+		core.DFUKey("easyrand")}, keys)
+
+	_, _, err = adminCl.Cl.GetDFU(reply.IID, "threshold", genesis)
+	require.Error(t, err)
+}
+
+func Test_InitService(t *testing.T) {
+	l := onet.NewTCPTest(cothority.Suite)
+	servers, roster, _ := l.GenTree(3, true)
+	defer l.CloseAll()
+
+	adminCl, byzID, err := SetupByzcoin(roster, 1)
+	require.NoError(t, err)
+	reply, err := adminCl.InitRegistry(&core.DFURegistry{
+		Units: map[string]*core.DFU{}}, 3)
+	require.NoError(t, err)
+	_, err = adminCl.Cl.WaitProof(reply.IID, time.Second, nil)
+	require.NoError(t, err)
+	s := l.GetServices(servers, registryID)[0].(*Service)
+
+	newReq := func(iid byzcoin.InstanceID,
+		signer darc.Signer) *InitServiceRequest {
+		req := &InitServiceRequest{ByzID: byzID, Roster: roster, IID: iid,
+			Identity: signer.Identity()}
+		sig, err := signer.Sign(req.Hash())
+		require.NoError(t, err)
+		req.Signature = sig
+		return req
+	}
+	// The request must be signed by an admin of the registry
+	_, err = s.InitService(newReq(reply.IID,
+		darc.NewSignerEd25519(nil, nil)))
+	require.Error(t, err)
+	req := newReq(reply.IID, adminCl.signer)
+	req.Signature = []byte("forged")
+	_, err = s.InitService(req)
+	require.Error(t, err)
+	// The instance must be a registry instance
+	_, err = s.InitService(newReq(byzcoin.NewInstanceID([]byte("missing")),
+		adminCl.signer))
+	require.Error(t, err)
+	_, err = s.InitService(newReq(byzcoin.NewInstanceID(
+		adminCl.GMsg.GenesisDarc.GetBaseID()), adminCl.signer))
+	require.Error(t, err)
+
+	_, err = s.InitService(newReq(reply.IID, adminCl.signer))
+	require.NoError(t, err)
+	_, err = s.InitService(newReq(reply.IID, adminCl.signer))
+	require.Error(t, err)
+}
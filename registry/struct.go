@@ -1 +1,75 @@
 package registry
+
+import (
+	"crypto/sha256"
+
+	"github.com/dedis/protean/core"
+	"go.dedis.ch/cothority/v3/byzcoin"
+	"go.dedis.ch/cothority/v3/darc"
+	"go.dedis.ch/cothority/v3/skipchain"
+	"go.dedis.ch/onet/v3"
+)
+
+// InitServiceRequest sets up the service with the registry instance IID.
+// It can only be sent once. Signature is the signature of Identity on
+// InitServiceRequest.Hash, and the darc of the registry instance must let
+// Identity register DFUs.
+type InitServiceRequest struct {
+	ByzID     skipchain.SkipBlockID
+	Roster    *onet.Roster
+	IID       byzcoin.InstanceID
+	Identity  darc.Identity
+	Signature []byte
+}
+
+// Hash returns the message that the admin signs to initialize the service:
+// the ledger and the registry instance that the service serves.
+func (req *InitServiceRequest) Hash() []byte {
+	h := sha256.New()
+	h.Write(req.ByzID)
+	h.Write(req.IID.Slice())
+	return h.Sum(nil)
+}
+
+type InitServiceReply struct{}
+
+// RegisterDFURequest carries a transaction that invokes register_dfu on the
+// registry instance. It is signed by the admin client, so the darc of the
+// registry authorizes it (see AdminClient.RegisterDFU).
+type RegisterDFURequest struct {
+	Tx   byzcoin.ClientTransaction
+	Wait int
+}
+
+// UpdateDFURequest carries a signed transaction that invokes update_dfu,
+// e.g. after the roster, keys or threshold of a DFU change.
+type UpdateDFURequest struct {
+	Tx   byzcoin.ClientTransaction
+	Wait int
+}
+
+// RetireDFURequest carries a signed transaction that invokes retire_dfu.
+type RetireDFURequest struct {
+	Tx   byzcoin.ClientTransaction
+	Wait int
+}
+
+type DFUReply struct {
+	TxResp *byzcoin.AddTxResponse
+}
+
+type GetDFURequest struct {
+	ID string
+}
+
+// GetDFUReply has a proof that only covers the key of the DFU (see
+// core.DFUKey) and the header of the registry contract.
+type GetDFUReply struct {
+	Proof core.StateProof
+}
+
+type ListDFUsRequest struct{}
+
+type ListDFUsReply struct {
+	Proof core.StateProof
+}
@@ -23,9 +23,12 @@ type DecryptOutput struct {
 	Ps []kyber.Point
 }
 
-func (decInput *DecryptInput) PrepareHashes() (map[string][]byte, error) {
+// PrepareHashes returns the input hashes with the hash version of the
+// execution plan.
+func (decInput *DecryptInput) PrepareHashes(version int) (map[string][]byte,
+	error) {
 	inputHashes := make(map[string][]byte)
-	hash, err := decInput.Hash()
+	hash, err := decInput.Hash(version)
 	if err != nil {
 		return nil, err
 	}
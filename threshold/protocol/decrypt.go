@@ -43,6 +43,8 @@ type ThreshDecrypt struct {
 	ExecReq        *core.ExecutionRequest
 	InputHashes    map[string][]byte
 	KP             *key.Pair
+	Replay         *core.ReplayCache
+	Hashes         core.HashConfig
 	Ps             []kyber.Point
 	InputReceipts  map[string]*core.OpcodeReceipt
 	OutputReceipts map[string]*core.OpcodeReceipt
@@ -129,7 +131,7 @@ func (d *ThreshDecrypt) decryptShare(r structDecryptShare) error {
 		return cothority.ErrorOrNil(d.SendToParent(&DecryptShareResponse{}),
 			"sending DecryptShareResponse to parent")
 	}
-	d.InputHashes, err = d.DecInput.PrepareHashes()
+	d.InputHashes, err = d.DecInput.PrepareHashes(d.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("%s couldn't generate the input hashes: %v", d.Name(), err)
 		d.Done()
@@ -336,6 +338,8 @@ func (d *ThreshDecrypt) runVerification() error {
 		UID:         base.UID,
 		OpcodeName:  base.DEC,
 		InputHashes: d.InputHashes,
+		Replay:      d.Replay,
+		Hashes:      d.Hashes,
 	}
 	return d.ExecReq.Verify(vData)
 }
@@ -345,12 +349,13 @@ func (d *ThreshDecrypt) generateResponse() (*ReconstructResponse, error) {
 	outSigs := make(map[string]bdnproto.BdnSignature)
 	epid := d.ExecReq.EP.Hash()
 	opIdx := d.ExecReq.Index
-	hash, err := utils.HashPoints(d.Ps)
+	hash, err := utils.HashPoints(d.ExecReq.EP.Version, d.Ps)
 	if err != nil {
 		log.Errorf("calculating the hash of points: %v", err)
 		return &ReconstructResponse{}, err
 	}
 	r := &core.OpcodeReceipt{
+		Version:   d.ExecReq.EP.Version,
 		EPID:      epid,
 		OpIdx:     opIdx,
 		Name:      "plaintexts",
@@ -367,6 +372,7 @@ func (d *ThreshDecrypt) generateResponse() (*ReconstructResponse, error) {
 	// Input receipts
 	for inputName, inputHash := range d.InputHashes {
 		r := core.OpcodeReceipt{
+			Version:   d.ExecReq.EP.Version,
 			EPID:      epid,
 			OpIdx:     opIdx,
 			Name:      inputName,
@@ -36,6 +36,8 @@ type VerifyDKG struct {
 	X        kyber.Point
 	ExecReq  *core.ExecutionRequest
 	KP       *key.Pair
+	Replay   *core.ReplayCache
+	Hashes   core.HashConfig
 	Receipts map[string]*core.OpcodeReceipt
 
 	Threshold int
@@ -167,11 +169,12 @@ func (v *VerifyDKG) verifyDKGResponse(r structVerifyResponse) error {
 }
 
 func (v *VerifyDKG) generateResponse() (*VerifyResponse, error) {
-	hash, err := utils.HashPoint(v.X)
+	hash, err := utils.HashPoint(v.ExecReq.EP.Version, v.X)
 	if err != nil {
 		return &VerifyResponse{}, err
 	}
 	r := &core.OpcodeReceipt{
+		Version:   v.ExecReq.EP.Version,
 		EPID:      v.ExecReq.EP.Hash(),
 		OpIdx:     v.ExecReq.Index,
 		Name:      "X",
@@ -193,6 +196,8 @@ func (v *VerifyDKG) runVerification() error {
 	vData := &core.VerificationData{
 		UID:        base.UID,
 		OpcodeName: base.DKG,
+		Replay:     v.Replay,
+		Hashes:     v.Hashes,
 	}
 	return v.ExecReq.Verify(vData)
 }
@@ -48,6 +48,8 @@ type Service struct {
 	roster     *onet.Roster
 	threshold  int
 	blsService *blscosi.Service
+	replay     *core.ReplayCache
+	hashes     core.HashConfig
 }
 
 func init() {
@@ -59,6 +61,12 @@ func init() {
 	network.RegisterMessages(&storage{})
 }
 
+// SetHashConfig sets which plan hash versions the service accepts. It must
+// be called before the service handles any request.
+func (s *Service) SetHashConfig(cfg core.HashConfig) {
+	s.hashes = cfg
+}
+
 func (s *Service) InitUnit(req *InitUnitRequest) (*InitUnitReply, error) {
 	s.roster = req.Roster
 	s.threshold = req.Threshold
@@ -138,6 +146,9 @@ func (s *Service) InitDKG(req *InitDKGRequest) (*InitDKGReply, error) {
 }
 
 func (s *Service) Decrypt(req *DecryptRequest) (*DecryptReply, error) {
+	if req.ExecReq.EP == nil {
+		return nil, xerrors.New("missing execution plan")
+	}
 	dkgID := NewDKGID(req.ExecReq.EP.CID)
 	// create protocol
 	nodeCount := len(s.roster.List)
@@ -147,7 +158,8 @@ func (s *Service) Decrypt(req *DecryptRequest) (*DecryptReply, error) {
 		return nil, xerrors.New("failed to create decryptShare protocol: " + err.Error())
 	}
 	decProto := pi.(*protocol.ThreshDecrypt)
-	decProto.InputHashes, err = req.Input.PrepareHashes()
+	decProto.InputHashes, err = req.Input.PrepareHashes(
+		req.ExecReq.EP.Version)
 	if err != nil {
 		log.Errorf("failed to prepare the input hashes: %v", err)
 		return nil, err
@@ -155,6 +167,8 @@ func (s *Service) Decrypt(req *DecryptRequest) (*DecryptReply, error) {
 	decProto.DecInput = &req.Input
 	decProto.ExecReq = &req.ExecReq
 	decProto.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+	decProto.Replay = s.replay
+	decProto.Hashes = s.hashes
 	decProto.Threshold = s.threshold
 	err = decProto.SetConfig(&onet.GenericConfig{Data: dkgID[:]})
 	if err != nil {
@@ -209,6 +223,8 @@ func (s *Service) verifyDKG(dkgID DKGID, X kyber.Point,
 	vfDKG.X = X
 	vfDKG.ExecReq = req
 	vfDKG.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+	vfDKG.Replay = s.replay
+	vfDKG.Hashes = s.hashes
 	err = vfDKG.SetConfig(&onet.GenericConfig{Data: dkgID[:]})
 	if err := vfDKG.Start(); err != nil {
 		return nil, err
@@ -314,6 +330,8 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		dec.Shared = shared
 		dec.DKGID = NewDKGID(conf.Data)
 		dec.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+		dec.Replay = s.replay
+		dec.Hashes = s.hashes
 		return dec, nil
 	case protocol.VerifyDKGProtoName:
 		pi, err := protocol.NewVerifyDKG(tn)
@@ -323,6 +341,8 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 		vfDKG := pi.(*protocol.VerifyDKG)
 		vfDKG.DKGID = NewDKGID(conf.Data)
 		vfDKG.KP = protean.GetBLSKeyPair(s.ServerIdentity())
+		vfDKG.Replay = s.replay
+		vfDKG.Hashes = s.hashes
 		s.storage.Lock()
 		shared, ok := s.storage.Shared[vfDKG.DKGID]
 		shared = shared.Clone()
@@ -339,6 +359,7 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		replay:           core.NewReplayCache(core.DefaultReplayCacheSize),
 		blsService:       c.Service(blscosi.ServiceName).(*blscosi.Service),
 	}
 	err := s.RegisterHandlers(s.InitUnit, s.InitDKG, s.Decrypt)
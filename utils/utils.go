@@ -2,8 +2,9 @@ package utils
 
 import (
 	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
+
+	"github.com/dedis/protean/core"
 	"go.dedis.ch/cothority/v3/blscosi"
 	"go.dedis.ch/kyber/v3/util/key"
 	"go.dedis.ch/onet/v3/network"
@@ -48,8 +49,11 @@ func ElGamalDecrypt(private kyber.Scalar, egp ElGamalPair) kyber.Point {
 	return cothority.Suite.Point().Sub(egp.C, S)     // use to un-blind the message
 }
 
-func (ps *ElGamalPairs) Hash() ([]byte, error) {
-	h := sha256.New()
+// Hash returns the hash of the pairs with the hash version of the execution
+// plan.
+func (ps *ElGamalPairs) Hash(version int) ([]byte, error) {
+	hr := core.NewVersionedHasher(version, core.DomainElGamalPairs)
+	hr.WriteLen(len(ps.Pairs))
 	for _, p := range ps.Pairs {
 		bufK, err := p.K.MarshalBinary()
 		if err != nil {
@@ -59,46 +63,51 @@ func (ps *ElGamalPairs) Hash() ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		h.Write(bufK)
-		h.Write(bufC)
+		hr.WriteBytes(bufK)
+		hr.WriteBytes(bufC)
 	}
-	return h.Sum(nil), nil
+	return hr.Sum(), nil
 }
 
-func HashString(val string) []byte {
-	h := sha256.New()
-	h.Write([]byte(val))
-	return h.Sum(nil)
+// HashString returns the hash of a string CONST value with the hash version
+// of the execution plan. It matches the hash that is used by
+// ExecutionRequest.Verify.
+func HashString(version int, val string) []byte {
+	return core.NewStringValue(val).Hash(version)
 }
 
-func HashPoint(p kyber.Point) ([]byte, error) {
+// HashPoint returns the hash of a point with the given hash version, which
+// is the version of the execution plan if the hash is signed in a receipt.
+func HashPoint(version int, p kyber.Point) ([]byte, error) {
 	buf, err := p.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
-	h := sha256.New()
-	h.Write(buf)
-	return h.Sum(nil), nil
+	hr := core.NewVersionedHasher(version, core.DomainPoint)
+	hr.WriteBytes(buf)
+	return hr.Sum(), nil
 }
 
-func HashPoints(ps []kyber.Point) ([]byte, error) {
-	h := sha256.New()
+// HashPoints returns the hash of a list of points with the hash version of
+// the execution plan.
+func HashPoints(version int, ps []kyber.Point) ([]byte, error) {
+	hr := core.NewVersionedHasher(version, core.DomainPoints)
+	hr.WriteLen(len(ps))
 	for _, ptext := range ps {
 		data, err := ptext.MarshalBinary()
 		if err != nil {
 			return nil, xerrors.Errorf("couldn't marshal point: %v", err)
 		}
-		h.Write(data)
+		hr.WriteBytes(data)
 	}
-	return h.Sum(nil), nil
+	return hr.Sum(), nil
 }
 
-func HashUint64(val uint64) []byte {
-	h := sha256.New()
-	buf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(buf, val)
-	h.Write(buf)
-	return h.Sum(nil)
+// HashUint64 returns the hash of a uint64 CONST value with the hash version
+// of the execution plan. It matches the hash that is used by
+// ExecutionRequest.Verify.
+func HashUint64(version int, val uint64) []byte {
+	return core.NewUint64Value(val).Hash(version)
 }
 
 func GetCodeHash() []byte {